@@ -0,0 +1,151 @@
+package cmd
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/bhojpur/ufs/pkg/clientconfig"
+	"github.com/spf13/cobra"
+)
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manages the contexts of the client configuration",
+	Long: `Manages the contexts of the client configuration. A context holds the settings for
+connecting to a Bhojpur UFS installation. The current context is used unless --context
+names another one, and flags and env vars take precedence over the settings of the context.
+
+The configuration is kept in ` + clientconfig.DefaultPath + ` in the user's config directory,
+or in the file UFS_CONFIG points to.`,
+	Args: cobra.NoArgs,
+	// the commands manage contexts rather than use them, hence they must work with contexts
+	// which do not exist yet
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		setupLogging()
+	},
+}
+
+// configGetContextsCmd represents the config get-contexts command
+var configGetContextsCmd = &cobra.Command{
+	Use:   "get-contexts",
+	Short: "Lists all contexts",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		_, cfg, err := loadClientConfig()
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "CURRENT\tNAME\tDIAL MODE\tSERVER")
+		for _, name := range cfg.Names() {
+			ctx := cfg.Contexts[name]
+			var current string
+			if name == cfg.CurrentContext {
+				current = "*"
+			}
+			mode, server := ctx.DialMode, ctx.Host
+			if mode == "" {
+				mode = dialModeHost
+			}
+			if mode == dialModeKubernetes {
+				server = strings.TrimSpace(ctx.Namespace + " " + ctx.LabelSelector)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", current, name, mode, orNone(server))
+		}
+		return tw.Flush()
+	},
+}
+
+// configUseContextCmd represents the config use-context command
+var configUseContextCmd = &cobra.Command{
+	Use:   "use-context <name>",
+	Short: "Makes a context the current one",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		fn, cfg, err := loadClientConfig()
+		if err != nil {
+			return err
+		}
+		if err := cfg.UseContext(args[0]); err != nil {
+			return err
+		}
+		if err := cfg.Save(fn); err != nil {
+			return err
+		}
+		fmt.Printf("switched to context %s\n", args[0])
+		return nil
+	},
+}
+
+// configSetCmd represents the config set command
+var configSetCmd = &cobra.Command{
+	Use:   "set <context> <key>=<value>...",
+	Short: "Changes settings of a context, which is created if it does not exist",
+	Long: `Changes settings of a context, which is created if it does not exist.
+An empty value removes a setting. The first context becomes the current one.
+
+Keys are ` + strings.Join(clientconfig.Keys, ", ") + `.`,
+	Example: `  ufs config set staging host=ufs.staging.example.com:7777 tls.ca=staging-ca.pem
+  ufs config set production dialMode=kubernetes namespace=ufs kubeconfig=$HOME/.kube/production`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		fn, cfg, err := loadClientConfig()
+		if err != nil {
+			return err
+		}
+		for _, kv := range args[1:] {
+			segs := strings.SplitN(kv, "=", 2)
+			if len(segs) != 2 {
+				return fmt.Errorf("invalid setting %q: must be key=value", kv)
+			}
+			if err := cfg.Set(args[0], segs[0], segs[1]); err != nil {
+				return err
+			}
+		}
+		return cfg.Save(fn)
+	},
+}
+
+// loadClientConfig loads the client configuration and returns the file it belongs to
+func loadClientConfig() (fn string, cfg *clientconfig.Config, err error) {
+	fn, err = clientconfig.Path()
+	if err != nil {
+		return "", nil, err
+	}
+	cfg, err = clientconfig.Load(fn)
+	if err != nil {
+		return "", nil, err
+	}
+	return fn, cfg, nil
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configGetContextsCmd)
+	configCmd.AddCommand(configUseContextCmd)
+	configCmd.AddCommand(configSetCmd)
+}
@@ -0,0 +1,55 @@
+package cmd
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"os"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/spf13/cobra"
+)
+
+// engineGetCmd represents the engine get command
+var engineGetCmd = &cobra.Command{
+	Use:   "get <name>",
+	Short: "Prints the details of an Engine",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		printer, err := newEnginePrinter(engineCmdOpts.Output, os.Stdout)
+		if err != nil {
+			return err
+		}
+
+		conn := dial()
+		defer conn.Close()
+		ctx, cancel := interruptContext()
+		defer cancel()
+		resp, err := v1.NewUfsServiceClient(conn).GetEngine(ctx, &v1.GetEngineRequest{Name: args[0]})
+		if err != nil {
+			return err
+		}
+		return printer.PrintDetails(resp.Result)
+	},
+}
+
+func init() {
+	engineCmd.AddCommand(engineGetCmd)
+}
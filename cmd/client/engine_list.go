@@ -0,0 +1,98 @@
+package cmd
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"os"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/filterexpr"
+	"github.com/spf13/cobra"
+)
+
+var engineListCmdOpts struct {
+	Order []string
+	Start int32
+	Limit int32
+}
+
+// engineListCmd represents the engine list command
+var engineListCmd = &cobra.Command{
+	Use:   "list [filter...]",
+	Short: "Lists Engines which match all filters",
+	Long: `Lists Engines which match all filters. A filter consists of terms separated by "|",
+of which one must match. A term compares an Engine field with a value:
+
+  field==value  the field equals value
+  field!=value  the field does not equal value
+  field^=value  the field starts with value
+  field$=value  the field ends with value
+  field~=value  the field contains value
+  field         the field is set
+
+A leading "!" negates a term. Annotations are addressed as annotation.<key>.`,
+	Example: `  ufs engine list owner==alice "phase==running|phase==waiting"
+  ufs engine list --order created:desc --limit 10 '!annotation.nightly'`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filter, err := filterexpr.Parse(args...)
+		if err != nil {
+			return err
+		}
+		order, err := filterexpr.ParseOrder(engineListCmdOpts.Order...)
+		if err != nil {
+			return err
+		}
+		printer, err := newEnginePrinter(engineCmdOpts.Output, os.Stdout)
+		if err != nil {
+			return err
+		}
+
+		conn := dial()
+		defer conn.Close()
+		ctx, cancel := interruptContext()
+		defer cancel()
+		resp, err := v1.NewUfsServiceClient(conn).ListEngines(ctx, &v1.ListEnginesRequest{
+			Filter: filter,
+			Order:  order,
+			Start:  engineListCmdOpts.Start,
+			Limit:  engineListCmdOpts.Limit,
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := printer.PrintRows(resp, resp.Result...); err != nil {
+			return err
+		}
+		if printer.Format == outputTable && int(engineListCmdOpts.Start)+len(resp.Result) < int(resp.Total) {
+			fmt.Fprintf(os.Stderr, "showing %d-%d of %d Engines\n", engineListCmdOpts.Start+1, int(engineListCmdOpts.Start)+len(resp.Result), resp.Total)
+		}
+		return nil
+	},
+}
+
+func init() {
+	engineCmd.AddCommand(engineListCmd)
+	engineListCmd.Flags().StringSliceVar(&engineListCmdOpts.Order, "order", nil, fmt.Sprintf("comma separated fields to order by, each optionally followed by :asc or :desc. Fields are %v and annotation.<key>", filterexpr.Fields))
+	engineListCmd.Flags().Int32Var(&engineListCmdOpts.Start, "start", 0, "number of Engines to skip")
+	engineListCmd.Flags().Int32Var(&engineListCmdOpts.Limit, "limit", 50, "maximum number of Engines to list")
+}
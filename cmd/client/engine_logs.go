@@ -0,0 +1,166 @@
+package cmd
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/filterexpr"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// logCatchUpTimeout is how long we wait for more log output of a running Engine before we
+// consider its log printed, unless we follow the log
+const logCatchUpTimeout = 500 * time.Millisecond
+
+var engineLogsCmdOpts struct {
+	Follow bool
+}
+
+// engineLogsCmd represents the engine logs command
+var engineLogsCmd = &cobra.Command{
+	Use:   "logs <name>",
+	Short: "Prints the log of an Engine",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conn := dial()
+		defer conn.Close()
+		ctx, cancel := interruptContext()
+		defer cancel()
+
+		client := v1.NewUfsServiceClient(conn)
+		if engineLogsCmdOpts.Follow {
+			_, err := followEngine(ctx, client, args[0], os.Stdout)
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		return printLog(ctx, client, args[0], os.Stdout)
+	},
+}
+
+// followEngine prints the log of an Engine until the Engine is done and returns its last status
+func followEngine(ctx context.Context, client v1.UfsServiceClient, name string, out io.Writer) (*v1.EngineStatus, error) {
+	stream, err := client.Listen(ctx, &v1.ListenRequest{
+		Name:    name,
+		Updates: true,
+		Logs:    v1.ListenRequestLogs_LOGS_UNSLICED,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var last *v1.EngineStatus
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return last, nil
+		}
+		if err != nil {
+			return last, err
+		}
+
+		switch c := resp.Content.(type) {
+		case *v1.ListenResponse_Update:
+			if last == nil || last.Phase != c.Update.Phase {
+				log.WithField("name", name).WithField("phase", filterexpr.PhaseName(c.Update.Phase)).Debug("Engine phase changed")
+			}
+			last = c.Update
+		case *v1.ListenResponse_Slice:
+			fmt.Fprintln(out, c.Slice.Payload)
+		}
+	}
+}
+
+// printLog prints the log an Engine has produced so far
+func printLog(ctx context.Context, client v1.UfsServiceClient, name string, out io.Writer) error {
+	resp, err := client.GetEngine(ctx, &v1.GetEngineRequest{Name: name})
+	if err != nil {
+		return err
+	}
+	done := resp.Result.Phase == v1.EnginePhase_PHASE_DONE
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.Listen(ctx, &v1.ListenRequest{Name: name, Logs: v1.ListenRequestLogs_LOGS_UNSLICED})
+	if err != nil {
+		return err
+	}
+
+	type recv struct {
+		Resp *v1.ListenResponse
+		Err  error
+	}
+	incoming := make(chan recv)
+	go func() {
+		defer close(incoming)
+		for {
+			resp, err := stream.Recv()
+			select {
+			case incoming <- recv{resp, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// the log of a running Engine only ends when the Engine is done
+	var idle <-chan time.Time
+	if !done {
+		idle = time.After(logCatchUpTimeout)
+	}
+	for {
+		select {
+		case <-idle:
+			return nil
+		case <-ctx.Done():
+			return nil
+		case r := <-incoming:
+			if r.Err == io.EOF {
+				return nil
+			}
+			if r.Err != nil {
+				return r.Err
+			}
+			if slice := r.Resp.GetSlice(); slice != nil {
+				fmt.Fprintln(out, slice.Payload)
+			}
+			if !done {
+				idle = time.After(logCatchUpTimeout)
+			}
+		}
+	}
+}
+
+func init() {
+	engineCmd.AddCommand(engineLogsCmd)
+	engineLogsCmd.Flags().BoolVarP(&engineLogsCmdOpts.Follow, "follow", "f", false, "follow the log until the Engine is done")
+}
@@ -0,0 +1,236 @@
+package cmd
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/spec"
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var engineStartCmdOpts struct {
+	Metadata   metadataFlags
+	Spec       string
+	Sideload   string
+	NameSuffix string
+	WaitUntil  string
+	Follow     bool
+}
+
+// metadataFlags are the flags which describe a new Engine
+type metadataFlags struct {
+	Owner       string
+	Repository  string
+	Ref         string
+	Revision    string
+	Annotations []string
+}
+
+func (f *metadataFlags) AddFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.Owner, "owner", "", "owner of the Engine. Servers which authenticate their users default to the user.")
+	cmd.Flags().StringVar(&f.Repository, "repo", "", "repository the Engine belongs to, as [[host/]owner/]repo")
+	cmd.Flags().StringVar(&f.Ref, "ref", "", "ref of the repository the Engine runs on")
+	cmd.Flags().StringVar(&f.Revision, "revision", "", "revision of the repository the Engine runs on")
+	cmd.Flags().StringArrayVarP(&f.Annotations, "annotation", "a", nil, "annotation of the Engine as key=value. Can be repeated.")
+}
+
+// Metadata produces the metadata of a manually triggered Engine from the flags
+func (f *metadataFlags) Metadata() (*v1.EngineMetadata, error) {
+	md := &v1.EngineMetadata{
+		Owner:   f.Owner,
+		Trigger: v1.EngineTrigger_TRIGGER_MANUAL,
+	}
+	if f.Repository != "" || f.Ref != "" || f.Revision != "" {
+		repo, err := parseRepository(f.Repository)
+		if err != nil {
+			return nil, err
+		}
+		repo.Ref = f.Ref
+		repo.Revision = f.Revision
+		md.Repository = repo
+	}
+	for _, a := range f.Annotations {
+		segs := strings.SplitN(a, "=", 2)
+		if len(segs) != 2 || segs[0] == "" {
+			return nil, fmt.Errorf("invalid annotation %q: must be key=value", a)
+		}
+		md.Annotations = append(md.Annotations, &v1.Annotation{Key: segs[0], Value: segs[1]})
+	}
+	return md, nil
+}
+
+// engineStartCmd represents the engine start command
+var engineStartCmd = &cobra.Command{
+	Use:   "start <engine.yaml>",
+	Short: "Starts an Engine from its YAML, or from stdin if the file is -",
+	Example: `  ufs engine start --repo bhojpur/storage --ref main -f storage.yaml
+  ufs engine start --annotation nightly=true --wait-until 2h storage.yaml`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		req, err := newStartEngineRequest(args[0])
+		if err != nil {
+			return err
+		}
+		printer, err := newEnginePrinter(engineCmdOpts.Output, os.Stdout)
+		if err != nil {
+			return err
+		}
+
+		conn := dial()
+		defer conn.Close()
+		ctx, cancel := interruptContext()
+		defer cancel()
+
+		client := v1.NewUfsServiceClient(conn)
+		resp, err := client.StartEngine(ctx, req)
+		if err != nil {
+			return err
+		}
+		if printer.Format == outputTable {
+			fmt.Println(resp.Status.Name)
+		} else if err := printer.printMessage(resp); err != nil {
+			return err
+		}
+		if !engineStartCmdOpts.Follow {
+			return nil
+		}
+
+		s, err := followEngine(ctx, client, resp.Status.Name, os.Stdout)
+		if ctx.Err() != nil {
+			return errStillRunning(resp.Status.Name)
+		}
+		if err != nil {
+			return err
+		}
+		return engineResult(s)
+	},
+}
+
+// newStartEngineRequest produces the request to start the Engine in fn from the command line flags
+func newStartEngineRequest(fn string) (*v1.StartEngineRequest, error) {
+	var (
+		engineYAML []byte
+		err        error
+	)
+	if fn == "-" {
+		engineYAML, err = io.ReadAll(os.Stdin)
+	} else {
+		engineYAML, err = os.ReadFile(fn)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read Engine YAML: %w", err)
+	}
+	if _, err := spec.ParseEngine(engineYAML); err != nil {
+		return nil, err
+	}
+
+	opts := engineStartCmdOpts
+	md, err := opts.Metadata.Metadata()
+	if err != nil {
+		return nil, err
+	}
+	md.EngineSpecName = opts.Spec
+
+	req := &v1.StartEngineRequest{
+		Metadata:   md,
+		EngineYaml: engineYAML,
+		NameSuffix: opts.NameSuffix,
+	}
+	if opts.Sideload != "" {
+		req.Sideload, err = os.ReadFile(opts.Sideload)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read sideload: %w", err)
+		}
+	}
+	if opts.WaitUntil != "" {
+		t, err := parseWaitUntil(opts.WaitUntil, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		req.WaitUntil = timestamppb.New(t)
+	}
+	return req, nil
+}
+
+// parseRepository parses a repository of the form [[host/]owner/]repo
+func parseRepository(s string) (*v1.Repository, error) {
+	res := &v1.Repository{}
+	segs := strings.Split(s, "/")
+	switch len(segs) {
+	case 1:
+		res.Repo = segs[0]
+	case 2:
+		res.Owner, res.Repo = segs[0], segs[1]
+	case 3:
+		res.Host, res.Owner, res.Repo = segs[0], segs[1], segs[2]
+	default:
+		return nil, fmt.Errorf("invalid repository %q: must be [[host/]owner/]repo", s)
+	}
+	return res, nil
+}
+
+// parseWaitUntil parses either an RFC 3339 timestamp, or a duration relative to now
+func parseWaitUntil(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --wait-until %q: must be a duration or an RFC 3339 timestamp", s)
+	}
+	return t, nil
+}
+
+// engineResult turns the last status of a followed Engine into the result of the command
+func engineResult(s *v1.EngineStatus) error {
+	if s == nil || s.Phase != v1.EnginePhase_PHASE_DONE {
+		return fmt.Errorf("lost track of Engine before it was done")
+	}
+	if !s.GetConditions().GetSuccess() {
+		if s.Details != "" {
+			return fmt.Errorf("%s: %s", s.Name, s.Details)
+		}
+		return fmt.Errorf("%s failed", s.Name)
+	}
+	return nil
+}
+
+// errStillRunning is the result of a command which was interrupted while it followed an Engine
+func errStillRunning(name string) error {
+	return fmt.Errorf("interrupted while %s is still running - stop it with \"ufs engine stop %s\"", name, name)
+}
+
+func init() {
+	engineCmd.AddCommand(engineStartCmd)
+	engineStartCmdOpts.Metadata.AddFlags(engineStartCmd)
+	engineStartCmd.Flags().StringVar(&engineStartCmdOpts.Spec, "spec", "", "name of the Engine spec in ufs/config.yaml the Engine is started from")
+	engineStartCmd.Flags().StringVar(&engineStartCmdOpts.Sideload, "sideload", "", "file which is passed to the Engine as sideload")
+	engineStartCmd.Flags().StringVar(&engineStartCmdOpts.NameSuffix, "name-suffix", "", "suffix of the Engine name")
+	engineStartCmd.Flags().StringVar(&engineStartCmdOpts.WaitUntil, "wait-until", "", "time at which the Engine starts, as duration from now or RFC 3339 timestamp")
+	engineStartCmd.Flags().BoolVarP(&engineStartCmdOpts.Follow, "follow", "f", false, "follow the log until the Engine is done. The command fails if the Engine does.")
+}
@@ -0,0 +1,55 @@
+package cmd
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/spf13/cobra"
+)
+
+// engineStopCmd represents the engine stop command
+var engineStopCmd = &cobra.Command{
+	Use:   "stop <name>...",
+	Short: "Stops running Engines",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conn := dial()
+		defer conn.Close()
+		ctx, cancel := interruptContext()
+		defer cancel()
+
+		client := v1.NewUfsServiceClient(conn)
+		for _, name := range args {
+			_, err := client.StopEngine(ctx, &v1.StopEngineRequest{Name: name})
+			if err != nil {
+				return fmt.Errorf("cannot stop %s: %w", name, err)
+			}
+			fmt.Printf("stopped %s\n", name)
+		}
+		return nil
+	},
+}
+
+func init() {
+	engineCmd.AddCommand(engineStopCmd)
+}
@@ -0,0 +1,76 @@
+package cmd
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"io"
+	"os"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/filterexpr"
+	"github.com/spf13/cobra"
+)
+
+// engineSubscribeCmd represents the engine subscribe command
+var engineSubscribeCmd = &cobra.Command{
+	Use:   "subscribe [filter...]",
+	Short: "Prints updates of all Engines which match the filters until interrupted",
+	Long: `Prints updates of all Engines which match the filters until interrupted.
+Filters are written the same way as for "ufs engine list".`,
+	Example: `  ufs engine subscribe owner==alice
+  ufs engine subscribe -o json 'phase==done' | jq .result.name`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filter, err := filterexpr.Parse(args...)
+		if err != nil {
+			return err
+		}
+		printer, err := newEnginePrinter(engineCmdOpts.Output, os.Stdout)
+		if err != nil {
+			return err
+		}
+		printer.Stream = true
+
+		conn := dial()
+		defer conn.Close()
+		ctx, cancel := interruptContext()
+		defer cancel()
+		sub, err := v1.NewUfsServiceClient(conn).Subscribe(ctx, &v1.SubscribeRequest{Filter: filter})
+		if err != nil {
+			return err
+		}
+		for {
+			resp, err := sub.Recv()
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := printer.PrintRows(resp, resp.Result); err != nil {
+				return err
+			}
+		}
+	},
+}
+
+func init() {
+	engineCmd.AddCommand(engineSubscribeCmd)
+}
@@ -0,0 +1,225 @@
+package cmd
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/homedir"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+)
+
+// credentialsFile is the file in the user's config directory which holds the tokens of servers
+const credentialsFile = "ufs/credentials.yaml"
+
+// storedCredentials maps servers to the token used when talking to them
+type storedCredentials struct {
+	Servers map[string]string `json:"servers,omitempty"`
+}
+
+func credentialsPath() (string, error) {
+	cfgHome, err := homedir.GetConfigHome()
+	if err != nil {
+		return "", fmt.Errorf("cannot determine config directory: %w", err)
+	}
+	return filepath.Join(cfgHome, credentialsFile), nil
+}
+
+func loadCredentials() (*storedCredentials, error) {
+	fn, err := credentialsPath()
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return &storedCredentials{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var res storedCredentials
+	if err := yaml.Unmarshal(content, &res); err != nil {
+		return nil, fmt.Errorf("invalid credentials file %s: %w", fn, err)
+	}
+	return &res, nil
+}
+
+func (c *storedCredentials) Save() error {
+	fn, err := credentialsPath()
+	if err != nil {
+		return err
+	}
+	content, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(fn, content, 0600)
+}
+
+// serverKey identifies the server the client talks to in the credentials file
+func serverKey() string {
+	if rootCmdOpts.DialMode == dialModeKubernetes {
+		return fmt.Sprintf("kubernetes:%s/%s", rootCmdOpts.Kubeconfig, rootCmdOpts.K8sNamespace)
+	}
+	return rootCmdOpts.Host
+}
+
+// token returns the bearer token for the server the client talks to. UFS_TOKEN takes precedence
+// over the token of the context in use, which takes precedence over the credentials stored by ufs login.
+func token() string {
+	if t := os.Getenv("UFS_TOKEN"); t != "" {
+		return t
+	}
+	if rootCmdOpts.ContextToken != "" {
+		return rootCmdOpts.ContextToken
+	}
+	creds, err := loadCredentials()
+	if err != nil {
+		log.WithError(err).Warn("cannot load credentials")
+		return ""
+	}
+	return creds.Servers[serverKey()]
+}
+
+// tokenCredentials adds a bearer token to every RPC
+type tokenCredentials string
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+// RequireTransportSecurity is false so that tokens can be used with development servers and
+// through Kubernetes port-forwards, which often run without TLS. dial refuses to send tokens to
+// other servers without TLS unless --insecure-send-token is set.
+func (tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+var loginCmdOpts struct {
+	Token string
+}
+
+// loginCmd represents the login command
+var loginCmd = &cobra.Command{
+	Use:   "login",
+	Short: "Stores a token for the server, which is used for all further requests",
+	Long: `Stores a token for the server, which is used for all further requests.
+The token is read from --token, or from stdin if that is not set. If a client
+configuration context is in use, the token is stored in the context.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		tkn := loginCmdOpts.Token
+		if tkn == "" {
+			fmt.Fprint(os.Stderr, "token: ")
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				return fmt.Errorf("cannot read token: %w", err)
+			}
+			tkn = strings.TrimSpace(line)
+		}
+		if tkn == "" {
+			return fmt.Errorf("token must not be empty")
+		}
+
+		// make sure the server accepts the token before we store it
+		conn := dial(tokenCredentials(tkn))
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err := v1.NewUfsServiceClient(conn).ListEngines(ctx, &v1.ListEnginesRequest{Limit: 1})
+		if err != nil {
+			return fmt.Errorf("server does not accept token: %w", err)
+		}
+
+		target, err := storeToken(tkn)
+		if err != nil {
+			return fmt.Errorf("cannot store credentials: %w", err)
+		}
+		fmt.Printf("logged in to %s\n", target)
+		return nil
+	},
+}
+
+// storeToken stores the token of the server in the context in use, or in the credentials file
+// if there is none. An empty token removes the stored one. It returns what the token is stored for.
+func storeToken(tkn string) (target string, err error) {
+	if rootCmdOpts.Context != "" {
+		target = fmt.Sprintf("context %s", rootCmdOpts.Context)
+		fn, cfg, err := loadClientConfig()
+		if err != nil {
+			return "", err
+		}
+		if tkn == "" && rootCmdOpts.ContextToken == "" {
+			return "", fmt.Errorf("not logged in to %s", target)
+		}
+		if err := cfg.Set(rootCmdOpts.Context, "token", tkn); err != nil {
+			return "", err
+		}
+		return target, cfg.Save(fn)
+	}
+
+	target = serverKey()
+	creds, err := loadCredentials()
+	if err != nil {
+		return "", err
+	}
+	if tkn == "" {
+		if _, ok := creds.Servers[target]; !ok {
+			return "", fmt.Errorf("not logged in to %s", target)
+		}
+		delete(creds.Servers, target)
+		return target, creds.Save()
+	}
+	if creds.Servers == nil {
+		creds.Servers = make(map[string]string)
+	}
+	creds.Servers[target] = tkn
+	return target, creds.Save()
+}
+
+// logoutCmd represents the logout command
+var logoutCmd = &cobra.Command{
+	Use:   "logout",
+	Short: "Removes the stored token of the server",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		_, err := storeToken("")
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(loginCmd)
+	rootCmd.AddCommand(logoutCmd)
+	loginCmd.Flags().StringVar(&loginCmdOpts.Token, "token", "", "token to log in with")
+}
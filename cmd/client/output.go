@@ -0,0 +1,213 @@
+package cmd
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/filterexpr"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+// streamColumnWidths are the widths of the table columns when printing a stream of Engines,
+// whose rows cannot be aligned with each other up front
+var streamColumnWidths = []int{24, 12, 32, 10, 8, 0}
+
+// enginePrinter prints Engines in the output format chosen by the user. Tables get their
+// header with the first row, so that a printer can be used for a stream of Engines, too.
+type enginePrinter struct {
+	Format string
+	Out    io.Writer
+	// Stream prints table rows with fixed column widths, such that rows printed one at
+	// a time line up
+	Stream bool
+
+	tw     *tabwriter.Writer
+	header bool
+	docs   int
+}
+
+func newEnginePrinter(format string, out io.Writer) (*enginePrinter, error) {
+	switch format {
+	case outputTable, outputJSON, outputYAML:
+	default:
+		return nil, fmt.Errorf("unknown output format %q: must be one of %s, %s or %s", format, outputTable, outputJSON, outputYAML)
+	}
+	return &enginePrinter{
+		Format: format,
+		Out:    out,
+		tw:     tabwriter.NewWriter(out, 0, 4, 2, ' ', 0),
+	}, nil
+}
+
+// PrintRows prints Engines as table rows, or the message as a whole in all other formats
+func (p *enginePrinter) PrintRows(msg proto.Message, engines ...*v1.EngineStatus) error {
+	if p.Format != outputTable {
+		return p.printMessage(msg)
+	}
+
+	if !p.header {
+		p.printRow("NAME", "OWNER", "REPOSITORY", "PHASE", "SUCCESS", "CREATED")
+		p.header = true
+	}
+	for _, s := range engines {
+		md := s.GetMetadata()
+		p.printRow(
+			s.Name,
+			orNone(md.GetOwner()),
+			orNone(formatRepository(md.GetRepository())),
+			filterexpr.PhaseName(s.Phase),
+			orNone(formatSuccess(s)),
+			orNone(formatTime(md.GetCreated().AsTime(), md.GetCreated() != nil)),
+		)
+	}
+	return p.tw.Flush()
+}
+
+func (p *enginePrinter) printRow(cells ...string) {
+	if !p.Stream {
+		fmt.Fprintln(p.tw, strings.Join(cells, "\t"))
+		return
+	}
+	for i, c := range cells {
+		if i == len(cells)-1 {
+			fmt.Fprintln(p.tw, c)
+			break
+		}
+		fmt.Fprintf(p.tw, "%-*s  ", streamColumnWidths[i], c)
+	}
+}
+
+// PrintDetails prints all details of a single Engine
+func (p *enginePrinter) PrintDetails(s *v1.EngineStatus) error {
+	if p.Format != outputTable {
+		return p.printMessage(s)
+	}
+
+	md := s.GetMetadata()
+	rows := [][2]string{
+		{"Name", s.Name},
+		{"Owner", md.GetOwner()},
+		{"Repository", formatRepository(md.GetRepository())},
+		{"Revision", md.GetRepository().GetRevision()},
+		{"Spec", md.GetEngineSpecName()},
+		{"Trigger", filterexpr.TriggerName(md.GetTrigger())},
+		{"Phase", filterexpr.PhaseName(s.Phase)},
+		{"Success", formatSuccess(s)},
+		{"Can replay", fmt.Sprintf("%v", s.GetConditions().GetCanReplay())},
+		{"Wait until", formatTime(s.GetConditions().GetWaitUntil().AsTime(), s.GetConditions().GetWaitUntil() != nil)},
+		{"Created", formatTime(md.GetCreated().AsTime(), md.GetCreated() != nil)},
+		{"Finished", formatTime(md.GetFinished().AsTime(), md.GetFinished() != nil)},
+		{"Details", s.Details},
+	}
+	for _, a := range md.GetAnnotations() {
+		rows = append(rows, [2]string{"Annotation " + a.Key, a.Value})
+	}
+	for _, r := range s.Results {
+		desc := r.Payload
+		if r.Description != "" {
+			desc = fmt.Sprintf("%s (%s)", r.Payload, r.Description)
+		}
+		rows = append(rows, [2]string{"Result " + r.Type, desc})
+	}
+	for _, r := range rows {
+		if r[1] == "" {
+			continue
+		}
+		fmt.Fprintf(p.tw, "%s:\t%s\n", r[0], r[1])
+	}
+	return p.tw.Flush()
+}
+
+// printMessage prints a message as JSON or YAML. JSON is printed one message per line, and YAML
+// separates the documents, so that streams of messages can be processed by other tools.
+func (p *enginePrinter) printMessage(msg proto.Message) error {
+	content, err := protojson.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if p.Format == outputJSON {
+		_, err = fmt.Fprintf(p.Out, "%s\n", content)
+		return err
+	}
+
+	content, err = yaml.JSONToYAML(content)
+	if err != nil {
+		return err
+	}
+	if p.docs > 0 {
+		if _, err := fmt.Fprintln(p.Out, "---"); err != nil {
+			return err
+		}
+	}
+	p.docs++
+	_, err = p.Out.Write(content)
+	return err
+}
+
+// formatRepository renders a repository as host/owner/repo@ref, leaving out what is not set
+func formatRepository(repo *v1.Repository) string {
+	var segs []string
+	for _, s := range []string{repo.GetHost(), repo.GetOwner(), repo.GetRepo()} {
+		if s != "" {
+			segs = append(segs, s)
+		}
+	}
+	res := strings.Join(segs, "/")
+	if ref := repo.GetRef(); ref != "" {
+		res += "@" + ref
+	}
+	return res
+}
+
+func formatSuccess(s *v1.EngineStatus) string {
+	if s.Phase != v1.EnginePhase_PHASE_DONE {
+		return ""
+	}
+	return fmt.Sprintf("%v", s.GetConditions().GetSuccess())
+}
+
+func formatTime(t time.Time, ok bool) string {
+	if !ok {
+		return ""
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -21,27 +21,25 @@ package cmd
 // THE SOFTWARE.
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"net"
-	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
-	"strings"
-	"sync"
+	"strconv"
+	"time"
 
+	"github.com/bhojpur/ufs/pkg/clientconfig"
+	"github.com/bhojpur/ufs/pkg/kubedial"
+	"github.com/bhojpur/ufs/pkg/tlsconfig"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"google.golang.org/grpc"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"google.golang.org/grpc/credentials"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/tools/portforward"
-	"k8s.io/client-go/transport/spdy"
 )
 
 var (
@@ -57,20 +55,46 @@ var rootCmdOpts struct {
 	K8sLabelSelector string
 	K8sPodPort       string
 	DialMode         string
+
+	TLSCA         string
+	TLSCert       string
+	TLSKey        string
+	TLSServerName string
+	// InsecureSendToken allows sending tokens to remote servers without TLS
+	InsecureSendToken bool
+
+	// Context is the name of the client configuration context in use, and ContextToken its token
+	Context      string
+	ContextToken string
 }
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "ufs",
 	Short: "Bhojpur UFS is a universal file system powered by Kubernetes",
-	PersistentPreRun: func(cmd *cobra.Command, args []string) {
-		if verbose {
-			log.SetLevel(log.DebugLevel)
-			log.Debug("verbose logging enabled")
+	// Execute prints errors itself, and most errors are not caused by misuse of the command line
+	SilenceErrors: true,
+	SilenceUsage:  true,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		setupLogging()
+		explicit := rootCmdOpts.Context != ""
+		err := applyContext(cmd)
+		if err != nil && !explicit {
+			// a broken client configuration must not keep commands like version or tls from working
+			log.WithError(err).Warn("cannot apply client configuration, using flags and env vars only")
+			return nil
 		}
+		return err
 	},
 }
 
+func setupLogging() {
+	if verbose {
+		log.SetLevel(log.DebugLevel)
+		log.Debug("verbose logging enabled")
+	}
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -116,9 +140,15 @@ func init() {
 	}
 
 	rootCmd.PersistentFlags().BoolVar(&rootCmdOpts.Verbose, "verbose", false, "en/disable verbose logging")
+	rootCmd.PersistentFlags().StringVar(&rootCmdOpts.Context, "context", os.Getenv("UFS_CONTEXT"), "client configuration context to use instead of the current one. Flags and env vars take precedence over the context's settings (defaults to UFS_CONTEXT env var).")
 	rootCmd.PersistentFlags().StringVar(&rootCmdOpts.DialMode, "dial-mode", dialMode, "dial mode that determines how we connect to Bhojpur UFS. Valid values are \"host\" or \"kubernetes\" (defaults to UFS_DIAL_MODE env var).")
 	rootCmd.PersistentFlags().StringVar(&rootCmdOpts.Host, "host", ufsHost, "[host dial mode] Bhojpur UFS host to talk to (defaults to UFS_HOST env var)")
 	rootCmd.PersistentFlags().StringVar(&rootCmdOpts.Kubeconfig, "kubeconfig", ufsKubeconfig, "[kubernetes dial mode] kubeconfig file to use (defaults to KUEBCONFIG env var)")
+	rootCmd.PersistentFlags().StringVar(&rootCmdOpts.TLSCA, "tls-ca", os.Getenv("UFS_TLS_CA"), "PEM CA certificates to verify the server with. Setting any --tls-* flag enables TLS, which verifies against the system's CAs unless this is set (defaults to UFS_TLS_CA env var)")
+	rootCmd.PersistentFlags().StringVar(&rootCmdOpts.TLSCert, "tls-cert", os.Getenv("UFS_TLS_CERT"), "PEM client certificate for servers which require one (defaults to UFS_TLS_CERT env var)")
+	rootCmd.PersistentFlags().StringVar(&rootCmdOpts.TLSKey, "tls-key", os.Getenv("UFS_TLS_KEY"), "PEM key of the client certificate (defaults to UFS_TLS_KEY env var)")
+	rootCmd.PersistentFlags().StringVar(&rootCmdOpts.TLSServerName, "tls-server-name", os.Getenv("UFS_TLS_SERVER_NAME"), "name the server certificate must be valid for, if it differs from the host we connect to, e.g. in kubernetes dial mode (defaults to UFS_TLS_SERVER_NAME env var)")
+	rootCmd.PersistentFlags().BoolVar(&rootCmdOpts.InsecureSendToken, "insecure-send-token", false, "send the token to servers other than localhost without TLS, where anyone on the network can read it")
 	rootCmd.PersistentFlags().StringVar(&rootCmdOpts.K8sNamespace, "k8s-namespace", ufsNamespace, "[kubernetes dial mode] Kubernetes namespace in which to look for the Bhojpur UFS pods (defaults to UFS_K8S_NAMESPACE env var, or configured kube context namespace)")
 	// The following are such specific flags that really only matters if one doesn't use the stock helm charts.
 	// They can still be set using an env var, but there's no need to clutter the CLI with them.
@@ -126,18 +156,85 @@ func init() {
 	rootCmdOpts.K8sPodPort = ufsPodPort
 }
 
+// applyContext fills in the connection settings from the chosen context of the client
+// configuration, unless they are set by flag or env var
+func applyContext(cmd *cobra.Command) error {
+	_, cfg, err := loadClientConfig()
+	if err != nil {
+		return err
+	}
+	ctx, err := cfg.Context(rootCmdOpts.Context)
+	if err != nil {
+		return err
+	}
+	if ctx == nil {
+		return nil
+	}
+	if rootCmdOpts.Context == "" {
+		rootCmdOpts.Context = cfg.CurrentContext
+	}
+
+	tls := ctx.TLS
+	if tls == nil {
+		tls = &clientconfig.TLS{}
+	}
+	settings := []struct {
+		Flag  string
+		Env   string
+		Dest  *string
+		Value string
+	}{
+		{"dial-mode", "UFS_DIAL_MODE", &rootCmdOpts.DialMode, ctx.DialMode},
+		{"host", "UFS_HOST", &rootCmdOpts.Host, ctx.Host},
+		{"kubeconfig", "KUBECONFIG", &rootCmdOpts.Kubeconfig, ctx.Kubeconfig},
+		{"k8s-namespace", "UFS_K8S_NAMESPACE", &rootCmdOpts.K8sNamespace, ctx.Namespace},
+		{"", "UFS_K8S_LABEL", &rootCmdOpts.K8sLabelSelector, ctx.LabelSelector},
+		{"", "UFS_K8S_POD_PORT", &rootCmdOpts.K8sPodPort, ctx.PodPort},
+		{"tls-ca", "UFS_TLS_CA", &rootCmdOpts.TLSCA, tls.CA},
+		{"tls-cert", "UFS_TLS_CERT", &rootCmdOpts.TLSCert, tls.Cert},
+		{"tls-key", "UFS_TLS_KEY", &rootCmdOpts.TLSKey, tls.Key},
+		{"tls-server-name", "UFS_TLS_SERVER_NAME", &rootCmdOpts.TLSServerName, tls.ServerName},
+	}
+	for _, s := range settings {
+		if s.Value == "" || os.Getenv(s.Env) != "" || (s.Flag != "" && cmd.Flags().Changed(s.Flag)) {
+			continue
+		}
+		*s.Dest = s.Value
+	}
+	rootCmdOpts.ContextToken = ctx.Token
+	return nil
+}
+
 type closableGrpcClientConnInterface interface {
 	grpc.ClientConnInterface
 	io.Closer
 }
 
-func dial() (res closableGrpcClientConnInterface) {
-	var err error
+// dial connects to the server. Unless the caller passes credentials, the stored token
+// of the server is sent with every RPC.
+func dial(rpcCreds ...credentials.PerRPCCredentials) (res closableGrpcClientConnInterface) {
+	creds, err := transportCredentials()
+	if err != nil {
+		log.WithError(err).Fatal("cannot configure TLS")
+	}
+	opts := []grpc.DialOption{creds}
+	if len(rpcCreds) == 0 {
+		if t := token(); t != "" {
+			rpcCreds = append(rpcCreds, tokenCredentials(t))
+		}
+	}
+	if len(rpcCreds) > 0 && !usesTLS() && !isLocal() && !rootCmdOpts.InsecureSendToken {
+		log.Fatalf("refusing to send the token to %s without TLS: set --tls-ca or pass --insecure-send-token", rootCmdOpts.Host)
+	}
+	for _, c := range rpcCreds {
+		opts = append(opts, grpc.WithPerRPCCredentials(c))
+	}
+
 	switch rootCmdOpts.DialMode {
 	case dialModeHost:
-		res, err = grpc.Dial(rootCmdOpts.Host, grpc.WithInsecure())
+		res, err = grpc.Dial(rootCmdOpts.Host, opts...)
 	case dialModeKubernetes:
-		res, err = dialKubernetes()
+		res, err = dialKubernetes(opts...)
 	default:
 		log.Fatalf("unknown dial mode: %s", rootCmdOpts.DialMode)
 	}
@@ -148,7 +245,45 @@ func dial() (res closableGrpcClientConnInterface) {
 	return
 }
 
-func dialKubernetes() (closableGrpcClientConnInterface, error) {
+// transportCredentials produces the dial option which secures the connection to the server.
+// Unless a --tls-* flag is set, the connection is not encrypted.
+func transportCredentials() (grpc.DialOption, error) {
+	if !usesTLS() {
+		return grpc.WithInsecure(), nil
+	}
+	cfg, err := tlsconfig.ClientConfig(rootCmdOpts.TLSCA, rootCmdOpts.TLSCert, rootCmdOpts.TLSKey, rootCmdOpts.TLSServerName)
+	if err != nil {
+		return nil, err
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(cfg)), nil
+}
+
+// usesTLS is true if any --tls-* flag is set
+func usesTLS() bool {
+	return rootCmdOpts.TLSCA != "" || rootCmdOpts.TLSCert != "" || rootCmdOpts.TLSKey != "" || rootCmdOpts.TLSServerName != ""
+}
+
+// isLocal is true if the connection to the server does not leave the machine unencrypted, i.e. if
+// the server runs on a loopback address or is reached through a Kubernetes port-forward
+func isLocal() bool {
+	if rootCmdOpts.DialMode == dialModeKubernetes {
+		return true
+	}
+	host, _, err := net.SplitHostPort(rootCmdOpts.Host)
+	if err != nil {
+		host = rootCmdOpts.Host
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// kubernetesDialTimeout limits how long we wait for the port-forward to the first pod
+const kubernetesDialTimeout = 30 * time.Second
+
+func dialKubernetes(opts ...grpc.DialOption) (closableGrpcClientConnInterface, error) {
 	kubecfg, namespace, err := getKubeconfig(rootCmdOpts.Kubeconfig)
 	if err != nil {
 		return nil, fmt.Errorf("cannot load kubeconfig %s: %w", rootCmdOpts.Kubeconfig, err)
@@ -156,62 +291,30 @@ func dialKubernetes() (closableGrpcClientConnInterface, error) {
 	if rootCmdOpts.K8sNamespace != "" {
 		namespace = rootCmdOpts.K8sNamespace
 	}
-
-	clientSet, err := kubernetes.NewForConfig(kubecfg)
+	port, err := strconv.Atoi(rootCmdOpts.K8sPodPort)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid pod port %q: %w", rootCmdOpts.K8sPodPort, err)
 	}
 
-	pod, err := findUfsPod(clientSet, namespace, rootCmdOpts.K8sLabelSelector)
+	clientSet, err := kubernetes.NewForConfig(kubecfg)
 	if err != nil {
-		return nil, fmt.Errorf("cannot find Bhojpur UFS pod: %w", err)
-	}
-
-	localPort, err := findFreeLocalPort()
-
-	ctx, cancel := context.WithCancel(context.Background())
-	readychan, errchan := forwardPort(ctx, kubecfg, namespace, pod, fmt.Sprintf("%d:%s", localPort, rootCmdOpts.K8sPodPort))
-	select {
-	case err := <-errchan:
-		cancel()
 		return nil, err
-	case <-readychan:
 	}
 
-	res, err := grpc.Dial(fmt.Sprintf("localhost:%d", localPort), grpc.WithInsecure())
-	if err != nil {
-		cancel()
-		return nil, fmt.Errorf("cannot dial forwarded connection: %w", err)
+	dialer := &kubedial.Dialer{
+		Client:    clientSet,
+		Forwarder: &kubedial.PortForwarder{Client: clientSet, Config: kubecfg},
+		Namespace: namespace,
+		Selector:  rootCmdOpts.K8sLabelSelector,
+		Port:      port,
 	}
-
-	return closableConn{
-		ClientConnInterface: res,
-		Closer:              func() error { cancel(); return nil },
-	}, nil
-}
-
-type closableConn struct {
-	grpc.ClientConnInterface
-	Closer func() error
-}
-
-func (c closableConn) Close() error {
-	return c.Closer()
-}
-
-func findFreeLocalPort() (int, error) {
-	const (
-		start = 30000
-		end   = 60000
-	)
-	for p := start; p <= end; p++ {
-		l, err := net.Listen("tcp", fmt.Sprintf(":%d", p))
-		if err == nil {
-			l.Close()
-			return p, nil
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), kubernetesDialTimeout)
+	defer cancel()
+	conn, err := dialer.Dial(ctx, opts...)
+	if err != nil {
+		return nil, err
 	}
-	return 0, fmt.Errorf("no free local port found")
+	return conn, nil
 }
 
 // GetKubeconfig loads kubernetes connection config from a kubeconfig file
@@ -232,74 +335,3 @@ func getKubeconfig(kubeconfig string) (res *rest.Config, namespace string, err e
 
 	return res, namespace, nil
 }
-
-// findUfsPod returns the first pod we found for a particular component
-func findUfsPod(clientSet kubernetes.Interface, namespace, selector string) (podName string, err error) {
-	pods, err := clientSet.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{
-		LabelSelector: selector,
-	})
-	if err != nil {
-		return "", err
-	}
-	if len(pods.Items) == 0 {
-		return "", fmt.Errorf("no pod in %s with label component=%s", namespace, selector)
-	}
-	return pods.Items[0].Name, nil
-}
-
-// ForwardPort establishes a TCP port forwarding to a Kubernetes pod
-func forwardPort(ctx context.Context, config *rest.Config, namespace, pod, port string) (readychan chan struct{}, errchan chan error) {
-	errchan = make(chan error, 1)
-	readychan = make(chan struct{}, 1)
-
-	roundTripper, upgrader, err := spdy.RoundTripperFor(config)
-	if err != nil {
-		errchan <- err
-		return
-	}
-
-	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/portforward", namespace, pod)
-	hostIP := strings.TrimLeft(config.Host, "https://")
-	serverURL := url.URL{Scheme: "https", Path: path, Host: hostIP}
-	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: roundTripper}, http.MethodPost, &serverURL)
-
-	stopChan := make(chan struct{}, 1)
-	fwdReadyChan := make(chan struct{}, 1)
-	out, errOut := new(bytes.Buffer), new(bytes.Buffer)
-	forwarder, err := portforward.New(dialer, []string{port}, stopChan, fwdReadyChan, out, errOut)
-	if err != nil {
-		panic(err)
-	}
-
-	var once sync.Once
-	go func() {
-		err := forwarder.ForwardPorts()
-		if err != nil {
-			errchan <- err
-		}
-		once.Do(func() { close(readychan) })
-	}()
-
-	go func() {
-		select {
-		case <-readychan:
-			// we're out of here
-		case <-ctx.Done():
-			close(stopChan)
-		}
-	}()
-
-	go func() {
-		for range fwdReadyChan {
-		}
-
-		if errOut.Len() != 0 {
-			errchan <- fmt.Errorf(errOut.String())
-			return
-		}
-
-		once.Do(func() { close(readychan) })
-	}()
-
-	return
-}
@@ -0,0 +1,318 @@
+package cmd
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/archive"
+	"github.com/bhojpur/ufs/pkg/fileutils"
+	"github.com/bhojpur/ufs/pkg/spec"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// ignoreFile lists the files of a workspace which are not uploaded by ufs run
+	ignoreFile = ".ufsignore"
+
+	// uploadChunkSize is the size of the application tar chunks sent to the server
+	uploadChunkSize = 512 << 10
+
+	// progressThreshold is the size an upload must exceed before we report its progress
+	progressThreshold = 4 << 20
+)
+
+var runCmdOpts struct {
+	Metadata  metadataFlags
+	Workspace string
+	File      string
+	Detach    bool
+}
+
+// runCmd represents the run command
+var runCmd = &cobra.Command{
+	Use:   "run [engine]",
+	Short: "Uploads the workspace and runs one of its Engines",
+	Long: `Uploads the workspace and runs one of its Engines.
+
+The Engine is either named after an Engine in ufs/config.yaml, or given as file with --file.
+Otherwise the default Engine of ufs/config.yaml runs. Files which match the patterns in the
+.ufsignore file of the workspace are not uploaded.
+
+Unless --detach is set, the command follows the log of the Engine until it is done,
+and fails if the Engine fails. Interrupting the command does not stop the Engine, but
+the command fails nonetheless.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var name string
+		if len(args) > 0 {
+			name = args[0]
+		}
+		ws, err := loadWorkspace(runCmdOpts.Workspace, name, runCmdOpts.File)
+		if err != nil {
+			return err
+		}
+		md, err := runCmdOpts.Metadata.Metadata()
+		if err != nil {
+			return err
+		}
+		md.EngineSpecName = ws.SpecName
+
+		conn := dial()
+		defer conn.Close()
+		ctx, cancel := interruptContext()
+		defer cancel()
+
+		client := v1.NewUfsServiceClient(conn)
+		s, err := ws.Upload(ctx, client, md)
+		if err != nil {
+			return err
+		}
+		fmt.Println(s.Name)
+		if runCmdOpts.Detach {
+			return nil
+		}
+
+		name = s.Name
+		s, err = followEngine(ctx, client, name, os.Stdout)
+		if ctx.Err() != nil {
+			return errStillRunning(name)
+		}
+		if err != nil {
+			return err
+		}
+		return engineResult(s)
+	},
+}
+
+// workspace is a local directory which is uploaded to run one of its Engines
+type workspace struct {
+	Dir        string
+	ConfigYAML []byte
+	EngineYAML []byte
+	// SpecName is the name of the Engine in ufs/config.yaml, if it was chosen by name
+	SpecName string
+	Ignore   []string
+}
+
+// loadWorkspace reads the configuration of the workspace in dir and the Engine YAML which is run.
+// The Engine is chosen by its name in ufs/config.yaml, or by file, or is the default Engine.
+func loadWorkspace(dir, name, file string) (*workspace, error) {
+	res := &workspace{Dir: dir}
+
+	var err error
+	res.ConfigYAML, err = os.ReadFile(filepath.Join(dir, spec.ConfigPath))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", spec.ConfigPath, err)
+	}
+	cfg, err := spec.ParseConfig(res.ConfigYAML)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case name != "" && file != "":
+		return nil, fmt.Errorf("cannot run an Engine by name and by file at the same time")
+	case name != "":
+		for _, e := range cfg.Engines {
+			if e.Name == name {
+				file = e.Path
+				res.SpecName = e.Name
+				break
+			}
+		}
+		if file == "" {
+			return nil, fmt.Errorf("%s has no Engine named %q", spec.ConfigPath, name)
+		}
+	case file == "":
+		file = cfg.DefaultEngine
+		if file == "" {
+			return nil, fmt.Errorf("%s has no default Engine: name the Engine to run or use --file", spec.ConfigPath)
+		}
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	res.EngineYAML, err = os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read Engine YAML: %w", err)
+	}
+	if _, err := spec.ParseEngine(res.EngineYAML); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(dir, ignoreFile))
+	if err == nil {
+		res.Ignore, err = fileutils.ReadPatterns(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", ignoreFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot read %s: %w", ignoreFile, err)
+	}
+
+	return res, nil
+}
+
+// Upload sends the workspace to the server, which starts the Engine once the upload is complete
+func (ws *workspace) Upload(ctx context.Context, client v1.UfsServiceClient, md *v1.EngineMetadata) (*v1.EngineStatus, error) {
+	tar, err := archive.TarWithOptions(ws.Dir, &archive.TarOptions{
+		Compression:     archive.Gzip,
+		ExcludePatterns: ws.Ignore,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot archive workspace: %w", err)
+	}
+	defer tar.Close()
+
+	stream, err := client.StartLocalEngine(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reqs := []*v1.StartLocalEngineRequest{
+		{Content: &v1.StartLocalEngineRequest_Metadata{Metadata: md}},
+		{Content: &v1.StartLocalEngineRequest_ConfigYaml{ConfigYaml: ws.ConfigYAML}},
+		{Content: &v1.StartLocalEngineRequest_EngineYaml{EngineYaml: ws.EngineYAML}},
+	}
+	for _, req := range reqs {
+		if err := stream.Send(req); err != nil {
+			return nil, uploadError(stream, err)
+		}
+	}
+
+	progress := newUploadProgress(os.Stderr)
+	buf := make([]byte, uploadChunkSize)
+	for {
+		n, rerr := io.ReadFull(tar, buf)
+		if n > 0 {
+			err := stream.Send(&v1.StartLocalEngineRequest{Content: &v1.StartLocalEngineRequest_ApplicationTar{ApplicationTar: buf[:n]}})
+			if err != nil {
+				return nil, uploadError(stream, err)
+			}
+			progress.Add(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return nil, fmt.Errorf("cannot archive workspace: %w", rerr)
+		}
+	}
+	progress.Done()
+
+	err = stream.Send(&v1.StartLocalEngineRequest{Content: &v1.StartLocalEngineRequest_ApplicationTarDone{ApplicationTarDone: true}})
+	if err != nil {
+		return nil, uploadError(stream, err)
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Status, nil
+}
+
+// uploadError returns the reason why the server aborted an upload. Send only reports that
+// the stream broke, the server's error is returned when we receive the response.
+func uploadError(stream v1.UfsService_StartLocalEngineClient, err error) error {
+	if err != io.EOF {
+		return err
+	}
+	_, err = stream.CloseAndRecv()
+	if err == nil {
+		err = fmt.Errorf("server closed the upload prematurely")
+	}
+	return err
+}
+
+// uploadProgress reports the progress of large uploads on a terminal
+type uploadProgress struct {
+	Out io.Writer
+
+	terminal bool
+	total    int
+	start    time.Time
+	last     time.Time
+}
+
+func newUploadProgress(out *os.File) *uploadProgress {
+	var terminal bool
+	if stat, err := out.Stat(); err == nil {
+		terminal = stat.Mode()&os.ModeCharDevice != 0
+	}
+	return &uploadProgress{Out: out, terminal: terminal, start: time.Now()}
+}
+
+// Add records that n more bytes were sent
+func (p *uploadProgress) Add(n int) {
+	p.total += n
+	if !p.terminal || p.total < progressThreshold || time.Since(p.last) < 200*time.Millisecond {
+		return
+	}
+	p.last = time.Now()
+	fmt.Fprintf(p.Out, "\ruploading workspace: %s (%s/s)  ", formatBytes(p.total), formatBytes(p.rate()))
+}
+
+// Done finishes the progress report
+func (p *uploadProgress) Done() {
+	log.WithField("size", p.total).WithField("duration", time.Since(p.start)).Debug("uploaded workspace")
+	if !p.terminal || p.total < progressThreshold {
+		return
+	}
+	fmt.Fprintf(p.Out, "\ruploaded workspace: %s (%s/s)  \n", formatBytes(p.total), formatBytes(p.rate()))
+}
+
+func (p *uploadProgress) rate() int {
+	d := time.Since(p.start).Seconds()
+	if d <= 0 {
+		return 0
+	}
+	return int(float64(p.total) / d)
+}
+
+// formatBytes renders a size in bytes in the largest binary unit it has at least one of
+func formatBytes(n int) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := unit, 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func init() {
+	rootCmd.AddCommand(runCmd)
+	runCmdOpts.Metadata.AddFlags(runCmd)
+	runCmd.Flags().StringVarP(&runCmdOpts.Workspace, "workspace", "w", ".", "workspace which contains ufs/config.yaml")
+	runCmd.Flags().StringVar(&runCmdOpts.File, "file", "", "Engine YAML to run, relative to the workspace")
+	runCmd.Flags().BoolVarP(&runCmdOpts.Detach, "detach", "d", false, "do not follow the log of the Engine")
+}
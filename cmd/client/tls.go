@@ -0,0 +1,85 @@
+package cmd
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/bhojpur/ufs/pkg/homedir"
+	"github.com/bhojpur/ufs/pkg/tlsconfig"
+	"github.com/spf13/cobra"
+)
+
+// tlsCmd represents the tls command
+var tlsCmd = &cobra.Command{
+	Use:   "tls",
+	Short: "Helps setting up TLS between client and server",
+	Args:  cobra.NoArgs,
+}
+
+var tlsGenerateDevCACmdOpts struct {
+	Dir   string
+	Hosts []string
+}
+
+// tlsGenerateDevCACmd represents the tls generate-dev-ca command
+var tlsGenerateDevCACmd = &cobra.Command{
+	Use:   "generate-dev-ca",
+	Short: "Generates a self-signed CA with server and client certificates for development",
+	Long: `Generates a self-signed CA with server and client certificates for development.
+The keys are stored unencrypted - do not use them in production.
+
+Start the server with
+  ufs serve --tls-cert <dir>/server.pem --tls-key <dir>/server-key.pem --tls-client-ca <dir>/ca.pem
+and connect using
+  ufs --tls-ca <dir>/ca.pem --tls-cert <dir>/client.pem --tls-key <dir>/client-key.pem ...`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir := tlsGenerateDevCACmdOpts.Dir
+		if dir == "" {
+			cfgHome, err := homedir.GetConfigHome()
+			if err != nil {
+				return fmt.Errorf("cannot determine config directory - please use --dir: %w", err)
+			}
+			dir = filepath.Join(cfgHome, "ufs", "tls")
+		}
+
+		err := tlsconfig.GenerateDevCA(dir, tlsGenerateDevCACmdOpts.Hosts)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("generated development CA in %s\n\n", dir)
+		fmt.Printf("server flags: --tls-cert %s --tls-key %s --tls-client-ca %s\n",
+			filepath.Join(dir, tlsconfig.ServerFile), filepath.Join(dir, tlsconfig.ServerKeyFile), filepath.Join(dir, tlsconfig.CAFile))
+		fmt.Printf("client flags: --tls-ca %s --tls-cert %s --tls-key %s\n",
+			filepath.Join(dir, tlsconfig.CAFile), filepath.Join(dir, tlsconfig.ClientFile), filepath.Join(dir, tlsconfig.ClientKeyFile))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(tlsCmd)
+	tlsCmd.AddCommand(tlsGenerateDevCACmd)
+	tlsGenerateDevCACmd.Flags().StringVar(&tlsGenerateDevCACmdOpts.Dir, "dir", "", "directory the CA and certificates are written to (defaults to ufs/tls in the user's config directory)")
+	tlsGenerateDevCACmd.Flags().StringSliceVar(&tlsGenerateDevCACmdOpts.Hosts, "host", []string{"localhost", "127.0.0.1"}, "host names and IP addresses the server certificate is valid for")
+}
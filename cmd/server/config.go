@@ -0,0 +1,246 @@
+package cmd
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/bhojpur/ufs/pkg/auth"
+	"github.com/bhojpur/ufs/pkg/serverconfig"
+	"github.com/bhojpur/ufs/pkg/ufs"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Works with the server configuration file",
+	Args:  cobra.NoArgs,
+}
+
+// configValidateCmd represents the config validate command
+var configValidateCmd = &cobra.Command{
+	Use:   "validate [file]",
+	Short: "Checks a server configuration file and reports all problems",
+	Long: `Checks a server configuration file and reports all problems, including files it
+references which cannot be loaded. Validates the file UFS_SERVER_CONFIG points to
+unless a file is given.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		fn := os.Getenv("UFS_SERVER_CONFIG")
+		if len(args) > 0 {
+			fn = args[0]
+		}
+		if fn == "" {
+			return fmt.Errorf("no configuration file given")
+		}
+
+		cfg, err := serverconfig.Load(fn)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fn, err)
+		}
+		err = cfg.Validate()
+		var verr serverconfig.ValidationError
+		if errors.As(err, &verr) {
+			for _, fe := range verr {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", fn, fe)
+			}
+			return fmt.Errorf("%s is invalid: %d problem(s)", fn, len(verr))
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s is valid\n", fn)
+		return nil
+	},
+}
+
+// withConfigFile returns the options with all settings which neither a flag nor an
+// environment variable set taken from the configuration file
+func withConfigFile(cmd *cobra.Command, opts serveOptions, cfg *serverconfig.Config) serveOptions {
+	settings := []struct {
+		Flag  string
+		Env   string
+		Dest  *string
+		Value string
+	}{
+		{"listen", "UFS_LISTEN", &opts.Listen, cfg.Listen.GRPC},
+		{"db", "UFS_DB", &opts.DBDSN, cfg.Store.DSN},
+		{"staging-dir", "UFS_STAGING_DIR", &opts.StagingDir, cfg.Store.StagingDir},
+		{"log-dir", "UFS_LOG_DIR", &opts.LogDir, cfg.Store.LogDir},
+		{"replay-dir", "UFS_REPLAY_DIR", &opts.ReplayDir, cfg.Store.ReplayDir},
+		{"runner", "UFS_RUNNER", &opts.Runner, cfg.Runner.Type},
+		{"work-dir", "UFS_WORK_DIR", &opts.WorkDir, cfg.Runner.WorkDir},
+		{"kubeconfig", "KUBECONFIG", &opts.Kubeconfig, cfg.Runner.Kubeconfig},
+		{"k8s-namespace", "UFS_K8S_NAMESPACE", &opts.Namespace, cfg.Runner.Namespace},
+		{"engine-image", "UFS_ENGINE_IMAGE", &opts.Image, cfg.Runner.Image},
+		{"tls-cert", "UFS_TLS_CERT", &opts.TLSCert, cfg.TLS.Cert},
+		{"tls-key", "UFS_TLS_KEY", &opts.TLSKey, cfg.TLS.Key},
+		{"tls-client-ca", "UFS_TLS_CLIENT_CA", &opts.TLSClientCA, cfg.TLS.ClientCA},
+		{"auth-tokens-file", "UFS_AUTH_TOKENS_FILE", &opts.AuthTokensFile, cfg.Auth.TokensFile},
+		{"auth-hmac-key-file", "UFS_AUTH_HMAC_KEY_FILE", &opts.AuthHMACKeyFile, cfg.Auth.HMACKeyFile},
+	}
+	for _, s := range settings {
+		if s.Value == "" || os.Getenv(s.Env) != "" || cmd.Flags().Changed(s.Flag) {
+			continue
+		}
+		*s.Dest = s.Value
+	}
+
+	// an empty address disables a listener, so only an absent one falls back
+	if _, ok := os.LookupEnv("UFS_UI_LISTEN"); cfg.Listen.UI != nil && !ok && !cmd.Flags().Changed("ui-listen") {
+		opts.UIListen = *cfg.Listen.UI
+	}
+	if _, ok := os.LookupEnv("UFS_METRICS_LISTEN"); cfg.Listen.Metrics != nil && !ok && !cmd.Flags().Changed("metrics-listen") {
+		opts.MetricsListen = *cfg.Listen.Metrics
+	}
+	if cfg.ReadOnly != nil && os.Getenv("UFS_READ_ONLY") == "" && !cmd.Flags().Changed("read-only") {
+		opts.ReadOnly = *cfg.ReadOnly
+	}
+	if cfg.Runner.InsecureAllowLocal && os.Getenv("UFS_INSECURE_ALLOW_LOCAL_RUNNER") == "" && !cmd.Flags().Changed("insecure-allow-local-runner") {
+		opts.InsecureAllowLocalRunner = true
+	}
+	if len(cfg.SpecRepos) > 0 && os.Getenv("UFS_SPEC_REPOS") == "" && !cmd.Flags().Changed("spec-repo") {
+		opts.SpecRepos = make([]string, 0, len(cfg.SpecRepos))
+		for _, r := range cfg.SpecRepos {
+			s := r.Dir
+			if r.Name != "" {
+				s = r.Name + "=" + r.Dir
+			}
+			opts.SpecRepos = append(opts.SpecRepos, s)
+		}
+	}
+	return opts
+}
+
+// serverConfig converts the options into a configuration which can be validated
+func (o serveOptions) serverConfig() *serverconfig.Config {
+	uiListen := o.UIListen
+	metricsListen := o.MetricsListen
+	readOnly := o.ReadOnly
+	res := &serverconfig.Config{
+		Listen: serverconfig.Listen{GRPC: o.Listen, UI: &uiListen, Metrics: &metricsListen},
+		Store: serverconfig.Store{
+			DSN:        o.DBDSN,
+			LogDir:     o.LogDir,
+			ReplayDir:  o.ReplayDir,
+			StagingDir: o.StagingDir,
+		},
+		Runner: serverconfig.Runner{
+			Type:       o.Runner,
+			WorkDir:    o.WorkDir,
+			Kubeconfig: o.Kubeconfig,
+			Namespace:  o.Namespace,
+			Image:      o.Image,
+
+			InsecureAllowLocal: o.InsecureAllowLocalRunner,
+		},
+		Auth: serverconfig.Auth{TokensFile: o.AuthTokensFile, HMACKeyFile: o.AuthHMACKeyFile},
+		TLS:  serverconfig.TLS{Cert: o.TLSCert, Key: o.TLSKey, ClientCA: o.TLSClientCA},
+
+		ReadOnly: &readOnly,
+	}
+	for _, s := range o.SpecRepos {
+		// a repository without a directory is reported by Validate
+		r, _ := serverconfig.ParseSpecRepo(s)
+		res.SpecRepos = append(res.SpecRepos, r)
+	}
+	return res
+}
+
+// liveConfig applies changes of the configuration file to the running server. Read-only mode,
+// spec repositories and token files change immediately, everything else after a restart.
+type liveConfig struct {
+	cmd *cobra.Command
+	// flags are the options before the configuration file was applied
+	flags serveOptions
+	// running are the options the server started with
+	running serveOptions
+
+	service *ufs.Service
+	ui      *ufs.UI
+	// authn is nil if authentication is disabled
+	authn *auth.Reloadable
+}
+
+// Reload applies a changed configuration file. Invalid configurations are ignored.
+func (lc *liveConfig) Reload(cfg *serverconfig.Config, err error) {
+	logger := log.WithField("file", lc.flags.Config)
+	if err != nil {
+		logger.WithError(err).Warn("cannot load server configuration - keeping the previous one")
+		return
+	}
+	next := withConfigFile(lc.cmd, lc.flags, cfg)
+	nextCfg := next.serverConfig()
+	if err := nextCfg.Validate(); err != nil {
+		logger.WithError(err).Warn("invalid server configuration - keeping the previous one")
+		return
+	}
+
+	repos, err := parseSpecRepos(next.SpecRepos)
+	if err != nil {
+		logger.WithError(err).Warn("invalid server configuration - keeping the previous one")
+		return
+	}
+	lc.service.SetReadOnly(next.ReadOnly)
+	lc.ui.Update(repos, next.ReadOnly)
+
+	runningCfg := lc.running.serverConfig()
+	var restart []string
+	if nextCfg.Auth.Enabled() != runningCfg.Auth.Enabled() {
+		restart = append(restart, "auth")
+	} else if lc.authn != nil {
+		authn, err := newAuthenticator(next.AuthTokensFile, next.AuthHMACKeyFile)
+		if err != nil {
+			logger.WithError(err).Warn("cannot reload tokens - keeping the previous ones")
+		} else {
+			lc.authn.Set(authn)
+		}
+	}
+	for _, s := range []struct {
+		Name          string
+		Running, Next interface{}
+	}{
+		{"listen", runningCfg.Listen, nextCfg.Listen},
+		{"store", runningCfg.Store, nextCfg.Store},
+		{"runner", runningCfg.Runner, nextCfg.Runner},
+		{"tls", runningCfg.TLS, nextCfg.TLS},
+	} {
+		if !reflect.DeepEqual(s.Running, s.Next) {
+			restart = append(restart, s.Name)
+		}
+	}
+	if len(restart) > 0 {
+		logger.WithField("sections", restart).Warn("changed settings take effect after a restart")
+	}
+	logger.WithField("readOnly", next.ReadOnly).WithField("specRepos", len(repos)).Info("reloaded server configuration")
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configValidateCmd)
+}
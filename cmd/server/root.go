@@ -34,6 +34,8 @@ var verbose bool
 var rootCmd = &cobra.Command{
 	Use:   "ufs",
 	Short: "Bhojpur UFS is a universal file system powered by Kubernetes",
+	// Execute prints errors
+	SilenceErrors: true,
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
 		if verbose {
 			log.SetLevel(log.DebugLevel)
@@ -0,0 +1,92 @@
+package cmd
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bhojpur/ufs/pkg/auth"
+	"github.com/spf13/cobra"
+)
+
+// tokenCmd represents the token command
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manages HMAC-signed bearer tokens",
+	Args:  cobra.NoArgs,
+}
+
+// tokenGenerateKeyCmd represents the token generate-key command
+var tokenGenerateKeyCmd = &cobra.Command{
+	Use:   "generate-key",
+	Short: "Prints a new random key for signing tokens",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		if err != nil {
+			return err
+		}
+		fmt.Println(base64.RawURLEncoding.EncodeToString(key))
+		return nil
+	},
+}
+
+var tokenIssueCmdOpts struct {
+	KeyFile string
+	Admin   bool
+	TTL     time.Duration
+}
+
+// tokenIssueCmd represents the token issue command
+var tokenIssueCmd = &cobra.Command{
+	Use:   "issue <name>",
+	Short: "Issues a token for a user, to be used with \"ufs login\"",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if tokenIssueCmdOpts.KeyFile == "" {
+			return fmt.Errorf("--hmac-key-file is required")
+		}
+		tokens, err := auth.LoadHMACTokens(tokenIssueCmdOpts.KeyFile)
+		if err != nil {
+			return err
+		}
+		token, err := tokens.Issue(auth.Identity{Name: args[0], Admin: tokenIssueCmdOpts.Admin}, tokenIssueCmdOpts.TTL)
+		if err != nil {
+			return err
+		}
+		fmt.Println(token)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(tokenCmd)
+	tokenCmd.AddCommand(tokenGenerateKeyCmd)
+	tokenCmd.AddCommand(tokenIssueCmd)
+	tokenIssueCmd.Flags().StringVar(&tokenIssueCmdOpts.KeyFile, "hmac-key-file", os.Getenv("UFS_AUTH_HMAC_KEY_FILE"), "file containing the key which signs the token (defaults to UFS_AUTH_HMAC_KEY_FILE env var)")
+	tokenIssueCmd.Flags().BoolVar(&tokenIssueCmdOpts.Admin, "admin", false, "grants access to the Engines of all owners")
+	tokenIssueCmd.Flags().DurationVar(&tokenIssueCmdOpts.TTL, "ttl", 30*24*time.Hour, "time after which the token expires. Tokens without expiry are issued if zero")
+}
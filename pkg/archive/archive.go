@@ -33,6 +33,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -47,7 +48,9 @@ import (
 	fileutils "github.com/bhojpur/ufs/pkg/fileutils"
 	idtools "github.com/bhojpur/ufs/pkg/idtools"
 	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
 	"github.com/sirupsen/logrus"
+	"github.com/ulikunitz/xz"
 	exec "golang.org/x/sys/execabs"
 )
 
@@ -78,6 +81,48 @@ type (
 		// replaced with the matching name from this map.
 		RebaseNames map[string]string
 		InUserNS    bool
+		// CompressionOptions tune the compressor when packing.
+		CompressionOptions CompressionOptions
+		// Reproducible makes packing write the same archive for the same
+		// file names, contents, modes and links when not nil.
+		Reproducible *ReproducibleOptions
+		// Manifest is filled with the digests of the archive and of its entries
+		// when not nil. When packing, it is complete once the archive has been
+		// read to EOF. The chrootarchive package does not fill it.
+		Manifest *Manifest `json:"-"`
+		// ExpectedManifest makes unpacking fail with ErrManifestMismatch at the
+		// first entry which differs from it, or at the end of the archive if the
+		// digest of the stream differs. Entries before a mismatch are left in dest,
+		// but the entry which differs is not.
+		ExpectedManifest *Manifest
+	}
+
+	// CompressionOptions tune the compressor of CompressStreamWithOptions.
+	CompressionOptions struct {
+		// Level is the compression level: 1-9 for Gzip and Xz, 1-22 for Zstd.
+		// Zero selects the default level of the algorithm.
+		Level int
+		// Concurrency is the number of goroutines Gzip and Zstd compress with.
+		// Zero selects GOMAXPROCS. One compresses Gzip with compress/gzip
+		// instead of splitting the stream into blocks.
+		Concurrency int
+		// BlockSize is the size of the blocks Gzip compresses in parallel,
+		// which must be larger than 16 KiB. Zero selects 1 MiB.
+		BlockSize int
+	}
+
+	// ReproducibleOptions normalise the metadata which the filesystem adds to
+	// an archive. Entries are written in lexical order, depth first. Owners are
+	// reset to root unless ChownOpts are set, user and group names are dropped,
+	// access and change times are omitted and modification times are clamped
+	// to SourceDateEpoch. Headers are written in the PAX format, which only
+	// adds extended records for values USTAR cannot hold. File capabilities
+	// are kept as they change what the file does.
+	// Compressed archives are reproducible for the same CompressionOptions.
+	ReproducibleOptions struct {
+		// SourceDateEpoch is the latest modification time written, later ones
+		// are replaced by it. Zero clamps to the Unix epoch.
+		SourceDateEpoch time.Time
 	}
 )
 
@@ -208,9 +253,48 @@ func DetectCompression(source []byte) Compression {
 }
 
 func xzDecompress(ctx context.Context, archive io.Reader) (io.ReadCloser, error) {
-	args := []string{"xz", "-d", "-c", "-q"}
+	if useXzEnv := os.Getenv("BHOJPUR_USE_XZ_BINARY"); useXzEnv != "" {
+		useXz, err := strconv.ParseBool(useXzEnv)
+		if err != nil {
+			logrus.WithError(err).Warn("invalid value in BHOJPUR_USE_XZ_BINARY env var")
+		}
+		if useXz {
+			xzPath, err := exec.LookPath("xz")
+			if err == nil {
+				logrus.Debugf("Using %s to decompress", xzPath)
+				return cmdStream(exec.CommandContext(ctx, xzPath, "-d", "-c", "-q"), archive)
+			}
+			logrus.Debugf("xz binary not found, falling back to go xz library")
+		}
+	}
 
-	return cmdStream(exec.CommandContext(ctx, args[0], args[1:]...), archive)
+	xzReader, err := xz.NewReader(archive)
+	if err != nil {
+		return nil, fmt.Errorf("xz: %w", err)
+	}
+	return &xzReadCloser{ctx: ctx, r: xzReader}, nil
+}
+
+// xzReadCloser decompresses an xz stream in process. It stops reading once its context
+// is done, like the xz command which is killed when its context is done.
+type xzReadCloser struct {
+	ctx context.Context
+	r   *xz.Reader
+}
+
+func (r *xzReadCloser) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("xz: %w", err)
+	}
+	return n, err
+}
+
+func (r *xzReadCloser) Close() error {
+	return nil
 }
 
 func gzDecompress(ctx context.Context, buf io.Reader) (io.ReadCloser, error) {
@@ -292,7 +376,7 @@ func DecompressStream(archive io.Reader) (io.ReadCloser, error) {
 		if err != nil {
 			return nil, err
 		}
-		readBufWrapper := p.NewReadCloserWrapper(buf, zstdReader)
+		readBufWrapper := p.NewReadCloserWrapper(buf, zstdReader.IOReadCloser())
 		return readBufWrapper, nil
 	default:
 		return nil, fmt.Errorf("Unsupported compression format %s", (&compression).Extension())
@@ -301,25 +385,146 @@ func DecompressStream(archive io.Reader) (io.ReadCloser, error) {
 
 // CompressStream compresses the dest with specified compression algorithm.
 func CompressStream(dest io.Writer, compression Compression) (io.WriteCloser, error) {
+	return CompressStreamWithOptions(dest, compression, CompressionOptions{})
+}
+
+// CompressStreamWithOptions compresses the dest with specified compression algorithm,
+// level and concurrency.
+func CompressStreamWithOptions(dest io.Writer, compression Compression, opts CompressionOptions) (io.WriteCloser, error) {
+	if opts.Concurrency < 0 {
+		return nil, fmt.Errorf("invalid compression concurrency %d", opts.Concurrency)
+	}
 	p := pools.BufioWriter32KPool
-	buf := p.Get(dest)
 	switch compression {
 	case Uncompressed:
+		buf := p.Get(dest)
 		writeBufWrapper := p.NewWriteCloserWrapper(buf, buf)
 		return writeBufWrapper, nil
 	case Gzip:
-		gzWriter := gzip.NewWriter(dest)
-		writeBufWrapper := p.NewWriteCloserWrapper(buf, gzWriter)
-		return writeBufWrapper, nil
-	case Bzip2, Xz:
-		// archive/bzip2 does not support writing, and there is no xz support at all
-		// However, this is not a problem as docker only currently generates gzipped tars
+		level := gzip.DefaultCompression
+		if opts.Level != 0 {
+			if opts.Level < gzip.BestSpeed || opts.Level > gzip.BestCompression {
+				return nil, fmt.Errorf("invalid gzip compression level %d: must be 1-9", opts.Level)
+			}
+			level = opts.Level
+		}
+		if opts.BlockSize < 0 || (opts.BlockSize != 0 && opts.BlockSize < minGzipBlockSize) {
+			return nil, fmt.Errorf("invalid gzip block size %d: must be at least %d", opts.BlockSize, minGzipBlockSize)
+		}
+		buf := p.Get(dest)
+		if opts.Concurrency == 1 {
+			gzWriter, err := gzip.NewWriterLevel(buf, level)
+			if err != nil {
+				p.Put(buf)
+				return nil, err
+			}
+			return newBufferedCompressor(buf, gzWriter), nil
+		}
+		gzWriter, err := pgzip.NewWriterLevel(buf, level)
+		if err == nil {
+			blockSize, blocks := defaultGzipBlockSize, runtime.GOMAXPROCS(0)
+			if opts.BlockSize != 0 {
+				blockSize = opts.BlockSize
+			}
+			if opts.Concurrency != 0 {
+				blocks = opts.Concurrency
+			}
+			err = gzWriter.SetConcurrency(blockSize, blocks)
+		}
+		if err != nil {
+			p.Put(buf)
+			return nil, err
+		}
+		return newBufferedCompressor(buf, gzWriter), nil
+	case Xz:
+		config := xz.WriterConfig{}
+		if opts.Level != 0 {
+			if opts.Level < 1 || opts.Level > 9 {
+				return nil, fmt.Errorf("invalid xz compression level %d: must be 1-9", opts.Level)
+			}
+			config.DictCap = xzDictCap[opts.Level]
+		}
+		buf := p.Get(dest)
+		xzWriter, err := config.NewWriter(buf)
+		if err != nil {
+			p.Put(buf)
+			return nil, err
+		}
+		return newBufferedCompressor(buf, xzWriter), nil
+	case Zstd:
+		level := zstd.SpeedDefault
+		if opts.Level != 0 {
+			if opts.Level < 1 || opts.Level > 22 {
+				return nil, fmt.Errorf("invalid zstd compression level %d: must be 1-22", opts.Level)
+			}
+			level = zstd.EncoderLevelFromZstd(opts.Level)
+		}
+		zstdOpts := []zstd.EOption{zstd.WithEncoderLevel(level)}
+		if opts.Concurrency > 0 {
+			zstdOpts = append(zstdOpts, zstd.WithEncoderConcurrency(opts.Concurrency))
+		}
+		buf := p.Get(dest)
+		zstdWriter, err := zstd.NewWriter(buf, zstdOpts...)
+		if err != nil {
+			p.Put(buf)
+			return nil, err
+		}
+		return newBufferedCompressor(buf, zstdWriter), nil
+	case Bzip2:
+		// archive/bzip2 does not support writing
 		return nil, fmt.Errorf("Unsupported compression format %s", (&compression).Extension())
 	default:
 		return nil, fmt.Errorf("Unsupported compression format %s", (&compression).Extension())
 	}
 }
 
+const (
+	// defaultGzipBlockSize is the size of the blocks Gzip compresses in parallel by default.
+	defaultGzipBlockSize = 1 << 20
+	// minGzipBlockSize is the smallest block size which leaves room for the window
+	// each block is primed with.
+	minGzipBlockSize = 16<<10 + 1
+)
+
+// xzDictCap maps xz compression levels to the dictionary sizes of the presets of the xz tool.
+// The encoder has no other tunables which correspond to levels.
+var xzDictCap = [...]int{
+	1: 1 << 20,
+	2: 2 << 20,
+	3: 4 << 20,
+	4: 4 << 20,
+	5: 8 << 20,
+	6: 8 << 20,
+	7: 16 << 20,
+	8: 32 << 20,
+	9: 64 << 20,
+}
+
+// bufferedCompressor is a compressor which writes to a pooled buffer. Unlike the wrappers of
+// the pool, it reports the errors of flushing the compressor and the buffer on Close.
+type bufferedCompressor struct {
+	io.WriteCloser
+	buf *bufio.Writer
+}
+
+func newBufferedCompressor(buf *bufio.Writer, compressor io.WriteCloser) io.WriteCloser {
+	return &bufferedCompressor{WriteCloser: compressor, buf: buf}
+}
+
+// Close flushes the compressor and the buffer, then returns the buffer to its pool.
+func (c *bufferedCompressor) Close() error {
+	if c.buf == nil {
+		return nil
+	}
+	err := c.WriteCloser.Close()
+	if flushErr := c.buf.Flush(); err == nil {
+		err = flushErr
+	}
+	pools.BufioWriter32KPool.Put(c.buf)
+	c.buf = nil
+	return err
+}
+
 // TarModifierFunc is a function that can be passed to ReplaceFileTarWrapper to
 // modify the contents or header of an entry in the archive. If the file already
 // exists in the archive the TarModifierFunc will be called with the Header and
@@ -497,6 +702,39 @@ func ReadSecurityXattrToTarHeader(path string, hdr *tar.Header) error {
 	return nil
 }
 
+// SourceDateEpochFromEnv returns the time in the SOURCE_DATE_EPOCH environment variable,
+// see https://reproducible-builds.org/specs/source-date-epoch/. It returns the zero time
+// if the variable is not set.
+func SourceDateEpochFromEnv() (time.Time, error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return time.Time{}, nil
+	}
+	sec, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %w", epoch, err)
+	}
+	return time.Unix(sec, 0).UTC(), nil
+}
+
+// normalize removes the metadata of hdr which depends on the filesystem rather than the file.
+func (opts *ReproducibleOptions) normalize(hdr *tar.Header) {
+	epoch := opts.SourceDateEpoch
+	if epoch.IsZero() {
+		epoch = time.Unix(0, 0)
+	}
+	if hdr.ModTime.After(epoch) {
+		hdr.ModTime = epoch
+	}
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	hdr.Uid = 0
+	hdr.Gid = 0
+	hdr.Uname = ""
+	hdr.Gname = ""
+	hdr.Format = tar.FormatPAX
+}
+
 type tarWhiteoutConverter interface {
 	ConvertWrite(*tar.Header, string, os.FileInfo) (*tar.Header, error)
 	ConvertRead(*tar.Header, string) (bool, error)
@@ -516,6 +754,12 @@ type tarAppender struct {
 	// by the AUFS standard are used as the tar whiteout
 	// standard.
 	WhiteoutConverter tarWhiteoutConverter
+
+	// Reproducible normalises the headers when not nil.
+	Reproducible *ReproducibleOptions
+
+	// Manifest records the entries when not nil.
+	Manifest *manifestBuilder
 }
 
 func newTarAppender(idMapping *idtools.IdentityMapping, writer io.Writer, chownOpts *idtools.Identity) *tarAppender {
@@ -600,6 +844,10 @@ func (ta *tarAppender) addTarFile(path, name string) error {
 		}
 	}
 
+	if ta.Reproducible != nil {
+		ta.Reproducible.normalize(hdr)
+	}
+
 	// explicitly override with ChownOpts
 	if ta.ChownOpts != nil {
 		hdr.Uid = ta.ChownOpts.UID
@@ -621,10 +869,19 @@ func (ta *tarAppender) addTarFile(path, name string) error {
 			if err := ta.TarWriter.WriteHeader(hdr); err != nil {
 				return err
 			}
+			if ta.Manifest != nil {
+				ta.Manifest.readEntry(hdr, nil)
+				if err := ta.Manifest.endEntry(); err != nil {
+					return err
+				}
+			}
 			if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
 				return fmt.Errorf("tar: cannot use whiteout for non-empty file")
 			}
 			hdr = wo
+			if ta.Reproducible != nil {
+				ta.Reproducible.normalize(hdr)
+			}
 		}
 	}
 
@@ -641,9 +898,17 @@ func (ta *tarAppender) addTarFile(path, name string) error {
 			return err
 		}
 
+		var content io.Reader = file
+		if ta.Manifest != nil {
+			content = ta.Manifest.readEntry(hdr, file)
+		}
+
 		ta.Buffer.Reset(ta.TarWriter)
 		defer ta.Buffer.Reset(nil)
-		_, err = io.Copy(ta.Buffer, file)
+		_, err = io.Copy(ta.Buffer, content)
+		if err == nil && ta.Manifest != nil {
+			err = ta.Manifest.endEntry()
+		}
 		file.Close()
 		if err != nil {
 			return err
@@ -652,6 +917,11 @@ func (ta *tarAppender) addTarFile(path, name string) error {
 		if err != nil {
 			return err
 		}
+	} else if ta.Manifest != nil {
+		ta.Manifest.readEntry(hdr, nil)
+		if err := ta.Manifest.endEntry(); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -821,7 +1091,7 @@ func TarWithOptions(srcPath string, options *TarOptions) (io.ReadCloser, error)
 
 	pipeReader, pipeWriter := io.Pipe()
 
-	compressWriter, err := CompressStream(pipeWriter, options.Compression)
+	compressWriter, err := CompressStreamWithOptions(pipeWriter, options.Compression, options.CompressionOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -831,19 +1101,32 @@ func TarWithOptions(srcPath string, options *TarOptions) (io.ReadCloser, error)
 		return nil, err
 	}
 
+	manifest := newManifestBuilder(options.Manifest, nil)
+	var tarWriter io.Writer = compressWriter
+	if manifest != nil {
+		tarWriter = io.MultiWriter(compressWriter, manifest.stream)
+	}
+
 	go func() {
 		ta := newTarAppender(
 			idtools.NewIDMappingsFromMaps(options.UIDMaps, options.GIDMaps),
-			compressWriter,
+			tarWriter,
 			options.ChownOpts,
 		)
 		ta.WhiteoutConverter = whiteoutConverter
+		ta.Reproducible = options.Reproducible
+		ta.Manifest = manifest
 
 		defer func() {
 			// Make sure to check the error on Close.
 			if err := ta.TarWriter.Close(); err != nil {
 				logrus.Errorf("Can't close tar writer: %s", err)
 			}
+			if manifest != nil {
+				if err := manifest.finish(nil); err != nil {
+					logrus.Errorf("Can't complete manifest: %s", err)
+				}
+			}
 			if err := compressWriter.Close(); err != nil {
 				logrus.Errorf("Can't close compress writer: %s", err)
 			}
@@ -883,9 +1166,16 @@ func TarWithOptions(srcPath string, options *TarOptions) (io.ReadCloser, error)
 			options.IncludeFiles = []string{"."}
 		}
 
+		includeFiles := options.IncludeFiles
+		if options.Reproducible != nil {
+			// filepath.Walk visits the files of each include in lexical order
+			includeFiles = append([]string(nil), includeFiles...)
+			sort.Strings(includeFiles)
+		}
+
 		seen := make(map[string]bool)
 
-		for _, include := range options.IncludeFiles {
+		for _, include := range includeFiles {
 			rebaseName := options.RebaseNames[include]
 
 			var (
@@ -1012,6 +1302,10 @@ func TarWithOptions(srcPath string, options *TarOptions) (io.ReadCloser, error)
 
 // Unpack unpacks the decompressedArchive to dest with options.
 func Unpack(decompressedArchive io.Reader, dest string, options *TarOptions) error {
+	manifest := newManifestBuilder(options.Manifest, options.ExpectedManifest)
+	if manifest != nil {
+		decompressedArchive = io.TeeReader(decompressedArchive, manifest.stream)
+	}
 	tr := tar.NewReader(decompressedArchive)
 	trBuf := pools.BufioReader32KPool.Get(nil)
 	defer pools.BufioReader32KPool.Put(trBuf)
@@ -1024,9 +1318,30 @@ func Unpack(decompressedArchive io.Reader, dest string, options *TarOptions) err
 		return err
 	}
 
+	// unpacked is the regular file unpacked last, which is removed if its content
+	// differs from the expected manifest
+	var unpacked string
+	endEntry := func() error {
+		if err := manifest.endEntry(); err != nil {
+			if unpacked != "" {
+				os.Remove(unpacked)
+			}
+			return err
+		}
+		unpacked = ""
+		return nil
+	}
+
 	// Iterate through the files in the archive.
 loop:
 	for {
+		if manifest != nil {
+			// the content of the previous entry must be digested before tr moves on
+			if err := endEntry(); err != nil {
+				return err
+			}
+		}
+
 		hdr, err := tr.Next()
 		if err == io.EOF {
 			// end of tar archive
@@ -1036,6 +1351,14 @@ loop:
 			return err
 		}
 
+		var content io.Reader = tr
+		if manifest != nil {
+			content = manifest.readEntry(hdr, tr)
+			if err := manifest.checkEntry(); err != nil {
+				return err
+			}
+		}
+
 		// ignore XGlobalHeader early to avoid creating parent directories for them
 		if hdr.Typeflag == tar.TypeXGlobalHeader {
 			logrus.Debugf("PAX Global Extended Headers found for %s and ignored", hdr.Name)
@@ -1104,7 +1427,7 @@ loop:
 				}
 			}
 		}
-		trBuf.Reset(tr)
+		trBuf.Reset(content)
 
 		if err := remapIDs(idMapping, hdr); err != nil {
 			return err
@@ -1123,6 +1446,9 @@ loop:
 		if err := createTarFile(path, dest, hdr, trBuf, !options.NoLchown, options.ChownOpts, options.InUserNS); err != nil {
 			return err
 		}
+		if hdr.Typeflag == tar.TypeReg {
+			unpacked = path
+		}
 
 		// Directory mtimes must be handled at the end to avoid further
 		// file creation in them to modify the directory mtime
@@ -1131,6 +1457,16 @@ loop:
 		}
 	}
 
+	if manifest != nil {
+		if err := endEntry(); err != nil {
+			return err
+		}
+		// read the padding after the end of the archive into the digest of the stream
+		if err := manifest.finish(decompressedArchive); err != nil {
+			return err
+		}
+	}
+
 	for _, hdr := range dirs {
 		path := filepath.Join(dest, hdr.Name)
 
@@ -0,0 +1,66 @@
+//go:build go1.18
+// +build go1.18
+
+package archive
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func FuzzXzDecompress(f *testing.F) {
+	for _, opts := range []CompressionOptions{{}, {Level: 1}, {Level: 9}} {
+		for _, content := range [][]byte{nil, []byte("bhojpur ufs"), bytes.Repeat([]byte{0, 1, 2, 3}, 4096)} {
+			var compressed bytes.Buffer
+			w, err := CompressStreamWithOptions(&compressed, Xz, opts)
+			if err != nil {
+				f.Fatal(err)
+			}
+			if _, err := w.Write(content); err != nil {
+				f.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				f.Fatal(err)
+			}
+			f.Add(compressed.Bytes())
+		}
+	}
+	f.Add(xzMagic)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r, err := xzDecompress(context.Background(), bytes.NewReader(data))
+		if err == nil {
+			// Bound the output, a small stream may legitimately decompress to a lot of data.
+			_, err = io.Copy(io.Discard, io.LimitReader(r, 64<<20))
+			if closeErr := r.Close(); closeErr != nil {
+				t.Fatalf("close: %v", closeErr)
+			}
+		}
+		if err != nil && !strings.HasPrefix(err.Error(), "xz: ") {
+			t.Fatalf("error does not identify the xz stream: %v", err)
+		}
+	})
+}
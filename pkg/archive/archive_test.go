@@ -24,6 +24,7 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -162,16 +163,90 @@ func TestDecompressStreamZstd(t *testing.T) {
 	testDecompressStream(t, "zst", "zstd -f")
 }
 
-func TestCompressStreamXzUnsupported(t *testing.T) {
-	dest, err := os.Create(tmp + "dest")
-	if err != nil {
-		t.Fatalf("Fail to create the destination file")
+func TestCompressStreamWithOptions(t *testing.T) {
+	content := bytes.Repeat([]byte("bhojpur ufs compresses application tars\n"), 10000)
+
+	for _, tc := range []struct {
+		compression Compression
+		opts        CompressionOptions
+	}{
+		{Uncompressed, CompressionOptions{}},
+		{Gzip, CompressionOptions{}},
+		{Gzip, CompressionOptions{Level: 1}},
+		{Gzip, CompressionOptions{Level: 9}},
+		{Gzip, CompressionOptions{Concurrency: 1}},
+		{Gzip, CompressionOptions{Level: 1, Concurrency: 4, BlockSize: 64 << 10}},
+		{Xz, CompressionOptions{}},
+		{Xz, CompressionOptions{Level: 1}},
+		{Xz, CompressionOptions{Level: 9}},
+		{Zstd, CompressionOptions{}},
+		{Zstd, CompressionOptions{Level: 1, Concurrency: 1}},
+		{Zstd, CompressionOptions{Level: 22, Concurrency: 4}},
+	} {
+		name := fmt.Sprintf("%s/%+v", tc.compression.Extension(), tc.opts)
+
+		var compressed bytes.Buffer
+		w, err := CompressStreamWithOptions(&compressed, tc.compression, tc.opts)
+		assert.NilError(t, err, name)
+		_, err = w.Write(content)
+		assert.NilError(t, err, name)
+		assert.NilError(t, w.Close(), name)
+		assert.Check(t, is.Equal(DetectCompression(compressed.Bytes()), tc.compression), name)
+
+		r, err := DecompressStream(&compressed)
+		assert.NilError(t, err, name)
+		decompressed, err := io.ReadAll(r)
+		assert.NilError(t, err, name)
+		assert.NilError(t, r.Close(), name)
+		assert.Check(t, bytes.Equal(decompressed, content), name)
 	}
-	defer dest.Close()
+}
 
-	_, err = CompressStream(dest, Xz)
-	if err == nil {
-		t.Fatalf("Should fail as xz is unsupported for compression format.")
+// TestCompressStreamGzipParallel checks that compressing in blocks produces a
+// single standard gzip member.
+func TestCompressStreamGzipParallel(t *testing.T) {
+	content := make([]byte, 1<<20)
+	for i := range content {
+		content[i] = byte(i * i >> 7)
+	}
+
+	var compressed bytes.Buffer
+	w, err := CompressStreamWithOptions(&compressed, Gzip, CompressionOptions{Concurrency: 8, BlockSize: 32 << 10})
+	assert.NilError(t, err)
+	for i := 0; i < len(content); i += 10000 {
+		end := i + 10000
+		if end > len(content) {
+			end = len(content)
+		}
+		_, err = w.Write(content[i:end])
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, w.Close())
+
+	r, err := gzip.NewReader(&compressed)
+	assert.NilError(t, err)
+	r.Multistream(false)
+	decompressed, err := io.ReadAll(r)
+	assert.NilError(t, err)
+	assert.Check(t, bytes.Equal(decompressed, content))
+	assert.Check(t, is.Equal(compressed.Len(), 0), "trailing data after the gzip member")
+}
+
+func TestCompressStreamInvalidOptions(t *testing.T) {
+	for _, tc := range []struct {
+		compression Compression
+		opts        CompressionOptions
+		err         string
+	}{
+		{Gzip, CompressionOptions{Level: 10}, "invalid gzip compression level 10: must be 1-9"},
+		{Gzip, CompressionOptions{BlockSize: -1}, "invalid gzip block size -1: must be at least 16385"},
+		{Gzip, CompressionOptions{BlockSize: 16 << 10}, "invalid gzip block size 16384: must be at least 16385"},
+		{Xz, CompressionOptions{Level: -1}, "invalid xz compression level -1: must be 1-9"},
+		{Zstd, CompressionOptions{Level: 23}, "invalid zstd compression level 23: must be 1-22"},
+		{Zstd, CompressionOptions{Concurrency: -1}, "invalid compression concurrency -1"},
+	} {
+		_, err := CompressStreamWithOptions(io.Discard, tc.compression, tc.opts)
+		assert.Check(t, is.Error(err, tc.err))
 	}
 }
 
@@ -766,10 +841,13 @@ func TestTarUntar(t *testing.T) {
 	for _, c := range []Compression{
 		Uncompressed,
 		Gzip,
+		Xz,
+		Zstd,
 	} {
 		changes, err := tarUntar(t, origin, &TarOptions{
-			Compression:     c,
-			ExcludePatterns: []string{"3"},
+			Compression:        c,
+			CompressionOptions: CompressionOptions{Level: 3},
+			ExcludePatterns:    []string{"3"},
 		})
 
 		if err != nil {
@@ -871,6 +949,100 @@ func TestTarWithOptions(t *testing.T) {
 	}
 }
 
+func TestTarWithOptionsReproducible(t *testing.T) {
+	epoch := time.Unix(1600000000, 0)
+	old := time.Unix(1500000000, 0)
+
+	// writeTree creates the same files in the given order with modification times after epoch.
+	writeTree := func(names []string, mtime time.Time) string {
+		dir, err := os.MkdirTemp("", "bhojpur-test-tar-reproducible")
+		assert.NilError(t, err)
+		for _, name := range names {
+			p := filepath.Join(dir, name)
+			assert.NilError(t, os.MkdirAll(filepath.Dir(p), 0755))
+			assert.NilError(t, os.WriteFile(p, []byte(name), 0644))
+			assert.NilError(t, os.Chtimes(p, mtime, mtime))
+		}
+		assert.NilError(t, os.Symlink("a", filepath.Join(dir, "link")))
+		assert.NilError(t, os.WriteFile(filepath.Join(dir, "old"), []byte("old"), 0600))
+		assert.NilError(t, os.Chtimes(filepath.Join(dir, "old"), old, old))
+		return dir
+	}
+	tarBytes := func(dir string, options *TarOptions) []byte {
+		rdr, err := TarWithOptions(dir, options)
+		assert.NilError(t, err)
+		defer rdr.Close()
+		content, err := io.ReadAll(rdr)
+		assert.NilError(t, err)
+		return content
+	}
+
+	dir1 := writeTree([]string{"a", "b/c", "b/d", "e"}, time.Now())
+	defer os.RemoveAll(dir1)
+	dir2 := writeTree([]string{"e", "b/d", "a", "b/c"}, time.Now().Add(time.Hour))
+	defer os.RemoveAll(dir2)
+
+	for _, compression := range []Compression{Uncompressed, Gzip, Xz, Zstd} {
+		options := func() *TarOptions {
+			return &TarOptions{
+				Compression:  compression,
+				Reproducible: &ReproducibleOptions{SourceDateEpoch: epoch},
+			}
+		}
+		assert.Check(t, bytes.Equal(tarBytes(dir1, options()), tarBytes(dir2, options())), compression.Extension())
+	}
+
+	tr := tar.NewReader(bytes.NewReader(tarBytes(dir1, &TarOptions{
+		Reproducible: &ReproducibleOptions{SourceDateEpoch: epoch},
+	})))
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NilError(t, err)
+		names = append(names, hdr.Name)
+
+		expectedModTime := epoch
+		if hdr.Name == "old" {
+			expectedModTime = old
+		}
+		assert.Check(t, hdr.ModTime.Equal(expectedModTime), hdr.Name)
+		assert.Check(t, hdr.AccessTime.IsZero(), hdr.Name)
+		assert.Check(t, hdr.ChangeTime.IsZero(), hdr.Name)
+		assert.Check(t, is.Equal(hdr.Uid, 0), hdr.Name)
+		assert.Check(t, is.Equal(hdr.Gid, 0), hdr.Name)
+		assert.Check(t, is.Equal(hdr.Uname, ""), hdr.Name)
+		assert.Check(t, is.Equal(hdr.Gname, ""), hdr.Name)
+	}
+	assert.Check(t, is.DeepEqual(names, []string{"a", "b/", "b/c", "b/d", "e", "link", "old"}))
+
+	// Includes are sorted, so their order does not matter.
+	included := func(includes ...string) []byte {
+		return tarBytes(dir1, &TarOptions{IncludeFiles: includes, Reproducible: &ReproducibleOptions{}})
+	}
+	assert.Check(t, bytes.Equal(included("e", "b", "a"), included("a", "b", "e")))
+}
+
+func TestSourceDateEpochFromEnv(t *testing.T) {
+	defer os.Unsetenv("SOURCE_DATE_EPOCH")
+
+	os.Unsetenv("SOURCE_DATE_EPOCH")
+	epoch, err := SourceDateEpochFromEnv()
+	assert.NilError(t, err)
+	assert.Check(t, epoch.IsZero())
+
+	os.Setenv("SOURCE_DATE_EPOCH", "1600000000")
+	epoch, err = SourceDateEpochFromEnv()
+	assert.NilError(t, err)
+	assert.Check(t, epoch.Equal(time.Unix(1600000000, 0)))
+
+	os.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	_, err = SourceDateEpochFromEnv()
+	assert.Check(t, is.ErrorContains(err, `invalid SOURCE_DATE_EPOCH "yesterday"`))
+}
+
 // Some tar archives such as http://haproxy.1wt.eu/download/1.5/src/devel/haproxy-1.5-dev21.tar.gz
 // use PAX Global Extended Headers.
 // Failing prevents the archives from being uncompressed during ADD
@@ -963,6 +1135,42 @@ func BenchmarkTarUntar(b *testing.B) {
 	}
 }
 
+// BenchmarkCompressStreamGzip compares compressing with compress/gzip, which is
+// used with a Concurrency of 1, against compressing blocks in parallel.
+func BenchmarkCompressStreamGzip(b *testing.B) {
+	content := make([]byte, 32<<20)
+	for i := range content {
+		content[i] = byte(i * i >> 11)
+	}
+
+	for _, bc := range []struct {
+		name string
+		opts CompressionOptions
+	}{
+		{"compress-gzip", CompressionOptions{Concurrency: 1}},
+		{"parallel", CompressionOptions{}},
+		{"parallel-256KiB-blocks", CompressionOptions{BlockSize: 256 << 10}},
+		{"parallel-4MiB-blocks", CompressionOptions{BlockSize: 4 << 20}},
+		{"parallel-2-workers", CompressionOptions{Concurrency: 2}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(content)))
+			for n := 0; n < b.N; n++ {
+				w, err := CompressStreamWithOptions(io.Discard, Gzip, bc.opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := w.Write(content); err != nil {
+					b.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func BenchmarkTarUntarWithLinks(b *testing.B) {
 	origin, err := os.MkdirTemp("", "bhojpur-test-untar-origin")
 	if err != nil {
@@ -1421,3 +1629,85 @@ func TestPigz(t *testing.T) {
 		assert.Equal(t, reflect.TypeOf(contextReaderCloserWrapper.Reader), reflect.TypeOf(&gzip.Reader{}))
 	}
 }
+
+func TestXz(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Xz not present in msys2")
+	}
+	r := testDecompressStream(t, "xz", "xz -f")
+	// For the bufio pool
+	outsideReaderCloserWrapper := r.(*ioutils.ReadCloserWrapper)
+	// For the context canceller
+	contextReaderCloserWrapper := outsideReaderCloserWrapper.Reader.(*ioutils.ReadCloserWrapper)
+
+	assert.Equal(t, reflect.TypeOf(contextReaderCloserWrapper.Reader), reflect.TypeOf(&xzReadCloser{}))
+}
+
+func TestXzBinary(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Xz not present in msys2")
+	}
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz not installed")
+	}
+	os.Setenv("BHOJPUR_USE_XZ_BINARY", "true")
+	defer os.Unsetenv("BHOJPUR_USE_XZ_BINARY")
+
+	r := testDecompressStream(t, "xz", "xz -f")
+	// For the bufio pool
+	outsideReaderCloserWrapper := r.(*ioutils.ReadCloserWrapper)
+	// For the context canceller
+	contextReaderCloserWrapper := outsideReaderCloserWrapper.Reader.(*ioutils.ReadCloserWrapper)
+
+	// For the command wait wrapper
+	cmdWaitCloserWrapper := contextReaderCloserWrapper.Reader.(*ioutils.ReadCloserWrapper)
+	assert.Equal(t, reflect.TypeOf(cmdWaitCloserWrapper.Reader), reflect.TypeOf(&io.PipeReader{}))
+}
+
+func TestDecompressStreamXzMalformed(t *testing.T) {
+	var compressed bytes.Buffer
+	w, err := CompressStream(&compressed, Xz)
+	assert.NilError(t, err)
+	_, err = w.Write(bytes.Repeat([]byte("bhojpur ufs "), 1024))
+	assert.NilError(t, err)
+	assert.NilError(t, w.Close())
+	valid := compressed.Bytes()
+
+	corrupted := append([]byte{}, valid...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	badHeader := append([]byte{}, valid...)
+	badHeader[len(xzMagic)+1] ^= 0xff
+
+	for name, data := range map[string][]byte{
+		"magic only": xzMagic,
+		"bad header": badHeader,
+		"truncated":  valid[:len(valid)/2],
+		"corrupted":  corrupted,
+		"trailing":   append(append([]byte{}, valid...), "garbage"...),
+	} {
+		r, err := DecompressStream(bytes.NewReader(data))
+		if err == nil {
+			_, err = io.Copy(io.Discard, r)
+			assert.NilError(t, r.Close(), name)
+		}
+		assert.ErrorContains(t, err, "xz: ", name)
+	}
+}
+
+func TestXzDecompressCancel(t *testing.T) {
+	var compressed bytes.Buffer
+	w, err := CompressStream(&compressed, Xz)
+	assert.NilError(t, err)
+	_, err = w.Write([]byte("bhojpur ufs"))
+	assert.NilError(t, err)
+	assert.NilError(t, w.Close())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := xzDecompress(ctx, &compressed)
+	assert.NilError(t, err)
+	defer r.Close()
+
+	cancel()
+	_, err = io.Copy(io.Discard, r)
+	assert.Check(t, is.ErrorIs(err, context.Canceled))
+}
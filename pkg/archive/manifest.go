@@ -0,0 +1,175 @@
+package archive
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// ErrManifestMismatch is returned by Unpack when the archive differs from TarOptions.ExpectedManifest.
+var ErrManifestMismatch = errors.New("archive does not match the manifest")
+
+// Manifest lists the SHA-256 digests of an archive and of its entries.
+type Manifest struct {
+	// Digest is the digest of the uncompressed tar stream, in the form "sha256:<hex>".
+	Digest string `json:"digest"`
+	// Entries are the entries in the order of the archive.
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// ManifestEntry describes an entry of an archive.
+type ManifestEntry struct {
+	Name     string `json:"name"`
+	Typeflag byte   `json:"typeflag"`
+	Linkname string `json:"linkname,omitempty"`
+	Size     int64  `json:"size"`
+	// Digest is the digest of the content of regular files, in the form "sha256:<hex>".
+	Digest string `json:"digest,omitempty"`
+}
+
+// manifestBuilder fills a manifest while an archive is streamed, and compares it with
+// the expected manifest if there is one.
+type manifestBuilder struct {
+	manifest *Manifest
+	expected *Manifest
+	stream   hash.Hash
+
+	// the entry which is being read
+	pending *ManifestEntry
+	content io.Reader
+	digest  hash.Hash
+}
+
+// newManifestBuilder returns a builder which fills manifest, or nil if neither
+// manifest nor expected are set.
+func newManifestBuilder(manifest, expected *Manifest) *manifestBuilder {
+	if manifest == nil && expected == nil {
+		return nil
+	}
+	if manifest == nil {
+		manifest = &Manifest{}
+	}
+	*manifest = Manifest{Entries: []ManifestEntry{}}
+	return &manifestBuilder{manifest: manifest, expected: expected, stream: sha256.New()}
+}
+
+// readEntry starts the entry of hdr. It returns a reader which digests the content of
+// the entry read from r, which may be nil if the entry has no content.
+func (b *manifestBuilder) readEntry(hdr *tar.Header, r io.Reader) io.Reader {
+	b.pending = &ManifestEntry{
+		Name:     hdr.Name,
+		Typeflag: hdr.Typeflag,
+		Linkname: hdr.Linkname,
+		Size:     hdr.Size,
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return r
+	}
+	b.digest = sha256.New()
+	if r == nil {
+		return nil
+	}
+	b.content = io.TeeReader(r, b.digest)
+	return b.content
+}
+
+// checkEntry compares the entry started by readEntry with the expected manifest. The digest of its
+// content is compared by endEntry, but everything else can be checked before the entry is unpacked.
+func (b *manifestBuilder) checkEntry() error {
+	if b.expected == nil {
+		return nil
+	}
+	i := len(b.manifest.Entries)
+	if i >= len(b.expected.Entries) {
+		return fmt.Errorf("%w: unexpected entry %q", ErrManifestMismatch, b.pending.Name)
+	}
+	expected := b.expected.Entries[i]
+	expected.Digest = ""
+	if entry := *b.pending; entry != expected {
+		return fmt.Errorf("%w: entry %d is %+v, expected %+v", ErrManifestMismatch, i, entry, expected)
+	}
+	return nil
+}
+
+// endEntry reads whatever is left of the content of the entry started by readEntry, and
+// adds the entry to the manifest.
+func (b *manifestBuilder) endEntry() error {
+	if b.pending == nil {
+		return nil
+	}
+	entry := *b.pending
+	if b.content != nil {
+		if _, err := io.Copy(io.Discard, b.content); err != nil {
+			return err
+		}
+	}
+	if b.digest != nil {
+		entry.Digest = digestString(b.digest)
+	}
+	b.pending, b.content, b.digest = nil, nil, nil
+
+	i := len(b.manifest.Entries)
+	b.manifest.Entries = append(b.manifest.Entries, entry)
+	if b.expected == nil {
+		return nil
+	}
+	if i >= len(b.expected.Entries) {
+		return fmt.Errorf("%w: unexpected entry %q", ErrManifestMismatch, entry.Name)
+	}
+	if expected := b.expected.Entries[i]; entry != expected {
+		return fmt.Errorf("%w: entry %d is %+v, expected %+v", ErrManifestMismatch, i, entry, expected)
+	}
+	return nil
+}
+
+// finish adds the last entry to the manifest, and sets the digest of the stream once
+// rest, which is what is left of the stream, has been read.
+func (b *manifestBuilder) finish(rest io.Reader) error {
+	if err := b.endEntry(); err != nil {
+		return err
+	}
+	if rest != nil {
+		if _, err := io.Copy(io.Discard, rest); err != nil {
+			return err
+		}
+	}
+	b.manifest.Digest = digestString(b.stream)
+	if b.expected == nil {
+		return nil
+	}
+	if len(b.manifest.Entries) < len(b.expected.Entries) {
+		return fmt.Errorf("%w: missing entry %q", ErrManifestMismatch, b.expected.Entries[len(b.manifest.Entries)].Name)
+	}
+	if b.manifest.Digest != b.expected.Digest {
+		return fmt.Errorf("%w: stream digest is %s, expected %s", ErrManifestMismatch, b.manifest.Digest, b.expected.Digest)
+	}
+	return nil
+}
+
+func digestString(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,137 @@
+package archive
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func sha256String(content []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
+
+func TestManifestTarUntar(t *testing.T) {
+	origin, err := os.MkdirTemp("", "bhojpur-test-manifest-origin")
+	assert.NilError(t, err)
+	defer os.RemoveAll(origin)
+	assert.NilError(t, os.Mkdir(filepath.Join(origin, "dir"), 0755))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "dir", "file"), []byte("hello world"), 0644))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "empty"), nil, 0644))
+	assert.NilError(t, os.Symlink("dir/file", filepath.Join(origin, "link")))
+
+	var packed Manifest
+	rdr, err := TarWithOptions(origin, &TarOptions{Compression: Gzip, Manifest: &packed})
+	assert.NilError(t, err)
+	compressed, err := io.ReadAll(rdr)
+	assert.NilError(t, err)
+	assert.NilError(t, rdr.Close())
+
+	assert.Check(t, is.DeepEqual(packed.Entries, []ManifestEntry{
+		{Name: "dir/", Typeflag: tar.TypeDir},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Size: 11, Digest: sha256String([]byte("hello world"))},
+		{Name: "empty", Typeflag: tar.TypeReg, Digest: sha256String(nil)},
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "dir/file"},
+	}))
+
+	// the digest of the stream is the digest of the uncompressed archive
+	decompressed, err := DecompressStream(bytes.NewReader(compressed))
+	assert.NilError(t, err)
+	uncompressed, err := io.ReadAll(decompressed)
+	assert.NilError(t, err)
+	assert.NilError(t, decompressed.Close())
+	assert.Check(t, is.Equal(packed.Digest, sha256String(uncompressed)))
+
+	dest, err := os.MkdirTemp("", "bhojpur-test-manifest-dest")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dest)
+
+	var unpacked Manifest
+	err = Untar(bytes.NewReader(compressed), dest, &TarOptions{Manifest: &unpacked, ExpectedManifest: &packed})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(unpacked, packed))
+	content, err := os.ReadFile(filepath.Join(dest, "dir", "file"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(content), "hello world"))
+}
+
+func TestUnpackManifestMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, file := range []struct{ name, content string }{{"a", "a content"}, {"b", "b content"}} {
+		assert.NilError(t, tw.WriteHeader(&tar.Header{Name: file.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(file.content))}))
+		_, err := tw.Write([]byte(file.content))
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, tw.Close())
+	// pad the archive like tar does, up to a record of 20 blocks
+	buf.Write(make([]byte, 10240-buf.Len()))
+	archive := buf.Bytes()
+
+	unpack := func(options *TarOptions) error {
+		dest, err := os.MkdirTemp("", "bhojpur-test-manifest-dest")
+		assert.NilError(t, err)
+		defer os.RemoveAll(dest)
+		return Unpack(bytes.NewReader(archive), dest, options)
+	}
+
+	var expected Manifest
+	assert.NilError(t, unpack(&TarOptions{Manifest: &expected}))
+	assert.Check(t, is.Equal(expected.Digest, sha256String(archive)))
+	assert.Check(t, is.Len(expected.Entries, 2))
+	assert.NilError(t, unpack(&TarOptions{ExpectedManifest: &expected}))
+
+	for name, modify := range map[string]func(m *Manifest){
+		"content": func(m *Manifest) { m.Entries[1].Digest = sha256String([]byte("other content")) },
+		"name":    func(m *Manifest) { m.Entries[0].Name = "c" },
+		"missing": func(m *Manifest) { m.Entries = append(m.Entries, ManifestEntry{Name: "c"}) },
+		"extra":   func(m *Manifest) { m.Entries = m.Entries[:1] },
+		"stream":  func(m *Manifest) { m.Digest = sha256String(nil) },
+	} {
+		modified := Manifest{Digest: expected.Digest, Entries: append([]ManifestEntry{}, expected.Entries...)}
+		modify(&modified)
+		err := unpack(&TarOptions{ExpectedManifest: &modified})
+		assert.Check(t, errors.Is(err, ErrManifestMismatch), "%s: %v", name, err)
+	}
+
+	// the entry whose content differs is not left in dest
+	dest, err := os.MkdirTemp("", "bhojpur-test-manifest-dest")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dest)
+	modified := Manifest{Digest: expected.Digest, Entries: append([]ManifestEntry{}, expected.Entries...)}
+	modified.Entries[1].Digest = sha256String([]byte("other content"))
+	err = Unpack(bytes.NewReader(archive), dest, &TarOptions{ExpectedManifest: &modified})
+	assert.Check(t, errors.Is(err, ErrManifestMismatch), err)
+	_, err = os.Stat(filepath.Join(dest, "a"))
+	assert.Check(t, err)
+	_, err = os.Stat(filepath.Join(dest, "b"))
+	assert.Check(t, os.IsNotExist(err), "b was unpacked: %v", err)
+}
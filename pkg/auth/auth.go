@@ -0,0 +1,194 @@
+package auth
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// ErrInvalidToken is returned by authenticators which do not accept a token
+var ErrInvalidToken = errors.New("invalid token")
+
+// Identity is the authenticated caller of an RPC
+type Identity struct {
+	// Name identifies the caller. It is compared with the owner of Engines.
+	Name string `json:"name"`
+	// Admin callers may access all Engines
+	Admin bool `json:"admin,omitempty"`
+}
+
+// Authenticator establishes the identity of a bearer token
+type Authenticator interface {
+	Authenticate(token string) (*Identity, error)
+}
+
+// Chain tries each authenticator in turn and returns the first identity established
+type Chain []Authenticator
+
+// Authenticate establishes the identity of a token
+func (c Chain) Authenticate(token string) (*Identity, error) {
+	for _, a := range c {
+		id, err := a.Authenticate(token)
+		if err == ErrInvalidToken {
+			continue
+		}
+		return id, err
+	}
+	return nil, ErrInvalidToken
+}
+
+// Reloadable delegates to an authenticator which can be replaced while it is in use,
+// e.g. when the token files of the server change
+type Reloadable struct {
+	mu    sync.RWMutex
+	authn Authenticator
+}
+
+// NewReloadable creates a reloadable authenticator which initially delegates to authn
+func NewReloadable(authn Authenticator) *Reloadable {
+	return &Reloadable{authn: authn}
+}
+
+// Set replaces the authenticator
+func (r *Reloadable) Set(authn Authenticator) {
+	r.mu.Lock()
+	r.authn = authn
+	r.mu.Unlock()
+}
+
+// Authenticate establishes the identity of a token using the current authenticator
+func (r *Reloadable) Authenticate(token string) (*Identity, error) {
+	r.mu.RLock()
+	authn := r.authn
+	r.mu.RUnlock()
+	if authn == nil {
+		return nil, ErrInvalidToken
+	}
+	return authn.Authenticate(token)
+}
+
+type identityKey struct{}
+
+// WithIdentity attaches an identity to a context
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the identity attached to a context, if there is one
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok && id != nil
+}
+
+// TokenFromContext extracts the bearer token of the authorization metadata of an incoming call
+func TokenFromContext(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	for _, v := range md.Get("authorization") {
+		const prefix = "bearer "
+		if len(v) > len(prefix) && strings.EqualFold(v[:len(prefix)], prefix) {
+			return strings.TrimSpace(v[len(prefix):]), true
+		}
+	}
+	return "", false
+}
+
+// authenticate attaches the identity of the caller to the context of a call
+func authenticate(ctx context.Context, authn Authenticator, method string, skip func(method string) bool) (context.Context, error) {
+	if skip != nil && skip(method) {
+		return ctx, nil
+	}
+	token, ok := TokenFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+	id, err := authn.Authenticate(token)
+	if err == ErrInvalidToken {
+		return nil, status.Error(codes.Unauthenticated, "invalid bearer token")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "cannot authenticate: %v", err)
+	}
+	return WithIdentity(ctx, id), nil
+}
+
+// UnaryServerInterceptor rejects unauthenticated calls and attaches the identity of the caller
+// to the context of all others. Methods for which skip returns true are exempt.
+func UnaryServerInterceptor(authn Authenticator, skip func(method string) bool) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticate(ctx, authn, info.FullMethod, skip)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor is the streaming equivalent of UnaryServerInterceptor
+func StreamServerInterceptor(authn Authenticator, skip func(method string) bool) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(ss.Context(), authn, info.FullMethod, skip)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &identityStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+type identityStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *identityStream) Context() context.Context {
+	return s.ctx
+}
+
+// Authorizer decides whether the caller of an RPC may act on behalf of an owner
+type Authorizer interface {
+	// Authorize returns a gRPC status error if the caller must not access the Engines of owner
+	Authorize(ctx context.Context, owner string) error
+}
+
+// OwnerPolicy grants access to the Engines of an owner to that owner and to admins
+type OwnerPolicy struct{}
+
+// Authorize permits owners and admins
+func (OwnerPolicy) Authorize(ctx context.Context, owner string) error {
+	id, ok := FromContext(ctx)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "not authenticated")
+	}
+	if id.Admin || id.Name == owner {
+		return nil
+	}
+	return status.Errorf(codes.PermissionDenied, "%s cannot access Engines of %s", id.Name, owner)
+}
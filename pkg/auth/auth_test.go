@@ -0,0 +1,163 @@
+package auth
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestStaticTokens(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "tokens.yaml")
+	assert.NilError(t, os.WriteFile(fn, []byte(`
+- token: alice-secret
+  name: alice
+- token: root-secret
+  name: root
+  admin: true
+`), 0600))
+	tokens, err := LoadStaticTokens(fn)
+	assert.NilError(t, err)
+
+	id, err := tokens.Authenticate("alice-secret")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, id, &Identity{Name: "alice"})
+	id, err = tokens.Authenticate("root-secret")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, id, &Identity{Name: "root", Admin: true})
+	_, err = tokens.Authenticate("alice")
+	assert.Equal(t, err, ErrInvalidToken)
+
+	_, err = NewStaticTokens([]StaticToken{{Token: "secret"}})
+	assert.ErrorContains(t, err, "name is required")
+}
+
+func TestHMACTokens(t *testing.T) {
+	h := &HMACTokens{Key: []byte("0123456789abcdef0123456789abcdef")}
+
+	token, err := h.Issue(Identity{Name: "bob"}, time.Hour)
+	assert.NilError(t, err)
+	id, err := h.Authenticate(token)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, id, &Identity{Name: "bob"})
+
+	other := &HMACTokens{Key: []byte("fedcba9876543210fedcba9876543210")}
+	_, err = other.Authenticate(token)
+	assert.Equal(t, err, ErrInvalidToken)
+
+	// a payload which grants admin, but keeps the original signature
+	admin, err := other.Issue(Identity{Name: "bob", Admin: true}, time.Hour)
+	assert.NilError(t, err)
+	_, err = h.Authenticate(admin[:len(admin)-1] + token[len(token)-1:])
+	assert.Equal(t, err, ErrInvalidToken)
+
+	payload, err := json.Marshal(hmacClaims{Identity: Identity{Name: "bob"}, Expires: time.Now().Add(-time.Minute).Unix()})
+	assert.NilError(t, err)
+	p := tokenEncoding.EncodeToString(payload)
+	_, err = h.Authenticate(p + "." + tokenEncoding.EncodeToString(h.sign(p)))
+	assert.Equal(t, err, ErrInvalidToken, "expired token")
+
+	for _, token := range []string{"", "a.b.c", "nope", "!!.!!"} {
+		_, err = h.Authenticate(token)
+		assert.Check(t, is.Equal(err, ErrInvalidToken), token)
+	}
+}
+
+func TestReloadable(t *testing.T) {
+	alice, err := NewStaticTokens([]StaticToken{{Token: "secret", Identity: Identity{Name: "alice"}}})
+	assert.NilError(t, err)
+	bob, err := NewStaticTokens([]StaticToken{{Token: "secret", Identity: Identity{Name: "bob"}}})
+	assert.NilError(t, err)
+
+	r := NewReloadable(alice)
+	id, err := r.Authenticate("secret")
+	assert.NilError(t, err)
+	assert.Equal(t, id.Name, "alice")
+
+	r.Set(bob)
+	id, err = r.Authenticate("secret")
+	assert.NilError(t, err)
+	assert.Equal(t, id.Name, "bob")
+
+	r.Set(nil)
+	_, err = r.Authenticate("secret")
+	assert.Equal(t, err, ErrInvalidToken)
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	tokens, err := NewStaticTokens([]StaticToken{{Token: "secret", Identity: Identity{Name: "alice"}}})
+	assert.NilError(t, err)
+	intercept := UnaryServerInterceptor(Chain{&HMACTokens{Key: []byte("key")}, tokens}, func(method string) bool {
+		return method == "/public"
+	})
+
+	call := func(method, authorization string) (*Identity, error) {
+		ctx := context.Background()
+		if authorization != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", authorization))
+		}
+		var id *Identity
+		_, err := intercept(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			id, _ = FromContext(ctx)
+			return nil, nil
+		})
+		return id, err
+	}
+
+	id, err := call("/private", "Bearer secret")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, id, &Identity{Name: "alice"})
+	_, err = call("/private", "bearer secret")
+	assert.NilError(t, err)
+
+	_, err = call("/private", "")
+	assert.Check(t, is.Equal(status.Code(err), codes.Unauthenticated))
+	_, err = call("/private", "Bearer wrong")
+	assert.Check(t, is.Equal(status.Code(err), codes.Unauthenticated))
+	_, err = call("/private", "Basic secret")
+	assert.Check(t, is.Equal(status.Code(err), codes.Unauthenticated))
+
+	id, err = call("/public", "")
+	assert.NilError(t, err)
+	assert.Check(t, id == nil)
+}
+
+func TestOwnerPolicy(t *testing.T) {
+	var p OwnerPolicy
+	alice := WithIdentity(context.Background(), &Identity{Name: "alice"})
+	admin := WithIdentity(context.Background(), &Identity{Name: "root", Admin: true})
+
+	assert.Check(t, p.Authorize(alice, "alice"))
+	assert.Check(t, p.Authorize(admin, "alice"))
+	assert.Check(t, is.Equal(status.Code(p.Authorize(alice, "bob")), codes.PermissionDenied))
+	assert.Check(t, is.Equal(status.Code(p.Authorize(context.Background(), "bob")), codes.Unauthenticated))
+}
@@ -0,0 +1,163 @@
+package auth
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// StaticToken grants an identity to the holder of a token
+type StaticToken struct {
+	Token string `json:"token"`
+	Identity
+}
+
+// StaticTokens authenticates a fixed set of tokens
+type StaticTokens struct {
+	tokens []StaticToken
+}
+
+// NewStaticTokens creates an authenticator for a fixed set of tokens
+func NewStaticTokens(tokens []StaticToken) (*StaticTokens, error) {
+	for i, t := range tokens {
+		if t.Token == "" {
+			return nil, fmt.Errorf("token %d: token is required", i)
+		}
+		if t.Name == "" {
+			return nil, fmt.Errorf("token %d: name is required", i)
+		}
+	}
+	return &StaticTokens{tokens: tokens}, nil
+}
+
+// LoadStaticTokens reads a YAML file which lists tokens, e.g.
+//   - token: s3cr3t
+//     name: alice
+//     admin: true
+func LoadStaticTokens(fn string) (*StaticTokens, error) {
+	content, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []StaticToken
+	err = yaml.UnmarshalStrict(content, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tokens file %s: %w", fn, err)
+	}
+	return NewStaticTokens(tokens)
+}
+
+// Authenticate establishes the identity of a token
+func (s *StaticTokens) Authenticate(token string) (*Identity, error) {
+	var res *Identity
+	for i := range s.tokens {
+		// compare all tokens in constant time so that timing reveals nothing about them
+		if subtle.ConstantTimeCompare([]byte(s.tokens[i].Token), []byte(token)) == 1 && res == nil {
+			id := s.tokens[i].Identity
+			res = &id
+		}
+	}
+	if res == nil {
+		return nil, ErrInvalidToken
+	}
+	return res, nil
+}
+
+// HMACTokens issues and authenticates self-contained tokens which are signed using HMAC-SHA256.
+// Such tokens need no server-side state, but cannot be revoked before they expire.
+type HMACTokens struct {
+	Key []byte
+}
+
+// LoadHMACTokens reads the signing key from a file
+func LoadHMACTokens(fn string) (*HMACTokens, error) {
+	key, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	key = []byte(strings.TrimSpace(string(key)))
+	if len(key) < 32 {
+		return nil, fmt.Errorf("HMAC key in %s is too short: must be at least 32 bytes", fn)
+	}
+	return &HMACTokens{Key: key}, nil
+}
+
+type hmacClaims struct {
+	Identity
+	Expires int64 `json:"exp,omitempty"`
+}
+
+var tokenEncoding = base64.RawURLEncoding
+
+// Issue produces a token for an identity. The token expires after ttl, or never if ttl is zero.
+func (h *HMACTokens) Issue(id Identity, ttl time.Duration) (string, error) {
+	claims := hmacClaims{Identity: id}
+	if ttl > 0 {
+		claims.Expires = time.Now().Add(ttl).Unix()
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	p := tokenEncoding.EncodeToString(payload)
+	return p + "." + tokenEncoding.EncodeToString(h.sign(p)), nil
+}
+
+// Authenticate verifies the signature and expiry of a token
+func (h *HMACTokens) Authenticate(token string) (*Identity, error) {
+	segs := strings.Split(token, ".")
+	if len(segs) != 2 {
+		return nil, ErrInvalidToken
+	}
+	sig, err := tokenEncoding.DecodeString(segs[1])
+	if err != nil || !hmac.Equal(sig, h.sign(segs[0])) {
+		return nil, ErrInvalidToken
+	}
+	payload, err := tokenEncoding.DecodeString(segs[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims hmacClaims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil || claims.Name == "" {
+		return nil, ErrInvalidToken
+	}
+	if claims.Expires != 0 && time.Now().Unix() >= claims.Expires {
+		return nil, ErrInvalidToken
+	}
+	return &claims.Identity, nil
+}
+
+func (h *HMACTokens) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, h.Key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,240 @@
+package broadcaster
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrOverflow is returned by Subscription.Next if the subscriber was disconnected
+	// because it could not keep up with the published events.
+	ErrOverflow = errors.New("subscriber is too slow and was disconnected")
+	// ErrClosed is returned by Subscription.Next once the subscription or the broadcaster was closed.
+	ErrClosed = errors.New("subscription is closed")
+)
+
+// OverflowPolicy determines what happens when a subscriber's buffer is full
+type OverflowPolicy int
+
+const (
+	// OverflowDisconnect disconnects the subscriber once its buffer is full
+	OverflowDisconnect OverflowPolicy = iota
+	// OverflowCoalesce replaces a buffered event with the same key as the new event
+	// once the buffer is full. If there is no such event, the subscriber is disconnected.
+	OverflowCoalesce
+)
+
+// SubscriberOptions configure a subscription
+type SubscriberOptions struct {
+	// BufferSize is the number of events a subscriber can lag behind. Defaults to 64.
+	BufferSize int
+	// Overflow determines what happens if the buffer is full
+	Overflow OverflowPolicy
+	// Key identifies events which can be coalesced. Required for OverflowCoalesce.
+	Key func(event interface{}) string
+	// Filter selects the events a subscriber receives. If nil, all events are received.
+	Filter func(event interface{}) bool
+}
+
+// Buffered fans out events to subscribers. Every subscriber has its own buffer so that
+// publishing never blocks, no matter how slow a subscriber consumes its events.
+type Buffered struct {
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+
+	// OnOverflow, if set, is called whenever a subscriber is disconnected or an event is coalesced
+	OnOverflow func(disconnected bool)
+}
+
+// Subscribe registers a new subscriber
+func (b *Buffered) Subscribe(opts SubscriberOptions) *Subscription {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 64
+	}
+
+	s := &Subscription{
+		opts:   opts,
+		notify: make(chan struct{}, 1),
+		hub:    b,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		s.err = ErrClosed
+		return s
+	}
+	if b.subs == nil {
+		b.subs = make(map[*Subscription]struct{})
+	}
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// Publish sends an event to all subscribers whose filter accepts the event. Publish never blocks.
+func (b *Buffered) Publish(event interface{}) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for s := range b.subs {
+		if s.opts.Filter != nil && !s.opts.Filter(event) {
+			continue
+		}
+		s.push(event)
+	}
+}
+
+// Subscribers returns the number of active subscribers
+func (b *Buffered) Subscribers() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subs)
+}
+
+// Close disconnects all subscribers. Events published after Close are discarded.
+func (b *Buffered) Close() {
+	b.mu.Lock()
+	subs := b.subs
+	b.subs = nil
+	b.closed = true
+	b.mu.Unlock()
+
+	for s := range subs {
+		s.fail(ErrClosed)
+	}
+}
+
+func (b *Buffered) remove(s *Subscription) {
+	b.mu.Lock()
+	delete(b.subs, s)
+	b.mu.Unlock()
+}
+
+func (b *Buffered) overflow(disconnected bool) {
+	if b.OnOverflow != nil {
+		b.OnOverflow(disconnected)
+	}
+}
+
+// Subscription receives events from a Buffered broadcaster
+type Subscription struct {
+	opts   SubscriberOptions
+	hub    *Buffered
+	notify chan struct{}
+
+	mu    sync.Mutex
+	queue []interface{}
+	err   error
+}
+
+func (s *Subscription) push(event interface{}) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+
+	if len(s.queue) < s.opts.BufferSize {
+		s.queue = append(s.queue, event)
+		s.mu.Unlock()
+		s.wake()
+		return
+	}
+
+	if s.opts.Overflow == OverflowCoalesce && s.opts.Key != nil {
+		key := s.opts.Key(event)
+		for i := len(s.queue) - 1; i >= 0; i-- {
+			if s.opts.Key(s.queue[i]) == key {
+				s.queue[i] = event
+				s.mu.Unlock()
+				s.hub.overflow(false)
+				return
+			}
+		}
+	}
+
+	s.queue = nil
+	s.err = ErrOverflow
+	s.mu.Unlock()
+	s.wake()
+
+	// we are called while the hub holds its read lock, hence we must not remove ourselves synchronously
+	go s.hub.remove(s)
+	s.hub.overflow(true)
+}
+
+func (s *Subscription) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.wake()
+}
+
+func (s *Subscription) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Next returns the next event. Next blocks until an event is available, the context is done,
+// or the subscription ends. Buffered events are delivered before ErrClosed is returned,
+// whereas ErrOverflow is returned immediately.
+func (s *Subscription) Next(ctx context.Context) (interface{}, error) {
+	for {
+		s.mu.Lock()
+		if s.err == ErrOverflow {
+			s.mu.Unlock()
+			return nil, ErrOverflow
+		}
+		if len(s.queue) > 0 {
+			event := s.queue[0]
+			s.queue[0] = nil
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+			return event, nil
+		}
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return nil, err
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.notify:
+		}
+	}
+}
+
+// Close ends the subscription
+func (s *Subscription) Close() {
+	s.fail(ErrClosed)
+	s.hub.remove(s)
+}
@@ -0,0 +1,166 @@
+package broadcaster
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+type keyedEvent struct {
+	Key   string
+	Value int
+}
+
+func keyOf(evt interface{}) string {
+	return evt.(keyedEvent).Key
+}
+
+func TestBufferedFanOut(t *testing.T) {
+	var hub Buffered
+	ctx := context.Background()
+
+	even := hub.Subscribe(SubscriberOptions{Filter: func(evt interface{}) bool { return evt.(int)%2 == 0 }})
+	all := hub.Subscribe(SubscriberOptions{})
+	assert.Equal(t, hub.Subscribers(), 2)
+
+	for i := 0; i < 4; i++ {
+		hub.Publish(i)
+	}
+
+	for _, exp := range []int{0, 2} {
+		evt, err := even.Next(ctx)
+		assert.NilError(t, err)
+		assert.Equal(t, evt, exp)
+	}
+	for exp := 0; exp < 4; exp++ {
+		evt, err := all.Next(ctx)
+		assert.NilError(t, err)
+		assert.Equal(t, evt, exp)
+	}
+
+	even.Close()
+	assert.Equal(t, hub.Subscribers(), 1)
+	_, err := even.Next(ctx)
+	assert.Equal(t, err, ErrClosed)
+
+	hub.Publish(4)
+	hub.Close()
+	evt, err := all.Next(ctx)
+	assert.NilError(t, err, "buffered events must be delivered after close")
+	assert.Equal(t, evt, 4)
+	_, err = all.Next(ctx)
+	assert.Equal(t, err, ErrClosed)
+}
+
+func TestBufferedDisconnect(t *testing.T) {
+	var (
+		hub          Buffered
+		disconnected int
+	)
+	hub.OnOverflow = func(d bool) {
+		if d {
+			disconnected++
+		}
+	}
+
+	slow := hub.Subscribe(SubscriberOptions{BufferSize: 2})
+	fast := hub.Subscribe(SubscriberOptions{BufferSize: 2})
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		hub.Publish(i)
+		if i < 2 {
+			_, err := fast.Next(ctx)
+			assert.NilError(t, err)
+		}
+	}
+
+	_, err := slow.Next(ctx)
+	assert.Equal(t, err, ErrOverflow)
+	assert.Equal(t, disconnected, 1)
+
+	evt, err := fast.Next(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, evt, 2)
+}
+
+func TestBufferedCoalesce(t *testing.T) {
+	var hub Buffered
+	ctx := context.Background()
+
+	sub := hub.Subscribe(SubscriberOptions{BufferSize: 2, Overflow: OverflowCoalesce, Key: keyOf})
+	hub.Publish(keyedEvent{"a", 1})
+	hub.Publish(keyedEvent{"b", 1})
+	hub.Publish(keyedEvent{"a", 2})
+	hub.Publish(keyedEvent{"b", 2})
+
+	for _, exp := range []keyedEvent{{"a", 2}, {"b", 2}} {
+		evt, err := sub.Next(ctx)
+		assert.NilError(t, err)
+		assert.Equal(t, evt, exp)
+	}
+
+	hub.Publish(keyedEvent{"a", 3})
+	hub.Publish(keyedEvent{"b", 3})
+	hub.Publish(keyedEvent{"c", 3})
+	_, err := sub.Next(ctx)
+	assert.Equal(t, err, ErrOverflow, "events which cannot be coalesced must disconnect")
+}
+
+func TestBufferedPublishNeverBlocks(t *testing.T) {
+	var hub Buffered
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// a subscriber which never reads
+	hub.Subscribe(SubscriberOptions{BufferSize: 1})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		sub := hub.Subscribe(SubscriberOptions{BufferSize: 1000})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				evt, err := sub.Next(ctx)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if evt != fmt.Sprint(n) {
+					t.Errorf("received %v, expected %d", evt, n)
+					return
+				}
+			}
+		}()
+	}
+
+	for n := 0; n < 100; n++ {
+		hub.Publish(fmt.Sprint(n))
+	}
+	wg.Wait()
+}
@@ -0,0 +1,268 @@
+package clientconfig
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/bhojpur/ufs/pkg/homedir"
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultPath is the location of the client configuration within the user's config directory
+const DefaultPath = "ufs/client.yaml"
+
+// Config is the content of the client configuration file
+type Config struct {
+	// CurrentContext is the context which is used unless another one is chosen
+	CurrentContext string `json:"currentContext,omitempty"`
+	// Contexts are the named sets of connection settings
+	Contexts map[string]*Context `json:"contexts,omitempty"`
+}
+
+// Context holds the settings for connecting to a single Bhojpur UFS installation.
+// Settings which are empty fall back to their flags, environment variables or defaults.
+type Context struct {
+	// DialMode is either "host" or "kubernetes"
+	DialMode string `json:"dialMode,omitempty"`
+	// Host is the address of the server in host dial mode
+	Host string `json:"host,omitempty"`
+
+	// Kubeconfig, Namespace, LabelSelector and PodPort locate the server pods in kubernetes dial mode
+	Kubeconfig    string `json:"kubeconfig,omitempty"`
+	Namespace     string `json:"namespace,omitempty"`
+	LabelSelector string `json:"labelSelector,omitempty"`
+	PodPort       string `json:"podPort,omitempty"`
+
+	TLS *TLS `json:"tls,omitempty"`
+
+	// Token is the bearer token sent with every request
+	Token string `json:"token,omitempty"`
+}
+
+// TLS configures how connections to the server are secured
+type TLS struct {
+	CA         string `json:"ca,omitempty"`
+	Cert       string `json:"cert,omitempty"`
+	Key        string `json:"key,omitempty"`
+	ServerName string `json:"serverName,omitempty"`
+}
+
+// Keys lists the settings of a context which Set understands
+var Keys = []string{
+	"dialMode",
+	"host",
+	"kubeconfig",
+	"namespace",
+	"labelSelector",
+	"podPort",
+	"tls.ca",
+	"tls.cert",
+	"tls.key",
+	"tls.serverName",
+	"token",
+}
+
+// Path returns the location of the configuration file: the file UFS_CONFIG points to, or
+// the DefaultPath in the user's config directory.
+func Path() (string, error) {
+	if fn := os.Getenv("UFS_CONFIG"); fn != "" {
+		return fn, nil
+	}
+	cfgHome, err := homedir.GetConfigHome()
+	if err != nil {
+		return "", fmt.Errorf("cannot determine config directory: %w", err)
+	}
+	return filepath.Join(cfgHome, DefaultPath), nil
+}
+
+// Load reads a configuration file. A file which does not exist yields an empty configuration.
+func Load(fn string) (*Config, error) {
+	content, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var res Config
+	if err := yaml.UnmarshalStrict(content, &res); err != nil {
+		return nil, fmt.Errorf("invalid client configuration %s: %w", fn, err)
+	}
+	if err := res.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid client configuration %s: %w", fn, err)
+	}
+	return &res, nil
+}
+
+// Save writes the configuration file. Only the user can read it, as contexts can hold tokens.
+func (c *Config) Save(fn string) error {
+	content, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(fn, content, 0600)
+}
+
+// Validate checks that the current context exists and that all contexts are usable
+func (c *Config) Validate() error {
+	if c.CurrentContext != "" && c.Contexts[c.CurrentContext] == nil {
+		return fmt.Errorf("current context %q does not exist", c.CurrentContext)
+	}
+	for name, ctx := range c.Contexts {
+		if ctx == nil {
+			return fmt.Errorf("context %q is empty", name)
+		}
+		if err := ctx.Validate(); err != nil {
+			return fmt.Errorf("context %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks the settings of a context which can be checked without connecting
+func (ctx *Context) Validate() error {
+	switch ctx.DialMode {
+	case "", "host", "kubernetes":
+	default:
+		return fmt.Errorf("unknown dial mode %q: must be host or kubernetes", ctx.DialMode)
+	}
+	if ctx.PodPort != "" {
+		if _, err := strconv.ParseUint(ctx.PodPort, 10, 16); err != nil {
+			return fmt.Errorf("invalid pod port %q", ctx.PodPort)
+		}
+	}
+	return nil
+}
+
+// Names returns the names of all contexts in alphabetical order
+func (c *Config) Names() []string {
+	res := make([]string, 0, len(c.Contexts))
+	for name := range c.Contexts {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Context returns the named context, or the current one if name is empty. It returns nil
+// if no name is given and there is no current context.
+func (c *Config) Context(name string) (*Context, error) {
+	if name == "" {
+		name = c.CurrentContext
+	}
+	if name == "" {
+		return nil, nil
+	}
+	res, ok := c.Contexts[name]
+	if !ok {
+		return nil, fmt.Errorf("context %q does not exist", name)
+	}
+	return res, nil
+}
+
+// UseContext makes the named context the current one
+func (c *Config) UseContext(name string) error {
+	if _, ok := c.Contexts[name]; !ok {
+		return fmt.Errorf("context %q does not exist", name)
+	}
+	c.CurrentContext = name
+	return nil
+}
+
+// Set changes a setting of the named context, which is created if it does not exist yet.
+// The key is one of Keys, and an empty value removes the setting. The first context
+// becomes the current one.
+func (c *Config) Set(name, key, value string) error {
+	if name == "" {
+		return fmt.Errorf("context name must not be empty")
+	}
+	ctx := c.Contexts[name]
+	if ctx == nil {
+		ctx = &Context{}
+	}
+
+	// we change a copy so that the context stays intact if the value is invalid
+	res := *ctx
+	tls := TLS{}
+	if res.TLS != nil {
+		tls = *res.TLS
+	}
+	res.TLS = &tls
+	field := res.field(key)
+	if field == nil {
+		return fmt.Errorf("unknown key %q: must be one of %v", key, Keys)
+	}
+	*field = value
+	if tls == (TLS{}) {
+		res.TLS = nil
+	}
+	if err := res.Validate(); err != nil {
+		return err
+	}
+
+	if c.Contexts == nil {
+		c.Contexts = make(map[string]*Context)
+	}
+	c.Contexts[name] = &res
+	if c.CurrentContext == "" {
+		c.CurrentContext = name
+	}
+	return nil
+}
+
+// field returns the setting of a key, or nil if the key is unknown. ctx.TLS must not be nil.
+func (ctx *Context) field(key string) *string {
+	switch key {
+	case "dialMode":
+		return &ctx.DialMode
+	case "host":
+		return &ctx.Host
+	case "kubeconfig":
+		return &ctx.Kubeconfig
+	case "namespace":
+		return &ctx.Namespace
+	case "labelSelector":
+		return &ctx.LabelSelector
+	case "podPort":
+		return &ctx.PodPort
+	case "tls.ca":
+		return &ctx.TLS.CA
+	case "tls.cert":
+		return &ctx.TLS.Cert
+	case "tls.key":
+		return &ctx.TLS.Key
+	case "tls.serverName":
+		return &ctx.TLS.ServerName
+	case "token":
+		return &ctx.Token
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,102 @@
+package clientconfig
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestSet(t *testing.T) {
+	var cfg Config
+	assert.NilError(t, cfg.Set("staging", "host", "ufs.staging:7777"))
+	assert.NilError(t, cfg.Set("staging", "tls.ca", "/etc/ufs/ca.pem"))
+	assert.NilError(t, cfg.Set("production", "dialMode", "kubernetes"))
+	assert.NilError(t, cfg.Set("production", "podPort", "7777"))
+
+	assert.Equal(t, cfg.CurrentContext, "staging", "the first context must become the current one")
+	assert.DeepEqual(t, cfg.Names(), []string{"production", "staging"})
+	assert.DeepEqual(t, *cfg.Contexts["staging"], Context{Host: "ufs.staging:7777", TLS: &TLS{CA: "/etc/ufs/ca.pem"}})
+
+	assert.NilError(t, cfg.Set("staging", "host", ""))
+	assert.NilError(t, cfg.Set("staging", "tls.ca", ""))
+	assert.DeepEqual(t, *cfg.Contexts["staging"], Context{})
+
+	assert.ErrorContains(t, cfg.Set("staging", "color", "blue"), "unknown key")
+	assert.ErrorContains(t, cfg.Set("staging", "dialMode", "carrier-pigeon"), "unknown dial mode")
+	assert.ErrorContains(t, cfg.Set("production", "podPort", "http"), "invalid pod port")
+	assert.Equal(t, cfg.Contexts["production"].PodPort, "7777", "invalid values must not change the context")
+	assert.ErrorContains(t, cfg.Set("", "host", "localhost"), "must not be empty")
+}
+
+func TestContext(t *testing.T) {
+	var cfg Config
+	ctx, err := cfg.Context("")
+	assert.NilError(t, err)
+	assert.Check(t, is.Nil(ctx))
+
+	assert.NilError(t, cfg.Set("staging", "host", "ufs.staging:7777"))
+	assert.NilError(t, cfg.Set("production", "host", "ufs.production:7777"))
+	ctx, err = cfg.Context("")
+	assert.NilError(t, err)
+	assert.Equal(t, ctx.Host, "ufs.staging:7777")
+	ctx, err = cfg.Context("production")
+	assert.NilError(t, err)
+	assert.Equal(t, ctx.Host, "ufs.production:7777")
+	_, err = cfg.Context("development")
+	assert.ErrorContains(t, err, "does not exist")
+
+	assert.NilError(t, cfg.UseContext("production"))
+	assert.Equal(t, cfg.CurrentContext, "production")
+	assert.ErrorContains(t, cfg.UseContext("development"), "does not exist")
+}
+
+func TestLoadSave(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "ufs", "client.yaml")
+	cfg, err := Load(fn)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(cfg.Contexts, 0))
+
+	assert.NilError(t, cfg.Set("staging", "token", "s3cr3t"))
+	assert.NilError(t, cfg.Save(fn))
+	stat, err := os.Stat(fn)
+	assert.NilError(t, err)
+	assert.Equal(t, stat.Mode().Perm(), os.FileMode(0600))
+
+	loaded, err := Load(fn)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, loaded, cfg)
+
+	for content, msg := range map[string]string{
+		"currentContext: staging\n":                    "current context \"staging\" does not exist",
+		"contexts:\n  staging:\n    dialMode: ssh\n":   "unknown dial mode",
+		"contexts:\n  staging:\n    hots: localhost\n": "unknown field",
+		"contexts:\n  staging:\n    podPort: \"-1\"\n": "invalid pod port",
+	} {
+		assert.NilError(t, os.WriteFile(fn, []byte(content), 0600))
+		_, err := Load(fn)
+		assert.ErrorContains(t, err, msg, "content %q", content)
+	}
+}
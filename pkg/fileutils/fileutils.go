@@ -21,6 +21,7 @@ package fileutils
 // THE SOFTWARE.
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
@@ -508,3 +509,48 @@ func CreateIfNotExists(path string, isDir bool) error {
 	}
 	return nil
 }
+
+// ReadPatterns reads patterns in the format of ignore files like .ufsignore: one pattern per
+// line, with blank lines and lines starting with # ignored. Patterns are relative to the
+// directory of the ignore file, even if they start with a slash, and a leading ! re-includes
+// paths which an earlier pattern excluded.
+func ReadPatterns(r io.Reader) ([]string, error) {
+	var res []string
+	lines := bufio.NewScanner(r)
+	for lines.Scan() {
+		p := strings.TrimSpace(lines.Text())
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+
+		var exclusion bool
+		if strings.HasPrefix(p, "!") {
+			exclusion = true
+			p = strings.TrimSpace(p[1:])
+		}
+		if p == "" {
+			return nil, errors.New("illegal exclusion pattern: \"!\"")
+		}
+		p = filepath.Clean(filepath.FromSlash(p))
+		if filepath.IsAbs(p) {
+			// patterns are relative to the root even if they start with a slash
+			p = p[1:]
+			if p == "" {
+				p = "."
+			}
+		}
+		if exclusion {
+			p = "!" + p
+		}
+		res = append(res, p)
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+
+	// make sure the patterns can be used
+	if _, err := NewPatternMatcher(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -709,3 +709,37 @@ func TestMatch(t *testing.T) {
 		}
 	}
 }
+
+func TestReadPatterns(t *testing.T) {
+	patterns, err := ReadPatterns(strings.NewReader(`
+# build output
+bin/
+/node_modules
+  *.log
+!important.log
+
+**/.git
+`))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, patterns, []string{"bin", "node_modules", "*.log", "!important.log", "**/.git"})
+
+	pm, err := NewPatternMatcher(patterns)
+	assert.NilError(t, err)
+	for file, exp := range map[string]bool{
+		"bin/ufs":             true,
+		"node_modules/a/b.js": true,
+		"error.log":           true,
+		"important.log":       false,
+		"sub/.git/config":     true,
+		"main.go":             false,
+	} {
+		act, err := pm.MatchesOrParentMatches(file)
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(act, exp), file)
+	}
+
+	_, err = ReadPatterns(strings.NewReader("!"))
+	assert.ErrorContains(t, err, "illegal exclusion pattern")
+	_, err = ReadPatterns(strings.NewReader("[a-"))
+	assert.ErrorContains(t, err, "syntax error")
+}
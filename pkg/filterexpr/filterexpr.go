@@ -0,0 +1,227 @@
+package filterexpr
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+)
+
+// Fields lists all Engine fields which can be used in filter and order expressions.
+// Annotations are addressed using the AnnotationPrefix followed by the annotation key.
+var Fields = []string{
+	"name",
+	"owner",
+	"phase",
+	"trigger",
+	"spec",
+	"success",
+	"created",
+	"finished",
+	"repo.host",
+	"repo.owner",
+	"repo.repo",
+	"repo.ref",
+	"repo.rev",
+}
+
+// AnnotationPrefix prefixes a field which refers to an Engine annotation
+const AnnotationPrefix = "annotation."
+
+// timestampFormat renders timestamps such that their lexicographical order matches
+// their chronological order.
+const timestampFormat = "2006-01-02T15:04:05.000000000Z"
+
+// IsValidField returns true if field can be used in a filter or order expression
+func IsValidField(field string) bool {
+	if strings.HasPrefix(field, AnnotationPrefix) {
+		return len(field) > len(AnnotationPrefix)
+	}
+	for _, f := range Fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate ensures all filter and order expressions refer to known fields
+func Validate(filter []*v1.FilterExpression, order []*v1.OrderExpression) error {
+	for _, expr := range filter {
+		for _, term := range expr.Terms {
+			if !IsValidField(term.Field) {
+				return fmt.Errorf("unknown filter field %q", term.Field)
+			}
+			if _, ok := v1.FilterOp_name[int32(term.Operation)]; !ok {
+				return fmt.Errorf("unknown filter operation %d", term.Operation)
+			}
+		}
+	}
+	for _, o := range order {
+		if !IsValidField(o.Field) {
+			return fmt.Errorf("unknown order field %q", o.Field)
+		}
+	}
+	return nil
+}
+
+// PhaseName returns the filter representation of an Engine phase, e.g. "running" for PHASE_RUNNING
+func PhaseName(p v1.EnginePhase) string {
+	return strings.ToLower(strings.TrimPrefix(p.String(), "PHASE_"))
+}
+
+// TriggerName returns the filter representation of an Engine trigger, e.g. "manual" for TRIGGER_MANUAL
+func TriggerName(t v1.EngineTrigger) string {
+	return strings.ToLower(strings.TrimPrefix(t.String(), "TRIGGER_"))
+}
+
+// FormatTimestamp renders a timestamp the way it is compared in filter and order expressions
+func FormatTimestamp(t time.Time) string {
+	return t.UTC().Format(timestampFormat)
+}
+
+// Field returns the value of an Engine field and whether that field is set at all
+func Field(s *v1.EngineStatus, field string) (value string, ok bool) {
+	md := s.GetMetadata()
+	repo := md.GetRepository()
+
+	if strings.HasPrefix(field, AnnotationPrefix) {
+		key := strings.TrimPrefix(field, AnnotationPrefix)
+		for _, a := range md.GetAnnotations() {
+			if a.Key == key {
+				return a.Value, true
+			}
+		}
+		return "", false
+	}
+
+	switch field {
+	case "name":
+		value = s.GetName()
+	case "owner":
+		value = md.GetOwner()
+	case "phase":
+		return PhaseName(s.GetPhase()), true
+	case "trigger":
+		return TriggerName(md.GetTrigger()), true
+	case "spec":
+		value = md.GetEngineSpecName()
+	case "success":
+		return fmt.Sprintf("%v", s.GetConditions().GetSuccess()), true
+	case "created":
+		if md.GetCreated() == nil {
+			return "", false
+		}
+		return FormatTimestamp(md.GetCreated().AsTime()), true
+	case "finished":
+		if md.GetFinished() == nil {
+			return "", false
+		}
+		return FormatTimestamp(md.GetFinished().AsTime()), true
+	case "repo.host":
+		value = repo.GetHost()
+	case "repo.owner":
+		value = repo.GetOwner()
+	case "repo.repo":
+		value = repo.GetRepo()
+	case "repo.ref":
+		value = repo.GetRef()
+	case "repo.rev":
+		value = repo.GetRevision()
+	default:
+		return "", false
+	}
+	return value, value != ""
+}
+
+// MatchesTerm returns true if the Engine matches a single filter term
+func MatchesTerm(s *v1.EngineStatus, term *v1.FilterTerm) bool {
+	val, ok := Field(s, term.Field)
+
+	var res bool
+	switch term.Operation {
+	case v1.FilterOp_OP_EXISTS:
+		res = ok
+	case v1.FilterOp_OP_EQUALS:
+		res = val == term.Value
+	case v1.FilterOp_OP_STARTS_WITH:
+		res = strings.HasPrefix(val, term.Value)
+	case v1.FilterOp_OP_ENDS_WITH:
+		res = strings.HasSuffix(val, term.Value)
+	case v1.FilterOp_OP_CONTAINS:
+		res = strings.Contains(val, term.Value)
+	}
+
+	if term.Negate {
+		return !res
+	}
+	return res
+}
+
+// MatchesFilter returns true if the Engine matches the filter. All expressions of a
+// filter must match, whereas a single matching term suffices for an expression to match.
+// An empty filter matches all Engines.
+func MatchesFilter(s *v1.EngineStatus, filter []*v1.FilterExpression) bool {
+	for _, expr := range filter {
+		if len(expr.Terms) == 0 {
+			continue
+		}
+
+		var match bool
+		for _, term := range expr.Terms {
+			if MatchesTerm(s, term) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+// Sort orders Engines according to the order expressions. Engines which are
+// equal with respect to all order expressions keep their original order.
+func Sort(engines []*v1.EngineStatus, order []*v1.OrderExpression) {
+	if len(order) == 0 {
+		return
+	}
+
+	sort.SliceStable(engines, func(i, j int) bool {
+		for _, o := range order {
+			a, _ := Field(engines[i], o.Field)
+			b, _ := Field(engines[j], o.Field)
+			if a == b {
+				continue
+			}
+			if o.Ascending {
+				return a < b
+			}
+			return a > b
+		}
+		return false
+	})
+}
@@ -0,0 +1,82 @@
+package filterexpr
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"testing"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"gotest.tools/v3/assert"
+)
+
+func TestMatchesFilter(t *testing.T) {
+	engine := &v1.EngineStatus{
+		Name:  "storage-main.12",
+		Phase: v1.EnginePhase_PHASE_RUNNING,
+		Metadata: &v1.EngineMetadata{
+			Owner:       "alice",
+			Repository:  &v1.Repository{Host: "github.com", Owner: "bhojpur", Repo: "storage", Ref: "main"},
+			Annotations: []*v1.Annotation{{Key: "nightly", Value: "true"}},
+		},
+	}
+	term := func(field, value string, op v1.FilterOp, negate bool) *v1.FilterTerm {
+		return &v1.FilterTerm{Field: field, Value: value, Operation: op, Negate: negate}
+	}
+
+	tests := []struct {
+		Name   string
+		Filter []*v1.FilterExpression
+		Match  bool
+	}{
+		{"empty filter", nil, true},
+		{"equals", []*v1.FilterExpression{{Terms: []*v1.FilterTerm{term("owner", "alice", v1.FilterOp_OP_EQUALS, false)}}}, true},
+		{"negated equals", []*v1.FilterExpression{{Terms: []*v1.FilterTerm{term("owner", "alice", v1.FilterOp_OP_EQUALS, true)}}}, false},
+		{"starts with", []*v1.FilterExpression{{Terms: []*v1.FilterTerm{term("name", "storage-", v1.FilterOp_OP_STARTS_WITH, false)}}}, true},
+		{"ends with", []*v1.FilterExpression{{Terms: []*v1.FilterTerm{term("name", ".13", v1.FilterOp_OP_ENDS_WITH, false)}}}, false},
+		{"contains", []*v1.FilterExpression{{Terms: []*v1.FilterTerm{term("repo.owner", "hoj", v1.FilterOp_OP_CONTAINS, false)}}}, true},
+		{"phase", []*v1.FilterExpression{{Terms: []*v1.FilterTerm{term("phase", "running", v1.FilterOp_OP_EQUALS, false)}}}, true},
+		{"annotation exists", []*v1.FilterExpression{{Terms: []*v1.FilterTerm{term("annotation.nightly", "", v1.FilterOp_OP_EXISTS, false)}}}, true},
+		{"annotation missing", []*v1.FilterExpression{{Terms: []*v1.FilterTerm{term("annotation.weekly", "", v1.FilterOp_OP_EXISTS, false)}}}, false},
+		{"terms are or'ed", []*v1.FilterExpression{{Terms: []*v1.FilterTerm{
+			term("owner", "bob", v1.FilterOp_OP_EQUALS, false),
+			term("owner", "alice", v1.FilterOp_OP_EQUALS, false),
+		}}}, true},
+		{"expressions are and'ed", []*v1.FilterExpression{
+			{Terms: []*v1.FilterTerm{term("owner", "alice", v1.FilterOp_OP_EQUALS, false)}},
+			{Terms: []*v1.FilterTerm{term("repo.ref", "develop", v1.FilterOp_OP_EQUALS, false)}},
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			assert.Equal(t, MatchesFilter(engine, test.Filter), test.Match)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	assert.NilError(t, Validate(
+		[]*v1.FilterExpression{{Terms: []*v1.FilterTerm{{Field: "annotation.foo"}}}},
+		[]*v1.OrderExpression{{Field: "created"}},
+	))
+	assert.ErrorContains(t, Validate([]*v1.FilterExpression{{Terms: []*v1.FilterTerm{{Field: "foo"}}}}, nil), "unknown filter field")
+	assert.ErrorContains(t, Validate(nil, []*v1.OrderExpression{{Field: "annotation."}}), "unknown order field")
+}
@@ -0,0 +1,137 @@
+package filterexpr
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+)
+
+// operators maps the operators of the filter language to filter operations and whether they negate
+// the term. Two-character operators must come before "=" so that they take precedence.
+var operators = []struct {
+	Token  string
+	Op     v1.FilterOp
+	Negate bool
+}{
+	{"==", v1.FilterOp_OP_EQUALS, false},
+	{"!=", v1.FilterOp_OP_EQUALS, true},
+	{"^=", v1.FilterOp_OP_STARTS_WITH, false},
+	{"$=", v1.FilterOp_OP_ENDS_WITH, false},
+	{"~=", v1.FilterOp_OP_CONTAINS, false},
+	{"=", v1.FilterOp_OP_EQUALS, false},
+}
+
+// Parse parses filter expressions written in the filter language. All expressions must match,
+// and an expression consists of terms separated by "|" of which one must match. A term is one of
+//
+//	field==value  (or field=value) the field equals value
+//	field!=value  the field does not equal value
+//	field^=value  the field starts with value
+//	field$=value  the field ends with value
+//	field~=value  the field contains value
+//	field         the field is set
+//
+// A leading "!" negates a term, e.g. "!annotation.nightly" or "!name^=nightly-".
+func Parse(exprs ...string) ([]*v1.FilterExpression, error) {
+	res := make([]*v1.FilterExpression, 0, len(exprs))
+	for _, expr := range exprs {
+		var terms []*v1.FilterTerm
+		for _, t := range strings.Split(expr, "|") {
+			term, err := ParseTerm(t)
+			if err != nil {
+				return nil, err
+			}
+			terms = append(terms, term)
+		}
+		res = append(res, &v1.FilterExpression{Terms: terms})
+	}
+	return res, nil
+}
+
+// ParseTerm parses a single term of the filter language
+func ParseTerm(s string) (*v1.FilterTerm, error) {
+	s = strings.TrimSpace(s)
+	var negate bool
+	if strings.HasPrefix(s, "!") {
+		negate = true
+		s = strings.TrimSpace(s[1:])
+	}
+
+	res := &v1.FilterTerm{Field: s, Operation: v1.FilterOp_OP_EXISTS}
+	if idx := strings.IndexAny(s, "=!^$~"); idx >= 0 {
+		var found bool
+		for _, op := range operators {
+			if !strings.HasPrefix(s[idx:], op.Token) {
+				continue
+			}
+			res.Field = strings.TrimSpace(s[:idx])
+			res.Value = strings.TrimSpace(s[idx+len(op.Token):])
+			res.Operation = op.Op
+			negate = negate != op.Negate
+			found = true
+			break
+		}
+		if !found {
+			return nil, fmt.Errorf("invalid filter term %q: unknown operator", s)
+		}
+	}
+	res.Negate = negate
+
+	if res.Field == "" {
+		return nil, fmt.Errorf("invalid filter term %q: missing field", s)
+	}
+	if !IsValidField(res.Field) {
+		return nil, fmt.Errorf("unknown filter field %q", res.Field)
+	}
+	return res, nil
+}
+
+// ParseOrder parses comma separated order expressions of the form field[:asc|:desc].
+// Fields are sorted in ascending order unless stated otherwise.
+func ParseOrder(exprs ...string) ([]*v1.OrderExpression, error) {
+	var res []*v1.OrderExpression
+	for _, expr := range exprs {
+		for _, o := range strings.Split(expr, ",") {
+			o = strings.TrimSpace(o)
+			if o == "" {
+				continue
+			}
+
+			field, dir := o, "asc"
+			if idx := strings.LastIndex(o, ":"); idx >= 0 {
+				field, dir = o[:idx], strings.ToLower(o[idx+1:])
+			}
+			if !IsValidField(field) {
+				return nil, fmt.Errorf("unknown order field %q", field)
+			}
+			switch dir {
+			case "asc", "desc":
+			default:
+				return nil, fmt.Errorf("invalid order %q: direction must be asc or desc", o)
+			}
+			res = append(res, &v1.OrderExpression{Field: field, Ascending: dir == "asc"})
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,101 @@
+package filterexpr
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"testing"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/v3/assert"
+)
+
+func TestParse(t *testing.T) {
+	term := func(field, value string, op v1.FilterOp, negate bool) *v1.FilterTerm {
+		return &v1.FilterTerm{Field: field, Value: value, Operation: op, Negate: negate}
+	}
+
+	tests := []struct {
+		Input       []string
+		Expectation []*v1.FilterExpression
+		Error       string
+	}{
+		{[]string{"owner==alice"}, []*v1.FilterExpression{{Terms: []*v1.FilterTerm{term("owner", "alice", v1.FilterOp_OP_EQUALS, false)}}}, ""},
+		{[]string{"owner=alice"}, []*v1.FilterExpression{{Terms: []*v1.FilterTerm{term("owner", "alice", v1.FilterOp_OP_EQUALS, false)}}}, ""},
+		{[]string{"phase!=done"}, []*v1.FilterExpression{{Terms: []*v1.FilterTerm{term("phase", "done", v1.FilterOp_OP_EQUALS, true)}}}, ""},
+		{[]string{"name^=storage-"}, []*v1.FilterExpression{{Terms: []*v1.FilterTerm{term("name", "storage-", v1.FilterOp_OP_STARTS_WITH, false)}}}, ""},
+		{[]string{"name$=.1"}, []*v1.FilterExpression{{Terms: []*v1.FilterTerm{term("name", ".1", v1.FilterOp_OP_ENDS_WITH, false)}}}, ""},
+		{[]string{"repo.repo~=stor"}, []*v1.FilterExpression{{Terms: []*v1.FilterTerm{term("repo.repo", "stor", v1.FilterOp_OP_CONTAINS, false)}}}, ""},
+		{[]string{"annotation.nightly"}, []*v1.FilterExpression{{Terms: []*v1.FilterTerm{term("annotation.nightly", "", v1.FilterOp_OP_EXISTS, false)}}}, ""},
+		{[]string{"!annotation.nightly"}, []*v1.FilterExpression{{Terms: []*v1.FilterTerm{term("annotation.nightly", "", v1.FilterOp_OP_EXISTS, true)}}}, ""},
+		{[]string{"!name^=nightly-"}, []*v1.FilterExpression{{Terms: []*v1.FilterTerm{term("name", "nightly-", v1.FilterOp_OP_STARTS_WITH, true)}}}, ""},
+		{[]string{"!phase!=done"}, []*v1.FilterExpression{{Terms: []*v1.FilterTerm{term("phase", "done", v1.FilterOp_OP_EQUALS, false)}}}, ""},
+		{[]string{"annotation.url==a=b"}, []*v1.FilterExpression{{Terms: []*v1.FilterTerm{term("annotation.url", "a=b", v1.FilterOp_OP_EQUALS, false)}}}, ""},
+		{
+			[]string{"phase==running | phase==waiting", "owner==alice"},
+			[]*v1.FilterExpression{
+				{Terms: []*v1.FilterTerm{
+					term("phase", "running", v1.FilterOp_OP_EQUALS, false),
+					term("phase", "waiting", v1.FilterOp_OP_EQUALS, false),
+				}},
+				{Terms: []*v1.FilterTerm{term("owner", "alice", v1.FilterOp_OP_EQUALS, false)}},
+			},
+			"",
+		},
+		{[]string{"foo==bar"}, nil, "unknown filter field"},
+		{[]string{"==bar"}, nil, "missing field"},
+		{[]string{"owner~alice"}, nil, "unknown operator"},
+		{[]string{"owner==alice|"}, nil, "missing field"},
+	}
+	for _, test := range tests {
+		t.Run(test.Input[0], func(t *testing.T) {
+			act, err := Parse(test.Input...)
+			if test.Error != "" {
+				assert.ErrorContains(t, err, test.Error)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, len(act), len(test.Expectation))
+			for i := range act {
+				assert.Assert(t, proto.Equal(act[i], test.Expectation[i]), "expression %d: %v", i, act[i])
+			}
+		})
+	}
+}
+
+func TestParseOrder(t *testing.T) {
+	act, err := ParseOrder("created:desc, name", "annotation.priority:ASC")
+	assert.NilError(t, err)
+	exp := []*v1.OrderExpression{
+		{Field: "created"},
+		{Field: "name", Ascending: true},
+		{Field: "annotation.priority", Ascending: true},
+	}
+	assert.Equal(t, len(act), len(exp))
+	for i := range act {
+		assert.Assert(t, proto.Equal(act[i], exp[i]), "order %d: %v", i, act[i])
+	}
+
+	_, err = ParseOrder("foo")
+	assert.ErrorContains(t, err, "unknown order field")
+	_, err = ParseOrder("name:up")
+	assert.ErrorContains(t, err, "direction must be asc or desc")
+}
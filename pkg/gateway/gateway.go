@@ -0,0 +1,490 @@
+package gateway
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// MaxRequestSize limits the size of JSON request bodies, and of each message of a client-streaming request
+const MaxRequestSize = 4 * 1024 * 1024
+
+const (
+	contentTypeJSON   = "application/json"
+	contentTypeNDJSON = "application/x-ndjson"
+	contentTypeSSE    = "text/event-stream"
+)
+
+// Gateway translates JSON requests over HTTP into gRPC calls. Each RPC is available as
+// /<service>/<method>, e.g. /v1.UfsService/ListEngines, and messages are encoded using protojson.
+//
+// The request of unary and server-streaming RPCs is read from an application/json body, or from
+// the request query parameter of GET requests. GET is only available for RPCs which merely read,
+// i.e. List*, Get*, Subscribe and Listen. Client-streaming RPCs read their requests from an
+// application/x-ndjson body, one message per line. Requests with any other content type are
+// refused, so that browsers cannot send them across origins without a CORS preflight.
+//
+// Unary and client-streaming RPCs answer with JSON. Server-streaming RPCs answer with NDJSON, or
+// with server-sent events if the client accepts text/event-stream.
+//
+// The Authorization header is passed on as gRPC metadata, so that the gateway is subject to the
+// same authentication as gRPC clients.
+type Gateway struct {
+	conn    grpc.ClientConnInterface
+	methods map[string]protoreflect.MethodDescriptor
+}
+
+// New creates a gateway which makes the RPCs of the given services available through conn
+func New(conn grpc.ClientConnInterface, services ...protoreflect.ServiceDescriptor) *Gateway {
+	methods := make(map[string]protoreflect.MethodDescriptor)
+	for _, svc := range services {
+		ms := svc.Methods()
+		for i := 0; i < ms.Len(); i++ {
+			m := ms.Get(i)
+			methods[fmt.Sprintf("/%s/%s", svc.FullName(), m.Name())] = m
+		}
+	}
+	return &Gateway{
+		conn:    conn,
+		methods: methods,
+	}
+}
+
+var (
+	marshaler   = protojson.MarshalOptions{}
+	unmarshaler = protojson.UnmarshalOptions{DiscardUnknown: true}
+)
+
+// forwardedHeaders are passed on to the gRPC server as metadata
+var forwardedHeaders = []string{"Authorization"}
+
+// ServeHTTP serves a single RPC
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m, ok := g.methods[r.URL.Path]
+	if !ok {
+		writeError(w, status.Errorf(codes.NotFound, "unknown method %s", r.URL.Path))
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, status.Errorf(codes.Unimplemented, "method %s not allowed", r.Method))
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && (m.IsStreamingClient() || !isReadOnly(m)):
+		w.Header().Set("Allow", "POST")
+		writeHTTPError(w, http.StatusMethodNotAllowed, status.Errorf(codes.InvalidArgument, "%s must be called using POST", r.URL.Path))
+		return
+	case r.Method == http.MethodPost:
+		want := contentTypeJSON
+		if m.IsStreamingClient() {
+			want = contentTypeNDJSON
+		}
+		if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != want {
+			writeHTTPError(w, http.StatusUnsupportedMediaType, status.Errorf(codes.InvalidArgument, "%s expects Content-Type %s", r.URL.Path, want))
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	md := metadata.MD{}
+	for _, h := range forwardedHeaders {
+		if v := r.Header.Values(h); len(v) > 0 {
+			md.Set(h, v...)
+		}
+	}
+	ctx = metadata.NewOutgoingContext(ctx, md)
+
+	switch {
+	case m.IsStreamingClient() && m.IsStreamingServer():
+		writeError(w, status.Errorf(codes.Unimplemented, "%s is not available through the gateway", r.URL.Path))
+	case m.IsStreamingClient():
+		g.serveClientStream(ctx, w, r, m)
+	case m.IsStreamingServer():
+		g.serveServerStream(ctx, w, r, m)
+	default:
+		g.serveUnary(ctx, w, r, m)
+	}
+}
+
+// isReadOnly returns true for RPCs which do not change anything and hence may be called using GET
+func isReadOnly(m protoreflect.MethodDescriptor) bool {
+	name := string(m.Name())
+	return strings.HasPrefix(name, "List") || strings.HasPrefix(name, "Get") || name == "Subscribe" || name == "Listen"
+}
+
+// serveUnary forwards a single request and answers with the response
+func (g *Gateway) serveUnary(ctx context.Context, w http.ResponseWriter, r *http.Request, m protoreflect.MethodDescriptor) {
+	req, err := readRequest(r, m.Input())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp, err := newMessage(m.Output())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	err = g.conn.Invoke(ctx, r.URL.Path, req, resp)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, resp)
+}
+
+// serveClientStream forwards each line of an NDJSON body as message and answers with the response
+func (g *Gateway) serveClientStream(ctx context.Context, w http.ResponseWriter, r *http.Request, m protoreflect.MethodDescriptor) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, status.Errorf(codes.InvalidArgument, "%s requires a POST request with an NDJSON body", r.URL.Path))
+		return
+	}
+
+	stream, err := g.conn.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true}, r.URL.Path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	in := bufio.NewReader(r.Body)
+	for {
+		line, err := readLine(in)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		req, err := newMessage(m.Input())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		err = unmarshaler.Unmarshal(line, req)
+		if err != nil {
+			writeError(w, status.Errorf(codes.InvalidArgument, "invalid request: %v", err))
+			return
+		}
+		err = stream.SendMsg(req)
+		if err == io.EOF {
+			// the server has ended the call - RecvMsg tells us why
+			break
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp, err := newMessage(m.Output())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	err = stream.RecvMsg(resp)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, resp)
+}
+
+// serveServerStream forwards the messages of a server-streaming RPC as NDJSON or server-sent events.
+// Errors after the stream has started are sent in-band.
+func (g *Gateway) serveServerStream(ctx context.Context, w http.ResponseWriter, r *http.Request, m protoreflect.MethodDescriptor) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, status.Error(codes.Internal, "streaming is not supported"))
+		return
+	}
+	req, err := readRequest(r, m.Input())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	stream, err := g.conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, r.URL.Path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := stream.SendMsg(req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := stream.CloseSend(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// the first message tells us whether the call succeeded at all
+	resp, err := newMessage(m.Output())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	err = stream.RecvMsg(resp)
+	if err != nil && err != io.EOF {
+		writeError(w, err)
+		return
+	}
+
+	var out streamWriter = ndjsonWriter{w}
+	if acceptsSSE(r) {
+		out = sseWriter{w}
+	}
+	w.Header().Set("Content-Type", out.ContentType())
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for err == nil {
+		var msg []byte
+		msg, err = marshaler.Marshal(resp)
+		if err != nil {
+			break
+		}
+		err = out.Message(msg)
+		if err != nil {
+			// the client went away
+			return
+		}
+		flusher.Flush()
+
+		resp, _ = newMessage(m.Output())
+		err = stream.RecvMsg(resp)
+	}
+	if err == io.EOF {
+		out.End()
+	} else {
+		body, _ := json.Marshal(errorBody(err))
+		out.Error(body)
+	}
+	flusher.Flush()
+}
+
+// acceptsSSE returns true if the client prefers server-sent events over NDJSON
+func acceptsSSE(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept") {
+		if strings.Contains(v, contentTypeSSE) {
+			return true
+		}
+	}
+	return false
+}
+
+// streamWriter encodes the messages of a server-streaming RPC
+type streamWriter interface {
+	ContentType() string
+	Message(msg []byte) error
+	End()
+	Error(body []byte)
+}
+
+// ndjsonWriter writes one message per line. Errors are a line of the form {"error": {...}}.
+type ndjsonWriter struct{ w io.Writer }
+
+func (ndjsonWriter) ContentType() string { return contentTypeNDJSON }
+
+func (n ndjsonWriter) Message(msg []byte) error {
+	_, err := fmt.Fprintf(n.w, "%s\n", msg)
+	return err
+}
+
+func (ndjsonWriter) End() {}
+
+func (n ndjsonWriter) Error(body []byte) {
+	_, _ = fmt.Fprintf(n.w, "{\"error\":%s}\n", body)
+}
+
+// sseWriter writes messages as data events. Streams finish with an end or error event.
+type sseWriter struct{ w io.Writer }
+
+func (sseWriter) ContentType() string { return contentTypeSSE }
+
+func (s sseWriter) Message(msg []byte) error {
+	_, err := fmt.Fprintf(s.w, "data: %s\n\n", msg)
+	return err
+}
+
+func (s sseWriter) End() {
+	_, _ = io.WriteString(s.w, "event: end\ndata: {}\n\n")
+}
+
+func (s sseWriter) Error(body []byte) {
+	_, _ = fmt.Fprintf(s.w, "event: error\ndata: %s\n\n", body)
+}
+
+// readLine reads a single line of an NDJSON body
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		frag, isPrefix, err := r.ReadLine()
+		line = append(line, frag...)
+		if len(line) > MaxRequestSize {
+			return nil, status.Errorf(codes.InvalidArgument, "request message exceeds %d bytes", MaxRequestSize)
+		}
+		if err == io.EOF && len(line) > 0 {
+			return line, nil
+		}
+		if err != nil && err != io.EOF {
+			return nil, status.Errorf(codes.InvalidArgument, "cannot read request: %v", err)
+		}
+		if err != nil || !isPrefix {
+			return line, err
+		}
+	}
+}
+
+// writeResponse answers with a single JSON message
+func writeResponse(w http.ResponseWriter, resp proto.Message) {
+	out, err := marshaler.Marshal(resp)
+	if err != nil {
+		writeError(w, status.Errorf(codes.Internal, "cannot marshal response: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	_, _ = w.Write(out)
+}
+
+// readRequest parses the request message of an RPC
+func readRequest(r *http.Request, desc protoreflect.MessageDescriptor) (proto.Message, error) {
+	req, err := newMessage(desc)
+	if err != nil {
+		return nil, err
+	}
+
+	var in []byte
+	if r.Method == http.MethodGet {
+		in = []byte(r.URL.Query().Get("request"))
+	} else {
+		in, err = io.ReadAll(io.LimitReader(r.Body, MaxRequestSize+1))
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "cannot read request: %v", err)
+		}
+		if len(in) > MaxRequestSize {
+			return nil, status.Errorf(codes.InvalidArgument, "request exceeds %d bytes", MaxRequestSize)
+		}
+	}
+	if len(strings.TrimSpace(string(in))) == 0 {
+		return req, nil
+	}
+	err = unmarshaler.Unmarshal(in, req)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid request: %v", err)
+	}
+	return req, nil
+}
+
+func newMessage(desc protoreflect.MessageDescriptor) (proto.Message, error) {
+	mt, err := protoregistry.GlobalTypes.FindMessageByName(desc.FullName())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unknown message %s: %v", desc.FullName(), err)
+	}
+	return mt.New().Interface(), nil
+}
+
+type errorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func errorBody(err error) errorResponse {
+	s := status.Convert(err)
+	return errorResponse{Code: s.Code().String(), Message: s.Message()}
+}
+
+// writeError answers with the HTTP equivalent of a gRPC status
+func writeError(w http.ResponseWriter, err error) {
+	writeHTTPError(w, HTTPStatus(status.Code(err)), err)
+}
+
+// writeHTTPError answers with an error using the given HTTP status
+func writeHTTPError(w http.ResponseWriter, httpStatus int, err error) {
+	body := errorBody(err)
+	out, merr := json.Marshal(body)
+	if merr != nil {
+		log.WithError(merr).Warn("cannot marshal gateway error")
+	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(httpStatus)
+	_, _ = w.Write(out)
+}
+
+// HTTPStatus maps a gRPC status code to the corresponding HTTP status
+func HTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
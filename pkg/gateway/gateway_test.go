@@ -0,0 +1,381 @@
+package gateway
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/archive"
+	"github.com/bhojpur/ufs/pkg/runner"
+	"github.com/bhojpur/ufs/pkg/store"
+	"github.com/bhojpur/ufs/pkg/ufs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func newTestService(t *testing.T) *ufs.Service {
+	srv := ufs.NewService(store.NewInMemoryEngineStore(), store.NewInMemoryNumberGroup())
+	srv.StagingDir = t.TempDir()
+	srv.Untar = archive.UntarUncompressed
+	return srv
+}
+
+// idleRunner keeps Engines in PHASE_PREPARING until they are stopped
+type idleRunner struct{}
+
+func (idleRunner) Run(ctx context.Context, job *runner.Job, update func(runner.Update)) {
+	<-ctx.Done()
+	update(runner.Update{Phase: v1.EnginePhase_PHASE_DONE, Details: "stopped"})
+}
+
+func newTestGateway(t *testing.T, srv *ufs.Service, opts ...grpc.ServerOption) *httptest.Server {
+	t.Helper()
+
+	l := NewPipeListener()
+	gs := grpc.NewServer(opts...)
+	v1.RegisterUfsServiceServer(gs, srv)
+	v1.RegisterUfsUIServer(gs, ufs.NewUI(nil, srv.ReadOnly))
+	go gs.Serve(l)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.Dial("pipe", grpc.WithContextDialer(l.DialContext), grpc.WithInsecure())
+	assert.NilError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	hs := httptest.NewServer(New(conn,
+		v1.File_ufs_proto.Services().ByName("UfsService"),
+		v1.File_ufs_ui_proto.Services().ByName("UfsUI"),
+	))
+	t.Cleanup(hs.Close)
+	return hs
+}
+
+func post(t *testing.T, srv *httptest.Server, method, body string) (int, []byte) {
+	t.Helper()
+	return postAs(t, srv, method, "application/json", body)
+}
+
+func postAs(t *testing.T, srv *httptest.Server, method, contentType, body string) (int, []byte) {
+	t.Helper()
+	resp, err := http.Post(srv.URL+method, contentType, strings.NewReader(body))
+	assert.NilError(t, err)
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	assert.NilError(t, err)
+	return resp.StatusCode, out
+}
+
+func TestUnary(t *testing.T) {
+	srv := newTestGateway(t, newTestService(t))
+
+	code, out := post(t, srv, "/v1.UfsService/StartEngine", `{"metadata": {"owner": "alice", "repository": {"repo": "storage"}}}`)
+	assert.Equal(t, code, http.StatusOK, string(out))
+	var start v1.StartEngineResponse
+	assert.NilError(t, protojson.Unmarshal(out, &start))
+	assert.Equal(t, start.Status.Name, "storage.1")
+
+	code, out = post(t, srv, "/v1.UfsService/ListEngines", `{"filter": [{"terms": [{"field": "owner", "value": "alice"}]}]}`)
+	assert.Equal(t, code, http.StatusOK, string(out))
+	var list v1.ListEnginesResponse
+	assert.NilError(t, protojson.Unmarshal(out, &list))
+	assert.Equal(t, list.Total, int32(1))
+
+	// GET requests carry the request as query parameter, and an empty request is fine
+	resp, err := http.Get(srv.URL + "/v1.UfsService/ListEngines")
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+}
+
+func TestErrors(t *testing.T) {
+	srv := newTestGateway(t, newTestService(t))
+
+	tests := []struct {
+		Method string
+		Body   string
+		Status int
+		Code   string
+	}{
+		{"/v1.UfsService/GetEngine", `{"name": "nope.1"}`, http.StatusNotFound, "NotFound"},
+		{"/v1.UfsService/GetEngine", `{"name": `, http.StatusBadRequest, "InvalidArgument"},
+		{"/v1.UfsService/DoesNotExist", `{}`, http.StatusNotFound, "NotFound"},
+		{"/v1.UfsService/StartLocalEngine", "{\"metadata\": {}}\n{\"nope\n", http.StatusBadRequest, "InvalidArgument"},
+	}
+	for _, test := range tests {
+		contentType := "application/json"
+		if test.Method == "/v1.UfsService/StartLocalEngine" {
+			contentType = "application/x-ndjson"
+		}
+		code, out := postAs(t, srv, test.Method, contentType, test.Body)
+		assert.Check(t, is.Equal(code, test.Status), "%s: %s", test.Method, out)
+		var body errorResponse
+		assert.Check(t, json.Unmarshal(out, &body))
+		assert.Check(t, is.Equal(body.Code, test.Code), "%s: %s", test.Method, out)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	srv := newTestGateway(t, newTestService(t))
+
+	tests := []struct {
+		Method      string
+		ContentType string
+		Status      int
+	}{
+		{"/v1.UfsService/ListEngines", "application/json; charset=utf-8", http.StatusOK},
+		{"/v1.UfsService/StopEngine", "text/plain", http.StatusUnsupportedMediaType},
+		{"/v1.UfsService/StartEngine", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"/v1.UfsService/StartEngine", "", http.StatusUnsupportedMediaType},
+		{"/v1.UfsService/StartLocalEngine", "application/json", http.StatusUnsupportedMediaType},
+	}
+	for _, test := range tests {
+		code, out := postAs(t, srv, test.Method, test.ContentType, `{}`)
+		assert.Check(t, is.Equal(code, test.Status), "%s %q: %s", test.Method, test.ContentType, out)
+	}
+}
+
+func TestGetOnlyReads(t *testing.T) {
+	srv := newTestGateway(t, newTestService(t))
+
+	tests := []struct {
+		Method string
+		Status int
+	}{
+		{"/v1.UfsService/ListEngines", http.StatusOK},
+		{"/v1.UfsService/GetEngine", http.StatusNotFound},
+		{"/v1.UfsService/StartEngine", http.StatusMethodNotAllowed},
+		{"/v1.UfsService/StopEngine", http.StatusMethodNotAllowed},
+		{"/v1.UfsService/StartFromPreviousEngine", http.StatusMethodNotAllowed},
+		{"/v1.UfsService/StartLocalEngine", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(srv.URL + test.Method + "?request=" + url.QueryEscape(`{"name": "nope.1", "metadata": {"owner": "alice"}}`))
+		assert.NilError(t, err)
+		resp.Body.Close()
+		assert.Check(t, is.Equal(resp.StatusCode, test.Status), test.Method)
+		if test.Status == http.StatusMethodNotAllowed {
+			assert.Check(t, is.Equal(resp.Header.Get("Allow"), "POST"), test.Method)
+		}
+	}
+}
+
+func listen(ctx context.Context, t *testing.T, srv *httptest.Server, accept, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/v1.UfsService/Listen", strings.NewReader(body))
+	assert.NilError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.NilError(t, err)
+	return resp
+}
+
+func TestServerSentEvents(t *testing.T) {
+	svc := newTestService(t)
+	svc.Runner = idleRunner{}
+	srv := newTestGateway(t, svc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp := listen(ctx, t, srv, "text/event-stream", `{"name": "nope.1", "updates": true}`)
+	resp.Body.Close()
+	// errors before the first message are plain HTTP errors
+	assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+
+	code, out := post(t, srv, "/v1.UfsService/StartEngine", `{"metadata": {"owner": "alice"}, "engineYaml": "Y29tbWFuZDogWyJ0cnVlIl0K"}`)
+	assert.Equal(t, code, http.StatusOK, string(out))
+
+	resp = listen(ctx, t, srv, "text/event-stream", `{"name": "engine.1", "updates": true}`)
+	defer resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, resp.Header.Get("Content-Type"), "text/event-stream")
+
+	events := bufio.NewScanner(resp.Body)
+	nextData := func() string {
+		for events.Scan() {
+			if strings.HasPrefix(events.Text(), "data: ") {
+				return strings.TrimPrefix(events.Text(), "data: ")
+			}
+		}
+		t.Fatalf("stream ended: %v", events.Err())
+		return ""
+	}
+	var evt v1.ListenResponse
+	assert.NilError(t, protojson.Unmarshal([]byte(nextData()), &evt))
+	assert.Equal(t, evt.GetUpdate().GetName(), "engine.1")
+
+	code, out = post(t, srv, "/v1.UfsService/StopEngine", `{"name": "engine.1"}`)
+	assert.Equal(t, code, http.StatusOK, string(out))
+	assert.NilError(t, protojson.Unmarshal([]byte(nextData()), &evt))
+	assert.Equal(t, evt.GetUpdate().GetPhase(), v1.EnginePhase_PHASE_DONE)
+}
+
+func TestNDJSON(t *testing.T) {
+	srv := newTestGateway(t, newTestService(t))
+
+	// without a runner, the Engine is done right away
+	code, out := post(t, srv, "/v1.UfsService/StartEngine", `{"metadata": {"owner": "alice"}}`)
+	assert.Equal(t, code, http.StatusOK, string(out))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp := listen(ctx, t, srv, "", `{"name": "engine.1", "updates": true}`)
+	defer resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, resp.Header.Get("Content-Type"), "application/x-ndjson")
+
+	lines := bufio.NewScanner(resp.Body)
+	assert.Assert(t, lines.Scan(), lines.Err())
+	var evt v1.ListenResponse
+	assert.NilError(t, protojson.Unmarshal(lines.Bytes(), &evt))
+	assert.Equal(t, evt.GetUpdate().GetPhase(), v1.EnginePhase_PHASE_DONE)
+	// Listen ends once the Engine is done
+	assert.Assert(t, !lines.Scan())
+	assert.NilError(t, lines.Err())
+}
+
+// failingUI sends a single Engine spec before it fails
+type failingUI struct {
+	v1.UnimplementedUfsUIServer
+}
+
+func (failingUI) ListEngineSpecs(req *v1.ListEngineSpecsRequest, srv v1.UfsUI_ListEngineSpecsServer) error {
+	err := srv.Send(&v1.ListEngineSpecsResponse{Name: "backup"})
+	if err != nil {
+		return err
+	}
+	return status.Error(codes.Internal, "broken")
+}
+
+func TestStreamError(t *testing.T) {
+	l := NewPipeListener()
+	gs := grpc.NewServer()
+	v1.RegisterUfsUIServer(gs, failingUI{})
+	go gs.Serve(l)
+	t.Cleanup(gs.Stop)
+	conn, err := grpc.Dial("pipe", grpc.WithContextDialer(l.DialContext), grpc.WithInsecure())
+	assert.NilError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	srv := httptest.NewServer(New(conn, v1.File_ufs_ui_proto.Services().ByName("UfsUI")))
+	t.Cleanup(srv.Close)
+
+	// errors after the first message are sent in-band
+	code, out := post(t, srv, "/v1.UfsUI/ListEngineSpecs", ``)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, string(out), `{"name":"backup"}`+"\n"+`{"error":{"code":"Internal","message":"broken"}}`+"\n")
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/v1.UfsUI/ListEngineSpecs", nil)
+	assert.NilError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NilError(t, err)
+	defer resp.Body.Close()
+	out, err = io.ReadAll(resp.Body)
+	assert.NilError(t, err)
+	assert.Equal(t, string(out), `data: {"name":"backup"}`+"\n\n"+`event: error`+"\n"+`data: {"code":"Internal","message":"broken"}`+"\n\n")
+}
+
+func TestClientStream(t *testing.T) {
+	srv := newTestGateway(t, newTestService(t))
+
+	body := strings.Join([]string{
+		`{"metadata": {"owner": "alice", "engineSpecName": "backup"}}`,
+		`{"configYaml": "` + base64.StdEncoding.EncodeToString([]byte("defaultEngine: backup.yaml\n")) + `"}`,
+		`{"engineYaml": "` + base64.StdEncoding.EncodeToString([]byte("command: [\"true\"]\n")) + `"}`,
+		``,
+		`{"applicationTarDone": true}`,
+	}, "\n")
+	resp, err := http.Post(srv.URL+"/v1.UfsService/StartLocalEngine", "application/x-ndjson", strings.NewReader(body))
+	assert.NilError(t, err)
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	assert.NilError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK, string(out))
+
+	var start v1.StartEngineResponse
+	assert.NilError(t, protojson.Unmarshal(out, &start))
+	assert.Equal(t, start.Status.Name, "backup.1")
+
+	// errors of the service end the upload
+	code, out := postAs(t, srv, "/v1.UfsService/StartLocalEngine", "application/x-ndjson", `{"applicationTarDone": true}`)
+	assert.Check(t, is.Equal(code, http.StatusBadRequest), string(out))
+}
+
+func TestServerStreamUI(t *testing.T) {
+	srv := newTestGateway(t, newTestService(t))
+
+	code, out := post(t, srv, "/v1.UfsUI/ListEngineSpecs", ``)
+	assert.Equal(t, code, http.StatusOK, string(out))
+	// an empty stream is an empty body
+	assert.Equal(t, string(out), "")
+}
+
+func TestReadOnly(t *testing.T) {
+	svc := newTestService(t)
+	svc.ReadOnly = true
+	srv := newTestGateway(t, svc)
+
+	code, out := post(t, srv, "/v1.UfsUI/IsReadOnly", ``)
+	assert.Equal(t, code, http.StatusOK, string(out))
+	assert.Equal(t, string(out), `{"readonly":true}`)
+
+	code, out = post(t, srv, "/v1.UfsService/StartEngine", `{"metadata": {"owner": "alice"}}`)
+	assert.Check(t, is.Equal(code, http.StatusForbidden), string(out))
+	code, out = postAs(t, srv, "/v1.UfsService/StartLocalEngine", "application/x-ndjson", `{"metadata": {"owner": "alice"}}`)
+	assert.Check(t, is.Equal(code, http.StatusForbidden), string(out))
+}
+
+func TestForwardAuthorization(t *testing.T) {
+	var auth []string
+	srv := newTestGateway(t, newTestService(t), grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		auth = md.Get("authorization")
+		return handler(ctx, req)
+	}))
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/v1.UfsService/ListEngines", nil)
+	assert.NilError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.DeepEqual(t, auth, []string{"Bearer secret"})
+}
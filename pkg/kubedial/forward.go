@@ -0,0 +1,112 @@
+package kubedial
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// Forwarder forwards connections from a local port to a port of a pod
+type Forwarder interface {
+	// Forward listens on an OS-assigned port of the loopback interface and forwards connections
+	// to the port of the pod until ctx is done. It returns the local address once it listens.
+	// The returned channel is closed when forwarding stops, e.g. because the pod went away.
+	Forward(ctx context.Context, namespace, pod string, port int) (addr string, done <-chan struct{}, err error)
+}
+
+// PortForwarder forwards ports through the Kubernetes API server, like kubectl port-forward does
+type PortForwarder struct {
+	Client kubernetes.Interface
+	Config *rest.Config
+}
+
+// Forward forwards a local port to the port of the pod
+func (f *PortForwarder) Forward(ctx context.Context, namespace, pod string, port int) (addr string, done <-chan struct{}, err error) {
+	roundTripper, upgrader, err := spdy.RoundTripperFor(f.Config)
+	if err != nil {
+		return "", nil, err
+	}
+	url := f.Client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(pod).
+		SubResource("portforward").
+		URL()
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: roundTripper}, http.MethodPost, url)
+
+	var (
+		stop   = make(chan struct{})
+		ready  = make(chan struct{})
+		errOut = new(bytes.Buffer)
+	)
+	fwd, err := portforward.NewOnAddresses(dialer, []string{"127.0.0.1"}, []string{fmt.Sprintf("0:%d", port)}, stop, ready, io.Discard, errOut)
+	if err != nil {
+		return "", nil, err
+	}
+
+	forwarding := make(chan error, 1)
+	go func() {
+		forwarding <- fwd.ForwardPorts()
+	}()
+	select {
+	case <-ready:
+	case err := <-forwarding:
+		if err == nil {
+			err = fmt.Errorf("port-forward stopped: %s", strings.TrimSpace(errOut.String()))
+		}
+		return "", nil, err
+	case <-ctx.Done():
+		close(stop)
+		<-forwarding
+		return "", nil, ctx.Err()
+	}
+
+	ports, err := fwd.GetPorts()
+	if err != nil || len(ports) == 0 {
+		close(stop)
+		<-forwarding
+		return "", nil, fmt.Errorf("cannot determine forwarded port: %v", err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			close(stop)
+			<-forwarding
+		case err := <-forwarding:
+			log.WithError(err).WithField("pod", pod).Debug("port-forward stopped")
+		}
+	}()
+	return fmt.Sprintf("127.0.0.1:%d", ports[0].Local), stopped, nil
+}
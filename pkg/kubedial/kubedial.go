@@ -0,0 +1,419 @@
+package kubedial
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DefaultRetryInterval is how long a Dialer waits before it re-establishes a broken port-forward
+const DefaultRetryInterval = time.Second
+
+// Dialer connects to the Ready pods which match a label selector. It maintains a port-forward to
+// every Ready pod and spreads RPCs across them. Port-forwards follow the pods: when a pod stops
+// being Ready or restarts, its port-forward is replaced, and gRPC reconnects by itself.
+type Dialer struct {
+	Client    kubernetes.Interface
+	Forwarder Forwarder
+	Namespace string
+	Selector  string
+	Port      int
+	// RetryInterval defaults to DefaultRetryInterval
+	RetryInterval time.Duration
+}
+
+// Conn is a connection to the pods of a Dialer
+type Conn struct {
+	*grpc.ClientConn
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Close closes the connection and stops all port-forwards
+func (c *Conn) Close() error {
+	c.cancel()
+	<-c.done
+	return c.ClientConn.Close()
+}
+
+// Dial connects to the Ready pods. It returns once a port-forward to at least one of them is
+// established, or fails if there is no Ready pod, or if no port-forward could be established.
+func (d *Dialer) Dial(ctx context.Context, opts ...grpc.DialOption) (*Conn, error) {
+	pods, err := d.Client.CoreV1().Pods(d.Namespace).List(ctx, metav1.ListOptions{LabelSelector: d.Selector})
+	if err != nil {
+		return nil, err
+	}
+	var ready int
+	for i := range pods.Items {
+		if isReady(&pods.Items[i]) {
+			ready++
+		}
+	}
+	if ready == 0 {
+		return nil, fmt.Errorf("no Ready pod in %s matches %s", d.Namespace, d.Selector)
+	}
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	p := &pool{
+		Dialer:   d,
+		pods:     make(map[string]*corev1.Pod),
+		keepers:  make(map[string]*keeper),
+		addrs:    make(map[*keeper]string),
+		updates:  make(chan addrUpdate),
+		resolver: manual.NewBuilderWithScheme("kubedial"),
+		first:    make(chan error, 1),
+		failed:   make(map[*keeper]struct{}),
+	}
+	for i := range pods.Items {
+		p.pods[pods.Items[i].Name] = &pods.Items[i]
+	}
+	first := p.first
+	p.reconcile(runCtx)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.run(runCtx, pods.ResourceVersion)
+	}()
+
+	select {
+	case err = <-first:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		cancel()
+		<-done
+		return nil, err
+	}
+
+	// the resolver must not be updated before the connection uses it
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resolver.InitialState(p.state())
+	opts = append(opts,
+		grpc.WithResolvers(p.resolver),
+		grpc.WithDefaultServiceConfig(`{"loadBalancingConfig": [{"round_robin": {}}]}`),
+	)
+	cc, err := grpc.DialContext(ctx, p.resolver.Scheme()+":///"+d.Selector, opts...)
+	if err != nil {
+		cancel()
+		<-done
+		return nil, err
+	}
+	p.dialed = true
+
+	return &Conn{ClientConn: cc, cancel: cancel, done: done}, nil
+}
+
+// isReady returns true if the pod runs and is Ready to serve
+func isReady(pod *corev1.Pod) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase != corev1.PodRunning {
+		return false
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// addrUpdate reports the local address of a keeper's port-forward. An empty address means the
+// port-forward is down, for the reason given by Err.
+type addrUpdate struct {
+	Keeper *keeper
+	Addr   string
+	Err    error
+}
+
+// keeper keeps up the port-forward to a pod
+type keeper struct {
+	Pod    string
+	UID    types.UID
+	cancel context.CancelFunc
+}
+
+// pool tracks the pods of a Dialer and the port-forwards to them. All fields but the ones
+// guarded by mu are owned by the goroutine which runs the pool.
+type pool struct {
+	*Dialer
+
+	pods    map[string]*corev1.Pod
+	keepers map[string]*keeper
+	updates chan addrUpdate
+
+	// first receives the outcome of the first port-forwards: nil once one is established,
+	// or an error once all keepers failed to establish theirs
+	first   chan error
+	failed  map[*keeper]struct{}
+	lastErr error
+
+	mu       sync.Mutex
+	addrs    map[*keeper]string
+	resolver *manual.Resolver
+	dialed   bool
+}
+
+// run follows the pods until ctx is done
+func (p *pool) run(ctx context.Context, resourceVersion string) {
+	defer func() {
+		for _, k := range p.keepers {
+			k.cancel()
+		}
+	}()
+
+	for {
+		w, err := p.Client.CoreV1().Pods(p.Namespace).Watch(ctx, metav1.ListOptions{
+			LabelSelector:   p.Selector,
+			ResourceVersion: resourceVersion,
+		})
+		if err == nil {
+			resourceVersion = p.follow(ctx, w)
+		} else {
+			log.WithError(err).Debug("cannot watch pods")
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		// the watch ended, e.g. because it timed out: we start over with the current set of pods
+		if !p.wait(ctx, p.retryInterval()) {
+			return
+		}
+		pods, err := p.Client.CoreV1().Pods(p.Namespace).List(ctx, metav1.ListOptions{LabelSelector: p.Selector})
+		if err != nil {
+			log.WithError(err).Debug("cannot list pods")
+			resourceVersion = ""
+			continue
+		}
+		p.pods = make(map[string]*corev1.Pod, len(pods.Items))
+		for i := range pods.Items {
+			p.pods[pods.Items[i].Name] = &pods.Items[i]
+		}
+		resourceVersion = pods.ResourceVersion
+		p.reconcile(ctx)
+	}
+}
+
+// follow applies pod events until the watch ends and returns the last resource version it saw
+func (p *pool) follow(ctx context.Context, w watch.Interface) (resourceVersion string) {
+	defer w.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case u := <-p.updates:
+			p.apply(u)
+		case evt, ok := <-w.ResultChan():
+			if !ok {
+				return
+			}
+			pod, ok := evt.Object.(*corev1.Pod)
+			if !ok {
+				// most likely an error, after which the watch ends
+				continue
+			}
+			resourceVersion = pod.ResourceVersion
+			if evt.Type == watch.Deleted {
+				delete(p.pods, pod.Name)
+			} else {
+				p.pods[pod.Name] = pod
+			}
+			p.reconcile(ctx)
+		}
+	}
+}
+
+// wait waits for the duration while applying address updates, and returns false if ctx is done
+func (p *pool) wait(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-t.C:
+			return true
+		case u := <-p.updates:
+			p.apply(u)
+		}
+	}
+}
+
+// reconcile makes sure there is a keeper for every Ready pod, and for no other pod
+func (p *pool) reconcile(ctx context.Context) {
+	for name, k := range p.keepers {
+		pod, ok := p.pods[name]
+		if ok && pod.UID == k.UID && isReady(pod) {
+			continue
+		}
+		log.WithField("pod", name).Debug("pod is no longer Ready - stopping port-forward")
+		k.cancel()
+		delete(p.keepers, name)
+		delete(p.failed, k)
+		p.setAddr(k, "")
+	}
+	for name, pod := range p.pods {
+		if _, ok := p.keepers[name]; ok || !isReady(pod) {
+			continue
+		}
+		kctx, cancel := context.WithCancel(ctx)
+		k := &keeper{Pod: name, UID: pod.UID, cancel: cancel}
+		p.keepers[name] = k
+		go p.keep(kctx, k)
+	}
+	// the keepers which were removed will never report
+	p.failFirst()
+}
+
+// keep establishes the port-forward of a keeper, and re-establishes it whenever it breaks
+func (p *pool) keep(ctx context.Context, k *keeper) {
+	for {
+		addr, done, err := p.Forwarder.Forward(ctx, p.Namespace, k.Pod, p.Port)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			log.WithField("pod", k.Pod).WithField("addr", addr).Debug("port-forward established")
+		} else {
+			log.WithError(err).WithField("pod", k.Pod).Debug("cannot establish port-forward")
+		}
+		select {
+		case p.updates <- addrUpdate{Keeper: k, Addr: addr, Err: err}:
+		case <-ctx.Done():
+			return
+		}
+
+		if err == nil {
+			select {
+			case <-done:
+				log.WithField("pod", k.Pod).Debug("port-forward broke")
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case p.updates <- addrUpdate{Keeper: k}:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-time.After(p.retryInterval()):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// apply records the address of a keeper's port-forward, unless the keeper has been stopped
+func (p *pool) apply(u addrUpdate) {
+	if p.keepers[u.Keeper.Pod] != u.Keeper {
+		return
+	}
+
+	if p.first != nil {
+		if u.Err == nil {
+			p.first <- nil
+			p.first = nil
+		} else {
+			p.failed[u.Keeper] = struct{}{}
+			p.lastErr = fmt.Errorf("cannot establish port-forward: %w", u.Err)
+			p.failFirst()
+		}
+	}
+	p.setAddr(u.Keeper, u.Addr)
+}
+
+// failFirst fails the first port-forwards once every keeper failed to establish its port-forward,
+// or if there is no keeper left
+func (p *pool) failFirst() {
+	if p.first == nil {
+		return
+	}
+	for _, k := range p.keepers {
+		if _, failed := p.failed[k]; !failed {
+			return
+		}
+	}
+	err := p.lastErr
+	if len(p.keepers) == 0 || err == nil {
+		err = fmt.Errorf("no Ready pod in %s matches %s", p.Namespace, p.Selector)
+	}
+	p.first <- err
+	p.first = nil
+}
+
+// setAddr updates the address of a keeper and passes all addresses on to gRPC
+func (p *pool) setAddr(k *keeper, addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.addrs[k] == addr {
+		return
+	}
+	if addr == "" {
+		delete(p.addrs, k)
+	} else {
+		p.addrs[k] = addr
+	}
+	if p.dialed {
+		p.resolver.UpdateState(p.state())
+	}
+}
+
+// state produces the resolver state from the addresses of all port-forwards. Callers must hold p.mu.
+func (p *pool) state() resolver.State {
+	addrs := make([]string, 0, len(p.addrs))
+	for _, a := range p.addrs {
+		addrs = append(addrs, a)
+	}
+	sort.Strings(addrs)
+
+	res := resolver.State{Addresses: make([]resolver.Address, 0, len(addrs))}
+	for _, a := range addrs {
+		res.Addresses = append(res.Addresses, resolver.Address{Addr: a})
+	}
+	return res
+}
+
+func (p *pool) retryInterval() time.Duration {
+	if p.RetryInterval == 0 {
+		return DefaultRetryInterval
+	}
+	return p.RetryInterval
+}
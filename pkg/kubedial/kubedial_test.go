@@ -0,0 +1,354 @@
+package kubedial
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"google.golang.org/grpc"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	testNamespace = "ufs"
+	testSelector  = "app.kubernetes.io/name=ufs"
+)
+
+// podServer answers GetEngine with the name it was given, so that tests can tell which pod served an RPC
+type podServer struct {
+	v1.UnimplementedUfsServiceServer
+	Name string
+}
+
+func (s *podServer) GetEngine(ctx context.Context, req *v1.GetEngineRequest) (*v1.GetEngineResponse, error) {
+	return &v1.GetEngineResponse{Result: &v1.EngineStatus{Name: s.Name}}, nil
+}
+
+func startPodServer(t *testing.T, name string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	srv := grpc.NewServer()
+	v1.RegisterUfsServiceServer(srv, &podServer{Name: name})
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	return l.Addr().String()
+}
+
+// inProcessForwarder forwards ports to gRPC servers in the test process instead of pods
+type inProcessForwarder struct {
+	mu       sync.Mutex
+	backends map[string]string
+	breaks   map[string]chan struct{}
+}
+
+func newInProcessForwarder() *inProcessForwarder {
+	return &inProcessForwarder{
+		backends: make(map[string]string),
+		breaks:   make(map[string]chan struct{}),
+	}
+}
+
+// SetBackend makes a pod's port-forwards lead to addr from now on
+func (f *inProcessForwarder) SetBackend(pod, addr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.backends[pod] = addr
+}
+
+// Break breaks the current port-forward to a pod
+func (f *inProcessForwarder) Break(pod string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if brk, ok := f.breaks[pod]; ok {
+		close(brk)
+		delete(f.breaks, pod)
+	}
+}
+
+func (f *inProcessForwarder) Forward(ctx context.Context, namespace, pod string, port int) (string, <-chan struct{}, error) {
+	f.mu.Lock()
+	backend, ok := f.backends[pod]
+	brk := make(chan struct{})
+	f.breaks[pod] = brk
+	f.mu.Unlock()
+	if !ok {
+		return "", nil, fmt.Errorf("pod %s does not listen on %d", pod, port)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+
+	var (
+		mu    sync.Mutex
+		conns []net.Conn
+	)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", backend)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			mu.Lock()
+			conns = append(conns, conn, upstream)
+			mu.Unlock()
+			go io.Copy(conn, upstream)
+			go io.Copy(upstream, conn)
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-brk:
+		}
+		l.Close()
+		mu.Lock()
+		for _, c := range conns {
+			c.Close()
+		}
+		mu.Unlock()
+		close(done)
+	}()
+	return l.Addr().String(), done, nil
+}
+
+func newPod(name string, ready bool) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			UID:       types.UID(name),
+			Labels:    map[string]string{"app.kubernetes.io/name": "ufs"},
+		},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+		},
+	}
+}
+
+func setReady(t *testing.T, client *fake.Clientset, name string, ready bool) {
+	_, err := client.CoreV1().Pods(testNamespace).UpdateStatus(context.Background(), newPod(name, ready), metav1.UpdateOptions{})
+	assert.NilError(t, err)
+}
+
+func newDialer(client *fake.Clientset, fwd Forwarder) *Dialer {
+	return &Dialer{
+		Client:        client,
+		Forwarder:     fwd,
+		Namespace:     testNamespace,
+		Selector:      testSelector,
+		Port:          7777,
+		RetryInterval: 10 * time.Millisecond,
+	}
+}
+
+// servedBy returns the name of the pod which served a GetEngine call
+func servedBy(conn grpc.ClientConnInterface) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := v1.NewUfsServiceClient(conn).GetEngine(ctx, &v1.GetEngineRequest{})
+	if err != nil {
+		return "", err
+	}
+	return resp.Result.Name, nil
+}
+
+func waitForServer(t *testing.T, conn grpc.ClientConnInterface, name string) {
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		act, err := servedBy(conn)
+		if err != nil {
+			return poll.Continue("RPC failed: %v", err)
+		}
+		if act != name {
+			return poll.Continue("served by %s instead of %s", act, name)
+		}
+		return poll.Success()
+	}, poll.WithTimeout(10*time.Second), poll.WithDelay(10*time.Millisecond))
+}
+
+func TestDialBalancesReadyPods(t *testing.T) {
+	client := fake.NewSimpleClientset(newPod("a", true), newPod("b", true), newPod("c", false))
+	fwd := newInProcessForwarder()
+	for _, name := range []string{"a", "b", "c"} {
+		fwd.SetBackend(name, startPodServer(t, name))
+	}
+
+	conn, err := newDialer(client, fwd).Dial(context.Background(), grpc.WithInsecure())
+	assert.NilError(t, err)
+	defer conn.Close()
+
+	seen := make(map[string]int)
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		name, err := servedBy(conn)
+		if err != nil {
+			return poll.Error(err)
+		}
+		seen[name]++
+		if seen["a"] == 0 || seen["b"] == 0 {
+			return poll.Continue("not all Ready pods served an RPC yet: %v", seen)
+		}
+		return poll.Success()
+	}, poll.WithTimeout(10*time.Second), poll.WithDelay(time.Millisecond))
+	assert.Equal(t, seen["c"], 0, "a pod which is not Ready served an RPC")
+}
+
+func TestDialNoReadyPod(t *testing.T) {
+	client := fake.NewSimpleClientset(newPod("a", false))
+	_, err := newDialer(client, newInProcessForwarder()).Dial(context.Background(), grpc.WithInsecure())
+	assert.ErrorContains(t, err, "no Ready pod")
+}
+
+func TestDialForwardFails(t *testing.T) {
+	client := fake.NewSimpleClientset(newPod("a", true))
+	_, err := newDialer(client, newInProcessForwarder()).Dial(context.Background(), grpc.WithInsecure())
+	assert.ErrorContains(t, err, "cannot establish port-forward")
+}
+
+// stuckForwarder never establishes the port-forward to one pod
+type stuckForwarder struct {
+	Forwarder
+	Pod    string
+	called chan struct{}
+}
+
+func (f *stuckForwarder) Forward(ctx context.Context, namespace, pod string, port int) (string, <-chan struct{}, error) {
+	if pod != f.Pod {
+		return f.Forwarder.Forward(ctx, namespace, pod, port)
+	}
+	select {
+	case f.called <- struct{}{}:
+	default:
+	}
+	<-ctx.Done()
+	return "", nil, ctx.Err()
+}
+
+func TestDialPodStopsBeingReady(t *testing.T) {
+	client := fake.NewSimpleClientset(newPod("a", true), newPod("b", true))
+	fwd := &stuckForwarder{Forwarder: newInProcessForwarder(), Pod: "b", called: make(chan struct{}, 1)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dialed := make(chan error, 1)
+	go func() {
+		_, err := newDialer(client, fwd).Dial(ctx, grpc.WithInsecure())
+		dialed <- err
+	}()
+
+	// a cannot be forwarded to, and b stops being Ready while its port-forward is pending
+	<-fwd.called
+	var err error
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		setReady(t, client, "b", false)
+		select {
+		case err = <-dialed:
+			return poll.Success()
+		default:
+			return poll.Continue("Dial did not return")
+		}
+	}, poll.WithTimeout(5*time.Second), poll.WithDelay(10*time.Millisecond))
+	assert.ErrorContains(t, err, "cannot establish port-forward")
+}
+
+func TestDialReconnects(t *testing.T) {
+	client := fake.NewSimpleClientset(newPod("a", true))
+	fwd := newInProcessForwarder()
+	fwd.SetBackend("a", startPodServer(t, "a"))
+
+	conn, err := newDialer(client, fwd).Dial(context.Background(), grpc.WithInsecure())
+	assert.NilError(t, err)
+	defer conn.Close()
+	waitForServer(t, conn, "a")
+
+	// the pod restarts: it stops being Ready, and serves from a new process once it is Ready again
+	setReady(t, client, "a", false)
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		if _, err := servedBy(conn); err == nil {
+			return poll.Continue("pod which is not Ready still serves RPCs")
+		}
+		return poll.Success()
+	}, poll.WithTimeout(10*time.Second), poll.WithDelay(10*time.Millisecond))
+	fwd.SetBackend("a", startPodServer(t, "a restarted"))
+	setReady(t, client, "a", true)
+	waitForServer(t, conn, "a restarted")
+
+	// the port-forward breaks without the pod changing
+	fwd.SetBackend("a", startPodServer(t, "a forwarded again"))
+	fwd.Break("a")
+	waitForServer(t, conn, "a forwarded again")
+}
+
+func TestDialFollowsNewPods(t *testing.T) {
+	client := fake.NewSimpleClientset(newPod("a", true))
+	fwd := newInProcessForwarder()
+	fwd.SetBackend("a", startPodServer(t, "a"))
+	fwd.SetBackend("b", startPodServer(t, "b"))
+
+	conn, err := newDialer(client, fwd).Dial(context.Background(), grpc.WithInsecure())
+	assert.NilError(t, err)
+	defer conn.Close()
+	waitForServer(t, conn, "a")
+
+	_, err = client.CoreV1().Pods(testNamespace).Create(context.Background(), newPod("b", true), metav1.CreateOptions{})
+	assert.NilError(t, err)
+	err = client.CoreV1().Pods(testNamespace).Delete(context.Background(), "a", metav1.DeleteOptions{})
+	assert.NilError(t, err)
+
+	// once the deleted pod is gone, all RPCs go to the new one
+	var run int
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		name, err := servedBy(conn)
+		if err != nil || name != "b" {
+			run = 0
+			return poll.Continue("served by %q: %v", name, err)
+		}
+		run++
+		if run < 10 {
+			return poll.Continue("%d consecutive RPCs served by b", run)
+		}
+		return poll.Success()
+	}, poll.WithTimeout(10*time.Second), poll.WithDelay(time.Millisecond))
+}
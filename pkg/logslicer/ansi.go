@@ -0,0 +1,219 @@
+package logslicer
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// sgrRegexp matches ANSI escape sequences. Only SGR sequences (ending in "m") are rendered,
+// all other control sequences are dropped.
+var sgrRegexp = regexp.MustCompile(`\x1b\[([0-9;]*)([A-Za-z])`)
+
+var ansiColors = []string{
+	"#000000", "#cd3131", "#0dbc79", "#e5e510", "#2472c8", "#bc3fbc", "#11a8cd", "#e5e5e5",
+	"#666666", "#f14c4c", "#23d18b", "#f5f543", "#3b8eea", "#d670d6", "#29b8db", "#ffffff",
+}
+
+type sgrState struct {
+	bold      bool
+	italic    bool
+	underline bool
+	fg        string
+	bg        string
+}
+
+func (s sgrState) style() string {
+	var res []string
+	if s.bold {
+		res = append(res, "font-weight:bold")
+	}
+	if s.italic {
+		res = append(res, "font-style:italic")
+	}
+	if s.underline {
+		res = append(res, "text-decoration:underline")
+	}
+	if s.fg != "" {
+		res = append(res, "color:"+s.fg)
+	}
+	if s.bg != "" {
+		res = append(res, "background-color:"+s.bg)
+	}
+	return strings.Join(res, ";")
+}
+
+// apply updates the state with the SGR parameters of a single escape sequence
+func (s *sgrState) apply(params string) {
+	if params == "" {
+		*s = sgrState{}
+		return
+	}
+
+	codes := strings.Split(params, ";")
+	for i := 0; i < len(codes); i++ {
+		code, err := strconv.Atoi(codes[i])
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case code == 0:
+			*s = sgrState{}
+		case code == 1:
+			s.bold = true
+		case code == 3:
+			s.italic = true
+		case code == 4:
+			s.underline = true
+		case code == 22:
+			s.bold = false
+		case code == 23:
+			s.italic = false
+		case code == 24:
+			s.underline = false
+		case code >= 30 && code <= 37:
+			s.fg = ansiColors[code-30]
+		case code >= 90 && code <= 97:
+			s.fg = ansiColors[code-90+8]
+		case code == 39:
+			s.fg = ""
+		case code >= 40 && code <= 47:
+			s.bg = ansiColors[code-40]
+		case code >= 100 && code <= 107:
+			s.bg = ansiColors[code-100+8]
+		case code == 49:
+			s.bg = ""
+		case code == 38 || code == 48:
+			color, n := extendedColor(codes[i+1:])
+			i += n
+			if color == "" {
+				continue
+			}
+			if code == 38 {
+				s.fg = color
+			} else {
+				s.bg = color
+			}
+		}
+	}
+}
+
+// extendedColor parses the 256-colour (5;n) and true-colour (2;r;g;b) forms following a 38 or 48 code.
+// It returns the colour and the number of parameters it consumed.
+func extendedColor(params []string) (color string, consumed int) {
+	if len(params) == 0 {
+		return "", 0
+	}
+
+	num := func(s string) (int, bool) {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 0 || v > 255 {
+			return 0, false
+		}
+		return v, true
+	}
+
+	switch params[0] {
+	case "5":
+		if len(params) < 2 {
+			return "", len(params)
+		}
+		n, ok := num(params[1])
+		if !ok {
+			return "", 2
+		}
+		return xterm256(n), 2
+	case "2":
+		if len(params) < 4 {
+			return "", len(params)
+		}
+		r, rok := num(params[1])
+		g, gok := num(params[2])
+		b, bok := num(params[3])
+		if !rok || !gok || !bok {
+			return "", 4
+		}
+		return fmt.Sprintf("#%02x%02x%02x", r, g, b), 4
+	}
+	return "", 1
+}
+
+func xterm256(n int) string {
+	switch {
+	case n < 16:
+		return ansiColors[n]
+	case n < 232:
+		n -= 16
+		steps := []int{0, 95, 135, 175, 215, 255}
+		return fmt.Sprintf("#%02x%02x%02x", steps[n/36], steps[(n/6)%6], steps[n%6])
+	default:
+		v := 8 + (n-232)*10
+		return fmt.Sprintf("#%02x%02x%02x", v, v, v)
+	}
+}
+
+// ToHTML renders ANSI colour and style sequences as HTML spans with inline styles.
+// All text is HTML-escaped and unsupported escape sequences are removed.
+func ToHTML(in string) string {
+	var (
+		res   strings.Builder
+		state sgrState
+		open  bool
+	)
+	writeText := func(txt string) {
+		if txt == "" {
+			return
+		}
+		if !open {
+			if style := state.style(); style != "" {
+				res.WriteString(`<span style="` + style + `">`)
+				open = true
+			}
+		}
+		res.WriteString(html.EscapeString(txt))
+	}
+
+	var pos int
+	for _, m := range sgrRegexp.FindAllStringSubmatchIndex(in, -1) {
+		writeText(in[pos:m[0]])
+		pos = m[1]
+
+		if in[m[4]:m[5]] != "m" {
+			continue
+		}
+		if open {
+			res.WriteString("</span>")
+			open = false
+		}
+		state.apply(in[m[2]:m[3]])
+	}
+	writeText(in[pos:])
+	if open {
+		res.WriteString("</span>")
+	}
+
+	return res.String()
+}
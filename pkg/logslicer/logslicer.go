@@ -0,0 +1,194 @@
+package logslicer
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Engines mark their log output to structure it into slices. A marker precedes the
+// line content and names the slice, optionally followed by a verb:
+//
+//	[build] compiling sources          content of the "build" slice - the first line starts the slice
+//	[build|PHASE] Building storage     the Engine entered a new phase
+//	[build|DONE]                       the "build" slice finished successfully
+//	[build|FAIL] compiler error        the "build" slice failed
+//	[url|RESULT] https://example.com   the Engine produced a result
+//
+// The payload of a RESULT line is either a JSON-encoded EngineResult, or plain text in
+// which case the slice name is the result type. Lines without a marker are content of
+// the unnamed slice.
+var markerRegexp = regexp.MustCompile(`^\[([\w.\-]+)(?:\|(PHASE|DONE|FAIL|RESULT))?\] ?(.*)$`)
+
+// maxLineLength is the length after which a line is split into multiple events
+const maxLineLength = 64 << 10
+
+// Slicer turns raw Engine log output into log slice events
+type Slicer interface {
+	// Slice reads the log until EOF and emits the events it produces. Once the log is read,
+	// all slices which have started but not finished are marked as abandoned. Both channels
+	// are closed when slicing ends.
+	Slice(in io.Reader) (events <-chan *v1.LogSliceEvent, errchan <-chan error)
+}
+
+// DefaultSlicer slices logs using the marker syntax
+var DefaultSlicer Slicer = defaultSlicer{}
+
+type defaultSlicer struct{}
+
+// Slice reads the log until EOF and emits the events it produces
+func (defaultSlicer) Slice(in io.Reader) (<-chan *v1.LogSliceEvent, <-chan error) {
+	var (
+		events  = make(chan *v1.LogSliceEvent)
+		errchan = make(chan error, 1)
+	)
+	go func() {
+		defer close(events)
+		defer close(errchan)
+
+		var (
+			sl = &slicer{open: make(map[string]bool)}
+			r  = bufio.NewReader(in)
+		)
+		for {
+			line, err := ReadLine(r)
+			if line != "" || err == nil {
+				for _, evt := range sl.Line(line) {
+					events <- evt
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				errchan <- err
+				return
+			}
+		}
+		for _, evt := range sl.Abandon() {
+			events <- evt
+		}
+	}()
+	return events, errchan
+}
+
+// ReadLine reads a single line without its line ending. Lines longer than 64 KiB are split
+// and returned by consecutive calls.
+func ReadLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		frag, isPrefix, err := r.ReadLine()
+		line = append(line, frag...)
+		if err != nil {
+			return string(line), err
+		}
+		if !isPrefix || len(line) >= maxLineLength {
+			return string(line), nil
+		}
+	}
+}
+
+type slicer struct {
+	open  map[string]bool
+	order []string
+}
+
+// Line produces the events of a single log line
+func (s *slicer) Line(line string) []*v1.LogSliceEvent {
+	m := markerRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return []*v1.LogSliceEvent{{Type: v1.LogSliceType_SLICE_CONTENT, Payload: line}}
+	}
+
+	name, verb, payload := m[1], m[2], m[3]
+	switch verb {
+	case "PHASE":
+		return []*v1.LogSliceEvent{{Name: name, Type: v1.LogSliceType_SLICE_PHASE, Payload: payload}}
+	case "RESULT":
+		return []*v1.LogSliceEvent{{Name: name, Type: v1.LogSliceType_SLICE_RESULT, Payload: payload}}
+	case "DONE":
+		s.finish(name)
+		return []*v1.LogSliceEvent{{Name: name, Type: v1.LogSliceType_SLICE_DONE}}
+	case "FAIL":
+		s.finish(name)
+		return []*v1.LogSliceEvent{{Name: name, Type: v1.LogSliceType_SLICE_FAIL, Payload: payload}}
+	}
+
+	var res []*v1.LogSliceEvent
+	if !s.open[name] {
+		s.open[name] = true
+		s.order = append(s.order, name)
+		res = append(res, &v1.LogSliceEvent{Name: name, Type: v1.LogSliceType_SLICE_START})
+	}
+	return append(res, &v1.LogSliceEvent{Name: name, Type: v1.LogSliceType_SLICE_CONTENT, Payload: payload})
+}
+
+func (s *slicer) finish(name string) {
+	if !s.open[name] {
+		return
+	}
+	delete(s.open, name)
+	for i, n := range s.order {
+		if n == name {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Abandon produces events for all slices which have not finished, in the order they started
+func (s *slicer) Abandon() []*v1.LogSliceEvent {
+	res := make([]*v1.LogSliceEvent, 0, len(s.order))
+	for _, name := range s.order {
+		res = append(res, &v1.LogSliceEvent{Name: name, Type: v1.LogSliceType_SLICE_ABANDONED})
+	}
+	s.open = make(map[string]bool)
+	s.order = nil
+	return res
+}
+
+// ParseResult extracts the Engine result from a SLICE_RESULT event
+func ParseResult(evt *v1.LogSliceEvent) (*v1.EngineResult, error) {
+	if evt.Type != v1.LogSliceType_SLICE_RESULT {
+		return nil, fmt.Errorf("%s is not a result event", evt.Type)
+	}
+
+	payload := strings.TrimSpace(evt.Payload)
+	if strings.HasPrefix(payload, "{") {
+		var res v1.EngineResult
+		if err := protojson.Unmarshal([]byte(payload), &res); err != nil {
+			return nil, fmt.Errorf("invalid result: %w", err)
+		}
+		if res.Type == "" {
+			res.Type = evt.Name
+		}
+		return &res, nil
+	}
+
+	return &v1.EngineResult{Type: evt.Name, Payload: payload}, nil
+}
@@ -0,0 +1,197 @@
+package logslicer
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"strings"
+	"testing"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSlice(t *testing.T) {
+	tests := []struct {
+		Name        string
+		Input       string
+		Expectation []*v1.LogSliceEvent
+	}{
+		{
+			Name:  "unmarked",
+			Input: "hello\nworld",
+			Expectation: []*v1.LogSliceEvent{
+				{Type: v1.LogSliceType_SLICE_CONTENT, Payload: "hello"},
+				{Type: v1.LogSliceType_SLICE_CONTENT, Payload: "world"},
+			},
+		},
+		{
+			Name:  "complete slice",
+			Input: "[build|PHASE] Building\n[build] compiling\n[build] linking\n[build|DONE]\n",
+			Expectation: []*v1.LogSliceEvent{
+				{Name: "build", Type: v1.LogSliceType_SLICE_PHASE, Payload: "Building"},
+				{Name: "build", Type: v1.LogSliceType_SLICE_START},
+				{Name: "build", Type: v1.LogSliceType_SLICE_CONTENT, Payload: "compiling"},
+				{Name: "build", Type: v1.LogSliceType_SLICE_CONTENT, Payload: "linking"},
+				{Name: "build", Type: v1.LogSliceType_SLICE_DONE},
+			},
+		},
+		{
+			Name:  "failed slice",
+			Input: "[test] running\n[test|FAIL] 2 tests failed\n",
+			Expectation: []*v1.LogSliceEvent{
+				{Name: "test", Type: v1.LogSliceType_SLICE_START},
+				{Name: "test", Type: v1.LogSliceType_SLICE_CONTENT, Payload: "running"},
+				{Name: "test", Type: v1.LogSliceType_SLICE_FAIL, Payload: "2 tests failed"},
+			},
+		},
+		{
+			Name:  "result",
+			Input: "[url|RESULT] https://example.com\n",
+			Expectation: []*v1.LogSliceEvent{
+				{Name: "url", Type: v1.LogSliceType_SLICE_RESULT, Payload: "https://example.com"},
+			},
+		},
+		{
+			Name:  "abandoned",
+			Input: "[a] one\n[b] two\n[c] three\n[b|DONE]\n",
+			Expectation: []*v1.LogSliceEvent{
+				{Name: "a", Type: v1.LogSliceType_SLICE_START},
+				{Name: "a", Type: v1.LogSliceType_SLICE_CONTENT, Payload: "one"},
+				{Name: "b", Type: v1.LogSliceType_SLICE_START},
+				{Name: "b", Type: v1.LogSliceType_SLICE_CONTENT, Payload: "two"},
+				{Name: "c", Type: v1.LogSliceType_SLICE_START},
+				{Name: "c", Type: v1.LogSliceType_SLICE_CONTENT, Payload: "three"},
+				{Name: "b", Type: v1.LogSliceType_SLICE_DONE},
+				{Name: "a", Type: v1.LogSliceType_SLICE_ABANDONED},
+				{Name: "c", Type: v1.LogSliceType_SLICE_ABANDONED},
+			},
+		},
+		{
+			Name:  "unknown verb",
+			Input: "[a|WHAT] is this\n",
+			Expectation: []*v1.LogSliceEvent{
+				{Type: v1.LogSliceType_SLICE_CONTENT, Payload: "[a|WHAT] is this"},
+			},
+		},
+		{
+			Name:  "windows line endings",
+			Input: "[a] one\r\n",
+			Expectation: []*v1.LogSliceEvent{
+				{Name: "a", Type: v1.LogSliceType_SLICE_START},
+				{Name: "a", Type: v1.LogSliceType_SLICE_CONTENT, Payload: "one"},
+				{Name: "a", Type: v1.LogSliceType_SLICE_ABANDONED},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			evts, errchan := DefaultSlicer.Slice(strings.NewReader(test.Input))
+
+			var act []*v1.LogSliceEvent
+			for evt := range evts {
+				act = append(act, evt)
+			}
+			if err := <-errchan; err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(act) != len(test.Expectation) {
+				t.Fatalf("got %d events, want %d: %v", len(act), len(test.Expectation), act)
+			}
+			for i := range act {
+				if !proto.Equal(act[i], test.Expectation[i]) {
+					t.Errorf("event %d: got %v, want %v", i, act[i], test.Expectation[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseResult(t *testing.T) {
+	tests := []struct {
+		Name        string
+		Event       *v1.LogSliceEvent
+		Expectation *v1.EngineResult
+		Error       bool
+	}{
+		{
+			Name:        "plain text",
+			Event:       &v1.LogSliceEvent{Name: "url", Type: v1.LogSliceType_SLICE_RESULT, Payload: " https://example.com "},
+			Expectation: &v1.EngineResult{Type: "url", Payload: "https://example.com"},
+		},
+		{
+			Name:        "json",
+			Event:       &v1.LogSliceEvent{Name: "url", Type: v1.LogSliceType_SLICE_RESULT, Payload: `{"payload":"https://example.com","description":"preview","channels":["slack"]}`},
+			Expectation: &v1.EngineResult{Type: "url", Payload: "https://example.com", Description: "preview", Channels: []string{"slack"}},
+		},
+		{
+			Name:  "invalid json",
+			Event: &v1.LogSliceEvent{Name: "url", Type: v1.LogSliceType_SLICE_RESULT, Payload: `{"payload":`},
+			Error: true,
+		},
+		{
+			Name:  "not a result",
+			Event: &v1.LogSliceEvent{Name: "url", Type: v1.LogSliceType_SLICE_CONTENT},
+			Error: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			act, err := ParseResult(test.Event)
+			if test.Error {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !proto.Equal(act, test.Expectation) {
+				t.Errorf("got %v, want %v", act, test.Expectation)
+			}
+		})
+	}
+}
+
+func TestToHTML(t *testing.T) {
+	tests := []struct {
+		Input       string
+		Expectation string
+	}{
+		{"plain", "plain"},
+		{"<b>&", "&lt;b&gt;&amp;"},
+		{"\x1b[31mred\x1b[0m text", `<span style="color:#cd3131">red</span> text`},
+		{"\x1b[1;92mok\x1b[m", `<span style="font-weight:bold;color:#23d18b">ok</span>`},
+		{"\x1b[38;5;196mx\x1b[39m", `<span style="color:#ff0000">x</span>`},
+		{"\x1b[38;2;1;2;3;48;5;232mx", `<span style="color:#010203;background-color:#080808">x</span>`},
+		{"\x1b[4mu\x1b[24m n", `<span style="text-decoration:underline">u</span> n`},
+		{"\x1b[2Kcleared", "cleared"},
+	}
+
+	for _, test := range tests {
+		if act := ToHTML(test.Input); act != test.Expectation {
+			t.Errorf("ToHTML(%q) = %q, want %q", test.Input, act, test.Expectation)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package probe
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// DefaultTimeout bounds each readiness check unless Probes configure otherwise
+const DefaultTimeout = 5 * time.Second
+
+// errNotReady is reported while the server is starting up or shutting down
+var errNotReady = fmt.Errorf("not ready")
+
+// Check returns an error if a dependency of the server cannot be used
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	Name  string
+	Check Check
+}
+
+// Probes answers the liveness and readiness probes of Kubernetes. The server is live as long
+// as it answers at all, and ready once it was marked ready and all checks pass.
+type Probes struct {
+	// Timeout bounds each check. Defaults to DefaultTimeout.
+	Timeout time.Duration
+	// Health, if set, reports the serving status of all gRPC services as the server is marked ready
+	Health *health.Server
+
+	mu     sync.RWMutex
+	ready  bool
+	checks []namedCheck
+}
+
+// AddCheck adds a check which must pass for the server to be ready
+func (p *Probes) AddCheck(name string, check Check) {
+	p.mu.Lock()
+	p.checks = append(p.checks, namedCheck{Name: name, Check: check})
+	p.mu.Unlock()
+}
+
+// SetReady marks the server ready once it serves requests, and not ready once it shuts down
+func (p *Probes) SetReady(ready bool) {
+	p.mu.Lock()
+	p.ready = ready
+	p.mu.Unlock()
+
+	if p.Health == nil {
+		return
+	}
+	if ready {
+		p.Health.Resume()
+	} else {
+		p.Health.Shutdown()
+	}
+}
+
+// Ready returns an error if the server is not ready or one of its checks fails
+func (p *Probes) Ready(ctx context.Context) error {
+	p.mu.RLock()
+	ready := p.ready
+	checks := p.checks
+	p.mu.RUnlock()
+	if !ready {
+		return errNotReady
+	}
+
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	for _, c := range checks {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		err := c.Check(ctx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.Name, err)
+		}
+	}
+	return nil
+}
+
+// LivenessHandler answers liveness probes
+func (p *Probes) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// ReadinessHandler answers readiness probes. Servers which are not ready respond with
+// 503 Service Unavailable and the reason.
+func (p *Probes) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := p.Ready(r.Context()); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// NewHealthServer creates a gRPC health server which reports the given services as not
+// serving until the server is marked ready
+func NewHealthServer(services ...string) *health.Server {
+	hs := health.NewServer()
+	for _, s := range append([]string{""}, services...) {
+		hs.SetServingStatus(s, healthpb.HealthCheckResponse_SERVING)
+	}
+	hs.Shutdown()
+	return hs
+}
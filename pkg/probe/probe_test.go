@@ -0,0 +1,76 @@
+package probe
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"gotest.tools/v3/assert"
+)
+
+func probe(t *testing.T, h http.Handler) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	return rec.Code, strings.TrimSpace(rec.Body.String())
+}
+
+func TestProbes(t *testing.T) {
+	p := &Probes{Health: NewHealthServer("v1.UfsService")}
+	servingStatus := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		resp, err := p.Health.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		assert.NilError(t, err)
+		return resp.Status
+	}
+
+	code, _ := probe(t, p.LivenessHandler())
+	assert.Equal(t, code, http.StatusOK)
+	code, body := probe(t, p.ReadinessHandler())
+	assert.Equal(t, code, http.StatusServiceUnavailable)
+	assert.Equal(t, body, "not ready")
+	assert.Equal(t, servingStatus(""), healthpb.HealthCheckResponse_NOT_SERVING)
+
+	p.SetReady(true)
+	code, _ = probe(t, p.ReadinessHandler())
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, servingStatus(""), healthpb.HealthCheckResponse_SERVING)
+	assert.Equal(t, servingStatus("v1.UfsService"), healthpb.HealthCheckResponse_SERVING)
+
+	var storeErr error
+	p.AddCheck("store", func(ctx context.Context) error { return storeErr })
+	code, _ = probe(t, p.ReadinessHandler())
+	assert.Equal(t, code, http.StatusOK)
+	storeErr = errors.New("connection refused")
+	code, body = probe(t, p.ReadinessHandler())
+	assert.Equal(t, code, http.StatusServiceUnavailable)
+	assert.Equal(t, body, "store: connection refused")
+	code, _ = probe(t, p.LivenessHandler())
+	assert.Equal(t, code, http.StatusOK, "failing dependencies must not get the server restarted")
+
+	p.SetReady(false)
+	assert.Equal(t, servingStatus("v1.UfsService"), healthpb.HealthCheckResponse_NOT_SERVING)
+}
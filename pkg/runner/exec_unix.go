@@ -0,0 +1,65 @@
+//go:build !windows
+// +build !windows
+
+package runner
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/bhojpur/ufs/pkg/reexec"
+)
+
+// engineExecName is the reexec entry-point of local Engines
+const engineExecName = "ufs-engine-exec"
+
+func init() {
+	reexec.Register(engineExecName, engineExec)
+}
+
+// engineExec is the entry-point of a local Engine on re-exec. It is invoked with the working
+// directory and the command of the Engine, and replaces itself with the command.
+func engineExec() {
+	if len(os.Args) < 3 {
+		fatal(fmt.Errorf("usage: %s <dir> <command> [args...]", engineExecName))
+	}
+
+	dir, args := os.Args[1], os.Args[2:]
+	if err := os.Chdir(dir); err != nil {
+		fatal(err)
+	}
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		fatal(err)
+	}
+	if err := syscall.Exec(path, args, os.Environ()); err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "cannot start Engine: %v\n", err)
+	os.Exit(127)
+}
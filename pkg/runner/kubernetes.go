@@ -0,0 +1,513 @@
+package runner
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/archive"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const (
+	// LabelEngine is the label which marks pods running an Engine. Its value is given by EngineLabel.
+	LabelEngine = "ufs.bhojpur.net/engine"
+	// AnnotationEngine is the annotation which holds the name of the Engine a pod runs
+	AnnotationEngine = "ufs.bhojpur.net/engine"
+	// AnnotationOwner is the annotation which holds the owner of the Engine a pod runs
+	AnnotationOwner = "ufs.bhojpur.net/owner"
+
+	// DefaultHelperImage is the image of the init step which receives the application
+	DefaultHelperImage = "busybox:1.35"
+
+	applicationVolume = "application"
+	applicationPath   = "/application"
+	sideloadVolume    = "sideload"
+	sideloadPath      = "/sideload"
+	sideloadKey       = "sideload"
+	initContainer     = "application"
+	engineContainer   = "engine"
+)
+
+// Kubernetes runs each Engine as a pod. The application of an Engine is streamed into an
+// init container, which unpacks it into a volume shared with the Engine container. Sideloaded
+// content is kept in a secret owned by the pod, which the init container copies into that volume.
+type Kubernetes struct {
+	Client    kubernetes.Interface
+	Config    *rest.Config
+	Namespace string
+
+	// DefaultImage is the image of Engines whose spec names none
+	DefaultImage string
+	// HelperImage is the image of the init step which receives the application. It must provide sh,
+	// tar and cp. Defaults to DefaultHelperImage.
+	HelperImage string
+	// KeepPods retains the pods of Engines once they're done, e.g. for debugging
+	KeepPods bool
+
+	// Attach streams stdin into a container of a pod. Defaults to attaching through the Kubernetes API.
+	Attach func(ctx context.Context, namespace, pod, container string, stdin io.Reader) error
+}
+
+// NewKubernetes creates a runner which runs Engines as pods in a namespace
+func NewKubernetes(client kubernetes.Interface, config *rest.Config, namespace string) *Kubernetes {
+	return &Kubernetes{
+		Client:    client,
+		Config:    config,
+		Namespace: namespace,
+	}
+}
+
+var _ EngineRunner = &Kubernetes{}
+
+// PodName returns the name of the pod which runs an Engine
+func PodName(engine string) string {
+	return "ufs-" + engine
+}
+
+// EngineLabel returns the value of LabelEngine for the pod of an Engine. That's the name of the
+// Engine if it's a valid label value, and a hash of the name otherwise, as label values are limited
+// to 63 characters.
+func EngineLabel(engine string) string {
+	if len(validation.IsValidLabelValue(engine)) == 0 {
+		return engine
+	}
+	sum := sha256.Sum256([]byte(engine))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Run executes an Engine as pod and blocks until it is done
+func (k *Kubernetes) Run(ctx context.Context, job *Job, update func(Update)) {
+	res := Update{Phase: v1.EnginePhase_PHASE_DONE}
+	defer func() { update(res) }()
+
+	update(Update{Phase: v1.EnginePhase_PHASE_PREPARING})
+	pod, err := k.newPod(job)
+	if err != nil {
+		res.Details = fmt.Sprintf("cannot prepare Engine: %v", err)
+		res.FailureCount = 1
+		return
+	}
+
+	// we watch before creating the pod so that we don't miss an event in between
+	w, err := k.watchPod(pod.Name, "")
+	if err != nil {
+		res.Details = fmt.Sprintf("cannot watch Engine pod: %v", err)
+		res.FailureCount = 1
+		return
+	}
+	defer func() { w.Stop() }()
+
+	created, err := k.Client.CoreV1().Pods(k.Namespace).Create(context.Background(), pod, metav1.CreateOptions{})
+	if err != nil {
+		res.Details = fmt.Sprintf("cannot create Engine pod: %v", err)
+		res.FailureCount = 1
+		return
+	}
+	defer func() {
+		update(Update{Phase: v1.EnginePhase_PHASE_CLEANUP, DidExecute: res.DidExecute})
+		if len(job.Sideload) > 0 {
+			k.deleteSecret(pod.Name)
+		}
+		if k.KeepPods {
+			return
+		}
+		k.deletePod(pod.Name)
+	}()
+
+	// the pod waits for its sideload secret, which can only be owned by the pod once it exists
+	if len(job.Sideload) > 0 {
+		_, err = k.Client.CoreV1().Secrets(k.Namespace).Create(context.Background(), k.newSideloadSecret(job, created), metav1.CreateOptions{})
+		if err != nil {
+			res.Details = fmt.Sprintf("cannot create sideload secret: %v", err)
+			res.FailureCount = 1
+			return
+		}
+	}
+
+	var (
+		delivered = job.ApplicationDir == ""
+		delivery  = make(chan error, 1)
+		logs      chan struct{}
+		last      = v1.EnginePhase_PHASE_PREPARING
+		// resourceVersion is the version of the pod we saw last
+		resourceVersion string
+	)
+	startLogs := func() {
+		if logs != nil {
+			return
+		}
+		logs = make(chan struct{})
+		go func() {
+			defer close(logs)
+			k.streamLogs(ctx, pod.Name, job.Log)
+		}()
+	}
+	for {
+		var p *corev1.Pod
+		select {
+		case <-ctx.Done():
+			res.Details = "stopped"
+			return
+		case err := <-delivery:
+			if err != nil {
+				res.Details = fmt.Sprintf("cannot deliver application: %v", err)
+				res.FailureCount = 1
+				return
+			}
+			continue
+		case evt, ok := <-w.ResultChan():
+			if !ok {
+				// the API server ends watches every now and then, and we carry on where it ended
+				w, err = k.watchPod(pod.Name, resourceVersion)
+				if err != nil {
+					res.Details = fmt.Sprintf("cannot watch Engine pod: %v", err)
+					res.FailureCount = 1
+					return
+				}
+				continue
+			}
+			if evt.Type == watch.Error {
+				if err := errors.FromObject(evt.Object); errors.IsResourceExpired(err) || errors.IsGone(err) {
+					// the version we saw last is too old, so we start over from the current pod
+					resourceVersion = ""
+				}
+				log.WithField("name", job.Name).WithField("event", evt.Object).Warn("error while watching Engine pod")
+				continue
+			}
+
+			var isPod bool
+			p, isPod = evt.Object.(*corev1.Pod)
+			if !isPod || p.Name != pod.Name {
+				continue
+			}
+			resourceVersion = p.ResourceVersion
+			if evt.Type == watch.Deleted {
+				res.Details = "Engine pod was deleted"
+				res.FailureCount = 1
+				res.DidExecute = res.DidExecute || p.Status.Phase != corev1.PodPending
+				return
+			}
+		}
+
+		if !delivered && containerRunning(p.Status.InitContainerStatuses, initContainer) {
+			delivered = true
+			go func() { delivery <- k.deliver(ctx, pod.Name, job.ApplicationDir) }()
+		}
+
+		u, done := podUpdate(p)
+		if u.Phase == v1.EnginePhase_PHASE_RUNNING {
+			startLogs()
+		}
+		if done {
+			// make sure we have the complete log before the Engine is done
+			startLogs()
+			select {
+			case <-logs:
+			case <-time.After(30 * time.Second):
+				log.WithField("name", job.Name).Warn("timed out waiting for the Engine log")
+			}
+			res = u
+			return
+		}
+		if u.Phase != last {
+			last = u.Phase
+			res.DidExecute = u.DidExecute
+			update(u)
+		}
+	}
+}
+
+// newPod produces the pod which runs an Engine
+func (k *Kubernetes) newPod(job *Job) (*corev1.Pod, error) {
+	image := job.Spec.Image
+	if image == "" {
+		image = k.DefaultImage
+	}
+	if image == "" {
+		return nil, fmt.Errorf("the Engine YAML names no image and there is no default image")
+	}
+	helperImage := k.HelperImage
+	if helperImage == "" {
+		helperImage = DefaultHelperImage
+	}
+
+	var (
+		script      []string
+		engineEnv   []corev1.EnvVar
+		volumeMount = []corev1.VolumeMount{{Name: applicationVolume, MountPath: applicationPath}}
+		initMounts  = []corev1.VolumeMount{{Name: applicationVolume, MountPath: applicationPath}}
+		volumes     = []corev1.Volume{
+			{Name: applicationVolume, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+		}
+	)
+	if job.ApplicationDir != "" {
+		script = append(script, "tar -xzf - -C "+applicationPath)
+	}
+	if len(job.Sideload) > 0 {
+		sideload := path.Join(applicationPath, SideloadFile)
+		script = append(script, "cp "+path.Join(sideloadPath, sideloadKey)+" "+sideload)
+		volumes = append(volumes, corev1.Volume{
+			Name:         sideloadVolume,
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: PodName(job.Name)}},
+		})
+		initMounts = append(initMounts, corev1.VolumeMount{Name: sideloadVolume, MountPath: sideloadPath, ReadOnly: true})
+		engineEnv = append(engineEnv, corev1.EnvVar{Name: "UFS_SIDELOAD", Value: sideload})
+	}
+	if len(script) == 0 {
+		script = append(script, "true")
+	}
+
+	for k, v := range job.Spec.Env {
+		engineEnv = append(engineEnv, corev1.EnvVar{Name: k, Value: v})
+	}
+	engineEnv = append(engineEnv,
+		corev1.EnvVar{Name: "UFS_ENGINE_NAME", Value: job.Name},
+		corev1.EnvVar{Name: "UFS_SANDBOX", Value: applicationPath},
+	)
+
+	var deadline *int64
+	timeout, err := job.Spec.TimeoutDuration()
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		secs := int64(timeout.Seconds())
+		if secs < 1 {
+			secs = 1
+		}
+		deadline = &secs
+	}
+
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      PodName(job.Name),
+			Namespace: k.Namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": "ufs",
+				LabelEngine:                    EngineLabel(job.Name),
+			},
+			Annotations: map[string]string{
+				AnnotationEngine: job.Name,
+				AnnotationOwner:  job.Metadata.GetOwner(),
+			},
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy:         corev1.RestartPolicyNever,
+			ActiveDeadlineSeconds: deadline,
+			Volumes:               volumes,
+			InitContainers: []corev1.Container{
+				{
+					Name:         initContainer,
+					Image:        helperImage,
+					Command:      []string{"sh", "-c", strings.Join(script, " && ")},
+					Stdin:        job.ApplicationDir != "",
+					StdinOnce:    job.ApplicationDir != "",
+					VolumeMounts: initMounts,
+				},
+			},
+			Containers: []corev1.Container{
+				{
+					Name:         engineContainer,
+					Image:        image,
+					Command:      job.Spec.Command,
+					WorkingDir:   path.Join(applicationPath, job.Spec.WorkingDir),
+					Env:          engineEnv,
+					VolumeMounts: volumeMount,
+				},
+			},
+		},
+	}, nil
+}
+
+// newSideloadSecret produces the secret which holds the sideloaded content of an Engine. It's owned
+// by the pod of the Engine, so that it's gone with the pod even if we fail to delete it.
+func (k *Kubernetes) newSideloadSecret(job *Job, pod *corev1.Pod) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: k.Namespace,
+			Labels:    pod.Labels,
+			OwnerReferences: []metav1.OwnerReference{
+				{APIVersion: "v1", Kind: "Pod", Name: pod.Name, UID: pod.UID},
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{sideloadKey: job.Sideload},
+	}
+}
+
+// watchPod watches the pod of an Engine. If resourceVersion is not empty, the watch starts after it.
+func (k *Kubernetes) watchPod(pod, resourceVersion string) (watch.Interface, error) {
+	return k.Client.CoreV1().Pods(k.Namespace).Watch(context.Background(), metav1.ListOptions{
+		FieldSelector:   "metadata.name=" + pod,
+		ResourceVersion: resourceVersion,
+	})
+}
+
+// podUpdate maps the status of a pod to an Engine update. Done is true once the pod has terminated.
+func podUpdate(pod *corev1.Pod) (u Update, done bool) {
+	switch pod.Status.Phase {
+	case corev1.PodRunning:
+		return Update{Phase: v1.EnginePhase_PHASE_RUNNING, DidExecute: true}, false
+	case corev1.PodSucceeded:
+		return Update{Phase: v1.EnginePhase_PHASE_DONE, DidExecute: true, Success: true}, true
+	case corev1.PodFailed:
+		u = Update{
+			Phase:        v1.EnginePhase_PHASE_DONE,
+			DidExecute:   containerStarted(pod.Status.ContainerStatuses, engineContainer),
+			FailureCount: 1,
+			Details:      "Engine failed",
+		}
+		if pod.Status.Reason == "DeadlineExceeded" {
+			u.Details = "timed out"
+		}
+		if t := terminated(pod.Status.InitContainerStatuses, initContainer); t != nil && t.ExitCode != 0 {
+			u.Details = fmt.Sprintf("cannot unpack application: exit code %d", t.ExitCode)
+		}
+		if t := terminated(pod.Status.ContainerStatuses, engineContainer); t != nil && t.ExitCode != 0 {
+			u.Details = fmt.Sprintf("Engine failed: exit code %d", t.ExitCode)
+			if t.Message != "" {
+				u.Details += ": " + t.Message
+			}
+		}
+		return u, true
+	default:
+		// pending or unknown
+		return Update{Phase: v1.EnginePhase_PHASE_STARTING}, false
+	}
+}
+
+func containerStatus(statuses []corev1.ContainerStatus, name string) *corev1.ContainerStatus {
+	for i := range statuses {
+		if statuses[i].Name == name {
+			return &statuses[i]
+		}
+	}
+	return nil
+}
+
+func containerRunning(statuses []corev1.ContainerStatus, name string) bool {
+	s := containerStatus(statuses, name)
+	return s != nil && s.State.Running != nil
+}
+
+func containerStarted(statuses []corev1.ContainerStatus, name string) bool {
+	s := containerStatus(statuses, name)
+	return s != nil && (s.State.Running != nil || s.State.Terminated != nil)
+}
+
+func terminated(statuses []corev1.ContainerStatus, name string) *corev1.ContainerStateTerminated {
+	s := containerStatus(statuses, name)
+	if s == nil {
+		return nil
+	}
+	return s.State.Terminated
+}
+
+// deliver streams the application into the init container of the pod
+func (k *Kubernetes) deliver(ctx context.Context, pod, applicationDir string) error {
+	tar, err := archive.TarWithOptions(applicationDir, &archive.TarOptions{Compression: archive.Gzip})
+	if err != nil {
+		return err
+	}
+	defer tar.Close()
+
+	attach := k.Attach
+	if attach == nil {
+		attach = k.attach
+	}
+	return attach(ctx, k.Namespace, pod, initContainer, tar)
+}
+
+// attach streams stdin into a container through the Kubernetes API
+func (k *Kubernetes) attach(ctx context.Context, namespace, pod, container string, stdin io.Reader) error {
+	if k.Config == nil {
+		return fmt.Errorf("cannot attach to pod: no Kubernetes client config")
+	}
+
+	req := k.Client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(pod).
+		SubResource("attach").
+		VersionedParams(&corev1.PodAttachOptions{
+			Container: container,
+			Stdin:     true,
+		}, scheme.ParameterCodec)
+	exec, err := remotecommand.NewSPDYExecutor(k.Config, "POST", req.URL())
+	if err != nil {
+		return err
+	}
+	return exec.Stream(remotecommand.StreamOptions{Stdin: stdin})
+}
+
+// streamLogs copies the log of the Engine container until the container terminates
+func (k *Kubernetes) streamLogs(ctx context.Context, pod string, out io.Writer) {
+	req := k.Client.CoreV1().Pods(k.Namespace).GetLogs(pod, &corev1.PodLogOptions{
+		Container: engineContainer,
+		Follow:    true,
+	})
+	logs, err := req.Stream(ctx)
+	if err != nil {
+		log.WithError(err).WithField("pod", pod).Warn("cannot stream Engine log")
+		return
+	}
+	defer logs.Close()
+
+	_, err = io.Copy(out, logs)
+	if err != nil && ctx.Err() == nil {
+		log.WithError(err).WithField("pod", pod).Warn("cannot stream Engine log")
+	}
+}
+
+// deletePod deletes the pod of an Engine and ignores pods which are gone already
+func (k *Kubernetes) deletePod(pod string) {
+	err := k.Client.CoreV1().Pods(k.Namespace).Delete(context.Background(), pod, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		log.WithError(err).WithField("pod", pod).Warn("cannot delete Engine pod")
+	}
+}
+
+// deleteSecret deletes the sideload secret of an Engine and ignores secrets which are gone already
+func (k *Kubernetes) deleteSecret(name string) {
+	err := k.Client.CoreV1().Secrets(k.Namespace).Delete(context.Background(), name, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		log.WithError(err).WithField("secret", name).Warn("cannot delete sideload secret")
+	}
+}
@@ -0,0 +1,356 @@
+package runner
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+	"gotest.tools/v3/poll"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testNamespace = "ufs"
+
+// fakeAttach records the files of the application streamed into a pod
+type fakeAttach struct {
+	mu    sync.Mutex
+	files []string
+}
+
+func (f *fakeAttach) Attach(ctx context.Context, namespace, pod, container string, stdin io.Reader) error {
+	zr, err := gzip.NewReader(stdin)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		f.files = append(f.files, hdr.Name)
+	}
+}
+
+func (f *fakeAttach) Files() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.files...)
+}
+
+func newTestKubernetes(t *testing.T) (*Kubernetes, *fake.Clientset, *fakeAttach) {
+	client := fake.NewSimpleClientset()
+	attach := &fakeAttach{}
+	k := NewKubernetes(client, nil, testNamespace)
+	k.DefaultImage = "alpine:3.15"
+	k.Attach = attach.Attach
+	return k, client, attach
+}
+
+func waitForPod(t *testing.T, client *fake.Clientset, name string) *corev1.Pod {
+	var pod *corev1.Pod
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		p, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			return poll.Continue("pod %s does not exist: %v", name, err)
+		}
+		pod = p
+		return poll.Success()
+	}, poll.WithTimeout(5*time.Second), poll.WithDelay(10*time.Millisecond))
+	return pod
+}
+
+func setPodStatus(t *testing.T, client *fake.Clientset, pod *corev1.Pod, status corev1.PodStatus) *corev1.Pod {
+	pod = pod.DeepCopy()
+	pod.Status = status
+	pod, err := client.CoreV1().Pods(testNamespace).UpdateStatus(context.Background(), pod, metav1.UpdateOptions{})
+	assert.NilError(t, err)
+	return pod
+}
+
+func TestEngineLabel(t *testing.T) {
+	assert.Check(t, is.Equal(EngineLabel("storage-backup.2"), "storage-backup.2"))
+
+	// names which are no valid label values are hashed
+	long := strings.Repeat("storage-", 10) + "backup.2"
+	for _, name := range []string{long, "storage/backup.2"} {
+		l := EngineLabel(name)
+		assert.Check(t, is.Len(validation.IsValidLabelValue(l), 0), "label %q of %s", l, name)
+		assert.Check(t, l != EngineLabel(name+"3"), "labels of %s collide", name)
+	}
+}
+
+func TestKubernetesSuccess(t *testing.T) {
+	k, client, attach := newTestKubernetes(t)
+	job := newTestJob(t, "sh", "-c", "cat hello.txt")
+	job.Sideload = []byte("sideloaded\n")
+
+	rec := newRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		k.Run(context.Background(), job, rec.Update)
+	}()
+
+	pod := waitForPod(t, client, PodName(job.Name))
+	assert.Check(t, is.Equal(pod.Labels[LabelEngine], job.Name))
+	assert.Check(t, is.Equal(pod.Annotations[AnnotationEngine], job.Name))
+	assert.Check(t, is.Equal(pod.Annotations[AnnotationOwner], "alice"))
+	assert.Check(t, is.Equal(pod.Spec.Containers[0].Image, "alpine:3.15"))
+	assert.Check(t, is.DeepEqual(pod.Spec.Containers[0].Command, job.Spec.Command))
+	assert.Check(t, pod.Spec.InitContainers[0].Stdin)
+	assert.Check(t, is.Len(pod.Spec.InitContainers[0].Env, 0))
+
+	// the sideloaded content is kept in a secret owned by the pod
+	var secret *corev1.Secret
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		s, err := client.CoreV1().Secrets(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+		if err != nil {
+			return poll.Continue("secret %s does not exist: %v", pod.Name, err)
+		}
+		secret = s
+		return poll.Success()
+	}, poll.WithTimeout(5*time.Second), poll.WithDelay(10*time.Millisecond))
+	assert.Check(t, is.Equal(string(secret.Data[sideloadKey]), "sideloaded\n"))
+	assert.Check(t, is.Len(secret.OwnerReferences, 1))
+	assert.Check(t, is.Equal(secret.OwnerReferences[0].Name, pod.Name))
+	assert.Check(t, is.Equal(pod.Spec.Volumes[1].Secret.SecretName, secret.Name))
+
+	pod = setPodStatus(t, client, pod, corev1.PodStatus{
+		Phase: corev1.PodPending,
+		InitContainerStatuses: []corev1.ContainerStatus{
+			{Name: initContainer, State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+		},
+	})
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		if len(attach.Files()) == 0 {
+			return poll.Continue("application was not delivered")
+		}
+		return poll.Success()
+	}, poll.WithTimeout(5*time.Second), poll.WithDelay(10*time.Millisecond))
+	assert.Check(t, is.Contains(attach.Files(), "hello.txt"))
+
+	pod = setPodStatus(t, client, pod, corev1.PodStatus{Phase: corev1.PodRunning})
+	select {
+	case <-rec.running:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Engine did not start running")
+	}
+	setPodStatus(t, client, pod, corev1.PodStatus{Phase: corev1.PodSucceeded})
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Engine did not finish")
+	}
+	assert.DeepEqual(t, rec.Phases(), allPhases)
+	res := rec.Result()
+	assert.Check(t, res.Success, "details: %s", res.Details)
+	assert.Check(t, res.DidExecute)
+	// the fake clientset always answers with "fake logs"
+	assert.Check(t, is.Equal(job.Log.(*syncBuffer).String(), "fake logs"))
+
+	_, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	assert.Check(t, errors.IsNotFound(err), "pod was not deleted: %v", err)
+	_, err = client.CoreV1().Secrets(testNamespace).Get(context.Background(), secret.Name, metav1.GetOptions{})
+	assert.Check(t, errors.IsNotFound(err), "secret was not deleted: %v", err)
+}
+
+func TestKubernetesRewatch(t *testing.T) {
+	k, client, _ := newTestKubernetes(t)
+	job := newTestJob(t, "true")
+	job.ApplicationDir = ""
+
+	watches := make(chan *watch.FakeWatcher, 2)
+	versions := make(chan string, 2)
+	client.PrependWatchReactor("pods", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		w := watch.NewFake()
+		versions <- action.(k8stesting.WatchAction).GetWatchRestrictions().ResourceVersion
+		watches <- w
+		return true, w, nil
+	})
+
+	rec := newRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		k.Run(context.Background(), job, rec.Update)
+	}()
+
+	assert.Equal(t, <-versions, "")
+	w := <-watches
+	pod := waitForPod(t, client, PodName(job.Name))
+	pod.ResourceVersion = "42"
+	pod.Status.Phase = corev1.PodRunning
+	w.Modify(pod)
+	<-rec.running
+
+	// the API server ends the watch, and the runner carries on where it ended
+	w.Stop()
+	assert.Equal(t, <-versions, "42")
+	w = <-watches
+	pod = pod.DeepCopy()
+	pod.ResourceVersion = "43"
+	pod.Status.Phase = corev1.PodSucceeded
+	w.Modify(pod)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Engine did not finish")
+	}
+	res := rec.Result()
+	assert.Check(t, res.Success, "details: %s", res.Details)
+}
+
+func TestKubernetesStop(t *testing.T) {
+	k, client, _ := newTestKubernetes(t)
+	job := newTestJob(t, "sleep", "60")
+	job.ApplicationDir = ""
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rec := newRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		k.Run(ctx, job, rec.Update)
+	}()
+
+	pod := waitForPod(t, client, PodName(job.Name))
+	setPodStatus(t, client, pod, corev1.PodStatus{Phase: corev1.PodRunning})
+	select {
+	case <-rec.running:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Engine did not start running")
+	}
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Engine did not stop")
+	}
+	res := rec.Result()
+	assert.Check(t, !res.Success)
+	assert.Check(t, is.Equal(res.Details, "stopped"))
+
+	_, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	assert.Check(t, errors.IsNotFound(err), "pod was not deleted: %v", err)
+}
+
+func TestKubernetesNoImage(t *testing.T) {
+	k, client, _ := newTestKubernetes(t)
+	k.DefaultImage = ""
+	job := newTestJob(t, "true")
+
+	rec := newRecorder()
+	k.Run(context.Background(), job, rec.Update)
+
+	res := rec.Result()
+	assert.Check(t, !res.Success)
+	assert.Check(t, is.Contains(res.Details, "no image"))
+	pods, err := client.CoreV1().Pods(testNamespace).List(context.Background(), metav1.ListOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(pods.Items, 0))
+}
+
+func TestPodUpdate(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Status corev1.PodStatus
+		Update Update
+		Done   bool
+	}{
+		{
+			Name:   "pending",
+			Status: corev1.PodStatus{Phase: corev1.PodPending},
+			Update: Update{Phase: v1.EnginePhase_PHASE_STARTING},
+		},
+		{
+			Name:   "running",
+			Status: corev1.PodStatus{Phase: corev1.PodRunning},
+			Update: Update{Phase: v1.EnginePhase_PHASE_RUNNING, DidExecute: true},
+		},
+		{
+			Name:   "succeeded",
+			Status: corev1.PodStatus{Phase: corev1.PodSucceeded},
+			Update: Update{Phase: v1.EnginePhase_PHASE_DONE, DidExecute: true, Success: true},
+			Done:   true,
+		},
+		{
+			Name: "engine failed",
+			Status: corev1.PodStatus{
+				Phase: corev1.PodFailed,
+				ContainerStatuses: []corev1.ContainerStatus{
+					{Name: engineContainer, State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 2}}},
+				},
+			},
+			Update: Update{Phase: v1.EnginePhase_PHASE_DONE, DidExecute: true, FailureCount: 1, Details: "Engine failed: exit code 2"},
+			Done:   true,
+		},
+		{
+			Name: "unpack failed",
+			Status: corev1.PodStatus{
+				Phase: corev1.PodFailed,
+				InitContainerStatuses: []corev1.ContainerStatus{
+					{Name: initContainer, State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1}}},
+				},
+			},
+			Update: Update{Phase: v1.EnginePhase_PHASE_DONE, FailureCount: 1, Details: "cannot unpack application: exit code 1"},
+			Done:   true,
+		},
+		{
+			Name:   "deadline exceeded",
+			Status: corev1.PodStatus{Phase: corev1.PodFailed, Reason: "DeadlineExceeded"},
+			Update: Update{Phase: v1.EnginePhase_PHASE_DONE, FailureCount: 1, Details: "timed out"},
+			Done:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			u, done := podUpdate(&corev1.Pod{Status: test.Status})
+			assert.Check(t, is.DeepEqual(u, test.Update))
+			assert.Check(t, is.Equal(done, test.Done))
+		})
+	}
+}
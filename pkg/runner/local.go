@@ -0,0 +1,234 @@
+package runner
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/archive"
+	"github.com/bhojpur/ufs/pkg/chrootarchive"
+	"github.com/bhojpur/ufs/pkg/reexec"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultStopTimeout is how long a local Engine may take to exit once it was asked to stop
+const DefaultStopTimeout = 10 * time.Second
+
+// SideloadFile is the name of the file in the sandbox which holds the sideloaded content
+const SideloadFile = ".ufs-sideload"
+
+// Local runs Engines as child processes on this host. Each Engine runs in its own sandbox
+// directory which holds a copy of its application. The child processes are re-executions
+// of the current binary (see pkg/reexec) and are terminated when the server dies.
+type Local struct {
+	// WorkDir holds the sandboxes of Engines. Defaults to a directory in os.TempDir().
+	WorkDir string
+	// StopTimeout is how long an Engine may take to exit once it was asked to stop, before
+	// it is killed. Defaults to DefaultStopTimeout.
+	StopTimeout time.Duration
+	// KeepSandbox retains the sandbox of an Engine once it's done, e.g. for debugging
+	KeepSandbox bool
+	// Untar unpacks uncompressed application tars into sandboxes. Defaults to chrootarchive.UntarUncompressed.
+	Untar func(io.Reader, string, *archive.TarOptions) error
+}
+
+// NewLocal creates a runner which executes Engines in sandboxes within workDir
+func NewLocal(workDir string) *Local {
+	return &Local{WorkDir: workDir}
+}
+
+var _ EngineRunner = &Local{}
+
+// Run executes an Engine as child process and blocks until it is done
+func (l *Local) Run(ctx context.Context, job *Job, update func(Update)) {
+	res := Update{Phase: v1.EnginePhase_PHASE_DONE}
+	defer func() { update(res) }()
+
+	update(Update{Phase: v1.EnginePhase_PHASE_PREPARING})
+	sandbox, err := l.prepare(job)
+	if err != nil {
+		res.Details = fmt.Sprintf("cannot prepare Engine: %v", err)
+		res.FailureCount = 1
+		return
+	}
+	defer func() {
+		update(Update{Phase: v1.EnginePhase_PHASE_CLEANUP, DidExecute: res.DidExecute})
+		if l.KeepSandbox {
+			return
+		}
+		if err := os.RemoveAll(sandbox); err != nil {
+			log.WithError(err).WithField("name", job.Name).Warn("cannot remove Engine sandbox")
+		}
+	}()
+
+	if err := ctx.Err(); err != nil {
+		res.Details = "stopped before it started"
+		return
+	}
+
+	update(Update{Phase: v1.EnginePhase_PHASE_STARTING})
+	timeout, err := job.Spec.TimeoutDuration()
+	if err != nil {
+		res.Details = err.Error()
+		res.FailureCount = 1
+		return
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := reexec.Command(append([]string{engineExecName, filepath.Join(sandbox, job.Spec.WorkingDir)}, job.Spec.Command...)...)
+	if cmd == nil {
+		res.Details = "local Engines are not supported on this platform"
+		res.FailureCount = 1
+		return
+	}
+	cmd.Stdout = job.Log
+	cmd.Stderr = job.Log
+	cmd.Env = engineEnv(job, sandbox)
+	if err := cmd.Start(); err != nil {
+		res.Details = fmt.Sprintf("cannot start Engine: %v", err)
+		res.FailureCount = 1
+		return
+	}
+	res.DidExecute = true
+	update(Update{Phase: v1.EnginePhase_PHASE_RUNNING, DidExecute: true})
+
+	err = l.wait(ctx, cmd)
+	switch {
+	case err == nil:
+		res.Success = true
+	case ctx.Err() == context.DeadlineExceeded:
+		res.Details = fmt.Sprintf("timed out after %s", timeout)
+		res.FailureCount = 1
+	case ctx.Err() != nil:
+		res.Details = "stopped"
+	default:
+		res.Details = fmt.Sprintf("Engine failed: %v", err)
+		res.FailureCount = 1
+	}
+}
+
+// engineEnv produces the environment of an Engine. Engines do not inherit the environment of
+// the server, which may hold its secrets, but only PATH and HOME.
+func engineEnv(job *Job, sandbox string) []string {
+	var res []string
+	for _, k := range []string{"PATH", "HOME"} {
+		if v, ok := os.LookupEnv(k); ok {
+			res = append(res, k+"="+v)
+		}
+	}
+	for k, v := range job.Spec.Env {
+		res = append(res, k+"="+v)
+	}
+	res = append(res,
+		"UFS_ENGINE_NAME="+job.Name,
+		"UFS_SANDBOX="+sandbox,
+	)
+	if len(job.Sideload) > 0 {
+		res = append(res, "UFS_SIDELOAD="+filepath.Join(sandbox, SideloadFile))
+	}
+	return res
+}
+
+// prepare creates the sandbox of an Engine and copies its application into it
+func (l *Local) prepare(job *Job) (sandbox string, err error) {
+	workDir := l.WorkDir
+	if workDir == "" {
+		workDir = filepath.Join(os.TempDir(), "ufs-engines")
+	}
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return "", err
+	}
+	sandbox, err = os.MkdirTemp(workDir, job.Name+"-")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(sandbox)
+		}
+	}()
+
+	if job.ApplicationDir != "" {
+		// TarWithOptions produces an empty archive for directories which do not exist
+		if _, err := os.Stat(job.ApplicationDir); err != nil {
+			return "", err
+		}
+		tar, err := archive.TarWithOptions(job.ApplicationDir, &archive.TarOptions{Compression: archive.Uncompressed})
+		if err != nil {
+			return "", err
+		}
+		defer tar.Close()
+
+		untar := l.Untar
+		if untar == nil {
+			untar = chrootarchive.UntarUncompressed
+		}
+		if err := untar(tar, sandbox, &archive.TarOptions{NoLchown: true}); err != nil {
+			return "", fmt.Errorf("cannot copy application: %w", err)
+		}
+	}
+	if len(job.Sideload) > 0 {
+		if err := os.WriteFile(filepath.Join(sandbox, SideloadFile), job.Sideload, 0644); err != nil {
+			return "", err
+		}
+	}
+	return sandbox, nil
+}
+
+// wait waits for the Engine to exit. Once the context is done, the Engine is asked to stop
+// and killed if it does not exit within the stop timeout.
+func (l *Local) wait(ctx context.Context, cmd *exec.Cmd) error {
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	stopTimeout := l.StopTimeout
+	if stopTimeout <= 0 {
+		stopTimeout = DefaultStopTimeout
+	}
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		cmd.Process.Kill()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(stopTimeout):
+		cmd.Process.Kill()
+		return <-done
+	}
+}
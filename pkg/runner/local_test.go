@@ -0,0 +1,250 @@
+package runner
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/archive"
+	"github.com/bhojpur/ufs/pkg/reexec"
+	"github.com/bhojpur/ufs/pkg/spec"
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+	"gotest.tools/v3/skip"
+)
+
+func init() {
+	reexec.Init()
+}
+
+// syncBuffer is a buffer which is safe for concurrent use
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+type recorder struct {
+	mu      sync.Mutex
+	updates []Update
+	running chan struct{}
+}
+
+func newRecorder() *recorder {
+	return &recorder{running: make(chan struct{})}
+}
+
+func (r *recorder) Update(u Update) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.updates = append(r.updates, u)
+	if u.Phase == v1.EnginePhase_PHASE_RUNNING {
+		close(r.running)
+	}
+}
+
+func (r *recorder) Phases() []v1.EnginePhase {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := make([]v1.EnginePhase, 0, len(r.updates))
+	for _, u := range r.updates {
+		res = append(res, u.Phase)
+	}
+	return res
+}
+
+func (r *recorder) Result() Update {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.updates[len(r.updates)-1]
+}
+
+var allPhases = []v1.EnginePhase{
+	v1.EnginePhase_PHASE_PREPARING,
+	v1.EnginePhase_PHASE_STARTING,
+	v1.EnginePhase_PHASE_RUNNING,
+	v1.EnginePhase_PHASE_CLEANUP,
+	v1.EnginePhase_PHASE_DONE,
+}
+
+func newTestRunner(t *testing.T) *Local {
+	l := NewLocal(t.TempDir())
+	l.Untar = archive.UntarUncompressed
+	l.StopTimeout = time.Second
+	return l
+}
+
+func newTestJob(t *testing.T, command ...string) *Job {
+	app := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(app, "hello.txt"), []byte("hello world\n"), 0644))
+	return &Job{
+		Name:           "backup.1",
+		Metadata:       &v1.EngineMetadata{Owner: "alice"},
+		Spec:           &spec.Engine{Command: command, Env: map[string]string{"GREETING": "hi"}},
+		ApplicationDir: app,
+		Log:            &syncBuffer{},
+	}
+}
+
+func TestLocalSuccess(t *testing.T) {
+	l := newTestRunner(t)
+	job := newTestJob(t, "sh", "-c", `cat hello.txt; echo "$GREETING $UFS_ENGINE_NAME"; cat "$UFS_SIDELOAD"`)
+	job.Sideload = []byte("sideloaded\n")
+
+	rec := newRecorder()
+	l.Run(context.Background(), job, rec.Update)
+
+	assert.DeepEqual(t, rec.Phases(), allPhases)
+	res := rec.Result()
+	assert.Check(t, res.Success, "details: %s", res.Details)
+	assert.Check(t, res.DidExecute)
+	assert.Equal(t, res.FailureCount, int32(0))
+	assert.Equal(t, job.Log.(*syncBuffer).String(), "hello world\nhi backup.1\nsideloaded\n")
+
+	// the sandbox is gone, but the application is untouched
+	sandboxes, err := os.ReadDir(l.WorkDir)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(sandboxes, 0))
+	_, err = os.Stat(filepath.Join(job.ApplicationDir, "hello.txt"))
+	assert.NilError(t, err)
+}
+
+func TestLocalEnvironment(t *testing.T) {
+	t.Setenv("UFS_TEST_SECRET", "s3cr3t")
+	l := newTestRunner(t)
+	job := newTestJob(t, "sh", "-c", `echo "secret=$UFS_TEST_SECRET greeting=$GREETING"; test -n "$PATH"`)
+
+	rec := newRecorder()
+	l.Run(context.Background(), job, rec.Update)
+
+	res := rec.Result()
+	assert.Check(t, res.Success, "details: %s", res.Details)
+	assert.Equal(t, job.Log.(*syncBuffer).String(), "secret= greeting=hi\n")
+}
+
+func TestLocalFailure(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Command []string
+		Execute bool
+	}{
+		{Name: "exit code", Command: []string{"sh", "-c", "exit 3"}, Execute: true},
+		{Name: "unknown command", Command: []string{"does-not-exist"}, Execute: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			rec := newRecorder()
+			newTestRunner(t).Run(context.Background(), newTestJob(t, test.Command...), rec.Update)
+
+			assert.DeepEqual(t, rec.Phases(), allPhases)
+			res := rec.Result()
+			assert.Check(t, !res.Success)
+			assert.Equal(t, res.DidExecute, test.Execute)
+			assert.Equal(t, res.FailureCount, int32(1))
+			assert.Check(t, is.Contains(res.Details, "Engine failed"))
+		})
+	}
+}
+
+func TestLocalMissingApplication(t *testing.T) {
+	job := newTestJob(t, "true")
+	job.ApplicationDir = filepath.Join(job.ApplicationDir, "does-not-exist")
+
+	rec := newRecorder()
+	newTestRunner(t).Run(context.Background(), job, rec.Update)
+
+	assert.DeepEqual(t, rec.Phases(), []v1.EnginePhase{v1.EnginePhase_PHASE_PREPARING, v1.EnginePhase_PHASE_DONE})
+	res := rec.Result()
+	assert.Check(t, !res.DidExecute)
+	assert.Equal(t, res.FailureCount, int32(1))
+	assert.Check(t, is.Contains(res.Details, "cannot prepare Engine"))
+}
+
+func TestLocalStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rec := newRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newTestRunner(t).Run(ctx, newTestJob(t, "sleep", "60"), rec.Update)
+	}()
+
+	<-rec.running
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Engine did not stop")
+	}
+
+	assert.DeepEqual(t, rec.Phases(), allPhases)
+	res := rec.Result()
+	assert.Check(t, !res.Success)
+	assert.Equal(t, res.Details, "stopped")
+	assert.Equal(t, res.FailureCount, int32(0))
+}
+
+func TestLocalTimeout(t *testing.T) {
+	job := newTestJob(t, "sleep", "60")
+	job.Spec.Timeout = "100ms"
+
+	rec := newRecorder()
+	newTestRunner(t).Run(context.Background(), job, rec.Update)
+
+	res := rec.Result()
+	assert.Check(t, !res.Success)
+	assert.Equal(t, res.Details, "timed out after 100ms")
+	assert.Equal(t, res.FailureCount, int32(1))
+}
+
+func TestLocalChroot(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+
+	l := newTestRunner(t)
+	l.Untar = nil
+	job := newTestJob(t, "cat", "hello.txt")
+
+	rec := newRecorder()
+	l.Run(context.Background(), job, rec.Update)
+
+	assert.Check(t, rec.Result().Success, "details: %s", rec.Result().Details)
+	assert.Equal(t, job.Log.(*syncBuffer).String(), "hello world\n")
+}
@@ -0,0 +1,66 @@
+package runner
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"io"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/spec"
+)
+
+// Job is everything a runner needs to execute an Engine
+type Job struct {
+	// Name is the unique name of the Engine
+	Name     string
+	Metadata *v1.EngineMetadata
+	Spec     *spec.Engine
+
+	// ApplicationDir is the staging directory of the unpacked application. Runners must not modify it.
+	// It is empty if the Engine has no application.
+	ApplicationDir string
+	// Sideload is additional content made available to the Engine
+	Sideload []byte
+
+	// Log receives the output of the Engine
+	Log io.Writer
+}
+
+// Update reports a change of the state of an Engine
+type Update struct {
+	Phase   v1.EnginePhase
+	Details string
+
+	// Conditions are only final once the Engine is in PHASE_DONE
+	Success      bool
+	FailureCount int32
+	DidExecute   bool
+}
+
+// EngineRunner executes Engines
+type EngineRunner interface {
+	// Run executes an Engine and blocks until it is done. Runners report every phase the Engine
+	// goes through, i.e. PHASE_PREPARING, PHASE_STARTING, PHASE_RUNNING and PHASE_CLEANUP,
+	// and always finish with an update in PHASE_DONE - even if the Engine failed before it
+	// started. Cancelling the context stops the Engine, which still goes through cleanup.
+	Run(ctx context.Context, job *Job, update func(Update))
+}
@@ -0,0 +1,343 @@
+package serverconfig
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/auth"
+	"github.com/bhojpur/ufs/pkg/spec"
+	"github.com/bhojpur/ufs/pkg/tlsconfig"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the content of the server configuration file. Settings which are empty fall
+// back to their flags, environment variables or defaults.
+type Config struct {
+	Listen Listen `json:"listen,omitempty"`
+	Store  Store  `json:"store,omitempty"`
+	Runner Runner `json:"runner,omitempty"`
+	Auth   Auth   `json:"auth,omitempty"`
+	TLS    TLS    `json:"tls,omitempty"`
+
+	// ReadOnly rejects all requests which would start or stop Engines
+	ReadOnly *bool `json:"readOnly,omitempty"`
+	// SpecRepos are checked out repositories whose ufs/config.yaml lists the Engines offered by the web UI
+	SpecRepos []SpecRepo `json:"specRepos,omitempty"`
+}
+
+// Listen configures the addresses the server listens on
+type Listen struct {
+	// GRPC is the address of the gRPC server
+	GRPC string `json:"grpc,omitempty"`
+	// UI is the address of the web UI and JSON gateway. An empty string disables them.
+	UI *string `json:"ui,omitempty"`
+	// Metrics is the address of the Prometheus metrics and the probe endpoints. An empty string disables them.
+	Metrics *string `json:"metrics,omitempty"`
+}
+
+// Store configures where the server keeps Engines, their logs and inputs
+type Store struct {
+	// DSN is the PostgreSQL connection string of the Engine store
+	DSN        string `json:"dsn,omitempty"`
+	LogDir     string `json:"logDir,omitempty"`
+	ReplayDir  string `json:"replayDir,omitempty"`
+	StagingDir string `json:"stagingDir,omitempty"`
+}
+
+// Runner configures how Engines are executed
+type Runner struct {
+	// Type is one of RunnerTypes
+	Type string `json:"type,omitempty"`
+	// WorkDir is used by the local runner
+	WorkDir string `json:"workDir,omitempty"`
+	// Kubeconfig, Namespace and Image are used by the kubernetes runner
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	Image      string `json:"image,omitempty"`
+
+	// InsecureAllowLocal allows the local runner without authentication
+	InsecureAllowLocal bool `json:"insecureAllowLocal,omitempty"`
+}
+
+// RunnerTypes lists the runners the server supports
+var RunnerTypes = []string{"local", "kubernetes", "none"}
+
+// Auth configures how callers are authenticated. Authentication is disabled unless a file is set.
+type Auth struct {
+	TokensFile  string `json:"tokensFile,omitempty"`
+	HMACKeyFile string `json:"hmacKeyFile,omitempty"`
+}
+
+// Enabled returns true if callers must authenticate
+func (a Auth) Enabled() bool {
+	return a.TokensFile != "" || a.HMACKeyFile != ""
+}
+
+// TLS configures how connections are secured. TLS is disabled unless a certificate is set.
+type TLS struct {
+	Cert     string `json:"cert,omitempty"`
+	Key      string `json:"key,omitempty"`
+	ClientCA string `json:"clientCA,omitempty"`
+}
+
+// SpecRepo is a checked out repository which offers Engines in the web UI
+type SpecRepo struct {
+	// Name is [[host/]owner/]repo. Defaults to the base name of Dir.
+	Name string `json:"name,omitempty"`
+	// Dir is the root of the checkout
+	Dir string `json:"dir"`
+}
+
+// ParseSpecRepo parses a repository given as [[host/]owner/]repo=dir, or just dir
+func ParseSpecRepo(s string) (SpecRepo, error) {
+	res := SpecRepo{Dir: s}
+	if i := strings.Index(s, "="); i >= 0 {
+		res.Name, res.Dir = s[:i], s[i+1:]
+	}
+	if res.Dir == "" {
+		return SpecRepo{}, fmt.Errorf("invalid spec repository %q: directory is missing", s)
+	}
+	return res, nil
+}
+
+// Repository returns the repository the Engines of a spec repo belong to
+func (r SpecRepo) Repository() (*v1.Repository, error) {
+	name := r.Name
+	if name == "" {
+		name = filepath.Base(filepath.Clean(r.Dir))
+	}
+
+	res := &v1.Repository{}
+	segs := strings.Split(name, "/")
+	switch len(segs) {
+	case 1:
+		res.Repo = segs[0]
+	case 2:
+		res.Owner, res.Repo = segs[0], segs[1]
+	case 3:
+		res.Host, res.Owner, res.Repo = segs[0], segs[1], segs[2]
+	default:
+		return nil, fmt.Errorf("invalid name %q: must be [[host/]owner/]repo", name)
+	}
+	for _, s := range segs {
+		if s == "" {
+			return nil, fmt.Errorf("invalid name %q: must be [[host/]owner/]repo", name)
+		}
+	}
+	return res, nil
+}
+
+// Load reads and parses a configuration file. It does not validate the configuration.
+func Load(fn string) (*Config, error) {
+	content, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(content)
+}
+
+// Parse parses the content of a configuration file. Unknown settings are an error.
+func Parse(content []byte) (*Config, error) {
+	var res Config
+	if err := yaml.UnmarshalStrict(content, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// FieldError is a problem with a single setting
+type FieldError struct {
+	// Field is the path of the setting, e.g. specRepos[1].dir
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError lists all problems of a configuration
+type ValidationError []*FieldError
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, fe := range e {
+		msgs = append(msgs, fe.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validate checks all settings, including that the files they reference can be loaded.
+// It returns a ValidationError listing every problem, or nil if there are none.
+func (c *Config) Validate() error {
+	var errs ValidationError
+	add := func(field string, err error) {
+		errs = append(errs, &FieldError{Field: field, Err: err})
+	}
+
+	if c.Listen.GRPC != "" {
+		if err := validateAddr(c.Listen.GRPC); err != nil {
+			add("listen.grpc", err)
+		}
+	}
+	if c.Listen.UI != nil && *c.Listen.UI != "" {
+		if err := validateAddr(*c.Listen.UI); err != nil {
+			add("listen.ui", err)
+		}
+	}
+	if c.Listen.Metrics != nil && *c.Listen.Metrics != "" {
+		if err := validateAddr(*c.Listen.Metrics); err != nil {
+			add("listen.metrics", err)
+		}
+	}
+
+	for _, d := range []struct{ Field, Dir string }{
+		{"store.logDir", c.Store.LogDir},
+		{"store.replayDir", c.Store.ReplayDir},
+		{"store.stagingDir", c.Store.StagingDir},
+		{"runner.workDir", c.Runner.WorkDir},
+	} {
+		if err := validateDir(d.Dir, false); err != nil {
+			add(d.Field, err)
+		}
+	}
+
+	switch c.Runner.Type {
+	case "", "local", "none":
+	case "kubernetes":
+		if c.Runner.Kubeconfig != "" {
+			if _, err := os.Stat(c.Runner.Kubeconfig); err != nil {
+				add("runner.kubeconfig", err)
+			}
+		}
+	default:
+		add("runner.type", fmt.Errorf("unknown runner %q: must be one of %s", c.Runner.Type, strings.Join(RunnerTypes, ", ")))
+	}
+
+	if fn := c.Auth.TokensFile; fn != "" {
+		if _, err := auth.LoadStaticTokens(fn); err != nil {
+			add("auth.tokensFile", err)
+		}
+	}
+	if fn := c.Auth.HMACKeyFile; fn != "" {
+		if _, err := auth.LoadHMACTokens(fn); err != nil {
+			add("auth.hmacKeyFile", err)
+		}
+	}
+
+	switch {
+	case c.TLS.Cert == "" && c.TLS.Key == "":
+		if c.TLS.ClientCA != "" {
+			add("tls.clientCA", fmt.Errorf("requires tls.cert and tls.key"))
+		}
+	case c.TLS.Cert == "" || c.TLS.Key == "":
+		add("tls", fmt.Errorf("cert and key must be set together"))
+	default:
+		if _, err := tls.LoadX509KeyPair(c.TLS.Cert, c.TLS.Key); err != nil {
+			add("tls.cert", err)
+		}
+		if c.TLS.ClientCA != "" {
+			if _, err := tlsconfig.LoadCertPool(c.TLS.ClientCA); err != nil {
+				add("tls.clientCA", err)
+			}
+		}
+	}
+
+	names := make(map[string]int, len(c.SpecRepos))
+	for i, r := range c.SpecRepos {
+		field := fmt.Sprintf("specRepos[%d]", i)
+		if r.Dir == "" {
+			add(field+".dir", fmt.Errorf("is required"))
+			continue
+		}
+		repo, err := r.Repository()
+		if err != nil {
+			add(field+".name", err)
+			continue
+		}
+		name := strings.Join([]string{repo.Host, repo.Owner, repo.Repo}, "/")
+		if j, exists := names[name]; exists {
+			add(field+".name", fmt.Errorf("duplicate of specRepos[%d]", j))
+		}
+		names[name] = i
+		if err := validateDir(r.Dir, true); err != nil {
+			add(field+".dir", err)
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(r.Dir, spec.ConfigPath))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			_, err = spec.ParseConfig(content)
+		}
+		if err != nil {
+			add(field+".dir", err)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// validateAddr checks that an address can be listened on by net.Listen("tcp", addr)
+func validateAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateDir checks that a path is a directory. Directories which do not exist yet are
+// fine unless they must exist.
+func validateDir(dir string, mustExist bool) error {
+	if dir == "" {
+		return nil
+	}
+	stat, err := os.Stat(dir)
+	if os.IsNotExist(err) && !mustExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package serverconfig
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+	"gotest.tools/v3/poll"
+)
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse([]byte(`
+listen:
+  grpc: ":7777"
+  ui: ""
+runner:
+  type: kubernetes
+  namespace: ufs
+readOnly: true
+specRepos:
+- name: bhojpur/engines
+  dir: /src/engines
+`))
+	assert.NilError(t, err)
+	assert.Equal(t, cfg.Listen.GRPC, ":7777")
+	assert.Check(t, cfg.Listen.UI != nil && *cfg.Listen.UI == "", "an empty UI address must disable the UI rather than fall back")
+	assert.Equal(t, cfg.Runner.Namespace, "ufs")
+	assert.Check(t, cfg.ReadOnly != nil && *cfg.ReadOnly)
+	assert.DeepEqual(t, cfg.SpecRepos, []SpecRepo{{Name: "bhojpur/engines", Dir: "/src/engines"}})
+
+	_, err = Parse([]byte("runner:\n  typ: local\n"))
+	assert.ErrorContains(t, err, `unknown field "typ"`)
+	_, err = Parse([]byte("readOnly: maybe\n"))
+	assert.Check(t, err != nil)
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	assert.NilError(t, os.WriteFile(file, nil, 0644))
+	brokenRepo := filepath.Join(dir, "broken")
+	assert.NilError(t, os.MkdirAll(filepath.Join(brokenRepo, "ufs"), 0755))
+	assert.NilError(t, os.WriteFile(filepath.Join(brokenRepo, "ufs", "config.yaml"), []byte("engines:\n- path: a.yaml\n"), 0644))
+	goodRepo := filepath.Join(dir, "good")
+	assert.NilError(t, os.MkdirAll(goodRepo, 0755))
+
+	ui, metrics := "localhost", "::1"
+	cfg := Config{
+		Listen: Listen{GRPC: ":7777", UI: &ui, Metrics: &metrics},
+		Store:  Store{LogDir: file, ReplayDir: filepath.Join(dir, "does-not-exist-yet")},
+		Runner: Runner{Type: "docker"},
+		Auth:   Auth{TokensFile: filepath.Join(dir, "missing.yaml")},
+		TLS:    TLS{Cert: file},
+		SpecRepos: []SpecRepo{
+			{Name: "bhojpur/engines", Dir: goodRepo},
+			{Name: "a/b/c/d", Dir: goodRepo},
+			{Dir: brokenRepo},
+			{Name: "engines", Dir: filepath.Join(dir, "missing")},
+			{Name: "bhojpur/engines", Dir: goodRepo},
+			{Name: "empty"},
+		},
+	}
+	err := cfg.Validate()
+	var verr ValidationError
+	assert.Assert(t, errors.As(err, &verr), "got %v", err)
+
+	var fields []string
+	for _, fe := range verr {
+		fields = append(fields, fe.Field)
+	}
+	assert.DeepEqual(t, fields, []string{
+		"listen.ui",
+		"listen.metrics",
+		"store.logDir",
+		"runner.type",
+		"auth.tokensFile",
+		"tls",
+		"specRepos[1].name",
+		"specRepos[2].dir",
+		"specRepos[3].dir",
+		"specRepos[4].name",
+		"specRepos[5].dir",
+	})
+	assert.Check(t, is.ErrorContains(err, `runner.type: unknown runner "docker": must be one of local, kubernetes, none`))
+	assert.Check(t, is.ErrorContains(err, "tls: cert and key must be set together"))
+	assert.Check(t, is.ErrorContains(err, "specRepos[2].dir: invalid ufs/config.yaml: engines[0]: name is required"))
+	assert.Check(t, is.ErrorContains(err, "specRepos[4].name: duplicate of specRepos[0]"))
+
+	assert.NilError(t, (&Config{}).Validate(), "an empty configuration uses the defaults")
+}
+
+func TestSpecRepo(t *testing.T) {
+	r, err := ParseSpecRepo("github.com/bhojpur/engines=/src/engines")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, r, SpecRepo{Name: "github.com/bhojpur/engines", Dir: "/src/engines"})
+	repo, err := r.Repository()
+	assert.NilError(t, err)
+	assert.Check(t, proto.Equal(repo, &v1.Repository{Host: "github.com", Owner: "bhojpur", Repo: "engines"}))
+
+	r, err = ParseSpecRepo("/src/engines/")
+	assert.NilError(t, err)
+	repo, err = r.Repository()
+	assert.NilError(t, err)
+	assert.Check(t, proto.Equal(repo, &v1.Repository{Repo: "engines"}), "the name must default to the directory")
+
+	_, err = ParseSpecRepo("engines=")
+	assert.ErrorContains(t, err, "directory is missing")
+	_, err = SpecRepo{Name: "bhojpur//engines", Dir: "/src"}.Repository()
+	assert.ErrorContains(t, err, "must be [[host/]owner/]repo")
+}
+
+func TestWatch(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "server.yaml")
+	assert.NilError(t, os.WriteFile(fn, []byte("readOnly: false\n"), 0644))
+
+	reloads := make(chan *Config, 10)
+	errs := make(chan error, 10)
+	stop, err := Watch(fn, func(cfg *Config, err error) {
+		if err != nil {
+			errs <- err
+			return
+		}
+		reloads <- cfg
+	})
+	assert.NilError(t, err)
+	defer stop()
+
+	assert.NilError(t, os.WriteFile(fn, []byte("readOnly: true\n"), 0644))
+	var cfg *Config
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		select {
+		case cfg = <-reloads:
+			return poll.Success()
+		default:
+			return poll.Continue("waiting for reload")
+		}
+	}, poll.WithTimeout(10*time.Second))
+	assert.Check(t, cfg.ReadOnly != nil && *cfg.ReadOnly)
+
+	assert.NilError(t, os.WriteFile(fn, []byte("readOnly: [\n"), 0644))
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		select {
+		case <-errs:
+			return poll.Success()
+		default:
+			return poll.Continue("waiting for parse error")
+		}
+	}, poll.WithTimeout(10*time.Second))
+}
@@ -0,0 +1,86 @@
+package serverconfig
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/bhojpur/ufs/pkg/filenotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// Watch calls reload with the new configuration whenever the content of the configuration
+// file changes, or with the error if the file cannot be loaded. Watching the directory
+// rather than the file catches editors and config maps which replace the file.
+// The returned function stops watching.
+func Watch(fn string, reload func(*Config, error)) (stop func(), err error) {
+	last, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	watcher, err := filenotify.New()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(fn)
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("cannot watch %s: %w", dir, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case _, ok := <-watcher.Events():
+				if !ok {
+					return
+				}
+				content, err := os.ReadFile(fn)
+				if err != nil {
+					reload(nil, err)
+					continue
+				}
+				if bytes.Equal(content, last) {
+					continue
+				}
+				last = content
+				reload(Parse(content))
+			case err, ok := <-watcher.Errors():
+				if !ok {
+					return
+				}
+				log.WithError(err).Warn("error while watching server configuration")
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		watcher.Close()
+	}, nil
+}
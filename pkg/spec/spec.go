@@ -0,0 +1,162 @@
+package spec
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// ConfigPath is the location of the configuration file within a repository or workspace
+const ConfigPath = "ufs/config.yaml"
+
+// Config is the content of a ufs/config.yaml file
+type Config struct {
+	// DefaultEngine is the path of the Engine YAML which is started unless another one is chosen.
+	// The path is relative to the root of the repository or workspace.
+	DefaultEngine string `json:"defaultEngine,omitempty"`
+	// Engines are the Engines which can be started through the web UI
+	Engines []EngineSpec `json:"engines,omitempty"`
+}
+
+// EngineSpec makes an Engine YAML of a repository available for starting through the web UI
+type EngineSpec struct {
+	// Name identifies the Engine within the repository
+	Name string `json:"name"`
+	// Path is the location of the Engine YAML, relative to the root of the repository
+	Path string `json:"path"`
+	// Description explains what the Engine does. Defaults to the description in the Engine YAML.
+	Description string `json:"description,omitempty"`
+	// Arguments are the annotations users are asked for when they start the Engine
+	Arguments []Argument `json:"arguments,omitempty"`
+}
+
+// Argument is an annotation an Engine expects when it is started
+type Argument struct {
+	Name        string `json:"name"`
+	Required    bool   `json:"required,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// Engine is the content of an Engine YAML file which describes how an Engine is executed
+type Engine struct {
+	// Description explains what the Engine does
+	Description string `json:"description,omitempty"`
+	// Image is the container image the Engine runs in. Runners which do not use containers ignore it.
+	Image string `json:"image,omitempty"`
+	// Command is the executable and its arguments
+	Command []string `json:"command"`
+	// Env are additional environment variables
+	Env map[string]string `json:"env,omitempty"`
+	// WorkingDir is the directory the command runs in, relative to the application
+	WorkingDir string `json:"workingDir,omitempty"`
+	// Timeout limits how long the Engine runs, e.g. "1h30m". Engines run without a limit if empty.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// ParseConfig parses and validates the content of a ufs/config.yaml file
+func ParseConfig(content []byte) (*Config, error) {
+	var res Config
+	if err := yaml.UnmarshalStrict(content, &res); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", ConfigPath, err)
+	}
+	if err := res.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", ConfigPath, err)
+	}
+	return &res, nil
+}
+
+// Validate checks that Engine specs are complete and unambiguous
+func (c *Config) Validate() error {
+	names := make(map[string]struct{}, len(c.Engines))
+	for i, e := range c.Engines {
+		if e.Name == "" {
+			return fmt.Errorf("engines[%d]: name is required", i)
+		}
+		if _, exists := names[e.Name]; exists {
+			return fmt.Errorf("engines[%d]: duplicate name %q", i, e.Name)
+		}
+		names[e.Name] = struct{}{}
+		if e.Path == "" {
+			return fmt.Errorf("engines[%d]: path is required", i)
+		}
+		if filepath.IsAbs(e.Path) || strings.HasPrefix(filepath.Clean(e.Path), "..") {
+			return fmt.Errorf("engines[%d]: path must be within the repository", i)
+		}
+
+		args := make(map[string]struct{}, len(e.Arguments))
+		for j, a := range e.Arguments {
+			if a.Name == "" {
+				return fmt.Errorf("engines[%d].arguments[%d]: name is required", i, j)
+			}
+			if _, exists := args[a.Name]; exists {
+				return fmt.Errorf("engines[%d].arguments[%d]: duplicate name %q", i, j, a.Name)
+			}
+			args[a.Name] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// ParseEngine parses and validates the content of an Engine YAML file
+func ParseEngine(content []byte) (*Engine, error) {
+	var res Engine
+	if err := yaml.UnmarshalStrict(content, &res); err != nil {
+		return nil, fmt.Errorf("invalid Engine YAML: %w", err)
+	}
+	if err := res.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid Engine YAML: %w", err)
+	}
+	return &res, nil
+}
+
+// Validate checks if the Engine can be executed
+func (e *Engine) Validate() error {
+	if len(e.Command) == 0 || e.Command[0] == "" {
+		return fmt.Errorf("command is required")
+	}
+	if filepath.IsAbs(e.WorkingDir) || strings.HasPrefix(filepath.Clean(e.WorkingDir), "..") {
+		return fmt.Errorf("workingDir must be within the application")
+	}
+	if _, err := e.TimeoutDuration(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// TimeoutDuration returns the parsed timeout, or zero if the Engine has none
+func (e *Engine) TimeoutDuration() (time.Duration, error) {
+	if e.Timeout == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(e.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout: %w", err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("timeout must not be negative")
+	}
+	return d, nil
+}
@@ -0,0 +1,99 @@
+package spec
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestParseEngine(t *testing.T) {
+	e, err := ParseEngine([]byte(`
+description: nightly backup
+command: ["sh", "-c", "echo hello"]
+env:
+  FOO: bar
+workingDir: scripts
+timeout: 1h30m
+`))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, e.Command, []string{"sh", "-c", "echo hello"})
+	assert.Equal(t, e.Env["FOO"], "bar")
+	d, err := e.TimeoutDuration()
+	assert.NilError(t, err)
+	assert.Equal(t, d, 90*time.Minute)
+
+	for input, msg := range map[string]string{
+		"description: no command":            "command is required",
+		"command: [true]\ntimeout: soon":     "invalid timeout",
+		"command: [true]\nfoo: bar":          "unknown field",
+		"command: true":                      "cannot unmarshal",
+		"command: [true]\nworkingDir: ../..": "workingDir must be within the application",
+	} {
+		_, err := ParseEngine([]byte(input))
+		assert.ErrorContains(t, err, msg, "input %q", input)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	c, err := ParseConfig([]byte("defaultEngine: ufs/backup.yaml\n"))
+	assert.NilError(t, err)
+	assert.Equal(t, c.DefaultEngine, "ufs/backup.yaml")
+
+	_, err = ParseConfig([]byte("defaultEngines: ufs/backup.yaml\n"))
+	assert.ErrorContains(t, err, "unknown field")
+}
+
+func TestParseConfigEngines(t *testing.T) {
+	c, err := ParseConfig([]byte(`
+engines:
+- name: backup
+  path: ufs/backup.yaml
+  arguments:
+  - name: target
+    required: true
+    description: where the backup goes
+  - name: comment
+`))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, c.Engines, []EngineSpec{{
+		Name: "backup",
+		Path: "ufs/backup.yaml",
+		Arguments: []Argument{
+			{Name: "target", Required: true, Description: "where the backup goes"},
+			{Name: "comment"},
+		},
+	}})
+
+	for input, msg := range map[string]string{
+		"engines: [{path: a.yaml}]":                                             "name is required",
+		"engines: [{name: a}]":                                                  "path is required",
+		"engines: [{name: a, path: /a.yaml}]":                                   "path must be within the repository",
+		"engines: [{name: a, path: a.yaml}, {name: a, path: b.yaml}]":           "duplicate name",
+		"engines: [{name: a, path: a.yaml, arguments: [{}]}]":                   "name is required",
+		"engines: [{name: a, path: a.yaml, arguments: [{name: x}, {name: x}]}]": "duplicate name",
+	} {
+		_, err := ParseConfig([]byte(input))
+		assert.ErrorContains(t, err, msg, "input %q", input)
+	}
+}
@@ -0,0 +1,218 @@
+package store
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const digestPrefix = "sha256:"
+
+var digestRegexp = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// validateDigest returns the hex part of a digest
+func validateDigest(digest string) (string, error) {
+	if !digestRegexp.MatchString(digest) {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return strings.TrimPrefix(digest, digestPrefix), nil
+}
+
+func validateTag(name string) error {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return fmt.Errorf("invalid tag %q", name)
+	}
+	return nil
+}
+
+// NewInMemoryBlobStore creates a blob store which keeps all content in memory
+func NewInMemoryBlobStore() Blobs {
+	return &inMemoryBlobStore{
+		blobs: make(map[string][]byte),
+		tags:  make(map[string]string),
+	}
+}
+
+type inMemoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+	tags  map[string]string
+}
+
+func (s *inMemoryBlobStore) Put(ctx context.Context, r io.Reader) (string, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	digest := digestPrefix + hex.EncodeToString(sum[:])
+
+	s.mu.Lock()
+	s.blobs[digest] = content
+	s.mu.Unlock()
+	return digest, nil
+}
+
+func (s *inMemoryBlobStore) Get(ctx context.Context, digest string) (io.ReadCloser, error) {
+	if _, err := validateDigest(digest); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	content, ok := s.blobs[digest]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (s *inMemoryBlobStore) Tag(ctx context.Context, name, digest string) error {
+	if err := validateTag(name); err != nil {
+		return err
+	}
+	if _, err := validateDigest(digest); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.tags[name] = digest
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *inMemoryBlobStore) Resolve(ctx context.Context, name string) (string, error) {
+	if err := validateTag(name); err != nil {
+		return "", err
+	}
+
+	s.mu.RLock()
+	digest, ok := s.tags[name]
+	s.mu.RUnlock()
+	if !ok {
+		return "", ErrNotFound
+	}
+	return digest, nil
+}
+
+// NewFileBlobStore creates a blob store which keeps its content in dir. Content lives in
+// dir/sha256/<hex>, tags in dir/tags/<name>.
+func NewFileBlobStore(dir string) (Blobs, error) {
+	for _, d := range []string{"sha256", "tags", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &fileBlobStore{dir: dir}, nil
+}
+
+type fileBlobStore struct {
+	dir string
+}
+
+func (s *fileBlobStore) Put(ctx context.Context, r io.Reader) (digest string, err error) {
+	// we don't know the digest before we've read the content, hence we write to a temporary file first
+	f, err := os.CreateTemp(filepath.Join(s.dir, "tmp"), "blob-")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(f, hash), r); err != nil {
+		return "", err
+	}
+	if err = f.Sync(); err != nil {
+		return "", err
+	}
+	if err = f.Close(); err != nil {
+		return "", err
+	}
+
+	hexsum := hex.EncodeToString(hash.Sum(nil))
+	if err = os.Rename(f.Name(), filepath.Join(s.dir, "sha256", hexsum)); err != nil {
+		return "", err
+	}
+	return digestPrefix + hexsum, nil
+}
+
+func (s *fileBlobStore) Get(ctx context.Context, digest string) (io.ReadCloser, error) {
+	hexsum, err := validateDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(s.dir, "sha256", hexsum))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *fileBlobStore) Tag(ctx context.Context, name, digest string) error {
+	if err := validateTag(name); err != nil {
+		return err
+	}
+	if _, err := validateDigest(digest); err != nil {
+		return err
+	}
+
+	// write and rename so that readers never see a partial tag
+	fn := filepath.Join(s.dir, "tags", name)
+	tmp := filepath.Join(s.dir, "tmp", "tag-"+name)
+	if err := os.WriteFile(tmp, []byte(digest), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+func (s *fileBlobStore) Resolve(ctx context.Context, name string) (string, error) {
+	if err := validateTag(name); err != nil {
+		return "", err
+	}
+
+	content, err := os.ReadFile(filepath.Join(s.dir, "tags", name))
+	if os.IsNotExist(err) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
@@ -0,0 +1,60 @@
+package store_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/bhojpur/ufs/pkg/store"
+	"github.com/bhojpur/ufs/pkg/store/storetest"
+	"gotest.tools/v3/assert"
+)
+
+func TestFileBlobStore(t *testing.T) {
+	storetest.TestBlobs(t, func(t *testing.T) store.Blobs {
+		b, err := store.NewFileBlobStore(t.TempDir())
+		assert.NilError(t, err)
+		return b
+	})
+}
+
+func TestFileBlobStoreSurvivesRestart(t *testing.T) {
+	var (
+		ctx = context.Background()
+		dir = t.TempDir()
+	)
+	b, err := store.NewFileBlobStore(dir)
+	assert.NilError(t, err)
+	digest, err := b.Put(ctx, strings.NewReader("config"))
+	assert.NilError(t, err)
+	assert.NilError(t, b.Tag(ctx, "storage.1", digest))
+
+	b, err = store.NewFileBlobStore(dir)
+	assert.NilError(t, err)
+	resolved, err := b.Resolve(ctx, "storage.1")
+	assert.NilError(t, err)
+	assert.Equal(t, resolved, digest)
+	r, err := b.Get(ctx, resolved)
+	assert.NilError(t, err)
+	r.Close()
+}
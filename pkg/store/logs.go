@@ -0,0 +1,199 @@
+package store
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// NewFileLogStore creates a log store which keeps one file per Engine in dir
+func NewFileLogStore(dir string) (Logs, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileLogStore{
+		dir:     dir,
+		writers: make(map[string]*logProgress),
+	}, nil
+}
+
+type fileLogStore struct {
+	dir string
+
+	mu      sync.Mutex
+	writers map[string]*logProgress
+}
+
+// logProgress tracks a log which is currently being written
+type logProgress struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	size   int64
+	closed bool
+}
+
+func (s *fileLogStore) path(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return "", fmt.Errorf("invalid log name %q", name)
+	}
+	return filepath.Join(s.dir, name+".log"), nil
+}
+
+// Open creates the log of an Engine and returns a writer for it
+func (s *fileLogStore) Open(name string) (io.WriteCloser, error) {
+	fn, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.writers[name]; exists {
+		return nil, ErrAlreadyExists
+	}
+
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsExist(err) {
+		return nil, ErrAlreadyExists
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p := &logProgress{}
+	p.cond = sync.NewCond(&p.mu)
+	s.writers[name] = p
+
+	return &logWriter{
+		f:        f,
+		progress: p,
+		done: func() {
+			s.mu.Lock()
+			delete(s.writers, name)
+			s.mu.Unlock()
+		},
+	}, nil
+}
+
+// Read returns a reader for the log of an Engine
+func (s *fileLogStore) Read(name string) (io.ReadCloser, error) {
+	fn, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// we must look up the writer before opening the file - otherwise the writer could
+	// finish in between and we'd miss the end of the log.
+	s.mu.Lock()
+	p := s.writers[name]
+	s.mu.Unlock()
+
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &logReader{f: f, progress: p}, nil
+}
+
+type logWriter struct {
+	f        *os.File
+	progress *logProgress
+	done     func()
+	once     sync.Once
+}
+
+func (w *logWriter) Write(p []byte) (n int, err error) {
+	n, err = w.f.Write(p)
+
+	w.progress.mu.Lock()
+	w.progress.size += int64(n)
+	w.progress.cond.Broadcast()
+	w.progress.mu.Unlock()
+
+	return n, err
+}
+
+func (w *logWriter) Close() error {
+	var err error
+	w.once.Do(func() {
+		err = w.f.Close()
+
+		w.progress.mu.Lock()
+		w.progress.closed = true
+		w.progress.cond.Broadcast()
+		w.progress.mu.Unlock()
+
+		w.done()
+	})
+	return err
+}
+
+type logReader struct {
+	f        *os.File
+	progress *logProgress
+	offset   int64
+	closed   bool
+}
+
+func (r *logReader) Read(p []byte) (n int, err error) {
+	for {
+		n, err = r.f.Read(p)
+		r.offset += int64(n)
+		if err != io.EOF || n > 0 || r.progress == nil {
+			return n, err
+		}
+
+		// we've reached the end of what was written so far - wait for more
+		r.progress.mu.Lock()
+		for r.progress.size <= r.offset && !r.progress.closed && !r.closed {
+			r.progress.cond.Wait()
+		}
+		done := r.progress.size <= r.offset
+		closed := r.closed
+		r.progress.mu.Unlock()
+
+		if closed {
+			return 0, os.ErrClosed
+		}
+		if done {
+			return 0, io.EOF
+		}
+	}
+}
+
+// Close closes the reader and unblocks a pending Read
+func (r *logReader) Close() error {
+	if r.progress != nil {
+		r.progress.mu.Lock()
+		r.closed = true
+		r.progress.cond.Broadcast()
+		r.progress.mu.Unlock()
+	}
+	return r.f.Close()
+}
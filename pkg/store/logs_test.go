@@ -0,0 +1,109 @@
+package store_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/bhojpur/ufs/pkg/store"
+	"gotest.tools/v3/assert"
+)
+
+func TestFileLogStore(t *testing.T) {
+	logs, err := store.NewFileLogStore(t.TempDir())
+	assert.NilError(t, err)
+
+	_, err = logs.Read("storage.1")
+	assert.Equal(t, err, store.ErrNotFound)
+	_, err = logs.Open("../storage.1")
+	assert.ErrorContains(t, err, "invalid log name")
+
+	w, err := logs.Open("storage.1")
+	assert.NilError(t, err)
+	_, err = logs.Open("storage.1")
+	assert.Equal(t, err, store.ErrAlreadyExists)
+
+	_, err = w.Write([]byte("hello "))
+	assert.NilError(t, err)
+
+	follower, err := logs.Read("storage.1")
+	assert.NilError(t, err)
+	defer follower.Close()
+
+	received := make(chan string)
+	go func() {
+		content, err := io.ReadAll(follower)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- string(content)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	_, err = w.Write([]byte("world"))
+	assert.NilError(t, err)
+	assert.NilError(t, w.Close())
+
+	select {
+	case content := <-received:
+		assert.Equal(t, content, "hello world")
+	case <-time.After(5 * time.Second):
+		t.Fatal("follower did not finish after the log was closed")
+	}
+
+	r, err := logs.Read("storage.1")
+	assert.NilError(t, err)
+	content, err := io.ReadAll(r)
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "hello world")
+	assert.NilError(t, r.Close())
+
+	_, err = logs.Open("storage.1")
+	assert.Equal(t, err, store.ErrAlreadyExists, "completed logs must not be overwritten")
+}
+
+func TestFileLogStoreCloseUnblocksReader(t *testing.T) {
+	logs, err := store.NewFileLogStore(t.TempDir())
+	assert.NilError(t, err)
+	w, err := logs.Open("storage.1")
+	assert.NilError(t, err)
+	defer w.Close()
+
+	r, err := logs.Read("storage.1")
+	assert.NilError(t, err)
+
+	done := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 10))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.NilError(t, r.Close())
+
+	select {
+	case err := <-done:
+		assert.Assert(t, err != nil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not unblock Read")
+	}
+}
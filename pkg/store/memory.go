@@ -0,0 +1,124 @@
+package store
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/filterexpr"
+	"google.golang.org/protobuf/proto"
+)
+
+// NewInMemoryEngineStore creates a new Engine store which keeps all Engines in memory
+func NewInMemoryEngineStore() Engines {
+	return &inMemoryEngineStore{
+		engines: make(map[string]*v1.EngineStatus),
+	}
+}
+
+type inMemoryEngineStore struct {
+	mu      sync.RWMutex
+	engines map[string]*v1.EngineStatus
+}
+
+// Store stores the status of an Engine
+func (s *inMemoryEngineStore) Store(ctx context.Context, engine *v1.EngineStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.engines[engine.Name] = proto.Clone(engine).(*v1.EngineStatus)
+	return nil
+}
+
+// Get retrieves the status of a single Engine
+func (s *inMemoryEngineStore) Get(ctx context.Context, name string) (*v1.EngineStatus, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	engine, ok := s.engines[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return proto.Clone(engine).(*v1.EngineStatus), nil
+}
+
+// Find searches for Engines
+func (s *inMemoryEngineStore) Find(ctx context.Context, filter []*v1.FilterExpression, order []*v1.OrderExpression, start, limit int) (slice []*v1.EngineStatus, total int, err error) {
+	if err := filterexpr.Validate(filter, order); err != nil {
+		return nil, 0, err
+	}
+
+	s.mu.RLock()
+	var res []*v1.EngineStatus
+	for _, engine := range s.engines {
+		if !filterexpr.MatchesFilter(engine, filter) {
+			continue
+		}
+		res = append(res, proto.Clone(engine).(*v1.EngineStatus))
+	}
+	s.mu.RUnlock()
+
+	// map iteration order is random - we order by name first so that paging is stable
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	filterexpr.Sort(res, order)
+
+	total = len(res)
+	if start > total {
+		start = total
+	}
+	end := total
+	if limit > 0 && start+limit < end {
+		end = start + limit
+	}
+	return res[start:end], total, nil
+}
+
+// NewInMemoryNumberGroup creates a new number group which keeps its numbers in memory
+func NewInMemoryNumberGroup() NumberGroup {
+	return &inMemoryNumberGroup{
+		groups: make(map[string]int),
+	}
+}
+
+type inMemoryNumberGroup struct {
+	mu     sync.Mutex
+	groups map[string]int
+}
+
+// Latest returns the most recently handed out number of a group
+func (g *inMemoryNumberGroup) Latest(ctx context.Context, group string) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.groups[group], nil
+}
+
+// Next increments the group's number and returns the new value
+func (g *inMemoryNumberGroup) Next(ctx context.Context, group string) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.groups[group]++
+	return g.groups[group], nil
+}
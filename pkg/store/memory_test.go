@@ -0,0 +1,40 @@
+package store_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"testing"
+
+	"github.com/bhojpur/ufs/pkg/store"
+	"github.com/bhojpur/ufs/pkg/store/storetest"
+)
+
+func TestInMemoryEngineStore(t *testing.T) {
+	storetest.TestEngines(t, func(t *testing.T) store.Engines { return store.NewInMemoryEngineStore() })
+}
+
+func TestInMemoryNumberGroup(t *testing.T) {
+	storetest.TestNumberGroup(t, func(t *testing.T) store.NumberGroup { return store.NewInMemoryNumberGroup() })
+}
+
+func TestInMemoryBlobStore(t *testing.T) {
+	storetest.TestBlobs(t, func(t *testing.T) store.Blobs { return store.NewInMemoryBlobStore() })
+}
@@ -0,0 +1,276 @@
+package postgres
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/filterexpr"
+	"github.com/bhojpur/ufs/pkg/store"
+	"google.golang.org/protobuf/proto"
+)
+
+// columns maps filter fields to the engine_status columns holding their value
+var columns = map[string]string{
+	"name":       "name",
+	"owner":      "owner",
+	"phase":      "phase",
+	"trigger":    "engine_trigger",
+	"spec":       "spec",
+	"success":    "success",
+	"created":    "created",
+	"finished":   "finished",
+	"repo.host":  "repo_host",
+	"repo.owner": "repo_owner",
+	"repo.repo":  "repo_repo",
+	"repo.ref":   "repo_ref",
+	"repo.rev":   "repo_rev",
+}
+
+// EngineStore stores Engines in a PostgreSQL database
+type EngineStore struct {
+	DB *sql.DB
+}
+
+// NewEngineStore creates a new Engine store backed by PostgreSQL. The database
+// schema is migrated to the latest version as part of this call.
+func NewEngineStore(ctx context.Context, db *sql.DB) (*EngineStore, error) {
+	if err := Migrate(ctx, db); err != nil {
+		return nil, err
+	}
+	return &EngineStore{DB: db}, nil
+}
+
+var _ store.Engines = &EngineStore{}
+
+// Store stores the status of an Engine
+func (s *EngineStore) Store(ctx context.Context, engine *v1.EngineStatus) error {
+	data, err := proto.Marshal(engine)
+	if err != nil {
+		return err
+	}
+
+	var (
+		cols = []string{"data"}
+		vals = []interface{}{data}
+	)
+	for _, field := range filterexpr.Fields {
+		var val sql.NullString
+		val.String, val.Valid = filterexpr.Field(engine, field)
+		cols = append(cols, columns[field])
+		vals = append(vals, val)
+	}
+
+	var (
+		placeholders = make([]string, len(cols))
+		updates      = make([]string, 0, len(cols))
+	)
+	for i, c := range cols {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		if c != "name" {
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", c, c))
+		}
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO engine_status (%s) VALUES (%s) ON CONFLICT (name) DO UPDATE SET %s",
+		strings.Join(cols, ", "), strings.Join(placeholders, ", "), strings.Join(updates, ", "),
+	), vals...)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM engine_annotations WHERE engine_name = $1", engine.Name)
+	if err != nil {
+		return err
+	}
+	for _, a := range engine.GetMetadata().GetAnnotations() {
+		// filter expressions use the first annotation with a given key, hence we ignore later duplicates
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO engine_annotations (engine_name, key, value) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+			engine.Name, a.Key, a.Value,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Get retrieves the status of a single Engine
+func (s *EngineStore) Get(ctx context.Context, name string) (*v1.EngineStatus, error) {
+	var data []byte
+	err := s.DB.QueryRowContext(ctx, "SELECT data FROM engine_status WHERE name = $1", name).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var res v1.EngineStatus
+	if err := proto.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Find searches for Engines
+func (s *EngineStore) Find(ctx context.Context, filter []*v1.FilterExpression, order []*v1.OrderExpression, start, limit int) (slice []*v1.EngineStatus, total int, err error) {
+	if err := filterexpr.Validate(filter, order); err != nil {
+		return nil, 0, err
+	}
+
+	var args []interface{}
+	where := buildWhere(filter, &args)
+
+	err = s.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM engine_status e"+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := "SELECT data FROM engine_status e" + where + buildOrderBy(order, &args)
+	if limit > 0 {
+		args = append(args, limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	if start > 0 {
+		args = append(args, start)
+		query += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, 0, err
+		}
+
+		var engine v1.EngineStatus
+		if err := proto.Unmarshal(data, &engine); err != nil {
+			return nil, 0, err
+		}
+		slice = append(slice, &engine)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return slice, total, nil
+}
+
+// fieldExpr produces the SQL expression holding the value of a filter field.
+// The expression is NULL if the field is not set.
+func fieldExpr(field string, args *[]interface{}) string {
+	if strings.HasPrefix(field, filterexpr.AnnotationPrefix) {
+		*args = append(*args, strings.TrimPrefix(field, filterexpr.AnnotationPrefix))
+		return fmt.Sprintf("(SELECT a.value FROM engine_annotations a WHERE a.engine_name = e.name AND a.key = $%d)", len(*args))
+	}
+	return "e." + columns[field]
+}
+
+// escapeLike escapes all LIKE wildcards in s
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func buildTerm(term *v1.FilterTerm, args *[]interface{}) string {
+	col := fieldExpr(term.Field, args)
+
+	var (
+		expr  string
+		value string
+	)
+	switch term.Operation {
+	case v1.FilterOp_OP_EXISTS:
+		expr = col + " IS NOT NULL"
+	case v1.FilterOp_OP_EQUALS:
+		expr, value = "COALESCE(%s, '') = $%d", term.Value
+	case v1.FilterOp_OP_STARTS_WITH:
+		expr, value = `COALESCE(%s, '') LIKE $%d ESCAPE '\'`, escapeLike(term.Value)+"%"
+	case v1.FilterOp_OP_ENDS_WITH:
+		expr, value = `COALESCE(%s, '') LIKE $%d ESCAPE '\'`, "%"+escapeLike(term.Value)
+	case v1.FilterOp_OP_CONTAINS:
+		expr, value = `COALESCE(%s, '') LIKE $%d ESCAPE '\'`, "%"+escapeLike(term.Value)+"%"
+	}
+	if term.Operation != v1.FilterOp_OP_EXISTS {
+		*args = append(*args, value)
+		expr = fmt.Sprintf(expr, col, len(*args))
+	}
+
+	if term.Negate {
+		return "NOT (" + expr + ")"
+	}
+	return expr
+}
+
+// buildWhere translates a filter into a WHERE clause. Expressions are AND'ed, the terms
+// within an expression are OR'ed.
+func buildWhere(filter []*v1.FilterExpression, args *[]interface{}) string {
+	var exprs []string
+	for _, f := range filter {
+		if len(f.Terms) == 0 {
+			continue
+		}
+
+		terms := make([]string, len(f.Terms))
+		for i, t := range f.Terms {
+			terms[i] = buildTerm(t, args)
+		}
+		exprs = append(exprs, "("+strings.Join(terms, " OR ")+")")
+	}
+	if len(exprs) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(exprs, " AND ")
+}
+
+// buildOrderBy translates the order expressions into an ORDER BY clause. Values are
+// compared byte-wise and unset fields compare as empty string. The name is always
+// used as last order criteria so that paging is stable.
+func buildOrderBy(order []*v1.OrderExpression, args *[]interface{}) string {
+	var exprs []string
+	for _, o := range order {
+		dir := "DESC"
+		if o.Ascending {
+			dir = "ASC"
+		}
+		exprs = append(exprs, fmt.Sprintf(`COALESCE(%s, '') COLLATE "C" %s`, fieldExpr(o.Field, args), dir))
+	}
+	exprs = append(exprs, `e.name COLLATE "C" ASC`)
+	return " ORDER BY " + strings.Join(exprs, ", ")
+}
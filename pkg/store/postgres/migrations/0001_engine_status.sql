@@ -0,0 +1,32 @@
+CREATE TABLE IF NOT EXISTS engine_status (
+    name           TEXT PRIMARY KEY,
+    data           BYTEA NOT NULL,
+    owner          TEXT,
+    phase          TEXT,
+    engine_trigger TEXT,
+    spec           TEXT,
+    success        TEXT,
+    created        TEXT,
+    finished       TEXT,
+    repo_host      TEXT,
+    repo_owner     TEXT,
+    repo_repo      TEXT,
+    repo_ref       TEXT,
+    repo_rev       TEXT
+);
+
+CREATE INDEX IF NOT EXISTS engine_status_owner_idx ON engine_status (owner);
+CREATE INDEX IF NOT EXISTS engine_status_phase_idx ON engine_status (phase);
+CREATE INDEX IF NOT EXISTS engine_status_created_idx ON engine_status (created);
+
+CREATE TABLE IF NOT EXISTS engine_annotations (
+    engine_name TEXT NOT NULL REFERENCES engine_status (name) ON DELETE CASCADE,
+    key         TEXT NOT NULL,
+    value       TEXT NOT NULL,
+    PRIMARY KEY (engine_name, key)
+);
+
+CREATE TABLE IF NOT EXISTS number_group (
+    name TEXT PRIMARY KEY,
+    val  INTEGER NOT NULL
+);
@@ -0,0 +1,135 @@
+package postgres
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/store"
+	"github.com/bhojpur/ufs/pkg/store/storetest"
+	_ "github.com/lib/pq"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/skip"
+)
+
+// testDSN points to a PostgreSQL database used by the tests. All data in that database is
+// deleted by the tests.
+var testDSN = os.Getenv("UFS_TEST_POSTGRES_DSN")
+
+func newTestDB(t *testing.T) *sql.DB {
+	skip.If(t, testDSN == "", "UFS_TEST_POSTGRES_DSN is not set")
+
+	db, err := sql.Open("postgres", testDSN)
+	assert.NilError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	ctx := context.Background()
+	assert.NilError(t, Migrate(ctx, db))
+	_, err = db.ExecContext(ctx, "TRUNCATE engine_status, engine_annotations, number_group")
+	assert.NilError(t, err)
+	return db
+}
+
+func TestEngineStore(t *testing.T) {
+	skip.If(t, testDSN == "", "UFS_TEST_POSTGRES_DSN is not set")
+	storetest.TestEngines(t, func(t *testing.T) store.Engines {
+		s, err := NewEngineStore(context.Background(), newTestDB(t))
+		assert.NilError(t, err)
+		return s
+	})
+}
+
+func TestNumberGroup(t *testing.T) {
+	skip.If(t, testDSN == "", "UFS_TEST_POSTGRES_DSN is not set")
+	storetest.TestNumberGroup(t, func(t *testing.T) store.NumberGroup {
+		g, err := NewNumberGroup(context.Background(), newTestDB(t))
+		assert.NilError(t, err)
+		return g
+	})
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	db := newTestDB(t)
+	assert.NilError(t, Migrate(context.Background(), db))
+}
+
+func TestLoadMigrations(t *testing.T) {
+	ms, err := loadMigrations()
+	assert.NilError(t, err)
+	assert.Assert(t, len(ms) > 0)
+	for i, m := range ms {
+		assert.Equal(t, m.Version, i+1, "migrations must be numbered consecutively: %s", m.Name)
+	}
+}
+
+func TestBuildWhere(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Filter   []*v1.FilterExpression
+		Expected string
+		Args     []interface{}
+	}{
+		{Name: "empty"},
+		{
+			Name:     "equals",
+			Filter:   []*v1.FilterExpression{{Terms: []*v1.FilterTerm{{Field: "owner", Value: "alice"}}}},
+			Expected: " WHERE (COALESCE(e.owner, '') = $1)",
+			Args:     []interface{}{"alice"},
+		},
+		{
+			Name: "or'ed terms and negation",
+			Filter: []*v1.FilterExpression{{Terms: []*v1.FilterTerm{
+				{Field: "repo.ref", Value: "main", Operation: v1.FilterOp_OP_ENDS_WITH},
+				{Field: "name", Value: "50%", Operation: v1.FilterOp_OP_CONTAINS, Negate: true},
+			}}},
+			Expected: ` WHERE (COALESCE(e.repo_ref, '') LIKE $1 ESCAPE '\' OR NOT (COALESCE(e.name, '') LIKE $2 ESCAPE '\'))`,
+			Args:     []interface{}{"%main", `%50\%%`},
+		},
+		{
+			Name: "and'ed expressions with annotation",
+			Filter: []*v1.FilterExpression{
+				{Terms: []*v1.FilterTerm{{Field: "annotation.nightly", Operation: v1.FilterOp_OP_EXISTS}}},
+				{Terms: []*v1.FilterTerm{{Field: "trigger", Value: "push", Operation: v1.FilterOp_OP_STARTS_WITH}}},
+			},
+			Expected: ` WHERE ((SELECT a.value FROM engine_annotations a WHERE a.engine_name = e.name AND a.key = $1) IS NOT NULL) AND (COALESCE(e.engine_trigger, '') LIKE $2 ESCAPE '\')`,
+			Args:     []interface{}{"nightly", "push%"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var args []interface{}
+			assert.Equal(t, buildWhere(test.Filter, &args), test.Expected)
+			assert.DeepEqual(t, args, test.Args)
+		})
+	}
+}
+
+func TestBuildOrderBy(t *testing.T) {
+	var args []interface{}
+	act := buildOrderBy([]*v1.OrderExpression{{Field: "created"}, {Field: "annotation.nightly", Ascending: true}}, &args)
+	assert.Equal(t, act, ` ORDER BY COALESCE(e.created, '') COLLATE "C" DESC, COALESCE((SELECT a.value FROM engine_annotations a WHERE a.engine_name = e.name AND a.key = $1), '') COLLATE "C" ASC, e.name COLLATE "C" ASC`)
+	assert.DeepEqual(t, args, []interface{}{"nightly"})
+}
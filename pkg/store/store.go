@@ -0,0 +1,94 @@
+package store
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+)
+
+var (
+	// ErrNotFound is returned by Get if the Engine does not exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrAlreadyExists is returned when attempting to create something that exists already
+	ErrAlreadyExists = errors.New("exists already")
+)
+
+// Blobs is a content-addressed store, e.g. for the inputs Engines were started from
+type Blobs interface {
+	// Put stores the content read from r and returns its digest in the form "sha256:<hex>".
+	// Storing the same content twice yields the same digest.
+	Put(ctx context.Context, r io.Reader) (digest string, err error)
+
+	// Get returns the content with the given digest. If there is no such content,
+	// ErrNotFound is returned.
+	Get(ctx context.Context, digest string) (io.ReadCloser, error)
+
+	// Tag points a name at a digest, replacing whatever the name pointed at before
+	Tag(ctx context.Context, name, digest string) error
+
+	// Resolve returns the digest a name points at. If the name is unknown, ErrNotFound is returned.
+	Resolve(ctx context.Context, name string) (digest string, err error)
+}
+
+// Logs provides access to the log output of Engines
+type Logs interface {
+	// Open creates the log of an Engine and returns a writer for it. There can
+	// only be one writer per Engine. Once the writer is closed, the log is complete.
+	Open(name string) (io.WriteCloser, error)
+
+	// Read returns a reader for the log of an Engine, starting at its beginning.
+	// While the log is being written the reader follows it, i.e. it blocks until more
+	// output is available, and returns io.EOF only once the log is complete.
+	// If the log does not exist, ErrNotFound is returned.
+	Read(name string) (io.ReadCloser, error)
+}
+
+// Engines provides access to the status of Engines
+type Engines interface {
+	// Store stores the status of an Engine. If an Engine with the same name
+	// exists already, it is replaced.
+	Store(ctx context.Context, engine *v1.EngineStatus) error
+
+	// Get retrieves the status of a single Engine. If the Engine does not exist,
+	// ErrNotFound is returned.
+	Get(ctx context.Context, name string) (*v1.EngineStatus, error)
+
+	// Find searches for Engines matching the filter, orders them and returns the
+	// page starting at start with at most limit entries. A limit of zero means no limit.
+	// Total is the number of Engines matching the filter irrespective of paging.
+	Find(ctx context.Context, filter []*v1.FilterExpression, order []*v1.OrderExpression, start, limit int) (slice []*v1.EngineStatus, total int, err error)
+}
+
+// NumberGroup hands out monotonically increasing numbers per group
+type NumberGroup interface {
+	// Latest returns the most recently handed out number of a group, or zero
+	// if the group has not handed out a number yet.
+	Latest(ctx context.Context, group string) (int, error)
+
+	// Next increments the group's number and returns the new value. The first
+	// number of a group is one.
+	Next(ctx context.Context, group string) (int, error)
+}
@@ -0,0 +1,247 @@
+package storetest
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/store"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+// Fixture returns the Engines used by TestEngines
+func Fixture() []*v1.EngineStatus {
+	created := time.Date(2021, 10, 1, 8, 0, 0, 0, time.UTC)
+	engine := func(name, owner string, phase v1.EnginePhase, success bool, offset time.Duration, annotations ...string) *v1.EngineStatus {
+		var annos []*v1.Annotation
+		for i := 0; i+1 < len(annotations); i += 2 {
+			annos = append(annos, &v1.Annotation{Key: annotations[i], Value: annotations[i+1]})
+		}
+		return &v1.EngineStatus{
+			Name:  name,
+			Phase: phase,
+			Metadata: &v1.EngineMetadata{
+				Owner:       owner,
+				Repository:  &v1.Repository{Host: "github.com", Owner: "bhojpur", Repo: "storage", Ref: "refs/heads/main"},
+				Trigger:     v1.EngineTrigger_TRIGGER_PUSH,
+				Created:     timestamppb.New(created.Add(offset)),
+				Annotations: annos,
+			},
+			Conditions: &v1.EngineConditions{Success: success},
+		}
+	}
+
+	return []*v1.EngineStatus{
+		engine("storage.1", "alice", v1.EnginePhase_PHASE_DONE, true, 0, "nightly", "true"),
+		engine("storage.2", "bob", v1.EnginePhase_PHASE_DONE, false, time.Minute),
+		engine("storage.3", "alice", v1.EnginePhase_PHASE_RUNNING, false, 2*time.Minute, "nightly", "false", "50%_off", "yes"),
+		engine("backup.1", "carol", v1.EnginePhase_PHASE_WAITING, false, 3*time.Minute),
+	}
+}
+
+// TestEngines runs the Engine store contract against the store produced by factory.
+// The factory must return an empty store.
+func TestEngines(t *testing.T, factory func(t *testing.T) store.Engines) {
+	ctx := context.Background()
+
+	t.Run("get unknown", func(t *testing.T) {
+		s := factory(t)
+		_, err := s.Get(ctx, "does-not-exist")
+		assert.Equal(t, err, store.ErrNotFound)
+	})
+
+	t.Run("store and get", func(t *testing.T) {
+		s := factory(t)
+		engine := Fixture()[2]
+		assert.NilError(t, s.Store(ctx, engine))
+
+		res, err := s.Get(ctx, engine.Name)
+		assert.NilError(t, err)
+		assert.Check(t, proto.Equal(res, engine), "got %v", res)
+
+		engine.Phase = v1.EnginePhase_PHASE_DONE
+		engine.Metadata.Annotations = engine.Metadata.Annotations[:1]
+		assert.NilError(t, s.Store(ctx, engine))
+		res, err = s.Get(ctx, engine.Name)
+		assert.NilError(t, err)
+		assert.Check(t, proto.Equal(res, engine), "got %v", res)
+	})
+
+	s := factory(t)
+	for _, engine := range Fixture() {
+		assert.NilError(t, s.Store(ctx, engine))
+	}
+
+	term := func(field, value string, op v1.FilterOp, negate bool) *v1.FilterExpression {
+		return &v1.FilterExpression{Terms: []*v1.FilterTerm{{Field: field, Value: value, Operation: op, Negate: negate}}}
+	}
+	tests := []struct {
+		Name     string
+		Filter   []*v1.FilterExpression
+		Order    []*v1.OrderExpression
+		Start    int
+		Limit    int
+		Expected []string
+		Total    int
+	}{
+		{Name: "no filter", Expected: []string{"backup.1", "storage.1", "storage.2", "storage.3"}, Total: 4},
+		{Name: "equals", Filter: []*v1.FilterExpression{term("owner", "alice", v1.FilterOp_OP_EQUALS, false)}, Expected: []string{"storage.1", "storage.3"}, Total: 2},
+		{Name: "not equals", Filter: []*v1.FilterExpression{term("owner", "alice", v1.FilterOp_OP_EQUALS, true)}, Expected: []string{"backup.1", "storage.2"}, Total: 2},
+		{Name: "starts with", Filter: []*v1.FilterExpression{term("name", "back", v1.FilterOp_OP_STARTS_WITH, false)}, Expected: []string{"backup.1"}, Total: 1},
+		{Name: "not starts with", Filter: []*v1.FilterExpression{term("name", "back", v1.FilterOp_OP_STARTS_WITH, true)}, Expected: []string{"storage.1", "storage.2", "storage.3"}, Total: 3},
+		{Name: "ends with", Filter: []*v1.FilterExpression{term("name", ".1", v1.FilterOp_OP_ENDS_WITH, false)}, Expected: []string{"backup.1", "storage.1"}, Total: 2},
+		{Name: "contains", Filter: []*v1.FilterExpression{term("owner", "o", v1.FilterOp_OP_CONTAINS, false)}, Expected: []string{"backup.1", "storage.2"}, Total: 2},
+		{Name: "contains wildcard literally", Filter: []*v1.FilterExpression{term("name", "%", v1.FilterOp_OP_CONTAINS, false)}, Total: 0},
+		{Name: "exists", Filter: []*v1.FilterExpression{term("annotation.nightly", "", v1.FilterOp_OP_EXISTS, false)}, Expected: []string{"storage.1", "storage.3"}, Total: 2},
+		{Name: "not exists", Filter: []*v1.FilterExpression{term("annotation.nightly", "", v1.FilterOp_OP_EXISTS, true)}, Expected: []string{"backup.1", "storage.2"}, Total: 2},
+		{Name: "annotation equals", Filter: []*v1.FilterExpression{term("annotation.nightly", "true", v1.FilterOp_OP_EQUALS, false)}, Expected: []string{"storage.1"}, Total: 1},
+		{Name: "annotation key with wildcards", Filter: []*v1.FilterExpression{term("annotation.50%_off", "y", v1.FilterOp_OP_STARTS_WITH, false)}, Expected: []string{"storage.3"}, Total: 1},
+		{Name: "phase", Filter: []*v1.FilterExpression{term("phase", "done", v1.FilterOp_OP_EQUALS, false)}, Expected: []string{"storage.1", "storage.2"}, Total: 2},
+		{Name: "success", Filter: []*v1.FilterExpression{term("success", "true", v1.FilterOp_OP_EQUALS, false)}, Expected: []string{"storage.1"}, Total: 1},
+		{Name: "trigger", Filter: []*v1.FilterExpression{term("trigger", "push", v1.FilterOp_OP_EQUALS, false)}, Expected: []string{"backup.1", "storage.1", "storage.2", "storage.3"}, Total: 4},
+		{Name: "repo", Filter: []*v1.FilterExpression{term("repo.ref", "main", v1.FilterOp_OP_ENDS_WITH, false)}, Expected: []string{"backup.1", "storage.1", "storage.2", "storage.3"}, Total: 4},
+		{Name: "unset field exists", Filter: []*v1.FilterExpression{term("finished", "", v1.FilterOp_OP_EXISTS, false)}, Total: 0},
+		{
+			Name: "terms are or'ed",
+			Filter: []*v1.FilterExpression{{Terms: []*v1.FilterTerm{
+				{Field: "owner", Value: "bob"},
+				{Field: "owner", Value: "carol"},
+			}}},
+			Expected: []string{"backup.1", "storage.2"},
+			Total:    2,
+		},
+		{
+			Name: "expressions are and'ed",
+			Filter: []*v1.FilterExpression{
+				term("owner", "alice", v1.FilterOp_OP_EQUALS, false),
+				term("phase", "running", v1.FilterOp_OP_EQUALS, false),
+			},
+			Expected: []string{"storage.3"},
+			Total:    1,
+		},
+		{Name: "order descending", Order: []*v1.OrderExpression{{Field: "created"}}, Expected: []string{"backup.1", "storage.3", "storage.2", "storage.1"}, Total: 4},
+		{
+			Name:     "order by multiple fields",
+			Order:    []*v1.OrderExpression{{Field: "owner", Ascending: true}, {Field: "created"}},
+			Expected: []string{"storage.3", "storage.1", "storage.2", "backup.1"},
+			Total:    4,
+		},
+		{Name: "order by annotation", Order: []*v1.OrderExpression{{Field: "annotation.nightly", Ascending: true}}, Expected: []string{"backup.1", "storage.2", "storage.3", "storage.1"}, Total: 4},
+		{Name: "paging", Order: []*v1.OrderExpression{{Field: "created", Ascending: true}}, Start: 1, Limit: 2, Expected: []string{"storage.2", "storage.3"}, Total: 4},
+		{Name: "paging beyond end", Start: 10, Limit: 2, Total: 4},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			res, total, err := s.Find(ctx, test.Filter, test.Order, test.Start, test.Limit)
+			assert.NilError(t, err)
+			assert.Equal(t, total, test.Total)
+
+			var names []string
+			for _, r := range res {
+				names = append(names, r.Name)
+			}
+			assert.DeepEqual(t, names, test.Expected)
+		})
+	}
+
+	t.Run("invalid field", func(t *testing.T) {
+		_, _, err := s.Find(ctx, []*v1.FilterExpression{term("foobar", "", v1.FilterOp_OP_EXISTS, false)}, nil, 0, 0)
+		assert.Check(t, is.ErrorContains(err, "unknown filter field"))
+	})
+}
+
+// TestNumberGroup runs the number group contract against the group produced by factory.
+// The factory must return an empty number group.
+func TestNumberGroup(t *testing.T, factory func(t *testing.T) store.NumberGroup) {
+	ctx := context.Background()
+	g := factory(t)
+
+	nr, err := g.Latest(ctx, "storage")
+	assert.NilError(t, err)
+	assert.Equal(t, nr, 0)
+
+	for i := 1; i <= 3; i++ {
+		nr, err = g.Next(ctx, "storage")
+		assert.NilError(t, err)
+		assert.Equal(t, nr, i, fmt.Sprintf("iteration %d", i))
+	}
+	nr, err = g.Next(ctx, "backup")
+	assert.NilError(t, err)
+	assert.Equal(t, nr, 1)
+
+	nr, err = g.Latest(ctx, "storage")
+	assert.NilError(t, err)
+	assert.Equal(t, nr, 3)
+}
+
+// TestBlobs runs the blob store contract against the store produced by factory
+func TestBlobs(t *testing.T, factory func(t *testing.T) store.Blobs) {
+	ctx := context.Background()
+	b := factory(t)
+
+	get := func(digest string) string {
+		t.Helper()
+		r, err := b.Get(ctx, digest)
+		assert.NilError(t, err)
+		defer r.Close()
+		content, err := io.ReadAll(r)
+		assert.NilError(t, err)
+		return string(content)
+	}
+
+	digest, err := b.Put(ctx, strings.NewReader("hello world"))
+	assert.NilError(t, err)
+	assert.Equal(t, digest, "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9")
+	assert.Equal(t, get(digest), "hello world")
+
+	again, err := b.Put(ctx, strings.NewReader("hello world"))
+	assert.NilError(t, err)
+	assert.Equal(t, again, digest)
+
+	empty, err := b.Put(ctx, strings.NewReader(""))
+	assert.NilError(t, err)
+	assert.Equal(t, get(empty), "")
+
+	_, err = b.Get(ctx, "sha256:0000000000000000000000000000000000000000000000000000000000000000")
+	assert.Equal(t, err, store.ErrNotFound)
+	_, err = b.Get(ctx, "sha256:../../etc/passwd")
+	assert.ErrorContains(t, err, "invalid digest")
+
+	_, err = b.Resolve(ctx, "storage.1")
+	assert.Equal(t, err, store.ErrNotFound)
+	assert.NilError(t, b.Tag(ctx, "storage.1", empty))
+	assert.NilError(t, b.Tag(ctx, "storage.1", digest))
+	resolved, err := b.Resolve(ctx, "storage.1")
+	assert.NilError(t, err)
+	assert.Equal(t, resolved, digest)
+
+	assert.ErrorContains(t, b.Tag(ctx, "../storage.1", digest), "invalid tag")
+	assert.ErrorContains(t, b.Tag(ctx, "storage.2", "md5:abc"), "invalid digest")
+}
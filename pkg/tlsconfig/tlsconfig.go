@@ -0,0 +1,219 @@
+package tlsconfig
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bhojpur/ufs/pkg/filenotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// Reloader serves a certificate and client CA which are reloaded whenever their files change.
+// If a reload fails, the previous certificate remains in use.
+type Reloader struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+
+	watcher filenotify.FileWatcher
+	done    chan struct{}
+}
+
+// NewReloader loads a certificate and, if clientCAFile is not empty, the CA which signs client
+// certificates. Call Watch to reload them on change.
+func NewReloader(certFile, keyFile, clientCAFile string) (*Reloader, error) {
+	r := &Reloader{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: clientCAFile,
+		done:         make(chan struct{}),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate and client CA from their files
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load certificate: %w", err)
+	}
+	var clientCA *x509.CertPool
+	if r.ClientCAFile != "" {
+		clientCA, err = LoadCertPool(r.ClientCAFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCA = clientCA
+	r.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the certificate and client CA whenever their files change until Close is called.
+// It watches the directories of the files, so that files which are replaced rather than written,
+// e.g. Kubernetes secret volumes, are picked up, too.
+func (r *Reloader) Watch() error {
+	watcher, err := filenotify.New()
+	if err != nil {
+		return err
+	}
+
+	dirs := make(map[string]struct{})
+	for _, fn := range []string{r.CertFile, r.KeyFile, r.ClientCAFile} {
+		if fn == "" {
+			continue
+		}
+		dirs[filepath.Dir(fn)] = struct{}{}
+	}
+	for dir := range dirs {
+		err := watcher.Add(dir)
+		if err != nil {
+			watcher.Close()
+			return fmt.Errorf("cannot watch %s: %w", dir, err)
+		}
+	}
+	r.watcher = watcher
+
+	go func() {
+		for {
+			select {
+			case <-r.done:
+				return
+			case evt, ok := <-watcher.Events():
+				if !ok {
+					return
+				}
+				err := r.Reload()
+				if err != nil {
+					log.WithError(err).WithField("event", evt.String()).Warn("cannot reload TLS certificate - keeping the previous one")
+					continue
+				}
+				log.WithField("event", evt.String()).Debug("reloaded TLS certificate")
+			case err, ok := <-watcher.Errors():
+				if !ok {
+					return
+				}
+				log.WithError(err).Warn("error while watching TLS certificate")
+			}
+		}
+	}()
+	return nil
+}
+
+// Close stops watching for changes
+func (r *Reloader) Close() error {
+	select {
+	case <-r.done:
+		return nil
+	default:
+		close(r.done)
+	}
+	if r.watcher == nil {
+		return nil
+	}
+	return r.watcher.Close()
+}
+
+// Certificate returns the current certificate
+func (r *Reloader) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+// ServerConfig produces a TLS config which always uses the current certificate. If there is a
+// client CA, clients must present a certificate signed by it.
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+			if r.clientCA != nil {
+				cfg.ClientCAs = r.clientCA
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// ClientConfig produces a TLS config for clients. Server certificates are verified against caFile,
+// or the system's roots if caFile is empty. If certFile is not empty, the client presents that certificate.
+func ClientConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("client certificate and key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// LoadCertPool reads a PEM file of CA certificates
+func LoadCertPool(fn string) (*x509.CertPool, error) {
+	content, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("cannot load CA: %s contains no PEM certificates", fn)
+	}
+	return pool, nil
+}
@@ -0,0 +1,135 @@
+package tlsconfig
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+)
+
+func serveTLS(t *testing.T, cfg *tls.Config) string {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	assert.NilError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = conn.(*tls.Conn).Handshake()
+				_, _ = conn.Write([]byte("hello"))
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func handshake(addr string, cfg *tls.Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	d := tls.Dialer{Config: cfg}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// TLS 1.3 reports rejected client certificates on the first read
+	buf := make([]byte, 5)
+	_, err = conn.Read(buf)
+	return err
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	assert.NilError(t, GenerateDevCA(dir, []string{"localhost", "127.0.0.1"}))
+	assert.ErrorContains(t, GenerateDevCA(dir, nil), "exists already")
+
+	r, err := NewReloader(filepath.Join(dir, ServerFile), filepath.Join(dir, ServerKeyFile), filepath.Join(dir, CAFile))
+	assert.NilError(t, err)
+	addr := serveTLS(t, r.ServerConfig())
+
+	cfg, err := ClientConfig(filepath.Join(dir, CAFile), filepath.Join(dir, ClientFile), filepath.Join(dir, ClientKeyFile), "")
+	assert.NilError(t, err)
+	cfg.ServerName = "localhost"
+	assert.NilError(t, handshake(addr, cfg))
+
+	// without client certificate
+	cfg, err = ClientConfig(filepath.Join(dir, CAFile), "", "", "localhost")
+	assert.NilError(t, err)
+	assert.Check(t, handshake(addr, cfg) != nil)
+
+	// a client which does not trust the CA
+	cfg, err = ClientConfig("", filepath.Join(dir, ClientFile), filepath.Join(dir, ClientKeyFile), "localhost")
+	assert.NilError(t, err)
+	assert.Check(t, handshake(addr, cfg) != nil)
+
+	_, err = ClientConfig(filepath.Join(dir, CAFile), filepath.Join(dir, ClientFile), "", "localhost")
+	assert.ErrorContains(t, err, "must be set together")
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	assert.NilError(t, GenerateDevCA(dir, []string{"localhost"}))
+	r, err := NewReloader(filepath.Join(dir, ServerFile), filepath.Join(dir, ServerKeyFile), "")
+	assert.NilError(t, err)
+	assert.NilError(t, r.Watch())
+	defer r.Close()
+	addr := serveTLS(t, r.ServerConfig())
+
+	cfg, err := ClientConfig(filepath.Join(dir, CAFile), "", "", "localhost")
+	assert.NilError(t, err)
+	assert.NilError(t, handshake(addr, cfg))
+
+	// a certificate of another CA replaces the current one
+	other := t.TempDir()
+	assert.NilError(t, GenerateDevCA(other, []string{"localhost"}))
+	otherCfg, err := ClientConfig(filepath.Join(other, CAFile), "", "", "localhost")
+	assert.NilError(t, err)
+	assert.Check(t, handshake(addr, otherCfg) != nil)
+
+	// a broken certificate keeps the current one in place
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, ServerFile), []byte("broken"), 0644))
+	time.Sleep(100 * time.Millisecond)
+	assert.NilError(t, handshake(addr, cfg))
+
+	for _, fn := range []string{ServerKeyFile, ServerFile} {
+		content, err := os.ReadFile(filepath.Join(other, fn))
+		assert.NilError(t, err)
+		assert.NilError(t, os.WriteFile(filepath.Join(dir, fn), content, 0600))
+	}
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		if err := handshake(addr, otherCfg); err != nil {
+			return poll.Continue("certificate was not reloaded: %v", err)
+		}
+		return poll.Success()
+	}, poll.WithTimeout(10*time.Second), poll.WithDelay(50*time.Millisecond))
+}
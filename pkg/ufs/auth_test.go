@@ -0,0 +1,109 @@
+package ufs
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func newTestAuthClient(t *testing.T, srv *Service) v1.UfsServiceClient {
+	t.Helper()
+
+	tokens, err := auth.NewStaticTokens([]auth.StaticToken{
+		{Token: "alice-secret", Identity: auth.Identity{Name: "alice"}},
+		{Token: "bob-secret", Identity: auth.Identity{Name: "bob"}},
+		{Token: "root-secret", Identity: auth.Identity{Name: "root", Admin: true}},
+	})
+	assert.NilError(t, err)
+	srv.Authorizer = auth.OwnerPolicy{}
+
+	l := bufconn.Listen(1024 * 1024)
+	gs := grpc.NewServer(
+		grpc.UnaryInterceptor(auth.UnaryServerInterceptor(tokens, nil)),
+		grpc.StreamInterceptor(auth.StreamServerInterceptor(tokens, nil)),
+	)
+	v1.RegisterUfsServiceServer(gs, srv)
+	go gs.Serve(l)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return l.Dial() }),
+		grpc.WithInsecure(),
+	)
+	assert.NilError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return v1.NewUfsServiceClient(conn)
+}
+
+func as(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func TestAuthorization(t *testing.T) {
+	client := newTestAuthClient(t, newTestService())
+
+	_, err := client.ListEngines(context.Background(), &v1.ListEnginesRequest{})
+	assert.Check(t, is.Equal(status.Code(err), codes.Unauthenticated))
+
+	// the owner defaults to the caller, who cannot start Engines on behalf of others
+	resp, err := client.StartEngine(as("alice-secret"), &v1.StartEngineRequest{Metadata: &v1.EngineMetadata{}, EngineYaml: testEngineYAML})
+	assert.NilError(t, err)
+	assert.Equal(t, resp.Status.Metadata.Owner, "alice")
+	name := resp.Status.Name
+	_, err = client.StartEngine(as("bob-secret"), &v1.StartEngineRequest{Metadata: &v1.EngineMetadata{Owner: "alice"}, EngineYaml: testEngineYAML})
+	assert.Check(t, is.Equal(status.Code(err), codes.PermissionDenied))
+	_, err = client.StartEngine(as("root-secret"), &v1.StartEngineRequest{Metadata: &v1.EngineMetadata{Owner: "alice"}, EngineYaml: testEngineYAML})
+	assert.Check(t, err)
+
+	// everyone can list Engines and follow their updates
+	list, err := client.ListEngines(as("bob-secret"), &v1.ListEnginesRequest{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(list.Total, int32(2)))
+
+	// but only the owner and admins can read logs, stop and replay them
+	listen, err := client.Listen(as("bob-secret"), &v1.ListenRequest{Name: name, Logs: v1.ListenRequestLogs_LOGS_RAW})
+	assert.NilError(t, err)
+	_, err = listen.Recv()
+	assert.Check(t, is.Equal(status.Code(err), codes.PermissionDenied))
+
+	_, err = client.StartFromPreviousEngine(as("bob-secret"), &v1.StartFromPreviousEngineRequest{PreviousEngine: name})
+	assert.Check(t, is.Equal(status.Code(err), codes.PermissionDenied))
+
+	_, err = client.StopEngine(as("bob-secret"), &v1.StopEngineRequest{Name: name})
+	assert.Check(t, is.Equal(status.Code(err), codes.PermissionDenied))
+	_, err = client.StopEngine(as("alice-secret"), &v1.StopEngineRequest{Name: name})
+	assert.Check(t, err)
+	_, err = client.StopEngine(as("root-secret"), &v1.StopEngineRequest{Name: "engine.2"})
+	assert.Check(t, err)
+}
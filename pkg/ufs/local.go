@@ -0,0 +1,388 @@
+package ufs
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/archive"
+	"github.com/bhojpur/ufs/pkg/store"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// UploadLimits restrict the size of the parts of a StartLocalEngine upload. A limit of zero
+// means the part is not limited.
+type UploadLimits struct {
+	ConfigYAML     int64
+	EngineYAML     int64
+	ApplicationTar int64
+	// UnpackedApplicationTar limits the size of the application tar once it is decompressed
+	UnpackedApplicationTar int64
+	Total                  int64
+}
+
+// DefaultUploadLimits are the upload limits used if a service has none configured
+var DefaultUploadLimits = UploadLimits{
+	ConfigYAML:             1 << 20,
+	EngineYAML:             1 << 20,
+	ApplicationTar:         1 << 30,
+	UnpackedApplicationTar: 8 << 30,
+	Total:                  1<<30 + 4<<20,
+}
+
+// uploadPart is a part of a StartLocalEngine upload. Parts must be sent in the order of their value.
+type uploadPart int
+
+const (
+	partNone uploadPart = iota
+	partMetadata
+	partConfigYAML
+	partEngineYAML
+	partApplicationTar
+	partApplicationTarDone
+)
+
+func (p uploadPart) String() string {
+	switch p {
+	case partNone:
+		return "nothing"
+	case partMetadata:
+		return "metadata"
+	case partConfigYAML:
+		return "config_yaml"
+	case partEngineYAML:
+		return "engine_yaml"
+	case partApplicationTar:
+		return "application_tar"
+	case partApplicationTarDone:
+		return "application_tar_done"
+	default:
+		return fmt.Sprintf("part(%d)", int(p))
+	}
+}
+
+// chunked returns true if the part can span multiple consecutive messages
+func (p uploadPart) chunked() bool {
+	return p == partConfigYAML || p == partEngineYAML || p == partApplicationTar
+}
+
+// localUpload is the state machine which consumes a StartLocalEngine request stream
+type localUpload struct {
+	Limits     UploadLimits
+	StagingDir string
+	Untar      func(io.Reader, string, *archive.TarOptions) error
+	// Blobs archives the application tar while it is received, if set
+	Blobs store.Blobs
+
+	Metadata   *v1.EngineMetadata
+	ConfigYAML []byte
+	EngineYAML []byte
+	// ApplicationTar is the digest of the archived application tar
+	ApplicationTar string
+
+	part       uploadPart
+	total      int64
+	tarSize    int64
+	tar        *io.PipeWriter
+	untar      chan error
+	archive    *blobWriter
+	archiveErr error
+}
+
+// Handle advances the upload by a single message
+func (u *localUpload) Handle(req *v1.StartLocalEngineRequest) error {
+	var part uploadPart
+	switch req.Content.(type) {
+	case *v1.StartLocalEngineRequest_Metadata:
+		part = partMetadata
+	case *v1.StartLocalEngineRequest_ConfigYaml:
+		part = partConfigYAML
+	case *v1.StartLocalEngineRequest_EngineYaml:
+		part = partEngineYAML
+	case *v1.StartLocalEngineRequest_ApplicationTar:
+		part = partApplicationTar
+	case *v1.StartLocalEngineRequest_ApplicationTarDone:
+		part = partApplicationTarDone
+	default:
+		return status.Error(codes.InvalidArgument, "empty request")
+	}
+
+	switch {
+	case part == u.part && part.chunked():
+		// continuation of the current part
+	case part == u.part+1:
+		// next part
+	case part == partApplicationTarDone && u.part == partEngineYAML:
+		// the application tar is empty
+	case part <= u.part:
+		return status.Errorf(codes.InvalidArgument, "received %s after %s: duplicate or out of order", part, u.part)
+	default:
+		return status.Errorf(codes.InvalidArgument, "received %s before %s", part, u.part+1)
+	}
+	u.part = part
+
+	u.total += int64(proto.Size(req))
+	if u.Limits.Total > 0 && u.total > u.Limits.Total {
+		return status.Errorf(codes.ResourceExhausted, "upload exceeds the maximum size of %d bytes", u.Limits.Total)
+	}
+
+	switch c := req.Content.(type) {
+	case *v1.StartLocalEngineRequest_Metadata:
+		if c.Metadata == nil {
+			return status.Error(codes.InvalidArgument, "metadata is required")
+		}
+		u.Metadata = c.Metadata
+	case *v1.StartLocalEngineRequest_ConfigYaml:
+		u.ConfigYAML = append(u.ConfigYAML, c.ConfigYaml...)
+		if u.Limits.ConfigYAML > 0 && int64(len(u.ConfigYAML)) > u.Limits.ConfigYAML {
+			return status.Errorf(codes.ResourceExhausted, "config_yaml exceeds the maximum size of %d bytes", u.Limits.ConfigYAML)
+		}
+	case *v1.StartLocalEngineRequest_EngineYaml:
+		u.EngineYAML = append(u.EngineYAML, c.EngineYaml...)
+		if u.Limits.EngineYAML > 0 && int64(len(u.EngineYAML)) > u.Limits.EngineYAML {
+			return status.Errorf(codes.ResourceExhausted, "engine_yaml exceeds the maximum size of %d bytes", u.Limits.EngineYAML)
+		}
+	case *v1.StartLocalEngineRequest_ApplicationTar:
+		u.tarSize += int64(len(c.ApplicationTar))
+		if u.Limits.ApplicationTar > 0 && u.tarSize > u.Limits.ApplicationTar {
+			return status.Errorf(codes.ResourceExhausted, "application_tar exceeds the maximum size of %d bytes", u.Limits.ApplicationTar)
+		}
+		return u.writeTar(c.ApplicationTar)
+	case *v1.StartLocalEngineRequest_ApplicationTarDone:
+		if !c.ApplicationTarDone {
+			return status.Error(codes.InvalidArgument, "application_tar_done must be true")
+		}
+		return u.finishTar()
+	}
+	return nil
+}
+
+// writeTar streams a chunk of the application tar into the unpacking process
+func (u *localUpload) writeTar(chunk []byte) error {
+	if u.tar == nil {
+		if u.Blobs != nil {
+			u.archive = newBlobWriter(u.Blobs)
+		}
+
+		pr, pw := io.Pipe()
+		u.tar = pw
+		u.untar = make(chan error, 1)
+		go func() {
+			err := u.unpack(pr)
+			if err == nil {
+				// consume trailing padding so that the writer does not block
+				_, err = io.Copy(io.Discard, pr)
+			}
+			pr.CloseWithError(err)
+			u.untar <- err
+		}()
+	}
+
+	if _, err := u.tar.Write(chunk); err != nil {
+		u.tar.CloseWithError(err)
+		if uerr := <-u.untar; uerr != nil {
+			err = uerr
+		}
+		u.tar = nil
+		if status.Code(err) == codes.ResourceExhausted {
+			return err
+		}
+		return status.Errorf(codes.InvalidArgument, "cannot unpack application tar: %v", err)
+	}
+	if u.archive != nil {
+		u.archive.Write(chunk)
+	}
+	return nil
+}
+
+func (u *localUpload) unpack(r io.Reader) error {
+	decompressed, err := archive.DecompressStream(r)
+	if err != nil {
+		return err
+	}
+	defer decompressed.Close()
+
+	// the compressed size is limited while receiving, but a small archive can decompress to a lot
+	unpacked := &countingReader{r: decompressed, limit: u.Limits.UnpackedApplicationTar}
+	err = u.Untar(unpacked, u.StagingDir, &archive.TarOptions{NoLchown: true})
+	if unpacked.exceeded() {
+		return status.Errorf(codes.ResourceExhausted, "unpacked application_tar exceeds the maximum size of %d bytes", unpacked.limit)
+	}
+	return err
+}
+
+// countingReader fails once more than limit bytes have been read, unless the limit is zero
+type countingReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+}
+
+var errLimitExceeded = errors.New("limit exceeded")
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	if c.exceeded() {
+		return 0, errLimitExceeded
+	}
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if c.exceeded() {
+		return n, errLimitExceeded
+	}
+	return n, err
+}
+
+func (c *countingReader) exceeded() bool {
+	return c.limit > 0 && c.n > c.limit
+}
+
+// finishTar waits for the application tar to be unpacked completely
+func (u *localUpload) finishTar() error {
+	if u.tar == nil {
+		return nil
+	}
+
+	u.tar.Close()
+	err := <-u.untar
+	u.tar = nil
+	if status.Code(err) == codes.ResourceExhausted {
+		return err
+	}
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "cannot unpack application tar: %v", err)
+	}
+
+	if u.archive != nil {
+		u.ApplicationTar, u.archiveErr = u.archive.Close()
+		u.archive = nil
+		if u.archiveErr != nil {
+			log.WithError(u.archiveErr).Warn("cannot archive application tar - Engine cannot be replayed")
+		}
+	}
+	return nil
+}
+
+// Abort stops unpacking the application tar. Abort must be called if the upload does not complete.
+func (u *localUpload) Abort(err error) {
+	if u.archive != nil {
+		u.archive.Abort(err)
+		u.archive = nil
+	}
+	if u.tar == nil {
+		return
+	}
+	u.tar.CloseWithError(err)
+	<-u.untar
+	u.tar = nil
+}
+
+// Done returns an error if the upload is incomplete
+func (u *localUpload) Done() error {
+	if u.part != partApplicationTarDone {
+		return status.Errorf(codes.InvalidArgument, "upload is incomplete: expected %s", u.part+1)
+	}
+	return nil
+}
+
+// StartLocalEngine starts an Engine from an upload. The application tar is unpacked while it is
+// received, hence it is never held in memory in its entirety.
+func (srv *Service) StartLocalEngine(inc v1.UfsService_StartLocalEngineServer) error {
+	if srv.isReadOnly() {
+		return errReadOnly
+	}
+	ctx := inc.Context()
+
+	stagingDir, err := srv.stagingDir()
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot create staging directory: %v", err)
+	}
+	uploadDir, err := os.MkdirTemp(stagingDir, "upload-")
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot create staging directory: %v", err)
+	}
+
+	limits := srv.UploadLimits
+	if limits == (UploadLimits{}) {
+		limits = DefaultUploadLimits
+	}
+	upload := &localUpload{
+		Limits:     limits,
+		StagingDir: uploadDir,
+		Untar:      srv.untar(),
+		Blobs:      srv.Blobs,
+	}
+
+	err = func() error {
+		for {
+			req, err := inc.Recv()
+			if err == io.EOF {
+				return upload.Done()
+			}
+			if err != nil {
+				return err
+			}
+			if err := upload.Handle(req); err != nil {
+				return err
+			}
+		}
+	}()
+	srv.Metrics.ingested(upload.total)
+	if err != nil {
+		upload.Abort(err)
+		os.RemoveAll(uploadDir)
+		return err
+	}
+
+	log.WithField("size", upload.total).Debug("received local Engine upload")
+
+	resp, err := srv.startEngine(ctx, upload.Metadata, "", nil, engineInputs{
+		ConfigYAML:     upload.ConfigYAML,
+		EngineYAML:     upload.EngineYAML,
+		ApplicationDir: uploadDir,
+		Replay:         srv.archiveUpload(ctx, upload),
+	})
+	if err != nil {
+		os.RemoveAll(uploadDir)
+		return err
+	}
+
+	return inc.SendAndClose(resp)
+}
+
+// stagingDir returns the directory in which uploaded applications are unpacked
+func (srv *Service) stagingDir() (string, error) {
+	dir := srv.StagingDir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "ufs-staging")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
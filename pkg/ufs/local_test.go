@@ -0,0 +1,192 @@
+package ufs
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/archive"
+	"github.com/bhojpur/ufs/pkg/reexec"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/skip"
+)
+
+func init() {
+	reexec.Init()
+}
+
+func newTestApplicationTar(t *testing.T) []byte {
+	t.Helper()
+
+	src := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(src, "hello.txt"), []byte("hello world"), 0644))
+	assert.NilError(t, os.MkdirAll(filepath.Join(src, "data"), 0755))
+	assert.NilError(t, os.WriteFile(filepath.Join(src, "data", "blob"), bytes.Repeat([]byte("x"), 64<<10), 0644))
+
+	rc, err := archive.Tar(src, archive.Gzip)
+	assert.NilError(t, err)
+	defer rc.Close()
+	res, err := io.ReadAll(rc)
+	assert.NilError(t, err)
+	return res
+}
+
+func newTestLocalService(t *testing.T) *Service {
+	srv := newTestService()
+	srv.StagingDir = t.TempDir()
+	srv.Untar = archive.UntarUncompressed
+	return srv
+}
+
+func chunks(data []byte, size int) []*v1.StartLocalEngineRequest {
+	var res []*v1.StartLocalEngineRequest
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		res = append(res, &v1.StartLocalEngineRequest{Content: &v1.StartLocalEngineRequest_ApplicationTar{ApplicationTar: data[:n]}})
+		data = data[n:]
+	}
+	return res
+}
+
+var (
+	reqMetadata   = &v1.StartLocalEngineRequest{Content: &v1.StartLocalEngineRequest_Metadata{Metadata: &v1.EngineMetadata{Owner: "alice", EngineSpecName: "backup"}}}
+	reqConfigYAML = &v1.StartLocalEngineRequest{Content: &v1.StartLocalEngineRequest_ConfigYaml{ConfigYaml: []byte("defaultEngine: backup.yaml\n")}}
+	reqEngineYAML = &v1.StartLocalEngineRequest{Content: &v1.StartLocalEngineRequest_EngineYaml{EngineYaml: []byte("command: [\"true\"]\n")}}
+	reqDone       = &v1.StartLocalEngineRequest{Content: &v1.StartLocalEngineRequest_ApplicationTarDone{ApplicationTarDone: true}}
+)
+
+func sendLocal(t *testing.T, client v1.UfsServiceClient, reqs []*v1.StartLocalEngineRequest) (*v1.StartEngineResponse, error) {
+	t.Helper()
+
+	stream, err := client.StartLocalEngine(context.Background())
+	assert.NilError(t, err)
+	for _, req := range reqs {
+		if err := stream.Send(req); err != nil {
+			// the server closed the stream - the error is returned by CloseAndRecv
+			break
+		}
+	}
+	return stream.CloseAndRecv()
+}
+
+func TestStartLocalEngine(t *testing.T) {
+	srv := newTestLocalService(t)
+	client := newTestClient(t, srv)
+
+	reqs := []*v1.StartLocalEngineRequest{reqMetadata, reqConfigYAML, reqEngineYAML}
+	reqs = append(reqs, chunks(newTestApplicationTar(t), 1024)...)
+	reqs = append(reqs, reqDone)
+
+	resp, err := sendLocal(t, client, reqs)
+	assert.NilError(t, err)
+	assert.Equal(t, resp.Status.Name, "backup.1")
+	assert.Equal(t, resp.Status.Metadata.Owner, "alice")
+
+	dirs, err := filepath.Glob(filepath.Join(srv.StagingDir, "upload-*", "data", "blob"))
+	assert.NilError(t, err)
+	assert.Equal(t, len(dirs), 1)
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(filepath.Dir(dirs[0])), "hello.txt"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "hello world")
+}
+
+func TestStartLocalEngineChroot(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+
+	srv := newTestLocalService(t)
+	srv.Untar = nil
+	client := newTestClient(t, srv)
+
+	reqs := []*v1.StartLocalEngineRequest{reqMetadata, reqConfigYAML, reqEngineYAML}
+	reqs = append(reqs, chunks(newTestApplicationTar(t), 32<<10)...)
+	reqs = append(reqs, reqDone)
+
+	_, err := sendLocal(t, client, reqs)
+	assert.NilError(t, err)
+
+	files, err := filepath.Glob(filepath.Join(srv.StagingDir, "upload-*", "hello.txt"))
+	assert.NilError(t, err)
+	assert.Equal(t, len(files), 1)
+}
+
+func TestStartLocalEngineWithoutApplication(t *testing.T) {
+	client := newTestClient(t, newTestLocalService(t))
+
+	_, err := sendLocal(t, client, []*v1.StartLocalEngineRequest{reqMetadata, reqConfigYAML, reqEngineYAML, reqDone})
+	assert.NilError(t, err)
+}
+
+func TestStartLocalEngineViolations(t *testing.T) {
+	tarChunk := &v1.StartLocalEngineRequest{Content: &v1.StartLocalEngineRequest_ApplicationTar{ApplicationTar: []byte("not a tar")}}
+	applicationTar := chunks(newTestApplicationTar(t), 16<<10)
+	bomb := append([]*v1.StartLocalEngineRequest{reqMetadata, reqConfigYAML, reqEngineYAML}, append(applicationTar, reqDone)...)
+	tests := []struct {
+		Name   string
+		Reqs   []*v1.StartLocalEngineRequest
+		Limits UploadLimits
+		Code   codes.Code
+	}{
+		{Name: "empty stream", Code: codes.InvalidArgument},
+		{Name: "config before metadata", Reqs: []*v1.StartLocalEngineRequest{reqConfigYAML}, Code: codes.InvalidArgument},
+		{Name: "duplicate metadata", Reqs: []*v1.StartLocalEngineRequest{reqMetadata, reqMetadata}, Code: codes.InvalidArgument},
+		{Name: "missing config", Reqs: []*v1.StartLocalEngineRequest{reqMetadata, reqEngineYAML}, Code: codes.InvalidArgument},
+		{Name: "config after engine", Reqs: []*v1.StartLocalEngineRequest{reqMetadata, reqConfigYAML, reqEngineYAML, reqConfigYAML}, Code: codes.InvalidArgument},
+		{Name: "message after done", Reqs: []*v1.StartLocalEngineRequest{reqMetadata, reqConfigYAML, reqEngineYAML, reqDone, reqDone}, Code: codes.InvalidArgument},
+		{Name: "missing done", Reqs: []*v1.StartLocalEngineRequest{reqMetadata, reqConfigYAML, reqEngineYAML}, Code: codes.InvalidArgument},
+		{Name: "done is false", Reqs: []*v1.StartLocalEngineRequest{reqMetadata, reqConfigYAML, reqEngineYAML, {Content: &v1.StartLocalEngineRequest_ApplicationTarDone{}}}, Code: codes.InvalidArgument},
+		{Name: "empty message", Reqs: []*v1.StartLocalEngineRequest{{}}, Code: codes.InvalidArgument},
+		{Name: "invalid tar", Reqs: []*v1.StartLocalEngineRequest{reqMetadata, reqConfigYAML, reqEngineYAML, tarChunk, reqDone}, Code: codes.InvalidArgument},
+		{Name: "config too large", Reqs: []*v1.StartLocalEngineRequest{reqMetadata, reqConfigYAML}, Limits: UploadLimits{ConfigYAML: 10}, Code: codes.ResourceExhausted},
+		{Name: "engine too large", Reqs: []*v1.StartLocalEngineRequest{reqMetadata, reqConfigYAML, reqEngineYAML, reqEngineYAML}, Limits: UploadLimits{EngineYAML: 20}, Code: codes.ResourceExhausted},
+		{Name: "tar too large", Reqs: []*v1.StartLocalEngineRequest{reqMetadata, reqConfigYAML, reqEngineYAML, tarChunk}, Limits: UploadLimits{ApplicationTar: 5}, Code: codes.ResourceExhausted},
+		{Name: "unpacked tar too large", Reqs: bomb, Limits: UploadLimits{ApplicationTar: 32 << 10, UnpackedApplicationTar: 32 << 10}, Code: codes.ResourceExhausted},
+		{Name: "total too large", Reqs: []*v1.StartLocalEngineRequest{reqMetadata, reqConfigYAML, reqEngineYAML}, Limits: UploadLimits{Total: 40}, Code: codes.ResourceExhausted},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			srv := newTestLocalService(t)
+			srv.UploadLimits = test.Limits
+			client := newTestClient(t, srv)
+
+			_, err := sendLocal(t, client, test.Reqs)
+			assert.Equal(t, status.Code(err), test.Code, "unexpected error: %v", err)
+
+			leftovers, _ := filepath.Glob(filepath.Join(srv.StagingDir, "upload-*"))
+			assert.Equal(t, len(leftovers), 0, "staging directory was not cleaned up")
+
+			_, total, err := srv.Engines.Find(context.Background(), nil, nil, 0, 0)
+			assert.NilError(t, err)
+			assert.Equal(t, total, 0)
+		})
+	}
+}
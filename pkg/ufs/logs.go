@@ -0,0 +1,240 @@
+package ufs
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bufio"
+	"context"
+	"io"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/logslicer"
+	"github.com/bhojpur/ufs/pkg/store"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// openLog creates the log of an Engine which is about to start and starts collecting the
+// results it reports. Engines without a log store have no log. Callers must hold srv.mu.
+func (srv *Service) openLog(name string) {
+	if srv.Logs == nil {
+		return
+	}
+
+	w, err := srv.Logs.Open(name)
+	if err != nil {
+		log.WithError(err).WithField("name", name).Warn("cannot create Engine log")
+		return
+	}
+
+	if srv.logWriters == nil {
+		srv.logWriters = make(map[string]io.WriteCloser)
+	}
+	srv.logWriters[name] = w
+
+	go srv.collectResults(name)
+}
+
+// logOutput returns the writer for the log of a running Engine, or io.Discard if it has none
+func (srv *Service) logOutput(name string) io.Writer {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	w, ok := srv.logWriters[name]
+	if !ok {
+		return io.Discard
+	}
+	return w
+}
+
+// closeLog marks the log of an Engine complete. Callers must hold srv.mu.
+func (srv *Service) closeLog(name string) {
+	w, ok := srv.logWriters[name]
+	if !ok {
+		return
+	}
+	delete(srv.logWriters, name)
+
+	err := w.Close()
+	if err != nil {
+		log.WithError(err).WithField("name", name).Warn("cannot close Engine log")
+	}
+}
+
+// collectResults slices the log of an Engine as it is written and adds the results it reports
+// to the Engine's status.
+func (srv *Service) collectResults(name string) {
+	r, err := srv.Logs.Read(name)
+	if err != nil {
+		log.WithError(err).WithField("name", name).Warn("cannot read Engine log")
+		return
+	}
+	defer r.Close()
+
+	evts, errchan := logslicer.DefaultSlicer.Slice(r)
+	for evt := range evts {
+		if evt.Type != v1.LogSliceType_SLICE_RESULT {
+			continue
+		}
+
+		res, err := logslicer.ParseResult(evt)
+		if err != nil {
+			log.WithError(err).WithField("name", name).Warn("Engine reported an invalid result")
+			continue
+		}
+		err = srv.addResult(name, res)
+		if err != nil {
+			log.WithError(err).WithField("name", name).Warn("cannot store Engine result")
+		}
+	}
+	if err := <-errchan; err != nil {
+		log.WithError(err).WithField("name", name).Warn("cannot slice Engine log")
+	}
+}
+
+func (srv *Service) addResult(name string, res *v1.EngineResult) error {
+	ctx := context.Background()
+
+	srv.mu.Lock()
+	s, err := srv.Engines.Get(ctx, name)
+	if err != nil {
+		srv.mu.Unlock()
+		return err
+	}
+	s.Results = append(s.Results, res)
+	err = srv.Engines.Store(ctx, s)
+	if err == nil {
+		srv.notify(s)
+	}
+	srv.mu.Unlock()
+	return err
+}
+
+// awaitLog waits for a waiting Engine to start and returns a reader for its log. If the Engine
+// ends without starting, or the client goes away, it returns a nil reader.
+func (srv *Service) awaitLog(ctx context.Context, name string) (io.ReadCloser, error) {
+	sub := srv.subscribe(func(s *v1.EngineStatus) bool {
+		return s.Name == name
+	})
+	defer sub.Close()
+
+	s, err := srv.Engines.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	for s.Phase == v1.EnginePhase_PHASE_WAITING {
+		s, err = nextUpdate(ctx, sub)
+		if err != nil {
+			return nil, err
+		}
+		if s == nil {
+			return nil, nil
+		}
+	}
+
+	return srv.Logs.Read(name)
+}
+
+// streamLogs sends the log of an Engine in the requested form until the log is complete
+func (srv *Service) streamLogs(ctx context.Context, name string, mode v1.ListenRequestLogs, send func(*v1.ListenResponse) error) error {
+	if srv.Logs == nil {
+		return status.Error(codes.Unimplemented, "this server does not keep Engine logs")
+	}
+
+	r, err := srv.Logs.Read(name)
+	if err == store.ErrNotFound {
+		// waiting Engines produce their log only once they start
+		r, err = srv.awaitLog(ctx, name)
+	}
+	if err == store.ErrNotFound || (err == nil && r == nil) {
+		// the Engine never produced a log
+		return nil
+	}
+	if _, ok := status.FromError(err); err != nil && ok {
+		return err
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot read log of Engine %s: %v", name, err)
+	}
+	defer r.Close()
+
+	// the reader follows the log and would block forever if the client went away
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.Close()
+		case <-done:
+		}
+	}()
+
+	sendSlice := func(evt *v1.LogSliceEvent) error {
+		return send(&v1.ListenResponse{Content: &v1.ListenResponse_Slice{Slice: evt}})
+	}
+
+	var readErr error
+	if mode == v1.ListenRequestLogs_LOGS_UNSLICED {
+		// long lines are split like the slicer does, rather than failing the stream
+		lines := bufio.NewReader(r)
+		for {
+			line, err := logslicer.ReadLine(lines)
+			if line != "" || err == nil {
+				if err := sendSlice(&v1.LogSliceEvent{Type: v1.LogSliceType_SLICE_CONTENT, Payload: line}); err != nil {
+					return err
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				break
+			}
+		}
+	} else {
+		evts, errchan := logslicer.DefaultSlicer.Slice(r)
+		for evt := range evts {
+			if mode == v1.ListenRequestLogs_LOGS_HTML {
+				switch evt.Type {
+				case v1.LogSliceType_SLICE_CONTENT, v1.LogSliceType_SLICE_PHASE, v1.LogSliceType_SLICE_FAIL:
+					evt.Payload = logslicer.ToHTML(evt.Payload)
+				}
+			}
+			if err := sendSlice(evt); err != nil {
+				// drain the slicer so that it can finish
+				r.Close()
+				for range evts {
+				}
+				return err
+			}
+		}
+		readErr = <-errchan
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+	if readErr != nil {
+		return status.Errorf(codes.Internal, "cannot read log of Engine %s: %v", name, readErr)
+	}
+	return nil
+}
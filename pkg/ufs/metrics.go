@@ -0,0 +1,197 @@
+package ufs
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/filterexpr"
+	"github.com/bhojpur/ufs/pkg/store"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsNamespace prefixes the names of all metrics
+const metricsNamespace = "ufs"
+
+// collectTimeout bounds the store queries of a scrape
+const collectTimeout = 5 * time.Second
+
+// Metrics instrument a service. They are a Prometheus collector: register them with a
+// registry and set Service.Metrics. The number of Engines by phase is counted in the store
+// when the metrics are collected, hence it survives a restart of the server.
+type Metrics struct {
+	engines store.Engines
+
+	enginesDesc    *prometheus.Desc
+	startLatency   prometheus.Histogram
+	failures       prometheus.Counter
+	ingestedBytes  prometheus.Counter
+	activeStreams  *prometheus.GaugeVec
+	broadcastDrops *prometheus.CounterVec
+}
+
+// NewMetrics creates the metrics of a service whose Engines are kept in the given store
+func NewMetrics(engines store.Engines) *Metrics {
+	m := &Metrics{
+		engines: engines,
+		enginesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "engines"),
+			"Number of Engines by phase.",
+			[]string{"phase"}, nil,
+		),
+		startLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "engine_start_latency_seconds",
+			Help:      "Time from the creation of an Engine, or the end of its wait, until it runs.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 14),
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "engine_failures_total",
+			Help:      "Number of Engines which finished unsuccessfully without being stopped.",
+		}),
+		ingestedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "local_engine_ingested_bytes_total",
+			Help:      "Number of bytes received by StartLocalEngine.",
+		}),
+		activeStreams: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_streams",
+			Help:      "Number of active Subscribe and Listen streams.",
+		}, []string{"method"}),
+		broadcastDrops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "broadcaster_drops_total",
+			Help:      "Number of Engine updates a slow client missed, either because they were coalesced or because the client was disconnected.",
+		}, []string{"reason"}),
+	}
+
+	// series which exist from the start are easier to graph and alert on
+	for _, method := range []string{"Subscribe", "Listen"} {
+		m.activeStreams.WithLabelValues(method)
+	}
+	for _, reason := range []string{"coalesced", "disconnected"} {
+		m.broadcastDrops.WithLabelValues(reason)
+	}
+	return m
+}
+
+// Describe implements prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.enginesDesc
+	m.startLatency.Describe(ch)
+	m.failures.Describe(ch)
+	m.ingestedBytes.Describe(ch)
+	m.activeStreams.Describe(ch)
+	m.broadcastDrops.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.collectEngines(ch)
+	m.startLatency.Collect(ch)
+	m.failures.Collect(ch)
+	m.ingestedBytes.Collect(ch)
+	m.activeStreams.Collect(ch)
+	m.broadcastDrops.Collect(ch)
+}
+
+// collectEngines counts the Engines of every phase in the store
+func (m *Metrics) collectEngines(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+
+	phases := make([]int, 0, len(v1.EnginePhase_name))
+	for p := range v1.EnginePhase_name {
+		if v1.EnginePhase(p) != v1.EnginePhase_PHASE_UNKNOWN {
+			phases = append(phases, int(p))
+		}
+	}
+	sort.Ints(phases)
+	for _, p := range phases {
+		phase := filterexpr.PhaseName(v1.EnginePhase(p))
+		_, total, err := m.engines.Find(ctx, []*v1.FilterExpression{
+			{Terms: []*v1.FilterTerm{{Field: "phase", Value: phase}}},
+		}, nil, 0, 1)
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(m.enginesDesc, err)
+			return
+		}
+		ch <- prometheus.MustNewConstMetric(m.enginesDesc, prometheus.GaugeValue, float64(total), phase)
+	}
+}
+
+// engineRunning records the start latency of an Engine which has just begun to run
+func (m *Metrics) engineRunning(s *v1.EngineStatus) {
+	if m == nil {
+		return
+	}
+	start := s.Metadata.GetCreated()
+	if wait := s.Conditions.GetWaitUntil(); wait != nil && (start == nil || wait.AsTime().After(start.AsTime())) {
+		start = wait
+	}
+	if start == nil {
+		return
+	}
+	m.startLatency.Observe(time.Since(start.AsTime()).Seconds())
+}
+
+// engineFailed counts an Engine which finished unsuccessfully
+func (m *Metrics) engineFailed() {
+	if m == nil {
+		return
+	}
+	m.failures.Inc()
+}
+
+// ingested counts the bytes of a StartLocalEngine upload
+func (m *Metrics) ingested(n int64) {
+	if m == nil {
+		return
+	}
+	m.ingestedBytes.Add(float64(n))
+}
+
+// streamStarted counts an active stream of the given method. The returned function ends it.
+func (m *Metrics) streamStarted(method string) (done func()) {
+	if m == nil {
+		return func() {}
+	}
+	g := m.activeStreams.WithLabelValues(method)
+	g.Inc()
+	return g.Dec
+}
+
+// broadcastDropped counts an Engine update a subscriber missed
+func (m *Metrics) broadcastDropped(disconnected bool) {
+	if m == nil {
+		return
+	}
+	reason := "coalesced"
+	if disconnected {
+		reason = "disconnected"
+	}
+	m.broadcastDrops.WithLabelValues(reason).Inc()
+}
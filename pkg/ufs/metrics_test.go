@@ -0,0 +1,137 @@
+package ufs
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+)
+
+// metricValue returns the value of the metric with the given name and label, or -1 if there is none.
+// Histograms yield their sample count.
+func metricValue(t *testing.T, m *Metrics, name, label, value string) float64 {
+	t.Helper()
+
+	reg := prometheus.NewPedanticRegistry()
+	assert.NilError(t, reg.Register(m))
+	families, err := reg.Gather()
+	assert.NilError(t, err)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, metric := range f.Metric {
+			if label != "" && !hasLabel(metric, label, value) {
+				continue
+			}
+			switch {
+			case metric.Gauge != nil:
+				return metric.Gauge.GetValue()
+			case metric.Counter != nil:
+				return metric.Counter.GetValue()
+			case metric.Histogram != nil:
+				return float64(metric.Histogram.GetSampleCount())
+			}
+		}
+	}
+	return -1
+}
+
+func hasLabel(m *dto.Metric, name, value string) bool {
+	for _, l := range m.Label {
+		if l.GetName() == name && l.GetValue() == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMetrics(t *testing.T) {
+	r := &fakeRunner{release: make(chan struct{}), fail: true}
+	srv := newTestRunnerService(t, r)
+	m := NewMetrics(srv.Engines)
+	srv.Metrics = m
+	client := newTestClient(t, srv)
+
+	reqs := []*v1.StartLocalEngineRequest{reqMetadata, reqConfigYAML, reqEngineYAML}
+	reqs = append(reqs, chunks(newTestApplicationTar(t), 1024)...)
+	reqs = append(reqs, reqDone)
+	var size int
+	for _, req := range reqs {
+		size += proto.Size(req)
+	}
+	resp, err := sendLocal(t, client, reqs)
+	assert.NilError(t, err)
+	assert.Equal(t, metricValue(t, m, "ufs_local_engine_ingested_bytes_total", "", ""), float64(size))
+
+	waitForPhase(t, srv, resp.Status.Name, v1.EnginePhase_PHASE_RUNNING)
+	assert.Equal(t, metricValue(t, m, "ufs_engines", "phase", "running"), 1.0)
+	assert.Equal(t, metricValue(t, m, "ufs_engines", "phase", "done"), 0.0)
+	assert.Equal(t, metricValue(t, m, "ufs_engine_start_latency_seconds", "", ""), 1.0)
+
+	close(r.release)
+	waitForPhase(t, srv, resp.Status.Name, v1.EnginePhase_PHASE_DONE)
+	assert.Equal(t, metricValue(t, m, "ufs_engines", "phase", "running"), 0.0)
+	assert.Equal(t, metricValue(t, m, "ufs_engines", "phase", "done"), 1.0)
+	assert.Equal(t, metricValue(t, m, "ufs_engine_failures_total", "", ""), 1.0)
+}
+
+func TestMetricsStreams(t *testing.T) {
+	srv := newTestLocalService(t)
+	srv.SubscriberBufferSize = 1
+	m := NewMetrics(srv.Engines)
+	srv.Metrics = m
+	client := newTestClient(t, srv)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := client.Subscribe(ctx, &v1.SubscribeRequest{})
+	assert.NilError(t, err)
+	waitForMetric := func(name, label, value string, want float64) {
+		t.Helper()
+		poll.WaitOn(t, func(poll.LogT) poll.Result {
+			if got := metricValue(t, m, name, label, value); got != want {
+				return poll.Continue("%s is %v rather than %v", name, got, want)
+			}
+			return poll.Success()
+		}, poll.WithTimeout(5*time.Second))
+	}
+	waitForMetric("ufs_active_streams", "method", "Subscribe", 1)
+	cancel()
+	waitForMetric("ufs_active_streams", "method", "Subscribe", 0)
+
+	// a subscriber which does not read has its updates coalesced, then is disconnected
+	sub := srv.subscribe(func(*v1.EngineStatus) bool { return true })
+	defer sub.Close()
+	srv.notify(&v1.EngineStatus{Name: "a"})
+	srv.notify(&v1.EngineStatus{Name: "a"})
+	srv.notify(&v1.EngineStatus{Name: "b"})
+	waitForMetric("ufs_broadcaster_drops_total", "reason", "coalesced", 1)
+	waitForMetric("ufs_broadcaster_drops_total", "reason", "disconnected", 1)
+}
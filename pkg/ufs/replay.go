@@ -0,0 +1,386 @@
+package ufs
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/archive"
+	"github.com/bhojpur/ufs/pkg/store"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// replayManifest records everything an Engine was started from. All content is referenced
+// by its digest in the blob store. The manifest itself is stored as a blob, and tagged
+// with the name of every Engine started from it.
+type replayManifest struct {
+	// Local is true for Engines started using StartLocalEngine
+	Local      bool            `json:"local,omitempty"`
+	Metadata   json.RawMessage `json:"metadata"`
+	NameSuffix string          `json:"nameSuffix,omitempty"`
+	EnginePath string          `json:"enginePath,omitempty"`
+
+	EngineYAML     string `json:"engineYAML,omitempty"`
+	ConfigYAML     string `json:"configYAML,omitempty"`
+	Sideload       string `json:"sideload,omitempty"`
+	ApplicationTar string `json:"applicationTar,omitempty"`
+}
+
+// archiveRequest stores the inputs of a StartEngine request and returns the digest of its
+// replay manifest. If the inputs cannot be archived, the digest is empty.
+func (srv *Service) archiveRequest(ctx context.Context, req *v1.StartEngineRequest) string {
+	if srv.Blobs == nil || req.Metadata == nil {
+		return ""
+	}
+	// without engine YAML there's nothing to start the Engine from again
+	if len(req.EngineYaml) == 0 {
+		return ""
+	}
+
+	mf := &replayManifest{
+		NameSuffix: req.NameSuffix,
+		EnginePath: req.EnginePath,
+	}
+	return srv.archive(ctx, mf, req.Metadata, map[*string][]byte{
+		&mf.EngineYAML: req.EngineYaml,
+		&mf.Sideload:   req.Sideload,
+	})
+}
+
+// archiveUpload stores the inputs of a StartLocalEngine upload and returns the digest of its
+// replay manifest. The application tar is archived while it is received. If the inputs cannot
+// be archived, the digest is empty.
+func (srv *Service) archiveUpload(ctx context.Context, upload *localUpload) string {
+	if srv.Blobs == nil || upload.Metadata == nil || upload.archiveErr != nil {
+		return ""
+	}
+
+	mf := &replayManifest{
+		Local:          true,
+		ApplicationTar: upload.ApplicationTar,
+	}
+	return srv.archive(ctx, mf, upload.Metadata, map[*string][]byte{
+		&mf.ConfigYAML: upload.ConfigYAML,
+		&mf.EngineYAML: upload.EngineYAML,
+	})
+}
+
+// archive stores the metadata and content of a manifest, and then the manifest itself
+func (srv *Service) archive(ctx context.Context, mf *replayManifest, md *v1.EngineMetadata, content map[*string][]byte) string {
+	var err error
+	mf.Metadata, err = protojson.Marshal(md)
+	if err != nil {
+		log.WithError(err).Warn("cannot archive Engine metadata - Engine cannot be replayed")
+		return ""
+	}
+
+	for digest, c := range content {
+		if len(c) == 0 {
+			continue
+		}
+		*digest, err = srv.Blobs.Put(ctx, bytes.NewReader(c))
+		if err != nil {
+			log.WithError(err).Warn("cannot archive Engine inputs - Engine cannot be replayed")
+			return ""
+		}
+	}
+
+	raw, err := json.Marshal(mf)
+	if err != nil {
+		log.WithError(err).Warn("cannot archive Engine inputs - Engine cannot be replayed")
+		return ""
+	}
+	digest, err := srv.Blobs.Put(ctx, bytes.NewReader(raw))
+	if err != nil {
+		log.WithError(err).Warn("cannot archive Engine inputs - Engine cannot be replayed")
+		return ""
+	}
+	return digest
+}
+
+// replayManifest loads the replay manifest of an Engine
+func (srv *Service) replayManifest(ctx context.Context, name string) (digest string, mf *replayManifest, err error) {
+	digest, err = srv.Blobs.Resolve(ctx, name)
+	if err != nil {
+		return "", nil, err
+	}
+	raw, err := srv.blob(ctx, digest)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var res replayManifest
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return "", nil, err
+	}
+	return digest, &res, nil
+}
+
+// replayRequest rebuilds the StartEngineRequest an Engine was started with
+func (srv *Service) replayRequest(ctx context.Context, mf *replayManifest) (*v1.StartEngineRequest, error) {
+	var md v1.EngineMetadata
+	if err := protojson.Unmarshal(mf.Metadata, &md); err != nil {
+		return nil, err
+	}
+
+	engineYAML, err := srv.blob(ctx, mf.EngineYAML)
+	if err != nil {
+		return nil, err
+	}
+	sideload, err := srv.blob(ctx, mf.Sideload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.StartEngineRequest{
+		Metadata:   &md,
+		EnginePath: mf.EnginePath,
+		EngineYaml: engineYAML,
+		Sideload:   sideload,
+		NameSuffix: mf.NameSuffix,
+	}, nil
+}
+
+// blob reads a blob entirely. An empty digest stands for absent content.
+func (srv *Service) blob(ctx context.Context, digest string) ([]byte, error) {
+	if digest == "" {
+		return nil, nil
+	}
+	r, err := srv.Blobs.Get(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// restoreInputs loads the inputs of an Engine from the replay archive, e.g. when a waiting Engine
+// starts after the server restarted.
+func (srv *Service) restoreInputs(ctx context.Context, s *v1.EngineStatus) (engineInputs, error) {
+	if srv.Blobs == nil || !s.Conditions.GetCanReplay() {
+		return engineInputs{}, fmt.Errorf("inputs of Engine %s were not archived", s.Name)
+	}
+	digest, mf, err := srv.replayManifest(ctx, s.Name)
+	if err != nil {
+		return engineInputs{}, err
+	}
+
+	res := engineInputs{
+		EnginePath: mf.EnginePath,
+		Replay:     digest,
+	}
+	if res.ConfigYAML, err = srv.blob(ctx, mf.ConfigYAML); err != nil {
+		return engineInputs{}, err
+	}
+	if res.EngineYAML, err = srv.blob(ctx, mf.EngineYAML); err != nil {
+		return engineInputs{}, err
+	}
+	if res.Sideload, err = srv.blob(ctx, mf.Sideload); err != nil {
+		return engineInputs{}, err
+	}
+	if mf.Local {
+		if res.ApplicationDir, err = srv.unpackArchived(ctx, mf.ApplicationTar); err != nil {
+			return engineInputs{}, err
+		}
+	}
+	return res, nil
+}
+
+// StartFromPreviousEngine starts a new Engine based on a previous one. Replays start from the
+// archived Engine YAML, as the server cannot check out repositories: requests with a gitops token
+// are rejected rather than replayed without it.
+func (srv *Service) StartFromPreviousEngine(ctx context.Context, req *v1.StartFromPreviousEngineRequest) (*v1.StartEngineResponse, error) {
+	if srv.isReadOnly() {
+		return nil, errReadOnly
+	}
+	if req.GitopsToken != "" {
+		return nil, status.Error(codes.Unimplemented, "gitops_token is not supported: Engines are replayed from their archived Engine YAML")
+	}
+	prev, err := srv.get(ctx, req.PreviousEngine)
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.authorize(ctx, prev); err != nil {
+		return nil, err
+	}
+	if srv.Blobs == nil || !prev.Conditions.GetCanReplay() {
+		return nil, status.Errorf(codes.FailedPrecondition, "Engine %s cannot be replayed", req.PreviousEngine)
+	}
+
+	digest, mf, err := srv.replayManifest(ctx, req.PreviousEngine)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot load inputs of Engine %s: %v", req.PreviousEngine, err)
+	}
+
+	if mf.Local {
+		return srv.replayLocal(ctx, req, digest, mf)
+	}
+
+	start, err := srv.replayRequest(ctx, mf)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot load inputs of Engine %s: %v", req.PreviousEngine, err)
+	}
+	// a replay is a new Engine in its own right
+	start.Metadata.Created = nil
+	start.Metadata.Finished = nil
+
+	return srv.startEngine(ctx, start.Metadata, start.NameSuffix, req.WaitUntil, engineInputs{
+		EngineYAML: start.EngineYaml,
+		EnginePath: start.EnginePath,
+		Sideload:   start.Sideload,
+		Replay:     digest,
+	})
+}
+
+// replayLocal starts an Engine again from the inputs of a StartLocalEngine upload
+func (srv *Service) replayLocal(ctx context.Context, req *v1.StartFromPreviousEngineRequest, digest string, mf *replayManifest) (*v1.StartEngineResponse, error) {
+	var md v1.EngineMetadata
+	if err := protojson.Unmarshal(mf.Metadata, &md); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot load inputs of Engine %s: %v", req.PreviousEngine, err)
+	}
+	md.Created = nil
+	md.Finished = nil
+
+	configYAML, err := srv.blob(ctx, mf.ConfigYAML)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot load inputs of Engine %s: %v", req.PreviousEngine, err)
+	}
+	engineYAML, err := srv.blob(ctx, mf.EngineYAML)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot load inputs of Engine %s: %v", req.PreviousEngine, err)
+	}
+
+	uploadDir, err := srv.unpackArchived(ctx, mf.ApplicationTar)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot unpack application of Engine %s: %v", req.PreviousEngine, err)
+	}
+
+	resp, err := srv.startEngine(ctx, proto.Clone(&md).(*v1.EngineMetadata), "", req.WaitUntil, engineInputs{
+		ConfigYAML:     configYAML,
+		EngineYAML:     engineYAML,
+		ApplicationDir: uploadDir,
+		Replay:         digest,
+	})
+	if err != nil {
+		os.RemoveAll(uploadDir)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// unpackArchived unpacks an archived application tar into a new staging directory
+func (srv *Service) unpackArchived(ctx context.Context, digest string) (string, error) {
+	stagingDir, err := srv.stagingDir()
+	if err != nil {
+		return "", err
+	}
+	uploadDir, err := os.MkdirTemp(stagingDir, "replay-")
+	if err != nil {
+		return "", err
+	}
+	if digest == "" {
+		return uploadDir, nil
+	}
+
+	err = func() error {
+		r, err := srv.Blobs.Get(ctx, digest)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		decompressed, err := archive.DecompressStream(r)
+		if err != nil {
+			return err
+		}
+		defer decompressed.Close()
+
+		return srv.untar()(decompressed, uploadDir, &archive.TarOptions{NoLchown: true})
+	}()
+	if err != nil {
+		os.RemoveAll(uploadDir)
+		return "", err
+	}
+	return uploadDir, nil
+}
+
+// blobWriter archives a stream in the blob store while it is being written. Archiving never
+// fails the writer: once archiving fails, all further content is dropped and Close reports the error.
+type blobWriter struct {
+	pw     *io.PipeWriter
+	result chan blobResult
+	err    error
+}
+
+type blobResult struct {
+	Digest string
+	Err    error
+}
+
+func newBlobWriter(blobs store.Blobs) *blobWriter {
+	pr, pw := io.Pipe()
+	w := &blobWriter{
+		pw:     pw,
+		result: make(chan blobResult, 1),
+	}
+	go func() {
+		digest, err := blobs.Put(context.Background(), pr)
+		pr.CloseWithError(err)
+		w.result <- blobResult{Digest: digest, Err: err}
+	}()
+	return w
+}
+
+func (w *blobWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return len(p), nil
+	}
+	if _, err := w.pw.Write(p); err != nil {
+		w.err = err
+	}
+	return len(p), nil
+}
+
+// Close completes the archive and returns the digest of the content
+func (w *blobWriter) Close() (string, error) {
+	w.pw.Close()
+	res := <-w.result
+	if w.err != nil {
+		return "", w.err
+	}
+	return res.Digest, res.Err
+}
+
+// Abort discards the archive
+func (w *blobWriter) Abort(err error) {
+	w.pw.CloseWithError(err)
+	<-w.result
+}
@@ -0,0 +1,172 @@
+package ufs
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gotest.tools/v3/assert"
+)
+
+func TestReplayStartEngine(t *testing.T) {
+	srv := NewService(store.NewInMemoryEngineStore(), store.NewInMemoryNumberGroup())
+	srv.Blobs = store.NewInMemoryBlobStore()
+	defer srv.Close()
+	ctx := context.Background()
+
+	req := &v1.StartEngineRequest{
+		Metadata: &v1.EngineMetadata{
+			Owner:       "alice",
+			Repository:  &v1.Repository{Host: "github.com", Owner: "bhojpur", Repo: "storage", Ref: "refs/heads/main"},
+			Trigger:     v1.EngineTrigger_TRIGGER_MANUAL,
+			Annotations: []*v1.Annotation{{Key: "nightly", Value: "true"}},
+		},
+		EnginePath: "ufs/backup.yaml",
+		EngineYaml: []byte("command: [\"true\"]\n"),
+		Sideload:   []byte("sideloaded"),
+		NameSuffix: "backup",
+	}
+	first, err := srv.StartEngine(ctx, req)
+	assert.NilError(t, err)
+	assert.Check(t, first.Status.Conditions.CanReplay)
+
+	_, mf, err := srv.replayManifest(ctx, first.Status.Name)
+	assert.NilError(t, err)
+	rebuilt, err := srv.replayRequest(ctx, mf)
+	assert.NilError(t, err)
+	assert.Check(t, proto.Equal(rebuilt, req), "got %v", rebuilt)
+
+	waitUntil := timestamppb.New(time.Now().Add(time.Hour))
+	replay, err := srv.StartFromPreviousEngine(ctx, &v1.StartFromPreviousEngineRequest{
+		PreviousEngine: first.Status.Name,
+		WaitUntil:      waitUntil,
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, replay.Status.Name, "storage-backup.2")
+	assert.Equal(t, replay.Status.Phase, v1.EnginePhase_PHASE_WAITING)
+	assert.Check(t, replay.Status.Conditions.CanReplay)
+	assert.Check(t, proto.Equal(replay.Status.Metadata.Repository, req.Metadata.Repository))
+	assert.Check(t, replay.Status.Metadata.Created.AsTime().After(first.Status.Metadata.Created.AsTime()))
+
+	// the replay is replayed from the same inputs
+	_, mf, err = srv.replayManifest(ctx, replay.Status.Name)
+	assert.NilError(t, err)
+	rebuilt, err = srv.replayRequest(ctx, mf)
+	assert.NilError(t, err)
+	assert.Check(t, proto.Equal(rebuilt, req), "got %v", rebuilt)
+}
+
+func TestReplayUnavailable(t *testing.T) {
+	srv := NewService(store.NewInMemoryEngineStore(), store.NewInMemoryNumberGroup())
+	srv.Blobs = store.NewInMemoryBlobStore()
+	defer srv.Close()
+	ctx := context.Background()
+
+	// without engine YAML or a repository there's nothing to start the Engine from again
+	resp, err := srv.StartEngine(ctx, &v1.StartEngineRequest{Metadata: &v1.EngineMetadata{Owner: "alice"}, EnginePath: "ufs/backup.yaml"})
+	assert.NilError(t, err)
+	assert.Check(t, !resp.Status.Conditions.CanReplay)
+	_, err = srv.StartFromPreviousEngine(ctx, &v1.StartFromPreviousEngineRequest{PreviousEngine: resp.Status.Name})
+	assert.Equal(t, status.Code(err), codes.FailedPrecondition)
+
+	_, err = srv.StartFromPreviousEngine(ctx, &v1.StartFromPreviousEngineRequest{PreviousEngine: "does-not-exist.1"})
+	assert.Equal(t, status.Code(err), codes.NotFound)
+
+	// repositories are never checked out again, so a gitops token cannot be honoured
+	resp, err = srv.StartEngine(ctx, &v1.StartEngineRequest{
+		Metadata:   &v1.EngineMetadata{Owner: "alice", Repository: &v1.Repository{Repo: "storage"}},
+		EnginePath: "ufs/backup.yaml",
+		EngineYaml: []byte("command: [backup]\n"),
+	})
+	assert.NilError(t, err)
+	assert.Check(t, resp.Status.Conditions.CanReplay)
+	_, err = srv.StartFromPreviousEngine(ctx, &v1.StartFromPreviousEngineRequest{PreviousEngine: resp.Status.Name, GitopsToken: "secret"})
+	assert.Equal(t, status.Code(err), codes.Unimplemented)
+
+	// neither can repository-backed Engines, as their Engine YAML was never archived
+	resp, err = srv.StartEngine(ctx, &v1.StartEngineRequest{
+		Metadata:   &v1.EngineMetadata{Owner: "alice", Repository: &v1.Repository{Repo: "storage"}},
+		EnginePath: "ufs/backup.yaml",
+	})
+	assert.NilError(t, err)
+	assert.Check(t, !resp.Status.Conditions.CanReplay)
+	_, err = srv.StartFromPreviousEngine(ctx, &v1.StartFromPreviousEngineRequest{PreviousEngine: resp.Status.Name})
+	assert.Equal(t, status.Code(err), codes.FailedPrecondition)
+
+	noBlobs := NewService(store.NewInMemoryEngineStore(), store.NewInMemoryNumberGroup())
+	defer noBlobs.Close()
+	resp, err = noBlobs.StartEngine(ctx, &v1.StartEngineRequest{Metadata: &v1.EngineMetadata{Owner: "alice"}, EngineYaml: []byte("{}")})
+	assert.NilError(t, err)
+	assert.Check(t, !resp.Status.Conditions.CanReplay)
+	_, err = noBlobs.StartFromPreviousEngine(ctx, &v1.StartFromPreviousEngineRequest{PreviousEngine: resp.Status.Name})
+	assert.Equal(t, status.Code(err), codes.FailedPrecondition)
+}
+
+func TestReplayLocalEngine(t *testing.T) {
+	srv := newTestLocalService(t)
+	blobs, err := store.NewFileBlobStore(t.TempDir())
+	assert.NilError(t, err)
+	srv.Blobs = blobs
+	defer srv.Close()
+	client := newTestClient(t, srv)
+	ctx := context.Background()
+
+	reqs := []*v1.StartLocalEngineRequest{reqMetadata, reqConfigYAML, reqEngineYAML}
+	reqs = append(reqs, chunks(newTestApplicationTar(t), 1024)...)
+	reqs = append(reqs, reqDone)
+	first, err := sendLocal(t, client, reqs)
+	assert.NilError(t, err)
+	assert.Check(t, first.Status.Conditions.CanReplay)
+
+	replay, err := client.StartFromPreviousEngine(ctx, &v1.StartFromPreviousEngineRequest{PreviousEngine: first.Status.Name})
+	assert.NilError(t, err)
+	assert.Equal(t, replay.Status.Name, "backup.2")
+	assert.Check(t, replay.Status.Conditions.CanReplay)
+	assert.Equal(t, replay.Status.Metadata.Owner, "alice")
+
+	content, err := os.ReadFile(filepath.Join(mustGlob(t, filepath.Join(srv.StagingDir, "replay-*")), "hello.txt"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "hello world")
+
+	// uploads without an application can be replayed, too
+	reqs = []*v1.StartLocalEngineRequest{reqMetadata, reqConfigYAML, reqEngineYAML, reqDone}
+	noTar, err := sendLocal(t, client, reqs)
+	assert.NilError(t, err)
+	assert.Check(t, noTar.Status.Conditions.CanReplay)
+}
+
+func mustGlob(t *testing.T, pattern string) string {
+	t.Helper()
+	matches, err := filepath.Glob(pattern)
+	assert.NilError(t, err)
+	assert.Equal(t, len(matches), 1, "pattern %s", pattern)
+	return matches[0]
+}
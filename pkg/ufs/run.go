@@ -0,0 +1,198 @@
+package ufs
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/runner"
+	"github.com/bhojpur/ufs/pkg/spec"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// runningEngine is an Engine which is currently executed by the runner
+type runningEngine struct {
+	cancel  context.CancelFunc
+	stopped bool
+}
+
+// begin starts an Engine which has just entered PHASE_PREPARING
+func (srv *Service) begin(s *v1.EngineStatus, inputs engineInputs) {
+	ctx, cancel := context.WithCancel(context.Background())
+	srv.mu.Lock()
+	if cur, err := srv.Engines.Get(ctx, s.Name); err == nil && cur.Phase == v1.EnginePhase_PHASE_DONE {
+		// the Engine was stopped before it began
+		srv.mu.Unlock()
+		cancel()
+		srv.removeApplication(s.Name, inputs)
+		return
+	}
+	// the Engine is running before anyone learns it's preparing, so that StopEngine leaves stopping it to us
+	if srv.running == nil {
+		srv.running = make(map[string]*runningEngine)
+	}
+	srv.running[s.Name] = &runningEngine{cancel: cancel}
+	srv.notify(s)
+	srv.mu.Unlock()
+
+	job, err := srv.newJob(s, inputs)
+	if err != nil {
+		srv.fail(s.Name, err.Error())
+		srv.release(s.Name, inputs)
+		cancel()
+		return
+	}
+
+	go func() {
+		defer cancel()
+		srv.mu.Lock()
+		stopped := srv.running[s.Name].stopped
+		srv.mu.Unlock()
+		if stopped {
+			// the Engine was stopped before the runner got to it
+			srv.applyUpdate(s.Name, runner.Update{Phase: v1.EnginePhase_PHASE_DONE})
+		} else {
+			srv.Runner.Run(ctx, job, func(u runner.Update) {
+				srv.applyUpdate(s.Name, u)
+			})
+		}
+		srv.release(s.Name, inputs)
+	}()
+}
+
+// release forgets a running Engine once it's done and removes its application
+func (srv *Service) release(name string, inputs engineInputs) {
+	srv.mu.Lock()
+	delete(srv.running, name)
+	srv.mu.Unlock()
+	srv.removeApplication(name, inputs)
+}
+
+// newJob produces the runner job of an Engine from its inputs
+func (srv *Service) newJob(s *v1.EngineStatus, inputs engineInputs) (*runner.Job, error) {
+	if srv.Runner == nil {
+		return nil, fmt.Errorf("no runner configured")
+	}
+	if len(inputs.EngineYAML) == 0 {
+		return nil, fmt.Errorf("no Engine YAML: Engines can only be started from their repository by runners which support it")
+	}
+	es, err := spec.ParseEngine(inputs.EngineYAML)
+	if err != nil {
+		return nil, err
+	}
+
+	return &runner.Job{
+		Name:           s.Name,
+		Metadata:       s.Metadata,
+		Spec:           es,
+		ApplicationDir: inputs.ApplicationDir,
+		Sideload:       inputs.Sideload,
+		Log:            srv.logOutput(s.Name),
+	}, nil
+}
+
+// removeApplication removes the staging directory of an Engine's application
+func (srv *Service) removeApplication(name string, inputs engineInputs) {
+	if inputs.ApplicationDir == "" {
+		return
+	}
+	if err := os.RemoveAll(inputs.ApplicationDir); err != nil {
+		log.WithError(err).WithField("name", name).Warn("cannot remove application staging directory")
+	}
+}
+
+// applyUpdate applies the update a runner reported to the status of an Engine
+func (srv *Service) applyUpdate(name string, u runner.Update) {
+	ctx := context.Background()
+
+	srv.mu.Lock()
+	s, err := srv.Engines.Get(ctx, name)
+	if err != nil {
+		srv.mu.Unlock()
+		log.WithError(err).WithField("name", name).Error("cannot update Engine")
+		return
+	}
+
+	started := u.Phase == v1.EnginePhase_PHASE_RUNNING && s.Phase != v1.EnginePhase_PHASE_RUNNING
+	failed := false
+	s.Phase = u.Phase
+	if u.Details != "" {
+		s.Details = u.Details
+	}
+	s.Conditions.DidExecute = s.Conditions.DidExecute || u.DidExecute
+	if u.Phase == v1.EnginePhase_PHASE_DONE {
+		s.Conditions.Success = u.Success
+		s.Conditions.FailureCount = u.FailureCount
+		s.Metadata.Finished = timestamppb.Now()
+		if r, ok := srv.running[name]; ok && r.stopped {
+			s.Details = "stopped"
+			s.Conditions.Success = false
+		} else {
+			failed = !u.Success
+		}
+	}
+	err = srv.Engines.Store(ctx, s)
+	if u.Phase == v1.EnginePhase_PHASE_DONE {
+		srv.closeLog(name)
+	}
+	if err == nil {
+		srv.notify(s)
+	}
+	srv.mu.Unlock()
+	if err != nil {
+		log.WithError(err).WithField("name", name).Error("cannot update Engine")
+		return
+	}
+
+	if started {
+		srv.Metrics.engineRunning(s)
+	}
+	if failed {
+		srv.Metrics.engineFailed()
+	}
+	log.WithField("name", name).WithField("phase", u.Phase).Debug("Engine changed phase")
+}
+
+// fail ends an Engine which cannot run
+func (srv *Service) fail(name, details string) {
+	log.WithField("name", name).WithField("details", details).Warn("Engine failed")
+	srv.applyUpdate(name, runner.Update{
+		Phase:        v1.EnginePhase_PHASE_DONE,
+		Details:      details,
+		FailureCount: 1,
+	})
+}
+
+// stopRunning asks the runner to stop an Engine. It returns false if the Engine is not running.
+// Callers must hold srv.mu.
+func (srv *Service) stopRunning(name string) bool {
+	r, ok := srv.running[name]
+	if !ok {
+		return false
+	}
+	r.stopped = true
+	r.cancel()
+	return true
+}
@@ -0,0 +1,370 @@
+package ufs
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/runner"
+	"github.com/bhojpur/ufs/pkg/spec"
+	"github.com/bhojpur/ufs/pkg/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+// fakeRunner goes through all phases and runs until it is stopped or released
+type fakeRunner struct {
+	mu      sync.Mutex
+	jobs    []*runner.Job
+	release chan struct{}
+	fail    bool
+}
+
+func (f *fakeRunner) Run(ctx context.Context, job *runner.Job, update func(runner.Update)) {
+	f.mu.Lock()
+	f.jobs = append(f.jobs, job)
+	f.mu.Unlock()
+
+	update(runner.Update{Phase: v1.EnginePhase_PHASE_PREPARING})
+	update(runner.Update{Phase: v1.EnginePhase_PHASE_STARTING})
+	update(runner.Update{Phase: v1.EnginePhase_PHASE_RUNNING, DidExecute: true})
+	fmt.Fprintf(job.Log, "[url|RESULT] https://%s.example.com\n", job.Name)
+
+	res := runner.Update{Phase: v1.EnginePhase_PHASE_DONE, DidExecute: true}
+	select {
+	case <-ctx.Done():
+		res.Details = "stopped"
+	case <-f.release:
+		res.Success = !f.fail
+		if f.fail {
+			res.FailureCount = 1
+			res.Details = "Engine failed"
+		}
+	}
+	update(runner.Update{Phase: v1.EnginePhase_PHASE_CLEANUP, DidExecute: true})
+	update(res)
+}
+
+func (f *fakeRunner) Jobs() []*runner.Job {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*runner.Job(nil), f.jobs...)
+}
+
+// idleRunner keeps Engines in PHASE_PREPARING until they are stopped
+type idleRunner struct{}
+
+func (idleRunner) Run(ctx context.Context, job *runner.Job, update func(runner.Update)) {
+	<-ctx.Done()
+	update(runner.Update{Phase: v1.EnginePhase_PHASE_DONE, Details: "stopped"})
+}
+
+// testEngineYAML is the Engine YAML of Engines whose spec is of no concern to a test
+var testEngineYAML = []byte("command: [\"true\"]\n")
+
+// newTestService returns a service whose Engines are idle until they are stopped
+func newTestService() *Service {
+	srv := NewService(store.NewInMemoryEngineStore(), store.NewInMemoryNumberGroup())
+	srv.Runner = idleRunner{}
+	return srv
+}
+
+func newTestRunnerService(t *testing.T, r runner.EngineRunner) *Service {
+	logs, err := store.NewFileLogStore(t.TempDir())
+	assert.NilError(t, err)
+	srv := newTestLocalService(t)
+	srv.Logs = logs
+	srv.Runner = r
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRunEngine(t *testing.T) {
+	r := &fakeRunner{release: make(chan struct{})}
+	srv := newTestRunnerService(t, r)
+	ctx := context.Background()
+
+	resp, err := srv.StartEngine(ctx, &v1.StartEngineRequest{
+		Metadata:   &v1.EngineMetadata{Owner: "alice"},
+		EngineYaml: []byte("command: [\"true\"]\n"),
+		Sideload:   []byte("sideloaded"),
+	})
+	assert.NilError(t, err)
+	name := resp.Status.Name
+
+	s := waitForPhase(t, srv, name, v1.EnginePhase_PHASE_RUNNING)
+	assert.Check(t, s.Conditions.DidExecute)
+	jobs := r.Jobs()
+	assert.Equal(t, len(jobs), 1)
+	assert.DeepEqual(t, jobs[0].Spec.Command, []string{"true"})
+	assert.Equal(t, string(jobs[0].Sideload), "sideloaded")
+
+	close(r.release)
+	s = waitForPhase(t, srv, name, v1.EnginePhase_PHASE_DONE)
+	assert.Check(t, s.Conditions.Success)
+	assert.Check(t, s.Conditions.DidExecute)
+	assert.Check(t, s.Metadata.Finished != nil)
+	assert.Equal(t, len(s.Results), 1)
+	assert.Equal(t, s.Results[0].Payload, "https://"+name+".example.com")
+}
+
+func TestRunSpecRepositoryEngine(t *testing.T) {
+	r := &fakeRunner{release: make(chan struct{})}
+	srv := newTestRunnerService(t, r)
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, spec.ConfigPath), "engines:\n- name: backup\n  path: ufs/backup.yaml\n")
+	writeFile(t, filepath.Join(dir, "ufs/backup.yaml"), "command: [backup]\n")
+	writeFile(t, filepath.Join(dir, "ufs/other.yaml"), "command: [other]\n")
+	repo := &v1.Repository{Owner: "bhojpur", Repo: "storage"}
+	srv.Specs = NewUI([]SpecRepository{{Repository: repo, Dir: dir}}, false)
+	ctx := context.Background()
+
+	// the web UI starts Engines by their path alone
+	resp, err := srv.StartEngine(ctx, &v1.StartEngineRequest{
+		Metadata:   &v1.EngineMetadata{Owner: "alice", Repository: &v1.Repository{Owner: "bhojpur", Repo: "storage", Revision: "abc"}},
+		EnginePath: "ufs/backup.yaml",
+	})
+	assert.NilError(t, err)
+	waitForPhase(t, srv, resp.Status.Name, v1.EnginePhase_PHASE_RUNNING)
+	assert.DeepEqual(t, r.Jobs()[0].Spec.Command, []string{"backup"})
+	close(r.release)
+	waitForPhase(t, srv, resp.Status.Name, v1.EnginePhase_PHASE_DONE)
+
+	for _, p := range []string{"ufs/other.yaml", "../ufs/backup.yaml"} {
+		_, err = srv.StartEngine(ctx, &v1.StartEngineRequest{
+			Metadata:   &v1.EngineMetadata{Owner: "alice", Repository: repo},
+			EnginePath: p,
+		})
+		assert.Check(t, is.Equal(status.Code(err), codes.InvalidArgument), "path %s", p)
+	}
+}
+
+func TestRunLocalEngine(t *testing.T) {
+	r := &fakeRunner{release: make(chan struct{}), fail: true}
+	srv := newTestRunnerService(t, r)
+	client := newTestClient(t, srv)
+
+	reqs := []*v1.StartLocalEngineRequest{reqMetadata, reqConfigYAML, reqEngineYAML}
+	reqs = append(reqs, chunks(newTestApplicationTar(t), 1024)...)
+	reqs = append(reqs, reqDone)
+	resp, err := sendLocal(t, client, reqs)
+	assert.NilError(t, err)
+
+	waitForPhase(t, srv, resp.Status.Name, v1.EnginePhase_PHASE_RUNNING)
+	appDir := r.Jobs()[0].ApplicationDir
+	_, err = os.Stat(appDir)
+	assert.NilError(t, err)
+
+	close(r.release)
+	s := waitForPhase(t, srv, resp.Status.Name, v1.EnginePhase_PHASE_DONE)
+	assert.Check(t, !s.Conditions.Success)
+	assert.Equal(t, s.Conditions.FailureCount, int32(1))
+	assert.Equal(t, s.Details, "Engine failed")
+
+	// the staging directory is removed once the runner returns
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err = os.Stat(appDir); os.IsNotExist(err) {
+			break
+		}
+	}
+	assert.Check(t, os.IsNotExist(err), "application dir still exists: %v", err)
+}
+
+func TestRunWithoutRunner(t *testing.T) {
+	srv := newTestLocalService(t)
+	srv.Runner = nil
+	client := newTestClient(t, srv)
+
+	reqs := []*v1.StartLocalEngineRequest{reqMetadata, reqConfigYAML, reqEngineYAML}
+	reqs = append(reqs, chunks(newTestApplicationTar(t), 1024)...)
+	reqs = append(reqs, reqDone)
+	resp, err := sendLocal(t, client, reqs)
+	assert.NilError(t, err)
+
+	s := waitForPhase(t, srv, resp.Status.Name, v1.EnginePhase_PHASE_DONE)
+	assert.Equal(t, s.Details, "no runner configured")
+	assert.Check(t, !s.Conditions.Success)
+	dirs, err := filepath.Glob(filepath.Join(srv.StagingDir, "upload-*"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(dirs, 0))
+}
+
+func TestStopRunningEngine(t *testing.T) {
+	r := &fakeRunner{release: make(chan struct{})}
+	srv := newTestRunnerService(t, r)
+	ctx := context.Background()
+
+	resp, err := srv.StartEngine(ctx, &v1.StartEngineRequest{
+		Metadata:   &v1.EngineMetadata{Owner: "alice"},
+		EngineYaml: []byte("command: [\"true\"]\n"),
+	})
+	assert.NilError(t, err)
+	waitForPhase(t, srv, resp.Status.Name, v1.EnginePhase_PHASE_RUNNING)
+
+	_, err = srv.StopEngine(ctx, &v1.StopEngineRequest{Name: resp.Status.Name})
+	assert.NilError(t, err)
+	s := waitForPhase(t, srv, resp.Status.Name, v1.EnginePhase_PHASE_DONE)
+	assert.Equal(t, s.Details, "stopped")
+	assert.Check(t, !s.Conditions.Success)
+	assert.Check(t, s.Conditions.DidExecute)
+}
+
+func TestStopPreparingEngine(t *testing.T) {
+	r := &fakeRunner{release: make(chan struct{})}
+	srv := newTestRunnerService(t, r)
+	ctx := context.Background()
+
+	// the Engine is stopped after it was stored, but before it begins
+	s := &v1.EngineStatus{
+		Name:       "engine",
+		Metadata:   &v1.EngineMetadata{Owner: "alice"},
+		Phase:      v1.EnginePhase_PHASE_PREPARING,
+		Conditions: &v1.EngineConditions{},
+	}
+	assert.NilError(t, srv.Engines.Store(ctx, s))
+	_, err := srv.StopEngine(ctx, &v1.StopEngineRequest{Name: s.Name})
+	assert.NilError(t, err)
+
+	sub := srv.subscribe(func(s *v1.EngineStatus) bool { return true })
+	defer sub.Close()
+	srv.begin(s, engineInputs{EngineYAML: []byte("command: [\"true\"]\n")})
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, len(r.Jobs()), 0)
+	nctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	evt, err := sub.Next(nctx)
+	assert.Check(t, err != nil, "unexpected update %v", evt)
+
+	s, err = srv.Engines.Get(ctx, s.Name)
+	assert.NilError(t, err)
+	assert.Equal(t, s.Phase, v1.EnginePhase_PHASE_DONE)
+	assert.Equal(t, s.Details, "stopped")
+}
+
+func TestRunInvalidEngine(t *testing.T) {
+	srv := newTestRunnerService(t, &fakeRunner{release: make(chan struct{})})
+	ctx := context.Background()
+
+	resp, err := srv.StartEngine(ctx, &v1.StartEngineRequest{
+		Metadata:   &v1.EngineMetadata{Owner: "alice"},
+		EngineYaml: []byte("description: no command\n"),
+	})
+	assert.NilError(t, err)
+
+	s := waitForPhase(t, srv, resp.Status.Name, v1.EnginePhase_PHASE_DONE)
+	assert.Check(t, !s.Conditions.DidExecute)
+	assert.Equal(t, s.Conditions.FailureCount, int32(1))
+	assert.Equal(t, s.Details, "invalid Engine YAML: command is required")
+}
+
+func TestRunWaitingEngineAfterRestart(t *testing.T) {
+	var (
+		engines = store.NewInMemoryEngineStore()
+		groups  = store.NewInMemoryNumberGroup()
+		blobs   = store.NewInMemoryBlobStore()
+		ctx     = context.Background()
+	)
+
+	before := NewService(engines, groups)
+	before.Blobs = blobs
+	resp, err := before.StartEngine(ctx, &v1.StartEngineRequest{
+		Metadata:   &v1.EngineMetadata{Owner: "alice"},
+		EngineYaml: []byte("command: [backup]\n"),
+	})
+	assert.NilError(t, err)
+	// pretend the Engine was waiting when the server went down
+	s, err := engines.Get(ctx, resp.Status.Name)
+	assert.NilError(t, err)
+	s.Phase = v1.EnginePhase_PHASE_WAITING
+	assert.NilError(t, engines.Store(ctx, s))
+	before.Close()
+
+	r := &fakeRunner{release: make(chan struct{})}
+	after := NewService(engines, groups)
+	after.Blobs = blobs
+	after.Runner = r
+	defer after.Close()
+	assert.NilError(t, after.ResumeWaiting(ctx))
+
+	waitForPhase(t, after, resp.Status.Name, v1.EnginePhase_PHASE_RUNNING)
+	assert.DeepEqual(t, r.Jobs()[0].Spec.Command, []string{"backup"})
+	close(r.release)
+	waitForPhase(t, after, resp.Status.Name, v1.EnginePhase_PHASE_DONE)
+}
+
+func TestUpdatesArePublishedInOrder(t *testing.T) {
+	srv := NewService(store.NewInMemoryEngineStore(), store.NewInMemoryNumberGroup())
+	defer srv.Close()
+	ctx := context.Background()
+
+	name := "engine"
+	assert.NilError(t, srv.Engines.Store(ctx, &v1.EngineStatus{
+		Name:       name,
+		Metadata:   &v1.EngineMetadata{},
+		Phase:      v1.EnginePhase_PHASE_RUNNING,
+		Conditions: &v1.EngineConditions{},
+	}))
+
+	// publishing the end of the Engine is slow, so that the result which is collected in
+	// the meantime would overtake it if updates were not published in the order they are stored
+	publishingDone := make(chan struct{}, 1)
+	sub := srv.subscribe(func(s *v1.EngineStatus) bool {
+		if s.Phase == v1.EnginePhase_PHASE_DONE && len(s.Results) == 0 {
+			publishingDone <- struct{}{}
+			time.Sleep(100 * time.Millisecond)
+		}
+		return true
+	})
+	defer sub.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.applyUpdate(name, runner.Update{Phase: v1.EnginePhase_PHASE_DONE, Success: true})
+	}()
+	<-publishingDone
+	assert.NilError(t, srv.addResult(name, &v1.EngineResult{Payload: "result"}))
+	<-done
+
+	var last *v1.EngineStatus
+	for {
+		nctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		evt, err := sub.Next(nctx)
+		cancel()
+		if err != nil {
+			break
+		}
+		last = evt.(*v1.EngineStatus)
+	}
+	assert.Assert(t, last != nil)
+	assert.Check(t, is.Equal(last.Phase, v1.EnginePhase_PHASE_DONE))
+	assert.Check(t, is.Len(last.Results, 1))
+}
@@ -0,0 +1,168 @@
+package ufs
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/filterexpr"
+	log "github.com/sirupsen/logrus"
+)
+
+// scheduler starts Engines which wait in PHASE_WAITING once their time has come
+type scheduler struct {
+	mu      sync.Mutex
+	timers  map[string]*time.Timer
+	stopped bool
+}
+
+// Schedule calls start with the Engine's name at the given time. Scheduling an Engine again
+// replaces its previous schedule.
+func (s *scheduler) Schedule(name string, at time.Time, start func(name string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	if s.timers == nil {
+		s.timers = make(map[string]*time.Timer)
+	}
+	if t, ok := s.timers[name]; ok {
+		t.Stop()
+	}
+
+	s.timers[name] = time.AfterFunc(time.Until(at), func() {
+		s.mu.Lock()
+		delete(s.timers, name)
+		stopped := s.stopped
+		s.mu.Unlock()
+
+		if stopped {
+			return
+		}
+		start(name)
+	})
+}
+
+// Cancel removes an Engine from the schedule. It returns false if the Engine was not scheduled.
+func (s *scheduler) Cancel(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.timers[name]
+	if !ok {
+		return false
+	}
+	t.Stop()
+	delete(s.timers, name)
+	return true
+}
+
+// Len returns the number of scheduled Engines
+func (s *scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.timers)
+}
+
+// Stop cancels all schedules. Once stopped, nothing can be scheduled anymore.
+func (s *scheduler) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, t := range s.timers {
+		t.Stop()
+		delete(s.timers, name)
+	}
+	s.stopped = true
+}
+
+// ResumeWaiting schedules all Engines the store holds in PHASE_WAITING. Servers call this
+// once on startup so that delayed starts survive a restart. Engines whose time has passed
+// while the server was down start right away.
+func (srv *Service) ResumeWaiting(ctx context.Context) error {
+	waiting, _, err := srv.Engines.Find(ctx, []*v1.FilterExpression{
+		{Terms: []*v1.FilterTerm{{Field: "phase", Value: filterexpr.PhaseName(v1.EnginePhase_PHASE_WAITING)}}},
+	}, nil, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range waiting {
+		at := time.Now()
+		if s.Conditions.GetWaitUntil() != nil {
+			at = s.Conditions.WaitUntil.AsTime()
+		}
+		srv.schedule.Schedule(s.Name, at, srv.startWaiting)
+		log.WithField("name", s.Name).WithField("waitUntil", at).Info("resumed waiting Engine")
+	}
+	return nil
+}
+
+// startWaiting moves an Engine out of PHASE_WAITING and starts it
+func (srv *Service) startWaiting(name string) {
+	ctx := context.Background()
+
+	srv.mu.Lock()
+	s, err := srv.Engines.Get(ctx, name)
+	if err != nil {
+		srv.mu.Unlock()
+		log.WithError(err).WithField("name", name).Error("cannot start waiting Engine")
+		return
+	}
+	if s.Phase != v1.EnginePhase_PHASE_WAITING {
+		// the Engine was stopped in the meantime
+		srv.mu.Unlock()
+		return
+	}
+	s.Phase = v1.EnginePhase_PHASE_PREPARING
+	srv.openLog(name)
+	err = srv.Engines.Store(ctx, s)
+	if err != nil {
+		srv.closeLog(name)
+	}
+	inputs, known := srv.pending[name]
+	delete(srv.pending, name)
+	srv.mu.Unlock()
+	if err != nil {
+		log.WithError(err).WithField("name", name).Error("cannot start waiting Engine")
+		return
+	}
+
+	if !known && srv.Runner != nil {
+		// the Engine was scheduled before the server restarted
+		inputs, err = srv.restoreInputs(ctx, s)
+		if err != nil {
+			srv.mu.Lock()
+			srv.notify(s)
+			srv.mu.Unlock()
+			srv.fail(name, fmt.Sprintf("cannot restore inputs after restart: %v", err))
+			return
+		}
+	}
+
+	log.WithField("name", name).Info("starting waiting Engine")
+	srv.begin(s, inputs)
+}
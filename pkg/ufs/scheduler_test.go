@@ -0,0 +1,160 @@
+package ufs
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/store"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gotest.tools/v3/assert"
+)
+
+// waitForPhase polls an Engine until it reaches the phase
+func waitForPhase(t *testing.T, srv *Service, name string, phase v1.EnginePhase) *v1.EngineStatus {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s, err := srv.Engines.Get(context.Background(), name)
+		assert.NilError(t, err)
+		if s.Phase == phase {
+			return s
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Engine %s did not reach %v", name, phase)
+	return nil
+}
+
+func TestWaitUntil(t *testing.T) {
+	srv := newTestService()
+	defer srv.Close()
+	ctx := context.Background()
+
+	waitUntil := timestamppb.New(time.Now().Add(200 * time.Millisecond))
+	resp, err := srv.StartEngine(ctx, &v1.StartEngineRequest{Metadata: &v1.EngineMetadata{Owner: "alice"}, EngineYaml: testEngineYAML, WaitUntil: waitUntil})
+	assert.NilError(t, err)
+	assert.Equal(t, resp.Status.Phase, v1.EnginePhase_PHASE_WAITING)
+	assert.Equal(t, resp.Status.Conditions.WaitUntil.AsTime(), waitUntil.AsTime())
+
+	s := waitForPhase(t, srv, resp.Status.Name, v1.EnginePhase_PHASE_PREPARING)
+	assert.Check(t, !time.Now().Before(waitUntil.AsTime()))
+	assert.Equal(t, s.Conditions.WaitUntil.AsTime(), waitUntil.AsTime())
+
+	past, err := srv.StartEngine(ctx, &v1.StartEngineRequest{Metadata: &v1.EngineMetadata{Owner: "alice"}, EngineYaml: testEngineYAML, WaitUntil: timestamppb.New(time.Now().Add(-time.Hour))})
+	assert.NilError(t, err)
+	assert.Equal(t, past.Status.Phase, v1.EnginePhase_PHASE_PREPARING)
+	assert.Check(t, past.Status.Conditions.WaitUntil == nil)
+}
+
+func TestStopWaitingEngine(t *testing.T) {
+	srv := NewService(store.NewInMemoryEngineStore(), store.NewInMemoryNumberGroup())
+	defer srv.Close()
+	ctx := context.Background()
+
+	resp, err := srv.StartEngine(ctx, &v1.StartEngineRequest{
+		Metadata:  &v1.EngineMetadata{Owner: "alice"},
+		WaitUntil: timestamppb.New(time.Now().Add(time.Hour)),
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, srv.schedule.Len(), 1)
+
+	_, err = srv.StopEngine(ctx, &v1.StopEngineRequest{Name: resp.Status.Name})
+	assert.NilError(t, err)
+	assert.Equal(t, srv.schedule.Len(), 0)
+
+	s, err := srv.Engines.Get(ctx, resp.Status.Name)
+	assert.NilError(t, err)
+	assert.Equal(t, s.Phase, v1.EnginePhase_PHASE_DONE)
+	assert.Equal(t, s.Details, "cancelled before it started")
+	assert.Check(t, !s.Conditions.Success)
+	assert.Check(t, !s.Conditions.DidExecute)
+}
+
+func TestResumeWaiting(t *testing.T) {
+	var (
+		engines = store.NewInMemoryEngineStore()
+		groups  = store.NewInMemoryNumberGroup()
+		ctx     = context.Background()
+	)
+
+	// the first server goes down while both Engines wait
+	before := NewService(engines, groups)
+	soon, err := before.StartEngine(ctx, &v1.StartEngineRequest{
+		Metadata:  &v1.EngineMetadata{Owner: "alice"},
+		WaitUntil: timestamppb.New(time.Now().Add(300 * time.Millisecond)),
+	})
+	assert.NilError(t, err)
+	later, err := before.StartEngine(ctx, &v1.StartEngineRequest{
+		Metadata:  &v1.EngineMetadata{Owner: "alice"},
+		WaitUntil: timestamppb.New(time.Now().Add(time.Hour)),
+	})
+	assert.NilError(t, err)
+	before.Close()
+
+	after := NewService(engines, groups)
+	defer after.Close()
+	assert.NilError(t, after.ResumeWaiting(ctx))
+	assert.Equal(t, after.schedule.Len(), 2)
+
+	// without a runner, the Engine fails as soon as it's due
+	s := waitForPhase(t, after, soon.Status.Name, v1.EnginePhase_PHASE_DONE)
+	assert.Equal(t, s.Details, "no runner configured")
+	s, err = engines.Get(ctx, later.Status.Name)
+	assert.NilError(t, err)
+	assert.Equal(t, s.Phase, v1.EnginePhase_PHASE_WAITING)
+
+	_, err = after.StopEngine(ctx, &v1.StopEngineRequest{Name: later.Status.Name})
+	assert.NilError(t, err)
+	assert.Equal(t, after.schedule.Len(), 0)
+}
+
+func TestListenLogsOfWaitingEngine(t *testing.T) {
+	logs, err := store.NewFileLogStore(t.TempDir())
+	assert.NilError(t, err)
+	srv := newTestService()
+	srv.Logs = logs
+	defer srv.Close()
+	client := newTestClient(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.StartEngine(ctx, &v1.StartEngineRequest{
+		Metadata:   &v1.EngineMetadata{Owner: "alice"},
+		EngineYaml: testEngineYAML,
+		WaitUntil:  timestamppb.New(time.Now().Add(200 * time.Millisecond)),
+	})
+	assert.NilError(t, err)
+	listen, err := client.Listen(ctx, &v1.ListenRequest{Name: resp.Status.Name, Logs: v1.ListenRequestLogs_LOGS_RAW})
+	assert.NilError(t, err)
+
+	waitForPhase(t, srv, resp.Status.Name, v1.EnginePhase_PHASE_PREPARING)
+	_, err = srv.logOutput(resp.Status.Name).Write([]byte("hello\n"))
+	assert.NilError(t, err)
+
+	msg, err := listen.Recv()
+	assert.NilError(t, err)
+	assert.Equal(t, msg.GetSlice().Payload, "hello")
+}
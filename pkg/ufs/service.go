@@ -0,0 +1,570 @@
+package ufs
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/archive"
+	"github.com/bhojpur/ufs/pkg/auth"
+	"github.com/bhojpur/ufs/pkg/broadcaster"
+	"github.com/bhojpur/ufs/pkg/chrootarchive"
+	"github.com/bhojpur/ufs/pkg/filterexpr"
+	"github.com/bhojpur/ufs/pkg/runner"
+	"github.com/bhojpur/ufs/pkg/store"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DefaultSubscriberBufferSize is the number of Engine updates a subscriber can lag behind
+// if the service does not configure otherwise.
+const DefaultSubscriberBufferSize = 100
+
+// errReadOnly is returned by all RPCs which would start or stop Engines on a read-only server
+var errReadOnly = status.Error(codes.PermissionDenied, "server is read-only")
+
+// Service implements the UfsService and keeps track of all Engines known to this server
+type Service struct {
+	Engines store.Engines
+	Groups  store.NumberGroup
+	// Logs keeps the log output of Engines. Without a log store, Listen cannot stream logs.
+	Logs store.Logs
+	// Blobs archives the inputs of Engines so that they can be replayed. Without a blob store,
+	// StartFromPreviousEngine is not available.
+	Blobs store.Blobs
+	// Runner executes Engines. Without a runner, Engines fail as soon as they leave PHASE_WAITING.
+	Runner runner.EngineRunner
+	// Specs are the spec repositories which Engines that are started by their path alone are read from
+	Specs *UI
+
+	// StagingDir is the directory in which uploaded applications are unpacked.
+	// Defaults to a directory in os.TempDir().
+	StagingDir string
+	// UploadLimits restrict the size of StartLocalEngine uploads. Defaults to DefaultUploadLimits.
+	UploadLimits UploadLimits
+	// Untar unpacks uncompressed application tars. Defaults to chrootarchive.UntarUncompressed.
+	Untar func(io.Reader, string, *archive.TarOptions) error
+
+	// SubscriberBufferSize is the number of Engine updates a Subscribe or Listen client can lag
+	// behind. Once a client's buffer is full, pending updates of the same Engine are coalesced.
+	// If that is not possible the client is disconnected. Defaults to DefaultSubscriberBufferSize.
+	SubscriberBufferSize int
+
+	// ReadOnly rejects all requests which would start or stop Engines.
+	// Use SetReadOnly once the service is serving requests.
+	ReadOnly bool
+	// readOnlyMu guards ReadOnly against SetReadOnly
+	readOnlyMu sync.RWMutex
+	// Authorizer decides who may start, stop and replay Engines of an owner, and read their logs.
+	// Everyone may if there is no authorizer.
+	Authorizer auth.Authorizer
+	// Metrics instrument the service, unless they are nil
+	Metrics *Metrics
+
+	// mu serialises read-modify-write cycles of Engine status
+	mu         sync.Mutex
+	logWriters map[string]io.WriteCloser
+	running    map[string]*runningEngine
+	// pending holds the inputs of Engines which wait for their start
+	pending map[string]engineInputs
+
+	events   broadcaster.Buffered
+	schedule scheduler
+
+	v1.UnimplementedUfsServiceServer
+}
+
+// NewService creates a new service which keeps its Engines in the given store
+func NewService(engines store.Engines, groups store.NumberGroup) *Service {
+	srv := &Service{
+		Engines: engines,
+		Groups:  groups,
+	}
+	srv.events.OnOverflow = func(disconnected bool) {
+		srv.Metrics.broadcastDropped(disconnected)
+	}
+	return srv
+}
+
+// defaultUntar unpacks applications unless a service configures otherwise
+var defaultUntar = chrootarchive.UntarUncompressed
+
+func (srv *Service) untar() func(io.Reader, string, *archive.TarOptions) error {
+	if srv.Untar == nil {
+		return defaultUntar
+	}
+	return srv.Untar
+}
+
+// engineInputs is everything an Engine is started from
+type engineInputs struct {
+	ConfigYAML []byte
+	EngineYAML []byte
+	EnginePath string
+	Sideload   []byte
+
+	// ApplicationDir is the staging directory of the unpacked application, if there is one
+	ApplicationDir string
+
+	// Replay is the digest of the replay manifest of these inputs, or empty if they were not archived
+	Replay string
+}
+
+// StartEngine starts a new Engine based on its specification
+func (srv *Service) StartEngine(ctx context.Context, req *v1.StartEngineRequest) (*v1.StartEngineResponse, error) {
+	if srv.isReadOnly() {
+		return nil, errReadOnly
+	}
+	var configYAML []byte
+	if len(req.EngineYaml) == 0 && req.EnginePath != "" && srv.Specs != nil {
+		cfg, engineYAML, found, err := srv.Specs.loadEngine(req.Metadata.GetRepository(), req.EnginePath)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			configYAML = cfg
+			// the Engine YAML is archived with the request, so that the Engine can be replayed
+			req = proto.Clone(req).(*v1.StartEngineRequest)
+			req.EngineYaml = engineYAML
+		}
+	}
+	return srv.startEngine(ctx, req.Metadata, req.NameSuffix, req.WaitUntil, engineInputs{
+		ConfigYAML: configYAML,
+		EngineYAML: req.EngineYaml,
+		EnginePath: req.EnginePath,
+		Sideload:   req.Sideload,
+		Replay:     srv.archiveRequest(ctx, req),
+	})
+}
+
+// startEngine creates a new Engine. If waitUntil lies in the future, the Engine waits in
+// PHASE_WAITING until then, otherwise it starts right away.
+func (srv *Service) startEngine(ctx context.Context, metadata *v1.EngineMetadata, nameSuffix string, waitUntil *timestamppb.Timestamp, inputs engineInputs) (*v1.StartEngineResponse, error) {
+	if metadata == nil {
+		return nil, status.Error(codes.InvalidArgument, "metadata is required")
+	}
+
+	phase := v1.EnginePhase_PHASE_PREPARING
+	conditions := &v1.EngineConditions{}
+	if waitUntil != nil {
+		if err := waitUntil.CheckValid(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid wait_until: %v", err)
+		}
+		if waitUntil.AsTime().After(time.Now()) {
+			phase = v1.EnginePhase_PHASE_WAITING
+			conditions.WaitUntil = waitUntil
+		}
+	}
+
+	md := proto.Clone(metadata).(*v1.EngineMetadata)
+	if err := srv.claim(ctx, md); err != nil {
+		return nil, err
+	}
+	if md.Created == nil {
+		md.Created = timestamppb.Now()
+	}
+	md.Finished = nil
+
+	srv.mu.Lock()
+	name, err := srv.newEngineName(ctx, md, nameSuffix)
+	if err != nil {
+		srv.mu.Unlock()
+		return nil, status.Errorf(codes.Internal, "cannot produce Engine name: %v", err)
+	}
+	s := &v1.EngineStatus{
+		Name:       name,
+		Metadata:   md,
+		Phase:      phase,
+		Conditions: conditions,
+	}
+	if inputs.Replay != "" {
+		// an Engine can only be replayed once its inputs are tagged with its name
+		err = srv.Blobs.Tag(ctx, name, inputs.Replay)
+		if err != nil {
+			log.WithError(err).WithField("name", name).Warn("cannot record Engine inputs - Engine cannot be replayed")
+		}
+		conditions.CanReplay = err == nil
+	}
+	if phase == v1.EnginePhase_PHASE_PREPARING {
+		srv.openLog(name)
+	}
+	err = srv.Engines.Store(ctx, s)
+	if err != nil {
+		srv.closeLog(name)
+	} else if phase == v1.EnginePhase_PHASE_WAITING {
+		if srv.pending == nil {
+			srv.pending = make(map[string]engineInputs)
+		}
+		srv.pending[name] = inputs
+		srv.notify(s)
+	}
+	srv.mu.Unlock()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot store Engine: %v", err)
+	}
+
+	if phase == v1.EnginePhase_PHASE_WAITING {
+		log.WithField("name", name).WithField("waitUntil", waitUntil.AsTime()).Info("Engine waits for its start")
+		srv.schedule.Schedule(name, waitUntil.AsTime(), srv.startWaiting)
+	} else {
+		log.WithField("name", name).WithField("application", inputs.ApplicationDir).Info("starting Engine")
+		srv.begin(s, inputs)
+	}
+
+	return &v1.StartEngineResponse{Status: s}, nil
+}
+
+var nameSanitizer = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// newEngineName produces a unique name for a new Engine. Callers must hold srv.mu.
+func (srv *Service) newEngineName(ctx context.Context, md *v1.EngineMetadata, suffix string) (string, error) {
+	base := md.GetRepository().GetRepo()
+	if base == "" {
+		base = md.EngineSpecName
+	}
+	if base == "" {
+		base = "engine"
+	}
+	if suffix != "" {
+		base += "-" + suffix
+	}
+	base = strings.Trim(nameSanitizer.ReplaceAllString(strings.ToLower(base), "-"), "-")
+	if base == "" {
+		base = "engine"
+	}
+
+	for {
+		nr, err := srv.Groups.Next(ctx, base)
+		if err != nil {
+			return "", err
+		}
+		name := fmt.Sprintf("%s.%d", base, nr)
+		_, err = srv.Engines.Get(ctx, name)
+		if err == store.ErrNotFound {
+			return name, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// ListEngines searches for Engines known to this server
+func (srv *Service) ListEngines(ctx context.Context, req *v1.ListEnginesRequest) (*v1.ListEnginesResponse, error) {
+	if err := filterexpr.Validate(req.Filter, req.Order); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.Start < 0 || req.Limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "start and limit must not be negative")
+	}
+
+	result, total, err := srv.Engines.Find(ctx, req.Filter, req.Order, int(req.Start), int(req.Limit))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot search Engines: %v", err)
+	}
+
+	return &v1.ListEnginesResponse{
+		Total:  int32(total),
+		Result: result,
+	}, nil
+}
+
+// GetEngine retrieves details of a single Engine
+func (srv *Service) GetEngine(ctx context.Context, req *v1.GetEngineRequest) (*v1.GetEngineResponse, error) {
+	s, err := srv.get(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.GetEngineResponse{Result: s}, nil
+}
+
+// get retrieves an Engine from the store and translates store errors to gRPC status
+func (srv *Service) get(ctx context.Context, name string) (*v1.EngineStatus, error) {
+	s, err := srv.Engines.Get(ctx, name)
+	if err == store.ErrNotFound {
+		return nil, status.Errorf(codes.NotFound, "Engine %s not found", name)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot get Engine %s: %v", name, err)
+	}
+	return s, nil
+}
+
+// authorize checks that the caller may access an Engine
+func (srv *Service) authorize(ctx context.Context, s *v1.EngineStatus) error {
+	if srv.Authorizer == nil {
+		return nil
+	}
+	return srv.Authorizer.Authorize(ctx, s.GetMetadata().GetOwner())
+}
+
+// claim makes the caller the owner of a new Engine unless it names one, and checks that the
+// caller may start Engines on behalf of that owner
+func (srv *Service) claim(ctx context.Context, md *v1.EngineMetadata) error {
+	if srv.Authorizer == nil {
+		return nil
+	}
+	if id, ok := auth.FromContext(ctx); ok && md.Owner == "" {
+		md.Owner = id.Name
+	}
+	return srv.Authorizer.Authorize(ctx, md.Owner)
+}
+
+// StopEngine stops a currently running Engine
+func (srv *Service) StopEngine(ctx context.Context, req *v1.StopEngineRequest) (*v1.StopEngineResponse, error) {
+	if srv.isReadOnly() {
+		return nil, errReadOnly
+	}
+	srv.mu.Lock()
+	s, err := srv.get(ctx, req.Name)
+	if err != nil {
+		srv.mu.Unlock()
+		return nil, err
+	}
+	if err := srv.authorize(ctx, s); err != nil {
+		srv.mu.Unlock()
+		return nil, err
+	}
+	if s.Phase == v1.EnginePhase_PHASE_DONE {
+		srv.mu.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "Engine %s is already done", req.Name)
+	}
+	if srv.stopRunning(s.Name) {
+		// the runner stops the Engine and reports once it's done
+		srv.mu.Unlock()
+		log.WithField("name", req.Name).Info("stopping Engine")
+		return &v1.StopEngineResponse{}, nil
+	}
+	srv.removeApplication(s.Name, srv.pending[s.Name])
+	delete(srv.pending, s.Name)
+	if s.Phase == v1.EnginePhase_PHASE_WAITING {
+		srv.schedule.Cancel(s.Name)
+		s.Details = "cancelled before it started"
+	} else {
+		s.Details = "stopped"
+	}
+	s.Phase = v1.EnginePhase_PHASE_DONE
+	s.Conditions.Success = false
+	s.Metadata.Finished = timestamppb.Now()
+	err = srv.Engines.Store(ctx, s)
+	if err == nil {
+		srv.closeLog(s.Name)
+		srv.notify(s)
+	}
+	srv.mu.Unlock()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot store Engine: %v", err)
+	}
+
+	log.WithField("name", req.Name).Info("stopped Engine")
+
+	return &v1.StopEngineResponse{}, nil
+}
+
+// Subscribe listens to new Engine updates
+func (srv *Service) Subscribe(req *v1.SubscribeRequest, resp v1.UfsService_SubscribeServer) error {
+	if err := filterexpr.Validate(req.Filter, nil); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	sub := srv.subscribe(func(s *v1.EngineStatus) bool {
+		return filterexpr.MatchesFilter(s, req.Filter)
+	})
+	defer sub.Close()
+	defer srv.Metrics.streamStarted("Subscribe")()
+
+	for {
+		s, err := nextUpdate(resp.Context(), sub)
+		if err != nil {
+			return err
+		}
+		if s == nil {
+			return nil
+		}
+		if err := resp.Send(&v1.SubscribeResponse{Result: s}); err != nil {
+			return err
+		}
+	}
+}
+
+// Listen listens to Engine updates and log output of a running Engine
+func (srv *Service) Listen(req *v1.ListenRequest, resp v1.UfsService_ListenServer) error {
+	// we subscribe before we get the current state so that we don't miss an update in between
+	sub := srv.subscribe(func(s *v1.EngineStatus) bool {
+		return s.Name == req.Name
+	})
+	defer sub.Close()
+	defer srv.Metrics.streamStarted("Listen")()
+
+	s, err := srv.get(resp.Context(), req.Name)
+	if err != nil {
+		return err
+	}
+	if !req.Updates && req.Logs == v1.ListenRequestLogs_LOGS_DISABLED {
+		return nil
+	}
+	if req.Logs != v1.ListenRequestLogs_LOGS_DISABLED {
+		if err := srv.authorize(resp.Context(), s); err != nil {
+			return err
+		}
+	}
+
+	// updates and log output are sent concurrently, but a stream must not be sent to concurrently
+	var sendMu sync.Mutex
+	send := func(r *v1.ListenResponse) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		return resp.Send(r)
+	}
+
+	ctx, cancel := context.WithCancel(resp.Context())
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, 2)
+	)
+	if req.Updates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- srv.listenUpdates(ctx, s, sub, send)
+		}()
+	}
+	if req.Logs != v1.ListenRequestLogs_LOGS_DISABLED {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- srv.streamLogs(ctx, req.Name, req.Logs, send)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(errs)
+	}()
+
+	for err := range errs {
+		if err != nil {
+			// stop the other half of the stream
+			cancel()
+			return err
+		}
+	}
+	return nil
+}
+
+// listenUpdates sends Engine updates starting with s until the Engine is done
+func (srv *Service) listenUpdates(ctx context.Context, s *v1.EngineStatus, sub *broadcaster.Subscription, send func(*v1.ListenResponse) error) error {
+	err := send(&v1.ListenResponse{Content: &v1.ListenResponse_Update{Update: s}})
+	if err != nil {
+		return err
+	}
+	for s.Phase != v1.EnginePhase_PHASE_DONE {
+		s, err = nextUpdate(ctx, sub)
+		if err != nil {
+			return err
+		}
+		if s == nil {
+			return nil
+		}
+		if err := send(&v1.ListenResponse{Content: &v1.ListenResponse_Update{Update: s}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subscribe registers for Engine updates matching the filter
+func (srv *Service) subscribe(filter func(*v1.EngineStatus) bool) *broadcaster.Subscription {
+	bufferSize := srv.SubscriberBufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultSubscriberBufferSize
+	}
+
+	return srv.events.Subscribe(broadcaster.SubscriberOptions{
+		BufferSize: bufferSize,
+		Overflow:   broadcaster.OverflowCoalesce,
+		Key:        func(evt interface{}) string { return evt.(*v1.EngineStatus).Name },
+		Filter:     func(evt interface{}) bool { return filter(evt.(*v1.EngineStatus)) },
+	})
+}
+
+// nextUpdate waits for the next Engine update. It returns nil if the client went away
+// and a gRPC status error if the subscription ended.
+func nextUpdate(ctx context.Context, sub *broadcaster.Subscription) (*v1.EngineStatus, error) {
+	evt, err := sub.Next(ctx)
+	switch {
+	case err == nil:
+		return evt.(*v1.EngineStatus), nil
+	case ctx.Err() != nil:
+		return nil, nil
+	case err == broadcaster.ErrOverflow:
+		return nil, status.Error(codes.ResourceExhausted, "client cannot keep up with Engine updates and was disconnected")
+	case err == broadcaster.ErrClosed:
+		return nil, status.Error(codes.Unavailable, "server is shutting down")
+	default:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+}
+
+// notify publishes an Engine update to all subscribers. Publishing never blocks,
+// regardless of how slow subscribers are. Callers must hold srv.mu, and publish
+// while still holding it after storing the update, so that subscribers receive
+// the updates of an Engine in the order they were stored.
+func (srv *Service) notify(s *v1.EngineStatus) {
+	srv.events.Publish(proto.Clone(s).(*v1.EngineStatus))
+}
+
+// SetReadOnly changes whether requests which would start or stop Engines are rejected.
+// It is safe to call while the service is serving requests.
+func (srv *Service) SetReadOnly(readOnly bool) {
+	srv.readOnlyMu.Lock()
+	srv.ReadOnly = readOnly
+	srv.readOnlyMu.Unlock()
+}
+
+func (srv *Service) isReadOnly() bool {
+	srv.readOnlyMu.RLock()
+	defer srv.readOnlyMu.RUnlock()
+	return srv.ReadOnly
+}
+
+// Close stops the scheduler, disconnects all Subscribe and Listen clients and closes the logs of running Engines
+func (srv *Service) Close() {
+	srv.schedule.Stop()
+	srv.events.Close()
+
+	srv.mu.Lock()
+	for name := range srv.logWriters {
+		srv.closeLog(name)
+	}
+	srv.mu.Unlock()
+}
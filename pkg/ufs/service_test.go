@@ -0,0 +1,305 @@
+package ufs
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/store"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func newTestClient(t *testing.T, srv *Service) v1.UfsServiceClient {
+	t.Helper()
+
+	l := bufconn.Listen(1024 * 1024)
+	gs := grpc.NewServer()
+	v1.RegisterUfsServiceServer(gs, srv)
+	go gs.Serve(l)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return l.Dial() }),
+		grpc.WithInsecure(),
+	)
+	assert.NilError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return v1.NewUfsServiceClient(conn)
+}
+
+func TestStartListGetStop(t *testing.T) {
+	client := newTestClient(t, newTestService())
+	ctx := context.Background()
+
+	for _, owner := range []string{"alice", "bob", "alice"} {
+		_, err := client.StartEngine(ctx, &v1.StartEngineRequest{
+			Metadata: &v1.EngineMetadata{
+				Owner:      owner,
+				Repository: &v1.Repository{Repo: "Storage"},
+				Trigger:    v1.EngineTrigger_TRIGGER_MANUAL,
+			},
+			EngineYaml: testEngineYAML,
+		})
+		assert.NilError(t, err)
+	}
+
+	list, err := client.ListEngines(ctx, &v1.ListEnginesRequest{
+		Filter: []*v1.FilterExpression{{Terms: []*v1.FilterTerm{{Field: "owner", Value: "alice"}}}},
+		Order:  []*v1.OrderExpression{{Field: "name", Ascending: false}},
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, list.Total, int32(2))
+	assert.Equal(t, list.Result[0].Name, "storage.3")
+	assert.Equal(t, list.Result[1].Name, "storage.1")
+
+	paged, err := client.ListEngines(ctx, &v1.ListEnginesRequest{Start: 1, Limit: 1})
+	assert.NilError(t, err)
+	assert.Equal(t, paged.Total, int32(3))
+	assert.Check(t, is.Len(paged.Result, 1))
+	assert.Equal(t, paged.Result[0].Name, "storage.2")
+
+	_, err = client.StopEngine(ctx, &v1.StopEngineRequest{Name: "storage.2"})
+	assert.NilError(t, err)
+	get, err := client.GetEngine(ctx, &v1.GetEngineRequest{Name: "storage.2"})
+	assert.NilError(t, err)
+	assert.Equal(t, get.Result.Phase, v1.EnginePhase_PHASE_DONE)
+	assert.Check(t, get.Result.Metadata.Finished != nil)
+
+	_, err = client.StopEngine(ctx, &v1.StopEngineRequest{Name: "storage.2"})
+	assert.Equal(t, status.Code(err), codes.FailedPrecondition)
+	_, err = client.GetEngine(ctx, &v1.GetEngineRequest{Name: "does-not-exist.1"})
+	assert.Equal(t, status.Code(err), codes.NotFound)
+	_, err = client.ListEngines(ctx, &v1.ListEnginesRequest{Order: []*v1.OrderExpression{{Field: "foobar"}}})
+	assert.Equal(t, status.Code(err), codes.InvalidArgument)
+}
+
+func TestSubscribeAndListen(t *testing.T) {
+	client := newTestClient(t, newTestService())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sub, err := client.Subscribe(ctx, &v1.SubscribeRequest{
+		Filter: []*v1.FilterExpression{{Terms: []*v1.FilterTerm{{Field: "owner", Value: "alice"}}}},
+	})
+	assert.NilError(t, err)
+	// give the subscription time to register on the server
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = client.StartEngine(ctx, &v1.StartEngineRequest{Metadata: &v1.EngineMetadata{Owner: "bob"}, EngineYaml: testEngineYAML})
+	assert.NilError(t, err)
+	resp, err := client.StartEngine(ctx, &v1.StartEngineRequest{Metadata: &v1.EngineMetadata{Owner: "alice"}, EngineYaml: testEngineYAML, NameSuffix: "nightly"})
+	assert.NilError(t, err)
+	assert.Equal(t, resp.Status.Name, "engine-nightly.1")
+
+	msg, err := sub.Recv()
+	assert.NilError(t, err)
+	assert.Equal(t, msg.Result.Name, "engine-nightly.1")
+
+	listen, err := client.Listen(ctx, &v1.ListenRequest{Name: resp.Status.Name, Updates: true})
+	assert.NilError(t, err)
+	upd, err := listen.Recv()
+	assert.NilError(t, err)
+	assert.Equal(t, upd.GetUpdate().Phase, v1.EnginePhase_PHASE_PREPARING)
+
+	_, err = client.StopEngine(ctx, &v1.StopEngineRequest{Name: resp.Status.Name})
+	assert.NilError(t, err)
+	upd, err = listen.Recv()
+	assert.NilError(t, err)
+	assert.Equal(t, upd.GetUpdate().Phase, v1.EnginePhase_PHASE_DONE)
+}
+
+type blockingSubscribeServer struct {
+	grpc.ServerStream
+	ctx     context.Context
+	release chan struct{}
+	sent    chan *v1.SubscribeResponse
+}
+
+func (b *blockingSubscribeServer) Context() context.Context { return b.ctx }
+
+func (b *blockingSubscribeServer) Send(resp *v1.SubscribeResponse) error {
+	<-b.release
+	b.sent <- resp
+	return nil
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	srv := newTestService()
+	srv.SubscriberBufferSize = 1
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream := &blockingSubscribeServer{ctx: ctx, release: make(chan struct{}), sent: make(chan *v1.SubscribeResponse, 10)}
+	errchan := make(chan error, 1)
+	go func() { errchan <- srv.Subscribe(&v1.SubscribeRequest{}, stream) }()
+	for srv.events.Subscribers() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the first update is stuck in Send, the second one waits in the buffer
+	first, err := srv.StartEngine(ctx, &v1.StartEngineRequest{Metadata: &v1.EngineMetadata{Owner: "alice"}, EngineYaml: testEngineYAML})
+	assert.NilError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	second, err := srv.StartEngine(ctx, &v1.StartEngineRequest{Metadata: &v1.EngineMetadata{Owner: "alice"}, EngineYaml: testEngineYAML})
+	assert.NilError(t, err)
+
+	// updates of the same Engine are coalesced, and StopEngine must not block on the slow subscriber
+	_, err = srv.StopEngine(ctx, &v1.StopEngineRequest{Name: second.Status.Name})
+	assert.NilError(t, err)
+
+	// an update of another Engine cannot be coalesced and disconnects the subscriber
+	_, err = srv.StopEngine(ctx, &v1.StopEngineRequest{Name: first.Status.Name})
+	assert.NilError(t, err)
+	waitForPhase(t, srv, first.Status.Name, v1.EnginePhase_PHASE_DONE)
+
+	close(stream.release)
+	err = <-errchan
+	assert.Equal(t, status.Code(err), codes.ResourceExhausted, "unexpected error: %v", err)
+
+	resp := <-stream.sent
+	assert.Equal(t, resp.Result.Name, first.Status.Name)
+	assert.Equal(t, resp.Result.Phase, v1.EnginePhase_PHASE_PREPARING)
+}
+
+func TestListenLogs(t *testing.T) {
+	logs, err := store.NewFileLogStore(t.TempDir())
+	assert.NilError(t, err)
+	srv := newTestService()
+	srv.Logs = logs
+	client := newTestClient(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.StartEngine(ctx, &v1.StartEngineRequest{Metadata: &v1.EngineMetadata{Owner: "alice"}, EngineYaml: testEngineYAML})
+	assert.NilError(t, err)
+	name := resp.Status.Name
+
+	out := srv.logOutput(name)
+	_, err = io.WriteString(out, "[build|PHASE] Building\n[build] \x1b[31mcompiling\x1b[0m\n[build|DONE]\n[url|RESULT] https://example.com\n")
+	assert.NilError(t, err)
+
+	recv := func(stream v1.UfsService_ListenClient) (res []*v1.LogSliceEvent) {
+		for {
+			msg, err := stream.Recv()
+			if err == io.EOF {
+				return res
+			}
+			assert.NilError(t, err)
+			res = append(res, msg.GetSlice())
+		}
+	}
+
+	raw, err := client.Listen(ctx, &v1.ListenRequest{Name: name, Logs: v1.ListenRequestLogs_LOGS_RAW})
+	assert.NilError(t, err)
+	html, err := client.Listen(ctx, &v1.ListenRequest{Name: name, Logs: v1.ListenRequestLogs_LOGS_HTML})
+	assert.NilError(t, err)
+	unsliced, err := client.Listen(ctx, &v1.ListenRequest{Name: name, Logs: v1.ListenRequestLogs_LOGS_UNSLICED})
+	assert.NilError(t, err)
+
+	_, err = io.WriteString(out, "[test] running\n")
+	assert.NilError(t, err)
+	// wait for the result to be collected before the Engine ends
+	for {
+		get, err := client.GetEngine(ctx, &v1.GetEngineRequest{Name: name})
+		assert.NilError(t, err)
+		if len(get.Result.Results) > 0 {
+			assert.Equal(t, get.Result.Results[0].Type, "url")
+			assert.Equal(t, get.Result.Results[0].Payload, "https://example.com")
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = client.StopEngine(ctx, &v1.StopEngineRequest{Name: name})
+	assert.NilError(t, err)
+
+	evts := recv(raw)
+	types := make([]v1.LogSliceType, 0, len(evts))
+	for _, evt := range evts {
+		types = append(types, evt.Type)
+	}
+	assert.DeepEqual(t, types, []v1.LogSliceType{
+		v1.LogSliceType_SLICE_PHASE,
+		v1.LogSliceType_SLICE_START,
+		v1.LogSliceType_SLICE_CONTENT,
+		v1.LogSliceType_SLICE_DONE,
+		v1.LogSliceType_SLICE_RESULT,
+		v1.LogSliceType_SLICE_START,
+		v1.LogSliceType_SLICE_CONTENT,
+		v1.LogSliceType_SLICE_ABANDONED,
+	})
+	assert.Equal(t, evts[2].Payload, "\x1b[31mcompiling\x1b[0m")
+	assert.Equal(t, evts[7].Name, "test")
+
+	evts = recv(html)
+	assert.Equal(t, evts[2].Payload, `<span style="color:#cd3131">compiling</span>`)
+
+	evts = recv(unsliced)
+	assert.Check(t, is.Len(evts, 5))
+	assert.Equal(t, evts[0].Payload, "[build|PHASE] Building")
+}
+
+func TestListenLogsLongLine(t *testing.T) {
+	logs, err := store.NewFileLogStore(t.TempDir())
+	assert.NilError(t, err)
+	srv := newTestService()
+	srv.Logs = logs
+	client := newTestClient(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.StartEngine(ctx, &v1.StartEngineRequest{Metadata: &v1.EngineMetadata{Owner: "alice"}, EngineYaml: testEngineYAML})
+	assert.NilError(t, err)
+	name := resp.Status.Name
+
+	long := strings.Repeat("x", 1<<20+10)
+	_, err = io.WriteString(srv.logOutput(name), long+"\nend\n")
+	assert.NilError(t, err)
+	_, err = client.StopEngine(ctx, &v1.StopEngineRequest{Name: name})
+	assert.NilError(t, err)
+
+	unsliced, err := client.Listen(ctx, &v1.ListenRequest{Name: name, Logs: v1.ListenRequestLogs_LOGS_UNSLICED})
+	assert.NilError(t, err)
+	var payloads []string
+	for {
+		msg, err := unsliced.Recv()
+		if err == io.EOF {
+			break
+		}
+		assert.NilError(t, err)
+		assert.Equal(t, msg.GetSlice().Type, v1.LogSliceType_SLICE_CONTENT)
+		payloads = append(payloads, msg.GetSlice().Payload)
+	}
+	assert.Assert(t, len(payloads) > 2, "the long line is not split")
+	assert.Equal(t, strings.Join(payloads[:len(payloads)-1], ""), long)
+	assert.Equal(t, payloads[len(payloads)-1], "end")
+}
@@ -0,0 +1,201 @@
+package ufs
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/spec"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// SpecRepository is a checked out repository whose ufs/config.yaml lists Engines
+// which can be started through the web UI
+type SpecRepository struct {
+	Repository *v1.Repository
+	// Dir is the root of the checkout
+	Dir string
+}
+
+// UI implements the UfsUI service
+type UI struct {
+	// Repositories are searched for Engine specs in order
+	Repositories []SpecRepository
+	// ReadOnly tells the web UI not to offer starting or stopping Engines
+	ReadOnly bool
+	// mu guards Repositories and ReadOnly against Update
+	mu sync.RWMutex
+
+	v1.UnimplementedUfsUIServer
+}
+
+// NewUI creates a new UfsUI service which discovers Engine specs in the given repositories
+func NewUI(repos []SpecRepository, readOnly bool) *UI {
+	return &UI{
+		Repositories: repos,
+		ReadOnly:     readOnly,
+	}
+}
+
+// Update replaces the repositories and read-only mode. It is safe to call while the
+// service is serving requests.
+func (ui *UI) Update(repos []SpecRepository, readOnly bool) {
+	ui.mu.Lock()
+	ui.Repositories = repos
+	ui.ReadOnly = readOnly
+	ui.mu.Unlock()
+}
+
+// ListEngineSpecs returns the Engines listed in the ufs/config.yaml of all repositories.
+// Repositories without a config are skipped, as are those whose config is invalid.
+func (ui *UI) ListEngineSpecs(req *v1.ListEngineSpecsRequest, srv v1.UfsUI_ListEngineSpecsServer) error {
+	ui.mu.RLock()
+	repos := ui.Repositories
+	ui.mu.RUnlock()
+
+	for _, repo := range repos {
+		specs, err := ui.engineSpecs(repo)
+		if err != nil {
+			log.WithError(err).WithField("dir", repo.Dir).Warn("cannot discover Engine specs")
+			continue
+		}
+		for _, s := range specs {
+			err := srv.Send(s)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// engineSpecs reads the Engine specs of a single repository
+func (ui *UI) engineSpecs(repo SpecRepository) ([]*v1.ListEngineSpecsResponse, error) {
+	content, err := os.ReadFile(filepath.Join(repo.Dir, spec.ConfigPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := spec.ParseConfig(content)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*v1.ListEngineSpecsResponse, 0, len(cfg.Engines))
+	for _, e := range cfg.Engines {
+		desc := e.Description
+		if desc == "" {
+			desc = engineDescription(filepath.Join(repo.Dir, e.Path))
+		}
+		args := make([]*v1.DesiredAnnotation, 0, len(e.Arguments))
+		for _, a := range e.Arguments {
+			args = append(args, &v1.DesiredAnnotation{
+				Name:        a.Name,
+				Required:    a.Required,
+				Description: a.Description,
+			})
+		}
+		var r *v1.Repository
+		if repo.Repository != nil {
+			r = proto.Clone(repo.Repository).(*v1.Repository)
+		}
+		res = append(res, &v1.ListEngineSpecsResponse{
+			Repo:        r,
+			Name:        e.Name,
+			Path:        e.Path,
+			Description: desc,
+			Arguments:   args,
+		})
+	}
+	return res, nil
+}
+
+// loadEngine reads the ufs/config.yaml and the Engine YAML at enginePath of the spec repository of repo.
+// Only Engines the config lists can be loaded. Found is false if no spec repository is repo.
+func (ui *UI) loadEngine(repo *v1.Repository, enginePath string) (configYAML, engineYAML []byte, found bool, err error) {
+	if repo == nil {
+		return nil, nil, false, nil
+	}
+	ui.mu.RLock()
+	repos := ui.Repositories
+	ui.mu.RUnlock()
+
+	for _, r := range repos {
+		if r.Repository == nil || r.Repository.Host != repo.Host || r.Repository.Owner != repo.Owner || r.Repository.Repo != repo.Repo {
+			continue
+		}
+
+		configYAML, err = os.ReadFile(filepath.Join(r.Dir, spec.ConfigPath))
+		if err != nil {
+			return nil, nil, true, status.Errorf(codes.FailedPrecondition, "cannot read %s of %s: %v", spec.ConfigPath, repo.Repo, err)
+		}
+		cfg, err := spec.ParseConfig(configYAML)
+		if err != nil {
+			return nil, nil, true, status.Errorf(codes.FailedPrecondition, "%s: %v", repo.Repo, err)
+		}
+		listed := enginePath == cfg.DefaultEngine
+		for _, e := range cfg.Engines {
+			listed = listed || e.Path == enginePath
+		}
+		fn := filepath.Join(r.Dir, filepath.FromSlash(enginePath))
+		if !listed || !strings.HasPrefix(fn, filepath.Clean(r.Dir)+string(filepath.Separator)) {
+			return nil, nil, true, status.Errorf(codes.InvalidArgument, "%s is not an Engine of %s", enginePath, repo.Repo)
+		}
+		engineYAML, err = os.ReadFile(fn)
+		if err != nil {
+			return nil, nil, true, status.Errorf(codes.FailedPrecondition, "cannot read Engine YAML: %v", err)
+		}
+		return configYAML, engineYAML, true, nil
+	}
+	return nil, nil, false, nil
+}
+
+// engineDescription returns the description of an Engine YAML, or an empty string if it cannot be read
+func engineDescription(path string) string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.WithError(err).WithField("path", path).Debug("cannot read Engine YAML")
+		return ""
+	}
+	e, err := spec.ParseEngine(content)
+	if err != nil {
+		log.WithError(err).WithField("path", path).Debug("cannot parse Engine YAML")
+		return ""
+	}
+	return e.Description
+}
+
+// IsReadOnly returns true if the server does not permit starting or stopping Engines
+func (ui *UI) IsReadOnly(ctx context.Context, req *v1.IsReadOnlyRequest) (*v1.IsReadOnlyResponse, error) {
+	ui.mu.RLock()
+	defer ui.mu.RUnlock()
+	return &v1.IsReadOnlyResponse{Readonly: ui.ReadOnly}, nil
+}
@@ -0,0 +1,165 @@
+package ufs
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/bhojpur/ufs/pkg/api/v1"
+	"github.com/bhojpur/ufs/pkg/spec"
+	"github.com/bhojpur/ufs/pkg/store"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func newTestUIClient(t *testing.T, ui *UI) v1.UfsUIClient {
+	t.Helper()
+
+	l := bufconn.Listen(1024 * 1024)
+	gs := grpc.NewServer()
+	v1.RegisterUfsUIServer(gs, ui)
+	go gs.Serve(l)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return l.Dial() }),
+		grpc.WithInsecure(),
+	)
+	assert.NilError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return v1.NewUfsUIClient(conn)
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	assert.NilError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.NilError(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+func TestListEngineSpecs(t *testing.T) {
+	storage := t.TempDir()
+	writeFile(t, filepath.Join(storage, spec.ConfigPath), `
+engines:
+- name: backup
+  path: ufs/backup.yaml
+  arguments:
+  - name: target
+    required: true
+    description: where the backup goes
+- name: restore
+  path: ufs/restore.yaml
+  description: restores a backup
+`)
+	writeFile(t, filepath.Join(storage, "ufs/backup.yaml"), "description: nightly backup\ncommand: [backup]\n")
+
+	broken := t.TempDir()
+	writeFile(t, filepath.Join(broken, spec.ConfigPath), "engines: [{path: a.yaml}]\n")
+
+	repo := &v1.Repository{Host: "github.com", Owner: "bhojpur", Repo: "storage"}
+	client := newTestUIClient(t, NewUI([]SpecRepository{
+		{Repository: repo, Dir: storage},
+		{Repository: &v1.Repository{Repo: "broken"}, Dir: broken},
+		{Repository: &v1.Repository{Repo: "empty"}, Dir: t.TempDir()},
+	}, false))
+
+	stream, err := client.ListEngineSpecs(context.Background(), &v1.ListEngineSpecsRequest{})
+	assert.NilError(t, err)
+	var specs []*v1.ListEngineSpecsResponse
+	for {
+		s, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		assert.NilError(t, err)
+		specs = append(specs, s)
+	}
+
+	expected := []*v1.ListEngineSpecsResponse{
+		{
+			Repo:        repo,
+			Name:        "backup",
+			Path:        "ufs/backup.yaml",
+			Description: "nightly backup",
+			Arguments: []*v1.DesiredAnnotation{
+				{Name: "target", Required: true, Description: "where the backup goes"},
+			},
+		},
+		{
+			Repo:        repo,
+			Name:        "restore",
+			Path:        "ufs/restore.yaml",
+			Description: "restores a backup",
+		},
+	}
+	assert.Assert(t, is.Len(specs, len(expected)))
+	for i := range expected {
+		assert.Check(t, proto.Equal(specs[i], expected[i]), "spec %d: %v", i, specs[i])
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	uiSrv := NewUI(nil, true)
+	ui := newTestUIClient(t, uiSrv)
+	resp, err := ui.IsReadOnly(context.Background(), &v1.IsReadOnlyRequest{})
+	assert.NilError(t, err)
+	assert.Check(t, resp.Readonly)
+
+	srv := NewService(store.NewInMemoryEngineStore(), store.NewInMemoryNumberGroup())
+	srv.ReadOnly = true
+	client := newTestClient(t, srv)
+	ctx := context.Background()
+
+	_, err = client.StartEngine(ctx, &v1.StartEngineRequest{Metadata: &v1.EngineMetadata{Owner: "alice"}})
+	assert.Check(t, is.Equal(status.Code(err), codes.PermissionDenied))
+	_, err = client.StopEngine(ctx, &v1.StopEngineRequest{Name: "engine.1"})
+	assert.Check(t, is.Equal(status.Code(err), codes.PermissionDenied))
+	_, err = client.StartFromPreviousEngine(ctx, &v1.StartFromPreviousEngineRequest{PreviousEngine: "engine.1"})
+	assert.Check(t, is.Equal(status.Code(err), codes.PermissionDenied))
+
+	local, err := client.StartLocalEngine(ctx)
+	assert.NilError(t, err)
+	_, err = local.CloseAndRecv()
+	assert.Check(t, is.Equal(status.Code(err), codes.PermissionDenied))
+
+	// reading is still permitted
+	_, err = client.ListEngines(ctx, &v1.ListEnginesRequest{})
+	assert.NilError(t, err)
+
+	// read-only mode can be lifted while serving
+	srv.SetReadOnly(false)
+	_, err = client.StopEngine(ctx, &v1.StopEngineRequest{Name: "engine.1"})
+	assert.Check(t, is.Equal(status.Code(err), codes.NotFound))
+	uiSrv.Update(nil, false)
+	resp, err = ui.IsReadOnly(ctx, &v1.IsReadOnlyRequest{})
+	assert.NilError(t, err)
+	assert.Check(t, !resp.Readonly)
+}
@@ -0,0 +1,518 @@
+// The web UI talks to the server through the JSON gateway: unary RPCs answer with JSON,
+// streaming RPCs with server-sent events.
+"use strict";
+
+const rpcBase = "rpc/";
+const pageSize = 50;
+
+const state = {
+  readOnly: true,
+  filter: [],
+  start: 0,
+  // streams is aborted whenever the view changes
+  streams: null,
+};
+
+class RPCError extends Error {
+  constructor(code, message) {
+    super(message);
+    this.code = code;
+  }
+}
+
+// headers adds the token the user logged in with, if any
+function headers(h) {
+  const token = localStorage.getItem("ufs-token");
+  if (token) {
+    h["Authorization"] = "Bearer " + token;
+  }
+  return h;
+}
+
+async function rpc(method, request) {
+  const resp = await fetch(rpcBase + method, {
+    method: "POST",
+    headers: headers({ "Content-Type": "application/json" }),
+    body: JSON.stringify(request || {}),
+  });
+  const body = await resp.json();
+  if (!resp.ok) {
+    throw new RPCError(body.code, body.message);
+  }
+  return body;
+}
+
+// stream calls a server-streaming RPC and invokes onMessage for every message until the
+// stream ends or signal is aborted.
+async function stream(method, request, onMessage, signal) {
+  const resp = await fetch(rpcBase + method, {
+    method: "POST",
+    headers: headers({ "Content-Type": "application/json", "Accept": "text/event-stream" }),
+    body: JSON.stringify(request || {}),
+    signal: signal,
+  });
+  if (!resp.ok) {
+    const body = await resp.json();
+    throw new RPCError(body.code, body.message);
+  }
+
+  const reader = resp.body.getReader();
+  const decoder = new TextDecoder();
+  let buffer = "";
+  for (;;) {
+    const { value, done } = await reader.read();
+    if (done) {
+      return;
+    }
+    buffer += decoder.decode(value, { stream: true });
+
+    let idx;
+    while ((idx = buffer.indexOf("\n\n")) >= 0) {
+      const raw = buffer.slice(0, idx);
+      buffer = buffer.slice(idx + 2);
+
+      let event = "message";
+      let data = "";
+      for (const line of raw.split("\n")) {
+        if (line.startsWith("event: ")) {
+          event = line.slice(7);
+        } else if (line.startsWith("data: ")) {
+          data += line.slice(6);
+        }
+      }
+      const msg = JSON.parse(data);
+      if (event === "error") {
+        throw new RPCError(msg.code, msg.message);
+      }
+      if (event === "end") {
+        return;
+      }
+      onMessage(msg);
+    }
+  }
+}
+
+function $(id) {
+  return document.getElementById(id);
+}
+
+function el(tag, attrs, ...children) {
+  const e = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    if (k === "class") {
+      e.className = v;
+    } else {
+      e.setAttribute(k, v);
+    }
+  }
+  for (const c of children) {
+    e.append(c === undefined || c === null ? "" : c);
+  }
+  return e;
+}
+
+function showError(err) {
+  if (!err || err.name === "AbortError") {
+    return;
+  }
+  if (err.code === "Unauthenticated") {
+    showLogin();
+    return;
+  }
+  $("error").textContent = err.message || String(err);
+  $("error").hidden = false;
+}
+
+function clearError() {
+  $("error").hidden = true;
+}
+
+function phaseName(phase) {
+  return (phase || "PHASE_UNKNOWN").replace("PHASE_", "").toLowerCase();
+}
+
+function phaseBadge(status) {
+  const phase = status.phase || "PHASE_UNKNOWN";
+  let cls = "phase " + phase;
+  if (phase === "PHASE_DONE") {
+    cls += status.conditions && status.conditions.success ? " success" : " failure";
+  }
+  return el("span", { class: cls }, phaseName(phase));
+}
+
+function repoName(repo) {
+  if (!repo) {
+    return "";
+  }
+  return [repo.host, repo.owner, repo.repo].filter((s) => s).join("/");
+}
+
+function formatTime(ts) {
+  return ts ? new Date(ts).toLocaleString() : "";
+}
+
+function resultText(status) {
+  if (status.phase !== "PHASE_DONE") {
+    return "";
+  }
+  const c = status.conditions || {};
+  return c.success ? "succeeded" : "failed";
+}
+
+// views
+
+function resetStreams() {
+  if (state.streams) {
+    state.streams.abort();
+  }
+  state.streams = new AbortController();
+  return state.streams.signal;
+}
+
+function showView(id) {
+  for (const v of ["list-view", "detail-view", "start-view", "login-view"]) {
+    $(v).hidden = v !== id;
+  }
+}
+
+function engineRow(status) {
+  const link = el("a", { href: "#/engines/" + encodeURIComponent(status.name) }, status.name);
+  const actions = el("td");
+  if (!state.readOnly && status.phase !== "PHASE_DONE") {
+    const stop = el("button", { class: "mutating" }, "Stop");
+    stop.onclick = () => stopEngine(status.name);
+    actions.append(stop);
+  }
+  const md = status.metadata || {};
+  const row = el("tr", { "data-name": status.name },
+    el("td", {}, link),
+    el("td", {}, md.owner),
+    el("td", {}, repoName(md.repository)),
+    el("td", {}, phaseBadge(status)),
+    el("td", {}, resultText(status)),
+    el("td", {}, formatTime(md.created)),
+    actions);
+  return row;
+}
+
+async function showList() {
+  showView("list-view");
+  const signal = resetStreams();
+
+  try {
+    const resp = await rpc("v1.UfsService/ListEngines", {
+      filter: state.filter,
+      order: [{ field: "created", ascending: false }],
+      start: state.start,
+      limit: pageSize,
+    });
+    const tbody = $("engines");
+    tbody.replaceChildren(...(resp.result || []).map(engineRow));
+
+    const total = resp.total || 0;
+    const end = Math.min(state.start + pageSize, total);
+    $("page-info").textContent = total ? `${state.start + 1}-${end} of ${total}` : "no Engines";
+    $("prev").disabled = state.start === 0;
+    $("next").disabled = end >= total;
+  } catch (err) {
+    showError(err);
+    return;
+  }
+
+  // live updates only make sense on the first page, which shows the newest Engines
+  try {
+    await stream("v1.UfsService/Subscribe", { filter: state.filter }, (msg) => {
+      const status = msg.result;
+      const row = engineRow(status);
+      row.classList.add("updated");
+      const existing = $("engines").querySelector(`tr[data-name="${CSS.escape(status.name)}"]`);
+      if (existing) {
+        existing.replaceWith(row);
+      } else if (state.start === 0) {
+        $("engines").prepend(row);
+      }
+    }, signal);
+  } catch (err) {
+    showError(err);
+  }
+}
+
+function readFilter(form) {
+  const data = new FormData(form);
+  const filter = [];
+  const term = (field, value, operation) => filter.push({ terms: [{ field: field, value: value, operation: operation }] });
+  if (data.get("name")) {
+    term("name", data.get("name"), "OP_CONTAINS");
+  }
+  if (data.get("owner")) {
+    term("owner", data.get("owner"), "OP_EQUALS");
+  }
+  if (data.get("repo")) {
+    term("repo.repo", data.get("repo"), "OP_EQUALS");
+  }
+  if (data.get("phase")) {
+    term("phase", data.get("phase"), "OP_EQUALS");
+  }
+  if (data.get("success")) {
+    term("success", data.get("success"), "OP_EQUALS");
+  }
+  return filter;
+}
+
+function renderStatus(status) {
+  $("detail-name").textContent = status.name;
+  $("detail-phase").replaceWith(Object.assign(phaseBadge(status), { id: "detail-phase" }));
+  $("stop-button").hidden = state.readOnly || status.phase === "PHASE_DONE";
+
+  const md = status.metadata || {};
+  const c = status.conditions || {};
+  const fields = [
+    ["Owner", md.owner],
+    ["Repository", repoName(md.repository)],
+    ["Engine spec", md.engineSpecName],
+    ["Trigger", (md.trigger || "").replace("TRIGGER_", "").toLowerCase()],
+    ["Created", formatTime(md.created)],
+    ["Finished", formatTime(md.finished)],
+    ["Wait until", formatTime(c.waitUntil)],
+    ["Result", resultText(status)],
+    ["Failures", c.failureCount],
+    ["Details", status.details],
+  ];
+  for (const a of md.annotations || []) {
+    fields.push([a.key, a.value]);
+  }
+  const dl = $("detail-status");
+  dl.replaceChildren();
+  for (const [k, v] of fields) {
+    if (v) {
+      dl.append(el("dt", {}, k), el("dd", {}, String(v)));
+    }
+  }
+
+  $("detail-results").replaceChildren(...(status.results || []).map((r) =>
+    el("li", {}, el("strong", {}, r.type), ": ", r.payload, r.description ? ` (${r.description})` : "")));
+}
+
+// logView renders LOGS_HTML slice events. Content outside of slices goes into the main slice.
+function logView(container) {
+  const slices = new Map();
+  const slice = (name) => {
+    if (slices.has(name)) {
+      return slices.get(name);
+    }
+    const state = el("span", { class: "state" });
+    const pre = el("pre");
+    const details = el("details", { class: "slice", open: "" }, el("summary", {}, name || "output", state), pre);
+    container.append(details);
+    const s = { details: details, state: state, pre: pre };
+    slices.set(name, s);
+    return s;
+  };
+
+  return (evt) => {
+    const s = slice(evt.name || "");
+    switch (evt.type || "SLICE_ABANDONED") {
+      case "SLICE_CONTENT": {
+        const line = el("div");
+        // the server renders content to HTML and escapes it
+        line.innerHTML = evt.payload || "";
+        s.pre.append(line);
+        break;
+      }
+      case "SLICE_PHASE":
+        s.state.innerHTML = evt.payload || "";
+        break;
+      case "SLICE_DONE":
+        s.details.classList.add("done");
+        s.details.open = false;
+        s.state.textContent = "done";
+        break;
+      case "SLICE_FAIL":
+        s.details.classList.add("failed");
+        s.state.innerHTML = "failed: " + (evt.payload || "");
+        break;
+      case "SLICE_ABANDONED":
+        s.state.textContent = "abandoned";
+        break;
+    }
+  };
+}
+
+async function showDetail(name) {
+  showView("detail-view");
+  const signal = resetStreams();
+  $("detail-log").replaceChildren();
+  $("stop-button").onclick = () => stopEngine(name);
+
+  try {
+    const resp = await rpc("v1.UfsService/GetEngine", { name: name });
+    renderStatus(resp.result);
+  } catch (err) {
+    showError(err);
+    return;
+  }
+
+  const onSlice = logView($("detail-log"));
+  try {
+    await stream("v1.UfsService/Listen", { name: name, updates: true, logs: "LOGS_HTML" }, (msg) => {
+      if (msg.update) {
+        renderStatus(msg.update);
+      }
+      if (msg.slice) {
+        onSlice(msg.slice);
+      }
+    }, signal);
+  } catch (err) {
+    // Engines which were started without a log store cannot be listened to
+    if (err.code !== "Unimplemented") {
+      showError(err);
+    }
+  }
+}
+
+async function stopEngine(name) {
+  if (!confirm(`Stop Engine ${name}?`)) {
+    return;
+  }
+  try {
+    await rpc("v1.UfsService/StopEngine", { name: name });
+  } catch (err) {
+    showError(err);
+  }
+}
+
+async function showStart() {
+  showView("start-view");
+  resetStreams();
+  if (state.readOnly) {
+    showError(new Error("this server is read-only"));
+    return;
+  }
+
+  const specs = [];
+  try {
+    await stream("v1.UfsUI/ListEngineSpecs", {}, (s) => specs.push(s), state.streams.signal);
+  } catch (err) {
+    showError(err);
+    return;
+  }
+
+  const form = $("start-form");
+  form.owner.value = localStorage.getItem("ufs-owner") || "";
+  const select = form.spec;
+  select.replaceChildren(...specs.map((s, i) => el("option", { value: i }, `${repoName(s.repo)}: ${s.name}`)));
+
+  const renderArguments = () => {
+    const s = specs[select.value];
+    const fieldset = $("spec-arguments");
+    fieldset.replaceChildren(el("legend", {}, "Annotations"));
+    $("spec-description").textContent = s ? s.description || "" : "no Engines available";
+    if (!s) {
+      return;
+    }
+    for (const a of s.arguments || []) {
+      const input = el("input", { name: "arg-" + a.name });
+      input.required = !!a.required;
+      fieldset.append(el("label", { title: a.description || "" },
+        el("span", { class: a.required ? "required" : "" }, a.name), " ", input,
+        a.description ? el("span", { class: "description" }, " " + a.description) : ""));
+    }
+  };
+  select.onchange = renderArguments;
+  renderArguments();
+
+  form.onsubmit = async (e) => {
+    e.preventDefault();
+    clearError();
+    const s = specs[select.value];
+    if (!s) {
+      return;
+    }
+    localStorage.setItem("ufs-owner", form.owner.value);
+    const annotations = (s.arguments || [])
+      .map((a) => ({ key: a.name, value: form["arg-" + a.name].value }))
+      .filter((a) => a.value !== "");
+    try {
+      const resp = await rpc("v1.UfsService/StartEngine", {
+        metadata: {
+          owner: form.owner.value,
+          repository: s.repo,
+          trigger: "TRIGGER_MANUAL",
+          engineSpecName: s.name,
+          annotations: annotations,
+        },
+        enginePath: s.path,
+      });
+      location.hash = "#/engines/" + encodeURIComponent(resp.status.name);
+    } catch (err) {
+      showError(err);
+    }
+  };
+}
+
+function showLogin() {
+  showView("login-view");
+  resetStreams();
+  const form = $("login-form");
+  form.onsubmit = (e) => {
+    e.preventDefault();
+    localStorage.setItem("ufs-token", form.token.value.trim());
+    form.reset();
+    updateLogout();
+    route();
+  };
+}
+
+function updateLogout() {
+  $("logout-button").hidden = !localStorage.getItem("ufs-token");
+}
+
+function route() {
+  clearError();
+  const hash = location.hash.replace(/^#\/?/, "");
+  if (hash.startsWith("engines/")) {
+    showDetail(decodeURIComponent(hash.slice("engines/".length)));
+  } else if (hash === "start") {
+    showStart();
+  } else {
+    showList();
+  }
+}
+
+async function init() {
+  try {
+    const resp = await rpc("v1.UfsUI/IsReadOnly", {});
+    state.readOnly = !!resp.readonly;
+  } catch (err) {
+    showError(err);
+  }
+  $("readonly").hidden = !state.readOnly;
+  $("start-button").hidden = state.readOnly;
+  $("start-button").onclick = () => { location.hash = "#/start"; };
+  $("logout-button").onclick = () => {
+    localStorage.removeItem("ufs-token");
+    updateLogout();
+    showLogin();
+  };
+  updateLogout();
+
+  $("filter").onsubmit = (e) => {
+    e.preventDefault();
+    state.filter = readFilter(e.target);
+    state.start = 0;
+    showList();
+  };
+  $("prev").onclick = () => {
+    state.start = Math.max(0, state.start - pageSize);
+    showList();
+  };
+  $("next").onclick = () => {
+    state.start += pageSize;
+    showList();
+  };
+
+  window.addEventListener("hashchange", route);
+  route();
+}
+
+init();
@@ -25,12 +25,17 @@ package main
 
 import (
 	cmd "github.com/bhojpur/ufs/cmd/server"
+	"github.com/bhojpur/ufs/pkg/reexec"
 
-	_ "github.com/bhojpur/ufs/pkg/webui"
 	_ "github.com/lib/pq"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 )
 
 func main() {
+	// chrootarchive unpacks uploaded applications in a re-executed child process
+	if reexec.Init() {
+		return
+	}
+
 	cmd.Execute()
 }